@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	addressFieldOrder lists the forms of the address itself that structured /ip responses carry after the geolocation fields:
+	its version (4 or 6), canonical text, reverse DNS name, value as a decimal integer and as hex, and classification (see classifyAddress())
+*/
+var addressFieldOrder = []string{"ip_version", "ip_canonical", "ip_arpa", "ip_decimal", "ip_hex", "ip_classification"}
+
+// documentFieldOrder is the order of every field a structured /ip document can hold, error aside
+var documentFieldOrder = append(append(append([]string{}, locationFieldOrder...), addressFieldOrder...), timeFieldOrder...)
+
+/*
+	The addressForms function derives the fields of addressFieldOrder from ip, none when it doesn't parse
+	An IPv4-mapped IPv6 address is treated as the IPv4 address it maps
+*/
+func addressForms(ip string) map[string]string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return map[string]string{}
+	}
+	address, version := parsed.To4(), "4"
+	if address == nil {
+		address, version = parsed.To16(), "6"
+	}
+
+	var arpa []string
+	if version == "4" {
+		for i := len(address) - 1; i >= 0; i-- {
+			arpa = append(arpa, strconv.Itoa(int(address[i])))
+		}
+		arpa = append(arpa, "in-addr.arpa")
+	} else {
+		digits := hex.EncodeToString(address)
+		for i := len(digits) - 1; i >= 0; i-- {
+			arpa = append(arpa, digits[i:i+1])
+		}
+		arpa = append(arpa, "ip6.arpa")
+	}
+
+	return map[string]string{
+		"ip_version":        version,
+		"ip_canonical":      parsed.String(),
+		"ip_arpa":           strings.Join(arpa, "."),
+		"ip_decimal":        new(big.Int).SetBytes(address).String(),
+		"ip_hex":            "0x" + hex.EncodeToString(address),
+		"ip_classification": classifyAddress(parsed.String()).Classification,
+	}
+}
+
+// The documentFields function is locationFields() along with the forms of the location's address and the local time in its timezone
+func documentFields(location geolocation) map[string]string {
+	fields := locationFields(location)
+	for name, value := range addressForms(location.IP) {
+		fields[name] = value
+	}
+	for name, value := range timeFields(location.Timezone, time.Now()) {
+		fields[name] = value
+	}
+	return fields
+}
+
+// The isAddressField function reports whether field is the address or one of its forms, which need no geolocation lookup
+func isAddressField(field string) bool {
+	if field == "ip" {
+		return true
+	}
+	for _, name := range addressFieldOrder {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+	The advisoryRule struct attaches operator-supplied compliance hints to the countries it lists ("*" matches every country)
+	Flags are short machine-readable markers (e.g. "data_residency_eu", "export_controlled"), Notes are free text for people
+	Nothing here comes from a provider, the advisory block only ever repeats what the operator configured
+*/
+type advisoryRule struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+	Flags     []string `json:"flags"`
+	Notes     []string `json:"notes"`
+}
+
+// The checkAdvisoryRules function rejects unnamed rules and malformed country codes at startup
+func checkAdvisoryRules(rules []advisoryRule) error {
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return errors.New("every advisory rule needs a name")
+		}
+		for _, country := range rule.Countries {
+			if country != "*" && len(country) != 2 {
+				return fmt.Errorf("advisory rule %q: %q is not a two-letter country code", rule.Name, country)
+			}
+		}
+	}
+	return nil
+}
+
+// The advisoryFor function merges every rule matching country, in config order and without repeating a flag or note
+func advisoryFor(country string, rules []advisoryRule) map[string]interface{} {
+	flags, notes, matched := []string{}, []string{}, []string{}
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		applies := false
+		for _, listed := range rule.Countries {
+			if listed == "*" || strings.EqualFold(listed, country) {
+				applies = true
+			}
+		}
+		if !applies {
+			continue
+		}
+		matched = append(matched, rule.Name)
+		for _, flag := range rule.Flags {
+			if !seen["flag:"+flag] {
+				seen["flag:"+flag] = true
+				flags = append(flags, flag)
+			}
+		}
+		for _, note := range rule.Notes {
+			if !seen["note:"+note] {
+				seen["note:"+note] = true
+				notes = append(notes, note)
+			}
+		}
+	}
+	return map[string]interface{}{"country": country, "flags": flags, "notes": notes, "rules": matched}
+}
+
+// The advisoryStage function contributes the advisory block for the country the geo stage resolved
+func advisoryStage(_ context.Context, _ string, inputs map[string]interface{}) (interface{}, error) {
+	fields, _ := inputs["geo"].(map[string]string)
+	if fields["country"] == "" {
+		return nil, errors.New("the provider did not report a country")
+	}
+	return advisoryFor(fields["country"], config.Enrichment.Advisories), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxAggregateIPs bounds a single /aggregate request
+	maxAggregateIPs = 1000
+	// aggregateWorkers is how many lookups an /aggregate request runs at once
+	aggregateWorkers = 8
+)
+
+// The aggregateReport struct is the /aggregate response, it only ever holds counts
+type aggregateReport struct {
+	Total     int            `json:"total"`
+	Invalid   int            `json:"invalid"`
+	Bogons    int            `json:"bogons"`
+	Failed    int            `json:"failed"`
+	Countries map[string]int `json:"countries"`
+	ASNs      map[string]int `json:"asns"`
+}
+
+/*
+	The handleAggregate function serves /aggregate, a POSTed JSON document {"ips": [...]} is geolocated and only the counts per country and ASN are returned
+	Individual results are never returned or logged, see lookupAnonymous()
+	Addresses that aren't valid, bogons and lookups that fail are counted but not identified
+*/
+func handleAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a JSON document of the form {\"ips\": [...]}", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		IPs []string `json:"ips"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		http.Error(w, "Error while reading the request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.IPs) > maxAggregateIPs {
+		http.Error(w, "too many IP addresses in one request", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	report := aggregateReport{Total: len(request.IPs), Countries: map[string]int{}, ASNs: map[string]int{}}
+	var mutex sync.Mutex
+	queue := make(chan string)
+	var group sync.WaitGroup
+	for i := 0; i < aggregateWorkers; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for ip := range queue {
+				location, err := lookupAnonymous(ip)
+				mutex.Lock()
+				var bogon *bogonError
+				if errors.As(err, &bogon) {
+					report.Bogons++
+				} else if err != nil {
+					report.Failed++
+				} else {
+					report.Countries[countKey(location.Country)]++
+					report.ASNs[countKey(asnOf(location))]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, ip := range request.IPs {
+		if net.ParseIP(ip) == nil {
+			report.Invalid++
+			continue
+		}
+		queue <- ip
+	}
+	close(queue)
+	group.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// The lookupAnonymous function is lookupCached() without the per-lookup log line, for callers that must not record which addresses were asked about
+func lookupAnonymous(ip string) (geolocation, error) {
+	if err := checkBogon(ip); err != nil {
+		return geolocation{}, err
+	}
+	location, _, fetched, err := degradation.lookup(ip)
+	if err != nil || !fetched {
+		return location, err
+	}
+	geoCache.put(ip, location)
+	return location, nil
+}
+
+// The asnOf function returns the "AS<number>" prefix of the provider's org field, "" when it has none
+func asnOf(location geolocation) string {
+	match := orgPattern.FindStringSubmatch(location.Org)
+	if match == nil {
+		return ""
+	}
+	return "AS" + match[1]
+}
+
+// The countKey function files empty values under "unknown"
+func countKey(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The asnSettings struct points at a local ASN database, a GeoLite2-ASN (or compatible) .mmdb file, asked before the provider
+type asnSettings struct {
+	Database string `json:"database"`
+}
+
+/*
+	The asnAnswer struct is the answer of /asn/{ip}, Source is "database" when the local ASN database knew the address
+	and "provider" when it came from the org field of the geolocation
+	Prefix is the network the database files the address under, or else the most specific announcement in the BGP dump when it's loaded
+*/
+type asnAnswer struct {
+	IP     string `json:"ip"`
+	ASN    int    `json:"asn"`
+	Org    string `json:"org"`
+	Prefix string `json:"prefix,omitempty"`
+	Source string `json:"source"`
+}
+
+// asnDatabase is opened in main() when asn.database is configured
+var asnDatabase *mmdbReader
+
+// The openASNDatabase function reads the configured ASN database, nil when there is none
+func openASNDatabase(settings asnSettings) (*mmdbReader, error) {
+	if settings.Database == "" {
+		return nil, nil
+	}
+	reader, err := openMMDB(settings.Database)
+	recordComponent("asn", "database", settings.Database, err)
+	return reader, err
+}
+
+// The asnHandler function returns the handler of /asn/, which hands /asn/{n}/prefixes to handleASNPrefixes() when prefixes is set
+func asnHandler(prefixes bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(strings.TrimPrefix(r.URL.Path, "/asn/"), "/") {
+			if !prefixes {
+				http.NotFound(w, r)
+				return
+			}
+			handleASNPrefixes(w, r)
+			return
+		}
+		handleASN(w, r)
+	}
+}
+
+// The handleASN function serves /asn/{ip}, the autonomous system announcing the address, from the local ASN database or the provider
+func handleASN(w http.ResponseWriter, r *http.Request) {
+	input := strings.TrimPrefix(r.URL.Path, "/asn/")
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		writeInvalidAddress(w, &invalidAddressError{Input: input})
+		return
+	}
+	ip := parsed.String()
+	if writeBogon(w, checkBogon(ip)) {
+		return
+	}
+
+	answer := asnAnswer{IP: ip}
+	if asnDatabase != nil {
+		record, network, err := asnDatabase.lookupNetwork(parsed)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"ip": ip, "error": "Error while reading the ASN database: " + err.Error()})
+			return
+		}
+		if number, err := strconv.Atoi(mmdbString(record, "autonomous_system_number")); err == nil {
+			answer.ASN, answer.Org, answer.Prefix, answer.Source = number, mmdbString(record, "autonomous_system_organization"), network.String(), "database"
+		}
+	}
+	if answer.Source == "" {
+		location, _, err := lookupFor(r, ip)
+		if writeBogon(w, err) {
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"ip": ip, "error": "Error while looking up the address: " + err.Error()})
+			return
+		}
+		if match := orgPattern.FindStringSubmatch(location.Org); match != nil {
+			answer.ASN, _ = strconv.Atoi(match[1])
+			answer.Org, answer.Source = match[2], "provider"
+		}
+	}
+	if answer.Source == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"ip": ip, "error": "no autonomous system is known for this address"})
+		return
+	}
+
+	if answer.Prefix == "" && bgp != nil && bgp.dataset.loaded() {
+		if announced, ok := bgp.origin(parsed); ok {
+			answer.Prefix = announced.Prefix.String()
+		}
+	}
+	writeJSON(w, http.StatusOK, answer)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+/*
+	The auditSettings struct turns on the lookup audit log, a record of every upstream lookup kept as audit.jsonl in the data_dir
+	It holds client addresses, so it is off unless enabled and is subject to retention.audit_days and /admin/forget
+*/
+type auditSettings struct {
+	Enabled bool `json:"enabled"`
+}
+
+/*
+	The auditRecord struct is one line of the audit log, Tenant is the tenant whose API key made the lookup, "" for none
+	Location is the geolocation the lookup returned, in canonical fields, which /history/ip answers point-in-time queries from
+*/
+type auditRecord struct {
+	Time     time.Time         `json:"time"`
+	Tenant   string            `json:"tenant,omitempty"`
+	IP       string            `json:"ip"`
+	Hash     string            `json:"hash"`
+	Location map[string]string `json:"location,omitempty"`
+}
+
+// auditLog is opened by main() when the audit log is enabled, nil otherwise
+var auditLog *jsonlStore
+
+// The recordLookup function appends an upstream lookup of ip made for tenant, and the location it returned, to the audit log when there is one
+func recordLookup(tenant, ip, hash string, location geolocation) {
+	if auditLog == nil {
+		return
+	}
+	fields := locationFields(location)
+	fields["ip"] = ip
+	if err := auditLog.append(auditRecord{Time: time.Now().UTC(), Tenant: tenant, IP: ip, Hash: hash, Location: fields}); err != nil {
+		log.Printf("writing the audit log: %v", err)
+	}
+}
+
+// The dropAuditRecords function removes every audit record drop matches, returning how many were removed
+func dropAuditRecords(drop func(auditRecord) bool) (int, error) {
+	if auditLog == nil {
+		return 0, nil
+	}
+	return auditLog.rewrite(func(line []byte) bool {
+		var record auditRecord
+		// A line that can't be decoded is kept, retention shouldn't destroy what it can't read
+		if err := json.Unmarshal(line, &record); err != nil {
+			return true
+		}
+		return !drop(record)
+	})
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// backupManifest is the first entry of a backup, listing every other entry with its checksum
+	backupManifest = "manifest.json"
+	// backupDataPrefix holds the files of data_dir in a backup, backupQuotaPrefix the quota state file
+	backupDataPrefix  = "data/"
+	backupQuotaPrefix = "quota/"
+	// backupTimeout bounds downloading a backup from a running instance
+	backupTimeout = 10 * time.Minute
+)
+
+// The backupFile struct is one persisted file in a backup, Name is its path inside the tarball
+type backupFile struct {
+	Name string
+	Data []byte
+}
+
+// The backupEntry struct is a file as the manifest lists it
+type backupEntry struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// The backupManifestFile struct is manifest.json, SchemaVersion is the migration the files were at so a restore can tell whether it can read them
+type backupManifestFile struct {
+	Created       time.Time     `json:"created"`
+	Instance      string        `json:"instance"`
+	Online        bool          `json:"online"`
+	SchemaVersion int           `json:"schema_version"`
+	Files         []backupEntry `json:"files"`
+}
+
+/*
+	The collectBackup function reads every persisted file, the whole of data_dir (bar schema_backup and half written temporary files) and the quota state file
+	Online, it runs inside the server and holds persisting, so no store, dataset cache, quota save or purge replaces or appends to a file while it is read,
+	and the quota counters are taken from memory under their lock, which is fresher than the last save
+	Offline it just reads the files, which is only consistent while no instance is running against them
+	Files encrypted at rest stay encrypted, restoring them needs the same key
+*/
+func collectBackup(online bool) ([]backupFile, error) {
+	if online {
+		persisting.Lock()
+		defer persisting.Unlock()
+	}
+
+	var files []backupFile
+	if config.DataDir != "" {
+		stateFile := ""
+		if config.Quota.StateFile != "" {
+			absolute, err := filepath.Abs(config.Quota.StateFile)
+			if err != nil {
+				return nil, err
+			}
+			stateFile = absolute
+		}
+		err := filepath.WalkDir(config.DataDir, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) && file == config.DataDir {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			relative, err := filepath.Rel(config.DataDir, file)
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if relative == schemaBackupDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// writeFileAtomic() names its temporary files <name>.tmp<random>, they are either renamed into place or left over from a crash
+			if !entry.Type().IsRegular() || strings.Contains(entry.Name(), ".tmp") {
+				return nil
+			}
+			// The quota state file may sit in data_dir, it is backed up on its own below
+			absolute, err := filepath.Abs(file)
+			if err != nil {
+				return err
+			}
+			if absolute == stateFile {
+				return nil
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			files = append(files, backupFile{Name: backupDataPrefix + filepath.ToSlash(relative), Data: data})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Quota.StateFile != "" {
+		var data []byte
+		var err error
+		if online {
+			quotas.mutex.Lock()
+			data, err = json.Marshal(quotas.state)
+			quotas.mutex.Unlock()
+		} else if data, err = os.ReadFile(config.Quota.StateFile); errors.Is(err, os.ErrNotExist) {
+			data, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			files = append(files, backupFile{Name: backupQuotaPrefix + filepath.Base(config.Quota.StateFile), Data: data})
+		}
+	}
+	return files, nil
+}
+
+// The writeBackup function writes files to w as a gzipped tarball, preceded by their manifest
+func writeBackup(w io.Writer, files []backupFile, online bool) error {
+	manifest := backupManifestFile{Created: time.Now().UTC(), Online: online}
+	manifest.Instance, _ = os.Hostname()
+	if config.DataDir != "" {
+		state, err := loadSchemaState(config.DataDir)
+		if err != nil {
+			return err
+		}
+		manifest.SchemaVersion = state.Version
+	}
+	for _, file := range files {
+		sum := sha256.Sum256(file.Data)
+		manifest.Files = append(manifest.Files, backupEntry{Name: file.Name, Size: len(file.Data), SHA256: hex.EncodeToString(sum[:])})
+	}
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	for _, file := range append([]backupFile{{Name: backupManifest, Data: encoded}}, files...) {
+		header := &tar.Header{Name: file.Name, Mode: 0600, Size: int64(len(file.Data)), ModTime: manifest.Created, Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := archive.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+/*
+	The readBackup function unpacks a backup written by writeBackup() and checks every file against the manifest
+	It fails on any file that is missing, unlisted, altered, or named outside data/ and quota/
+*/
+func readBackup(r io.Reader) (backupManifestFile, []backupFile, error) {
+	var manifest backupManifestFile
+	compressed, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, nil, err
+	}
+	archive := tar.NewReader(compressed)
+	contents := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return manifest, nil, err
+		}
+		contents[header.Name] = data
+	}
+
+	encoded, ok := contents[backupManifest]
+	if !ok {
+		return manifest, nil, errors.New("backup: there is no " + backupManifest + ", this isn't a backup")
+	}
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("backup: %s: %w", backupManifest, err)
+	}
+	delete(contents, backupManifest)
+
+	var files []backupFile
+	for _, entry := range manifest.Files {
+		data, ok := contents[entry.Name]
+		if !ok {
+			return manifest, nil, fmt.Errorf("backup: %s is listed but missing", entry.Name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return manifest, nil, fmt.Errorf("backup: %s doesn't match its checksum", entry.Name)
+		}
+		clean := path.Clean(entry.Name)
+		if clean != entry.Name || (!strings.HasPrefix(clean, backupDataPrefix) && !strings.HasPrefix(clean, backupQuotaPrefix)) || strings.Contains(clean, "..") {
+			return manifest, nil, fmt.Errorf("backup: %q isn't somewhere a backup puts files", entry.Name)
+		}
+		files = append(files, backupFile{Name: entry.Name, Data: data})
+		delete(contents, entry.Name)
+	}
+	for name := range contents {
+		return manifest, nil, fmt.Errorf("backup: %s isn't listed in the manifest", name)
+	}
+	return manifest, files, nil
+}
+
+/*
+	The handleBackup function serves /admin/backup, an online backup of this instance as a gzipped tarball, see collectBackup()
+	This is what "oracle backup -from" downloads
+*/
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	files, err := collectBackup(true)
+	if err != nil {
+		http.Error(w, "Error while reading the persisted files: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var archive bytes.Buffer
+	if err := writeBackup(&archive, files, true); err != nil {
+		http.Error(w, "Error while writing the backup: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="oracle-backup-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	w.Write(archive.Bytes())
+}
+
+// The fetchBackup function downloads an online backup from the /admin/backup of the instance at base
+func fetchBackup(base, key string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(base, "/")+"/admin/backup", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-API-Key", key)
+	response, err := (&http.Client{Timeout: backupTimeout}).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4<<10))
+		return nil, fmt.Errorf("backup: %s answered %s %s", base, response.Status, bytes.TrimSpace(message))
+	}
+	return io.ReadAll(response.Body)
+}
+
+/*
+	The runBackupCommand function implements "oracle backup -o <file or s3://bucket/key>"
+	With -from it downloads an online backup from the running instance at that URL, authenticated with -key (the first admin key by default),
+	without it the files the config names are read directly, which is only consistent with the instance stopped
+	It returns the process exit code
+*/
+func runBackupCommand(arguments []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON config file")
+	output := flags.String("o", "", "file or s3://bucket/key to write the backup to")
+	from := flags.String("from", "", "base URL of a running instance to take an online backup from")
+	key := flags.String("key", "", "admin key for -from, the first of admin_keys by default")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if *output == "" {
+		fmt.Fprintln(os.Stderr, "usage: oracle backup -o <file or s3://bucket/key> [-config file] [-from url [-key admin key]]")
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var archive []byte
+	var err error
+	if *from != "" {
+		if *key == "" && len(config.AdminKeys) > 0 {
+			*key = config.AdminKeys[0]
+		}
+		archive, err = fetchBackup(*from, *key)
+	} else {
+		var files []backupFile
+		if files, err = collectBackup(false); err == nil {
+			var buffer bytes.Buffer
+			err = writeBackup(&buffer, files, false)
+			archive = buffer.Bytes()
+		}
+	}
+	if err == nil {
+		err = storeBackup(*output, archive)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("backup: %d bytes written to %s\n", len(archive), *output)
+	return 0
+}
+
+// The storeBackup function writes archive to a local file or an s3:// URL
+func storeBackup(location string, archive []byte) error {
+	if isS3URL(location) {
+		object, err := parseS3URL(location)
+		if err != nil {
+			return err
+		}
+		return object.put(archive)
+	}
+	return writeFileAtomic(location, archive)
+}
+
+// The loadBackup function reads a backup from a local file or an s3:// URL
+func loadBackup(location string) ([]byte, error) {
+	if isS3URL(location) {
+		object, err := parseS3URL(location)
+		if err != nil {
+			return nil, err
+		}
+		return object.get()
+	}
+	return os.ReadFile(location)
+}
+
+/*
+	The runRestoreCommand function implements "oracle restore -i <file or s3://bucket/key>", which puts the files of a backup back where the config says
+	The instance must be stopped, a running one would overwrite the quota state with its own counters and keeps its history in memory
+	Nothing is written unless every file of the backup checks out, and a backup from a newer schema than this binary knows is refused,
+	an older one is migrated on the next start
+	Files in data_dir that aren't in the backup are left alone and listed
+	It returns the process exit code
+*/
+func runRestoreCommand(arguments []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON config file")
+	input := flags.String("i", "", "file or s3://bucket/key to restore from")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if *input == "" {
+		fmt.Fprintln(os.Stderr, "usage: oracle restore -i <file or s3://bucket/key> [-config file]")
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := restoreBackup(*input); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// The restoreBackup function reads the backup at location, checks it, and writes its files into place
+func restoreBackup(location string) error {
+	archive, err := loadBackup(location)
+	if err != nil {
+		return err
+	}
+	manifest, files, err := readBackup(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	if manifest.SchemaVersion > latestSchema() {
+		return fmt.Errorf("restore: the backup is at schema version %d, newer than the %d this binary knows", manifest.SchemaVersion, latestSchema())
+	}
+
+	targets := map[string]string{}
+	for _, file := range files {
+		switch {
+		case strings.HasPrefix(file.Name, backupDataPrefix):
+			if config.DataDir == "" {
+				return fmt.Errorf("restore: the backup has %s but data_dir isn't configured", file.Name)
+			}
+			targets[file.Name] = filepath.Join(config.DataDir, filepath.FromSlash(strings.TrimPrefix(file.Name, backupDataPrefix)))
+		case config.Quota.StateFile == "":
+			return fmt.Errorf("restore: the backup has %s but quota.state_file isn't configured", file.Name)
+		default:
+			targets[file.Name] = config.Quota.StateFile
+		}
+	}
+
+	restored := map[string]bool{}
+	for _, file := range files {
+		target := targets[file.Name]
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(target, file.Data); err != nil {
+			return fmt.Errorf("restore: %s: %w", target, err)
+		}
+		restored[target] = true
+		fmt.Printf("restore: %s\n", target)
+	}
+
+	var kept []string
+	if config.DataDir != "" {
+		filepath.WalkDir(config.DataDir, func(file string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.Type().IsRegular() && !restored[file] && filepath.Base(filepath.Dir(file)) != schemaBackupDir {
+				kept = append(kept, file)
+			}
+			return nil
+		})
+	}
+	sort.Strings(kept)
+	for _, file := range kept {
+		fmt.Printf("restore: kept %s, it isn't in the backup\n", file)
+	}
+	fmt.Printf("restore: %d files from a backup of %s taken %s at schema version %d\n", len(files), manifest.Instance, manifest.Created.Format(time.RFC3339), manifest.SchemaVersion)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxBatchIPs bounds a single /lookup request
+	maxBatchIPs = 1000
+	// batchWorkers is how many lookups a /lookup request runs at once, which bounds its concurrency against the provider
+	batchWorkers = 8
+)
+
+// The batchResult struct is the /lookup answer for one address, Location holds the fields of /ip/json when the lookup succeeded
+type batchResult struct {
+	IP       string            `json:"ip"`
+	Location map[string]string `json:"location,omitempty"`
+	Bogon    bool              `json:"bogon,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+/*
+	The handleBatchLookup function serves POST /lookup, a JSON array of addresses is geolocated and answered with an array
+	of results in the same order, each either a location or the error that address ran into, so one bad entry doesn't fail the rest
+	?fields= narrows every location as it does for /ip
+*/
+func handleBatchLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a JSON array of IP addresses", http.StatusMethodNotAllowed)
+		return
+	}
+	fields, err := requestedFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ips []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&ips); err != nil {
+		http.Error(w, "Error while reading the request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ips) > maxBatchIPs {
+		http.Error(w, "too many IP addresses in one request", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchResult, len(ips))
+	queue := make(chan int)
+	var group sync.WaitGroup
+	for i := 0; i < batchWorkers; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for index := range queue {
+				results[index] = lookupBatchEntry(r, results[index].IP, fields)
+			}
+		}()
+	}
+	for i, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			results[i] = batchResult{IP: ip, Error: (&invalidAddressError{Input: ip}).Error()}
+			continue
+		}
+		results[i].IP = parsed.String()
+		queue <- i
+	}
+	close(queue)
+	group.Wait()
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// The lookupBatchEntry function looks up one address of a /lookup request
+func lookupBatchEntry(r *http.Request, ip string, fields []string) batchResult {
+	location := geolocation{IP: ip}
+	if !onlyAddress(fields) {
+		var err error
+		location, _, err = lookupFor(r, ip)
+		var bogon *bogonError
+		if errors.As(err, &bogon) {
+			return batchResult{IP: ip, Bogon: true, Error: bogon.Error()}
+		}
+		if err != nil {
+			return batchResult{IP: ip, Error: err.Error()}
+		}
+		location.IP = ip
+	}
+	return batchResult{IP: ip, Location: selectFields(documentFields(location), fields)}
+}
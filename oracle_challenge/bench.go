@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBenchRequests and maxBenchConcurrency bound what /admin/bench may be asked to do
+	maxBenchRequests    = 10000
+	maxBenchConcurrency = 100
+)
+
+/*
+	The benchOptions struct describes a load test
+	Distribution picks the client IP sent in X-Forwarded-For: "random" (a new public address per request),
+	"pool" (PoolSize addresses reused, which exercises caching) or "none" (no header, the server sees the load generator)
+*/
+type benchOptions struct {
+	URL          string
+	Requests     int
+	Concurrency  int
+	Distribution string
+	PoolSize     int
+}
+
+// The benchReport struct summarizes a load test, latencies are in milliseconds and cache counts come from the X-Cache response header
+type benchReport struct {
+	Requests       int                `json:"requests"`
+	Errors         int                `json:"errors"`
+	StatusCodes    map[string]int     `json:"status_codes"`
+	DurationMS     int64              `json:"duration_ms"`
+	RequestsPerSec float64            `json:"requests_per_sec"`
+	LatencyMS      map[string]float64 `json:"latency_ms"`
+	CacheHits      int                `json:"cache_hits"`
+	CacheMisses    int                `json:"cache_misses"`
+}
+
+/*
+	The runBenchCommand function implements "oracle bench", load testing a running instance and printing the report
+	It returns the process exit code
+*/
+func runBenchCommand(arguments []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	options := benchOptions{}
+	flags.StringVar(&options.URL, "url", "http://127.0.0.1:8080/ip", "endpoint to load test")
+	flags.IntVar(&options.Requests, "n", 1000, "total number of requests")
+	flags.IntVar(&options.Concurrency, "c", 10, "number of concurrent workers")
+	flags.StringVar(&options.Distribution, "ips", "pool", "client IP distribution: random, pool or none")
+	flags.IntVar(&options.PoolSize, "pool", 100, "number of distinct client IPs when -ips=pool")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	report, err := runLoad(context.Background(), options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	return 0
+}
+
+/*
+	The handleBench function serves /admin/bench, a short load test of this instance against its own listener
+	Query parameters path, n, c, ips and pool mirror the flags of "oracle bench", the load goes to the first listener
+*/
+func handleBench(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := benchOptions{URL: "http://" + loopbackAddress(configuredListeners()[0].Address), Requests: 100, Concurrency: 10, Distribution: "pool", PoolSize: 20}
+
+	path := query.Get("path")
+	if path == "" {
+		path = "/ip"
+	}
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "/admin/") {
+		http.Error(w, "path must be a non-admin path on this instance", http.StatusBadRequest)
+		return
+	}
+	options.URL += path
+
+	for name, target := range map[string]*int{"n": &options.Requests, "c": &options.Concurrency, "pool": &options.PoolSize} {
+		if value := query.Get(name); value != "" {
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, name+" must be a number", http.StatusBadRequest)
+				return
+			}
+			*target = number
+		}
+	}
+	if ips := query.Get("ips"); ips != "" {
+		options.Distribution = ips
+	}
+	if options.Requests > maxBenchRequests || options.Concurrency > maxBenchConcurrency {
+		http.Error(w, fmt.Sprintf("at most %d requests and %d workers are allowed", maxBenchRequests, maxBenchConcurrency), http.StatusBadRequest)
+		return
+	}
+
+	report, err := runLoad(r.Context(), options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// The loopbackAddress function turns a listen address such as ":8080" into one this process can dial itself on
+func loopbackAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// The runLoad function sends options.Requests requests from options.Concurrency workers and summarizes the results
+func runLoad(ctx context.Context, options benchOptions) (benchReport, error) {
+	if options.Requests <= 0 || options.Concurrency <= 0 {
+		return benchReport{}, errors.New("requests and concurrency must be positive")
+	}
+	clientIP, err := benchIPSource(options)
+	if err != nil {
+		return benchReport{}, err
+	}
+
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: options.Concurrency},
+	}
+	report := benchReport{Requests: options.Requests, StatusCodes: map[string]int{}}
+	latencies := make([]time.Duration, 0, options.Requests)
+
+	var mutex sync.Mutex
+	var group sync.WaitGroup
+	jobs := make(chan int)
+	started := time.Now()
+	for worker := 0; worker < options.Concurrency; worker++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for sequence := range jobs {
+				request, err := http.NewRequestWithContext(ctx, http.MethodGet, options.URL, nil)
+				if err != nil {
+					mutex.Lock()
+					report.Errors++
+					mutex.Unlock()
+					continue
+				}
+				if ip := clientIP(sequence); ip != "" {
+					request.Header.Set("X-Forwarded-For", ip)
+				}
+
+				sent := time.Now()
+				response, err := client.Do(request)
+				elapsed := time.Since(sent)
+
+				mutex.Lock()
+				latencies = append(latencies, elapsed)
+				if err != nil {
+					report.Errors++
+					mutex.Unlock()
+					continue
+				}
+				report.StatusCodes[strconv.Itoa(response.StatusCode)]++
+				switch strings.ToUpper(response.Header.Get("X-Cache")) {
+				case "HIT":
+					report.CacheHits++
+				case "MISS":
+					report.CacheMisses++
+				}
+				mutex.Unlock()
+
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+			}
+		}()
+	}
+
+	for sequence := 0; sequence < options.Requests; sequence++ {
+		select {
+		case jobs <- sequence:
+		case <-ctx.Done():
+			sequence = options.Requests
+		}
+	}
+	close(jobs)
+	group.Wait()
+
+	duration := time.Since(started)
+	report.DurationMS = duration.Milliseconds()
+	if duration > 0 {
+		report.RequestsPerSec = float64(len(latencies)) / duration.Seconds()
+	}
+	report.LatencyMS = latencyPercentiles(latencies)
+	return report, ctx.Err()
+}
+
+// The latencyPercentiles function reports p50/p90/p99/max of latencies in milliseconds
+func latencyPercentiles(latencies []time.Duration) map[string]float64 {
+	percentiles := map[string]float64{}
+	if len(latencies) == 0 {
+		return percentiles
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	milliseconds := func(latency time.Duration) float64 {
+		return math.Round(float64(latency.Microseconds())/10) / 100
+	}
+	at := func(fraction float64) float64 {
+		return milliseconds(latencies[int(fraction*float64(len(latencies)-1))])
+	}
+	percentiles["p50"] = at(0.50)
+	percentiles["p90"] = at(0.90)
+	percentiles["p99"] = at(0.99)
+	percentiles["max"] = milliseconds(latencies[len(latencies)-1])
+	return percentiles
+}
+
+// The benchIPSource function returns the X-Forwarded-For value to send with each request number for the chosen distribution
+func benchIPSource(options benchOptions) (func(int) string, error) {
+	switch options.Distribution {
+	case "none":
+		return func(int) string { return "" }, nil
+	case "random", "pool":
+	default:
+		return nil, fmt.Errorf("unknown IP distribution %q, expected random, pool or none", options.Distribution)
+	}
+
+	guard, err := newOutboundGuard(outboundSettings{})
+	if err != nil {
+		return nil, err
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var mutex sync.Mutex
+	publicIP := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, random.Uint32())
+			if guard.checkIP(ip) == nil {
+				return ip.String()
+			}
+		}
+	}
+
+	if options.Distribution == "random" {
+		return func(int) string { return publicIP() }, nil
+	}
+	if options.PoolSize <= 0 {
+		return nil, errors.New("the IP pool size must be positive")
+	}
+	pool := make([]string, options.PoolSize)
+	for i := range pool {
+		pool[i] = publicIP()
+	}
+	return func(sequence int) string { return pool[sequence%len(pool)] }, nil
+}
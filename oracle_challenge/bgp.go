@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBGPRefresh applies when bgp.refresh_hours isn't configured
+const defaultBGPRefresh = 24 * time.Hour
+
+/*
+	The bgpSettings struct points at a prefix-to-AS dump of the global routing table
+	The format is RouteViews pfx2as as published by CAIDA: one "prefix<TAB>length<TAB>origin" line per announced prefix,
+	where origin may list several ASNs separated by _ (multiple origins) or , (an AS set), optionally gzip-compressed
+*/
+type bgpSettings struct {
+	URL          string `json:"url"`
+	RefreshHours int    `json:"refresh_hours"`
+}
+
+// The announcedPrefix struct is a single line of the dump
+type announcedPrefix struct {
+	Prefix  *net.IPNet
+	Origins []int
+}
+
+// The bgpTable struct holds the parsed dump, indexed by origin ASN and in a prefix trie of announcedPrefix values for address lookups
+type bgpTable struct {
+	mutex    sync.RWMutex
+	prefixes *prefixTrie
+	byOrigin map[int][]string
+	dataset  *remoteDataset
+}
+
+// bgp is built in main() when the bgp feature is enabled
+var bgp *bgpTable
+
+// The newBGPTable function builds the table and loads the cached dump, the download itself happens in the background through dataset.watch()
+func newBGPTable(settings bgpSettings) (*bgpTable, error) {
+	if settings.URL == "" {
+		return nil, errors.New("the bgp feature needs bgp.url")
+	}
+	interval := defaultBGPRefresh
+	if settings.RefreshHours > 0 {
+		interval = time.Duration(settings.RefreshHours) * time.Hour
+	}
+	table := &bgpTable{prefixes: &prefixTrie{}, byOrigin: map[int][]string{}}
+	table.dataset = newRemoteDataset("bgp_pfx2as.txt", settings.URL, interval, table.parse)
+	return table, table.dataset.load()
+}
+
+// The parse function replaces the table with the prefixes in a pfx2as dump
+func (table *bgpTable) parse(contents []byte) error {
+	prefixes := &prefixTrie{}
+	byOrigin := map[int][]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for line := 1; scanner.Scan(); line++ {
+		columns := strings.Fields(scanner.Text())
+		if len(columns) == 0 || strings.HasPrefix(columns[0], "#") {
+			continue
+		}
+		if len(columns) != 3 {
+			return fmt.Errorf("line %d: expected prefix, length and origin", line)
+		}
+		_, prefix, err := net.ParseCIDR(columns[0] + "/" + columns[1])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		var origins []int
+		for _, field := range strings.FieldsFunc(columns[2], func(r rune) bool { return r == '_' || r == ',' }) {
+			origin, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("line %d: origin %q is not an ASN", line, field)
+			}
+			origins = append(origins, origin)
+			byOrigin[origin] = append(byOrigin[origin], prefix.String())
+		}
+		prefixes.insert(prefix, announcedPrefix{Prefix: prefix, Origins: origins})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if prefixes.size == 0 {
+		return errors.New("the dump lists no prefixes")
+	}
+
+	table.mutex.Lock()
+	table.prefixes = prefixes
+	table.byOrigin = byOrigin
+	table.mutex.Unlock()
+	return nil
+}
+
+// The announcedBy function returns the prefixes originated by asn
+func (table *bgpTable) announcedBy(asn int) []string {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return append([]string{}, table.byOrigin[asn]...)
+}
+
+// The origin function returns the most specific announced prefix covering ip
+func (table *bgpTable) origin(ip net.IP) (announcedPrefix, bool) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	_, value, ok := table.prefixes.lookup(ip)
+	if !ok {
+		return announcedPrefix{}, false
+	}
+	return value.(announcedPrefix), true
+}
+
+// The parseASN function accepts an AS number with or without its "AS" prefix
+func parseASN(value string) (int, error) {
+	number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an AS number", value)
+	}
+	return int(number), nil
+}
+
+/*
+	The handleASNPrefixes function serves /asn/{n}/prefixes, every prefix the BGP dump shows originated by AS n
+	The response carries the dump's source and age so firewall rules built from it can be judged for staleness
+*/
+func handleASNPrefixes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/asn/"), "/")
+	if len(parts) != 2 || parts[1] != "prefixes" {
+		http.NotFound(w, r)
+		return
+	}
+	asn, err := parseASN(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !bgp.dataset.loaded() {
+		http.Error(w, "the BGP dump has not been downloaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	prefixes := bgp.announcedBy(asn)
+	sort.Strings(prefixes)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(struct {
+		ASN      int        `json:"asn"`
+		Count    int        `json:"count"`
+		Prefixes []string   `json:"prefixes"`
+		Data     datasetAge `json:"data"`
+	}{asn, len(prefixes), prefixes, bgp.dataset.age()})
+}
+
+/*
+	The handleOrigin function serves /origin/{ip}, the most specific prefix announcing the address and its origin ASNs according to the BGP dump
+	This comes from the routing table alone, independent of the geolocation providers, and carries the dump's source and age
+	With rpki.url configured each origin's RPKI validity is reported too, see rpkiTable.validate()
+*/
+func handleOrigin(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/origin/"))
+	if ip == nil {
+		http.Error(w, "not an IP address", http.StatusBadRequest)
+		return
+	}
+	if !bgp.dataset.loaded() {
+		http.Error(w, "the BGP dump has not been downloaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	report := struct {
+		IP        string         `json:"ip"`
+		Announced bool           `json:"announced"`
+		Prefix    string         `json:"prefix,omitempty"`
+		Origins   []int          `json:"origins"`
+		RPKI      []rpkiValidity `json:"rpki,omitempty"`
+		Data      datasetAge     `json:"data"`
+		RPKIData  *datasetAge    `json:"rpki_data,omitempty"`
+	}{IP: ip.String(), Origins: []int{}, Data: bgp.dataset.age()}
+	if announced, ok := bgp.origin(ip); ok {
+		report.Announced = true
+		report.Prefix = announced.Prefix.String()
+		report.Origins = announced.Origins
+		if rpki != nil && rpki.dataset.loaded() {
+			report.RPKI = rpki.validateAll(announced)
+		}
+	}
+	if rpki != nil {
+		age := rpki.dataset.age()
+		report.RPKIData = &age
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// The bogonRange struct is a special-purpose range, Type and Reference come from the IANA special-purpose address registries
+type bogonRange struct {
+	CIDR      string
+	Type      string
+	Reference string
+}
+
+// bogonRanges lists every range that is never routed on the public internet and so has no geolocation
+var bogonRanges = []bogonRange{
+	{"0.0.0.0/8", "this_network", "RFC 791"},
+	{"10.0.0.0/8", "private", "RFC 1918"},
+	{"100.64.0.0/10", "shared_address_space", "RFC 6598"},
+	{"127.0.0.0/8", "loopback", "RFC 1122"},
+	{"169.254.0.0/16", "link_local", "RFC 3927"},
+	{"172.16.0.0/12", "private", "RFC 1918"},
+	{"192.0.0.0/24", "ietf_protocol_assignments", "RFC 6890"},
+	{"192.0.2.0/24", "documentation", "RFC 5737"},
+	{"192.168.0.0/16", "private", "RFC 1918"},
+	{"198.18.0.0/15", "benchmarking", "RFC 2544"},
+	{"198.51.100.0/24", "documentation", "RFC 5737"},
+	{"203.0.113.0/24", "documentation", "RFC 5737"},
+	{"224.0.0.0/4", "multicast", "RFC 5771"},
+	{"240.0.0.0/4", "reserved", "RFC 1112"},
+	{"255.255.255.255/32", "limited_broadcast", "RFC 919"},
+	{"::/128", "unspecified", "RFC 4291"},
+	{"::1/128", "loopback", "RFC 4291"},
+	{"64:ff9b::/96", "nat64", "RFC 6052"},
+	{"100::/64", "discard_only", "RFC 6666"},
+	{"2001:db8::/32", "documentation", "RFC 3849"},
+	{"fc00::/7", "unique_local", "RFC 4193"},
+	{"fe80::/10", "link_local", "RFC 4291"},
+	{"ff00::/8", "multicast", "RFC 4291"},
+}
+
+// bogonTrie holds bogonRanges for lookups, the value of each node is its bogonRange
+var bogonTrie = func() *prefixTrie {
+	trie := &prefixTrie{}
+	for _, bogon := range bogonRanges {
+		_, networkRange, err := net.ParseCIDR(bogon.CIDR)
+		if err != nil {
+			panic(err)
+		}
+		trie.insert(networkRange, bogon)
+	}
+	return trie
+}()
+
+// The bogonError struct is returned instead of a geolocation for addresses within bogonRanges, no provider is asked about them
+type bogonError struct {
+	IP    string
+	Range bogonRange
+}
+
+// The Error function describes why the address can't be geolocated
+func (err *bogonError) Error() string {
+	return fmt.Sprintf("%s is a %s address (%s, %s) and is not routed on the public internet, so it has no geolocation", err.IP, err.Range.Type, err.Range.CIDR, err.Range.Reference)
+}
+
+// The checkBogon function returns a *bogonError when ip is within a special-purpose range, IPv4-mapped IPv6 addresses are unwrapped first
+func checkBogon(ip string) error {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return nil
+	}
+	if v4 := address.To4(); v4 != nil {
+		address = v4
+	}
+	_, value, ok := bogonTrie.lookup(address)
+	if !ok {
+		return nil
+	}
+	return &bogonError{IP: ip, Range: value.(bogonRange)}
+}
+
+// The checkBogonStatus function accepts only the two statuses bogon responses may be configured with
+func checkBogonStatus(status int) error {
+	if status != 0 && status != http.StatusOK && status != http.StatusUnprocessableEntity {
+		return fmt.Errorf("bogon_status must be 200 or 422, not %d", status)
+	}
+	return nil
+}
+
+/*
+	The writeBogon function writes the structured response for a bogon when err is one, reporting whether it did
+	The status is bogon_status from the config, 200 by default (as ipinfo.io does) or 422 for clients that want an error status
+*/
+func writeBogon(w http.ResponseWriter, err error) bool {
+	var bogon *bogonError
+	if !errors.As(err, &bogon) {
+		return false
+	}
+	status := config.BogonStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(struct {
+		IP        string `json:"ip"`
+		Bogon     bool   `json:"bogon"`
+		Type      string `json:"type"`
+		Range     string `json:"range"`
+		Reference string `json:"reference"`
+		Reason    string `json:"reason"`
+	}{bogon.IP, true, bogon.Range.Type, bogon.Range.CIDR, bogon.Range.Reference, bogon.Error()})
+	return true
+}
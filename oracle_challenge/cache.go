@@ -0,0 +1,260 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCacheBudgetMB applies when cache.memory_budget_mb isn't configured, a negative budget disables the cache
+	defaultCacheBudgetMB = 32
+	// defaultCacheTTL applies when cache.ttl_seconds isn't configured
+	defaultCacheTTL = time.Hour
+	// cacheEntryOverhead approximates the bytes a cached entry costs beyond its strings (list element, map slot, headers)
+	cacheEntryOverhead = 256
+	// cacheSampleEvery controls how often an inserted entry is measured to refresh the average entry size
+	cacheSampleEvery = 16
+)
+
+// The cacheSettings struct configures the geolocation cache, its capacity is derived from the memory budget rather than configured directly
+type cacheSettings struct {
+	MemoryBudgetMB int `json:"memory_budget_mb"`
+	TTLSeconds     int `json:"ttl_seconds"`
+}
+
+// The cacheEntry struct is a single cached lookup
+type cacheEntry struct {
+	ip       string
+	location geolocation
+	expires  time.Time
+}
+
+// The cacheStats struct is a snapshot of the cache's size and pressure counters, served by /stats and /metrics
+type cacheStats struct {
+	Entries          int   `json:"entries"`
+	Capacity         int   `json:"capacity"`
+	BudgetBytes      int64 `json:"budget_bytes"`
+	EstimatedBytes   int64 `json:"estimated_bytes"`
+	AverageEntrySize int64 `json:"average_entry_bytes"`
+	Hits             int64 `json:"hits"`
+	Misses           int64 `json:"misses"`
+	Evictions        int64 `json:"evictions"`
+	Expirations      int64 `json:"expirations"`
+}
+
+/*
+	The locationCache struct is an LRU cache of geolocations bounded by a memory budget
+	Entry sizes are estimated by measuring every cacheSampleEvery-th insert, and the capacity is re-derived from that average,
+	so the cache shrinks on its own when entries turn out bigger than expected
+*/
+type locationCache struct {
+	mutex    sync.Mutex
+	budget   int64
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+	average  int64
+	inserted int64
+	stats    cacheStats
+}
+
+// geoCache is consulted by lookupCached(), it is built in main() from config.Cache
+var geoCache = newLocationCache(cacheSettings{MemoryBudgetMB: -1})
+
+// The newLocationCache function builds a cache from settings, a nil cache (negative budget) caches nothing
+func newLocationCache(settings cacheSettings) *locationCache {
+	budget := settings.MemoryBudgetMB
+	if budget < 0 {
+		return nil
+	}
+	if budget == 0 {
+		budget = defaultCacheBudgetMB
+	}
+	ttl := defaultCacheTTL
+	if settings.TTLSeconds > 0 {
+		ttl = time.Duration(settings.TTLSeconds) * time.Second
+	}
+	return &locationCache{
+		budget:  int64(budget) << 20,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		average: cacheEntryOverhead,
+	}
+}
+
+// The get function returns the cached geolocation for ip, expired entries are dropped rather than returned
+func (cache *locationCache) get(ip string) (geolocation, bool) {
+	if cache == nil {
+		return geolocation{}, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[ip]
+	if !ok {
+		cache.stats.Misses++
+		return geolocation{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, ip)
+		cache.stats.Expirations++
+		cache.stats.Misses++
+		return geolocation{}, false
+	}
+	cache.order.MoveToFront(element)
+	cache.stats.Hits++
+	return entry.location, true
+}
+
+// The getStale function is get() that also returns entries past their TTL, for when an old answer beats none, see degradationTracker
+func (cache *locationCache) getStale(ip string) (geolocation, bool) {
+	if cache == nil {
+		return geolocation{}, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[ip]
+	if !ok {
+		cache.stats.Misses++
+		return geolocation{}, false
+	}
+	cache.order.MoveToFront(element)
+	cache.stats.Hits++
+	return element.Value.(*cacheEntry).location, true
+}
+
+// The put function caches location for ip and evicts the least recently used entries until the cache fits its budget again
+func (cache *locationCache) put(ip string, location geolocation) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry := &cacheEntry{ip: ip, location: location, expires: time.Now().Add(cache.ttl)}
+	if element, ok := cache.entries[ip]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+	} else {
+		cache.entries[ip] = cache.order.PushFront(entry)
+	}
+
+	if cache.inserted%cacheSampleEvery == 0 {
+		sample := estimateEntrySize(entry)
+		// An exponential moving average keeps one unusual entry from swinging the capacity
+		cache.average = (cache.average*3 + sample) / 4
+	}
+	cache.inserted++
+
+	capacity := cache.capacity()
+	for cache.order.Len() > capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).ip)
+		cache.stats.Evictions++
+	}
+}
+
+// The purgeExpired function drops every entry whose TTL has passed, returning how many were dropped
+func (cache *locationCache) purgeExpired() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now, purged := time.Now(), 0
+	for ip, element := range cache.entries {
+		if now.After(element.Value.(*cacheEntry).expires) {
+			cache.order.Remove(element)
+			delete(cache.entries, ip)
+			purged++
+		}
+	}
+	cache.stats.Expirations += int64(purged)
+	return purged
+}
+
+// The peek function returns the cached entry for ip without counting a hit or refreshing its place in the LRU order
+func (cache *locationCache) peek(ip string) (cacheEntry, bool) {
+	if cache == nil {
+		return cacheEntry{}, false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[ip]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	return *element.Value.(*cacheEntry), true
+}
+
+// The forget function drops the cached geolocation of ip, reporting whether there was one
+func (cache *locationCache) forget(ip string) bool {
+	if cache == nil {
+		return false
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[ip]
+	if ok {
+		cache.order.Remove(element)
+		delete(cache.entries, ip)
+	}
+	return ok
+}
+
+// The capacity function is the number of entries that fit in the budget at the current average entry size
+func (cache *locationCache) capacity() int {
+	capacity := int(cache.budget / cache.average)
+	if capacity < 1 {
+		capacity = 1
+	}
+	return capacity
+}
+
+// The snapshot function returns the cache's current size and counters, an empty snapshot when caching is disabled
+func (cache *locationCache) snapshot() cacheStats {
+	if cache == nil {
+		return cacheStats{}
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Entries = cache.order.Len()
+	stats.Capacity = cache.capacity()
+	stats.BudgetBytes = cache.budget
+	stats.AverageEntrySize = cache.average
+	stats.EstimatedBytes = int64(stats.Entries) * cache.average
+	return stats
+}
+
+// The estimateEntrySize function approximates the memory an entry holds: its strings plus the fixed bookkeeping overhead
+func estimateEntrySize(entry *cacheEntry) int64 {
+	size := int64(cacheEntryOverhead + 2*len(entry.ip) + len(entry.location.Sources))
+	for _, value := range locationFields(entry.location) {
+		size += int64(len(value)) + 16
+	}
+	return size
+}
+
+// The setCacheStatus function reports through the X-Cache header whether a response was served from the cache
+func setCacheStatus(w http.ResponseWriter, hit bool) {
+	if geoCache == nil {
+		return
+	}
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+}
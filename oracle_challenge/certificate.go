@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+)
+
+// The certificateReport struct describes the certificate a server presented, Verified says whether it chains to a trusted root for the name
+type certificateReport struct {
+	ConnectedIP string    `json:"connected_ip"`
+	Subject     string    `json:"subject"`
+	SANs        []string  `json:"sans"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Expired     bool      `json:"expired"`
+	SHA256      string    `json:"sha256"`
+	Verified    bool      `json:"verified"`
+	VerifyError string    `json:"verify_error,omitempty"`
+}
+
+/*
+	The inspectCertificate function connects to port 443 of name through the outbound guard and reports the certificate it presents
+	The handshake doesn't verify the certificate so that an untrusted or expired one can still be described, it is verified afterwards instead
+*/
+func inspectCertificate(ctx context.Context, name string) (*certificateReport, error) {
+	connection, err := outbound.dialContext(ctx, "tcp", net.JoinHostPort(name, "443"))
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+	}
+	client := tls.Client(connection, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+	if err := client.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	chain := client.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, errors.New("the server presented no certificate")
+	}
+
+	leaf := chain[0]
+	fingerprint := sha256.Sum256(leaf.Raw)
+	report := &certificateReport{
+		Subject:   leaf.Subject.String(),
+		SANs:      append([]string{}, leaf.DNSNames...),
+		Issuer:    leaf.Issuer.String(),
+		NotBefore: leaf.NotBefore.UTC(),
+		NotAfter:  leaf.NotAfter.UTC(),
+		Expired:   time.Now().After(leaf.NotAfter),
+		SHA256:    hex.EncodeToString(fingerprint[:]),
+	}
+	if host, _, err := net.SplitHostPort(connection.RemoteAddr().String()); err == nil {
+		report.ConnectedIP = host
+	}
+	for _, address := range leaf.IPAddresses {
+		report.SANs = append(report.SANs, address.String())
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Intermediates: intermediates}); err != nil {
+		report.VerifyError = err.Error()
+	} else {
+		report.Verified = true
+	}
+	return report, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxContainsCIDRs bounds how many ranges a single /cidr/contains request can check
+const maxContainsCIDRs = 256
+
+// The cidrMembership struct is whether the address falls inside one range of a /cidr/contains request
+type cidrMembership struct {
+	CIDR     string `json:"cidr"`
+	Contains bool   `json:"contains"`
+}
+
+// The cidrContainsAnswer struct is the answer of /cidr/contains, Contains is true when the address falls inside any of the ranges
+type cidrContainsAnswer struct {
+	IP       string           `json:"ip"`
+	Contains bool             `json:"contains"`
+	CIDRs    []cidrMembership `json:"cidrs"`
+}
+
+/*
+	The handleCIDRContains function serves /cidr/contains?ip=X&cidr=Y, the check determinePrivacy() makes against the private ranges
+	made against ranges of the client's choosing
+	cidr may be repeated or comma separated to check several ranges at once, each is answered on its own and contains is true if any match
+	Without ?ip= the client's own address is checked
+*/
+func handleCIDRContains(w http.ResponseWriter, r *http.Request) {
+	ip, err := targetIP(r)
+	if writeInvalidAddress(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var ranges []string
+	for _, value := range r.URL.Query()["cidr"] {
+		ranges = append(ranges, splitList(value)...)
+	}
+	if len(ranges) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "at least one ?cidr= is required"})
+		return
+	}
+	if len(ranges) > maxContainsCIDRs {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "too many ranges in one request"})
+		return
+	}
+
+	address := net.ParseIP(ip)
+	answer := cidrContainsAnswer{IP: ip}
+	for _, value := range ranges {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"cidr": value, "error": strconv.Quote(value) + " is not a valid CIDR range"})
+			return
+		}
+		membership := cidrMembership{CIDR: network.String(), Contains: network.Contains(address)}
+		answer.Contains = answer.Contains || membership.Contains
+		answer.CIDRs = append(answer.CIDRs, membership)
+	}
+	writeJSON(w, http.StatusOK, answer)
+}
+
+/*
+	The subnetInfo struct is the answer of /cidr/info/{prefix}
+	IPv4 has no broadcast address below a /31 and a /31 has no network or broadcast address either (RFC 3021), so there every address is usable,
+	IPv6 has no broadcast address at all
+	Addresses and UsableHosts are numbers that can outgrow 64 bits for IPv6
+*/
+type subnetInfo struct {
+	CIDR         string   `json:"cidr"`
+	Version      int      `json:"version"`
+	PrefixLength int      `json:"prefix_length"`
+	Network      string   `json:"network"`
+	Broadcast    string   `json:"broadcast,omitempty"`
+	Netmask      string   `json:"netmask"`
+	Wildcard     string   `json:"wildcard"`
+	FirstUsable  string   `json:"first_usable"`
+	LastUsable   string   `json:"last_usable"`
+	Addresses    *big.Int `json:"addresses"`
+	UsableHosts  *big.Int `json:"usable_hosts"`
+}
+
+// The offsetIP function returns ip moved by offset, which may be negative, within the address length of ip
+func offsetIP(ip net.IP, offset int64) net.IP {
+	value := new(big.Int).SetBytes(ip)
+	value.Add(value, big.NewInt(offset))
+	moved := make(net.IP, len(ip))
+	value.FillBytes(moved)
+	return moved
+}
+
+// The describeSubnet function works out everything /cidr/info reports about network
+func describeSubnet(network *net.IPNet) subnetInfo {
+	ones, bits := network.Mask.Size()
+	// Only a 32-bit mask is IPv4, an IPv4-mapped IPv6 prefix keeps its 16 bytes to line up with its 16-byte mask
+	base := network.IP
+	if v4 := base.To4(); v4 != nil && bits == 32 {
+		base = v4
+	}
+	wildcard := make(net.IP, len(base))
+	last := make(net.IP, len(base))
+	for i := range base {
+		wildcard[i] = ^network.Mask[i]
+		last[i] = base[i] | wildcard[i]
+	}
+
+	info := subnetInfo{
+		CIDR:         network.String(),
+		Version:      6,
+		PrefixLength: ones,
+		Network:      base.String(),
+		Netmask:      net.IP(network.Mask).String(),
+		Wildcard:     wildcard.String(),
+		FirstUsable:  base.String(),
+		LastUsable:   last.String(),
+		Addresses:    new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)),
+	}
+	info.UsableHosts = new(big.Int).Set(info.Addresses)
+	if bits == 32 {
+		info.Version = 4
+		if bits-ones >= 2 {
+			info.Broadcast = last.String()
+			info.FirstUsable, info.LastUsable = offsetIP(base, 1).String(), offsetIP(last, -1).String()
+			info.UsableHosts.Sub(info.UsableHosts, big.NewInt(2))
+		}
+	}
+	return info
+}
+
+/*
+	The handleCIDRInfo function serves /cidr/info/{prefix}, a subnet calculator for an IPv4 or IPv6 prefix such as /cidr/info/192.0.2.0/24
+	A prefix with host bits set is answered for the network it belongs to
+*/
+func handleCIDRInfo(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.Trim(strings.TrimPrefix(r.URL.Path, "/cidr/info/"), "/")
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"cidr": prefix, "error": strconv.Quote(prefix) + " is not a valid CIDR range"})
+		return
+	}
+	writeJSON(w, http.StatusOK, describeSubnet(network))
+}
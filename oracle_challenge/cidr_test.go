@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDescribeSubnet(t *testing.T) {
+	tests := []struct {
+		prefix        string
+		wantVersion   int
+		wantNetmask   string
+		wantWildcard  string
+		wantFirst     string
+		wantLast      string
+		wantBroadcast string
+		wantAddresses int64
+	}{
+		{prefix: "192.0.2.0/24", wantVersion: 4, wantNetmask: "255.255.255.0", wantWildcard: "0.0.0.255", wantFirst: "192.0.2.1", wantLast: "192.0.2.254", wantBroadcast: "192.0.2.255", wantAddresses: 256},
+		{prefix: "192.0.2.7/31", wantVersion: 4, wantNetmask: "255.255.255.254", wantWildcard: "0.0.0.1", wantFirst: "192.0.2.6", wantLast: "192.0.2.7", wantAddresses: 2},
+		{prefix: "2001:db8::/120", wantVersion: 6, wantNetmask: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00", wantWildcard: "::ff", wantFirst: "2001:db8::", wantLast: "2001:db8::ff", wantAddresses: 256},
+		// An IPv4-mapped prefix is an IPv6 one whose last 32 bits hold the IPv4 address
+		{prefix: "::ffff:1.2.3.0/120", wantVersion: 6, wantNetmask: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00", wantWildcard: "::ff", wantFirst: "1.2.3.0", wantLast: "1.2.3.255", wantAddresses: 256},
+	}
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			_, network, err := net.ParseCIDR(test.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := describeSubnet(network)
+			if info.Version != test.wantVersion || info.Netmask != test.wantNetmask || info.Wildcard != test.wantWildcard ||
+				info.FirstUsable != test.wantFirst || info.LastUsable != test.wantLast || info.Broadcast != test.wantBroadcast || info.Addresses.Int64() != test.wantAddresses {
+				t.Fatalf("describeSubnet() = %+v", info)
+			}
+		})
+	}
+}
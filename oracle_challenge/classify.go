@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+	bogonClasses folds the IANA types of bogonRanges into the classifications /classify and ip_classification report:
+	private covers RFC 1918 and IPv6 unique local addresses, cgnat the RFC 6598 shared address space,
+	and any special-purpose type not listed here is reserved
+*/
+var bogonClasses = map[string]string{
+	"private":              "private",
+	"unique_local":         "private",
+	"shared_address_space": "cgnat",
+	"loopback":             "loopback",
+	"link_local":           "link_local",
+	"multicast":            "multicast",
+	"documentation":        "documentation",
+}
+
+// The addressClassification struct is the answer of /classify/{ip}, the special-purpose range is only set for an address that isn't public
+type addressClassification struct {
+	IP             string `json:"ip"`
+	Classification string `json:"classification"`
+	Public         bool   `json:"public"`
+	Range          string `json:"range,omitempty"`
+	Type           string `json:"type,omitempty"`
+	Reference      string `json:"reference,omitempty"`
+}
+
+// The classifyAddress function labels ip as public or by the special-purpose range it is in, see bogonClasses
+func classifyAddress(ip string) addressClassification {
+	classification := addressClassification{IP: ip, Classification: "public", Public: true}
+	bogon, ok := checkBogon(ip).(*bogonError)
+	if !ok {
+		return classification
+	}
+	classification.Classification, ok = bogonClasses[bogon.Range.Type]
+	if !ok {
+		classification.Classification = "reserved"
+	}
+	classification.Public = false
+	classification.Range, classification.Type, classification.Reference = bogon.Range.CIDR, bogon.Range.Type, bogon.Range.Reference
+	return classification
+}
+
+// The handleClassify function serves /classify/{ip}, which special-purpose range (if any) the address is in, the client's own address without one
+func handleClassify(w http.ResponseWriter, r *http.Request) {
+	input := strings.Trim(strings.TrimPrefix(r.URL.Path, "/classify"), "/")
+	if input == "" {
+		ip, err := determineIP(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		input = ip
+	}
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		writeInvalidAddress(w, &invalidAddressError{Input: input})
+		return
+	}
+	writeJSON(w, http.StatusOK, classifyAddress(parsed.String()))
+}
@@ -0,0 +1,185 @@
+/*
+	Package client calls an oracle instance's lookup RPC (oracle.v1.LookupService, served when the connect feature is on)
+	so Go services don't each hand-roll the HTTP:
+
+		oracle := client.New("https://oracle.internal", client.Options{APIKey: key})
+		location, err := oracle.Lookup(ctx, "8.8.8.8")
+
+	Failed calls return an *Error carrying the service's error code, transient failures are retried first
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// lookupPath is where the Lookup RPC is served, relative to the instance's base URL
+const lookupPath = "/oracle.v1.LookupService/Lookup"
+
+// The Options struct configures a Client, the zero value is usable
+type Options struct {
+	// HTTPClient makes the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// APIKey is sent as X-API-Key when set, for instances or virtual hosts that require one
+	APIKey string
+	// MaxRetries is how many times a transient failure is retried, 2 when zero and none when negative
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled for each one after it, 200ms when zero
+	Backoff time.Duration
+	// UserAgent replaces the default User-Agent
+	UserAgent string
+}
+
+// The Location struct is the Lookup RPC's response, the same canonical fields /ip/json serves
+type Location struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	City     string `json:"city"`
+	Postal   string `json:"postal"`
+	Timezone string `json:"timezone"`
+	Loc      string `json:"loc"`
+	Org      string `json:"org"`
+}
+
+// The Error codes the service answers with, compare against Error.Code
+const (
+	CodeInvalidArgument    = "invalid_argument"
+	CodeFailedPrecondition = "failed_precondition"
+	CodeUnauthenticated    = "unauthenticated"
+	CodeUnimplemented      = "unimplemented"
+	CodeResourceExhausted  = "resource_exhausted"
+	CodeInternal           = "internal"
+	CodeUnavailable        = "unavailable"
+)
+
+/*
+	The Error struct is a failed call, Code is one of the Code constants (or "unknown" when the body wasn't an RPC error)
+	A bogon, such as a private address, is CodeFailedPrecondition since it has no geolocation to look up
+*/
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+// The Error function formats the code, HTTP status and message of the failed call
+func (err *Error) Error() string {
+	return fmt.Sprintf("oracle: %s (HTTP %d): %s", err.Code, err.StatusCode, err.Message)
+}
+
+// The Temporary function reports whether the call may succeed if it is made again later
+func (err *Error) Temporary() bool {
+	return err.Code == CodeUnavailable || err.Code == CodeResourceExhausted || err.StatusCode >= http.StatusInternalServerError
+}
+
+// statusCodes gives plain-text error responses the code their HTTP status stands for
+var statusCodes = map[int]string{
+	http.StatusUnauthorized:       CodeUnauthenticated,
+	http.StatusNotFound:           CodeUnimplemented,
+	http.StatusTooManyRequests:    CodeResourceExhausted,
+	http.StatusServiceUnavailable: CodeUnavailable,
+}
+
+// The Client struct calls one oracle instance, it is safe for concurrent use
+type Client struct {
+	baseURL string
+	options Options
+}
+
+// The New function returns a Client for the instance at baseURL, e.g. "https://oracle.internal"
+func New(baseURL string, options Options) *Client {
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = 2
+	}
+	if options.Backoff == 0 {
+		options.Backoff = 200 * time.Millisecond
+	}
+	if options.UserAgent == "" {
+		options.UserAgent = "oracle-go-client"
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), options: options}
+}
+
+/*
+	The Lookup function returns the geolocation of ip, or of the caller's own address when ip is ""
+	Network errors and temporary *Errors are retried with exponential backoff until ctx is done or the retries run out
+*/
+func (client *Client) Lookup(ctx context.Context, ip string) (*Location, error) {
+	payload, err := json.Marshal(map[string]string{"ip": ip})
+	if err != nil {
+		return nil, err
+	}
+
+	wait := client.options.Backoff
+	for attempt := 0; ; attempt++ {
+		location, err := client.lookupOnce(ctx, payload)
+		if err == nil {
+			return location, nil
+		}
+		var rpcError *Error
+		retryable := !errors.As(err, &rpcError) || rpcError.Temporary()
+		if !retryable || attempt >= client.options.MaxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+		wait *= 2
+	}
+}
+
+// The lookupOnce function makes a single Lookup call
+func (client *Client) lookupOnce(ctx context.Context, payload []byte) (*Location, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, client.baseURL+lookupPath, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Connect-Protocol-Version", "1")
+	request.Header.Set("User-Agent", client.options.UserAgent)
+	if client.options.APIKey != "" {
+		request.Header.Set("X-API-Key", client.options.APIKey)
+	}
+
+	response, err := client.options.HTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		rpcError := &Error{StatusCode: response.StatusCode}
+		// Errors from outside the RPC handler (a missing API key, maintenance mode, the feature being off) are plain text
+		if json.Unmarshal(body, rpcError) != nil || rpcError.Code == "" {
+			rpcError.Code, rpcError.Message = statusCodes[response.StatusCode], strings.TrimSpace(string(body))
+			if rpcError.Code == "" {
+				rpcError.Code = "unknown"
+			}
+		}
+		return nil, rpcError
+	}
+	var location Location
+	if err := json.Unmarshal(body, &location); err != nil {
+		return nil, fmt.Errorf("oracle: decoding the response: %w", err)
+	}
+	return &location, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+/*
+	The handleCheckIP function emulates http://checkip.dyndns.com/ byte for byte, including its trailing CRLF
+	Legacy clients hardcoded to that service can be pointed at /checkip without changing how they parse the response
+*/
+func handleCheckIP(w http.ResponseWriter, r *http.Request) {
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "<html><head><title>Current IP Check</title></head><body>Current IP Address: "+ip+"</body></html>\r\n")
+}
+
+/*
+	The handleBareIP function answers like icanhazip.com and ifconfig.me/ip, nothing but the client's IP address and a newline
+	It always serves /ip/raw, and with the compat feature on / and /ip too, anything else below / is still a 404
+*/
+func handleBareIP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/ip" && r.URL.Path != "/ip/raw" {
+		http.NotFound(w, r)
+		return
+	}
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, ip+"\n")
+}
+
+// The handleAllJSON function mirrors the shape of ifconfig.me/all.json, fields we can't know (like remote_host) say "unavailable" as ifconfig.me does
+func handleAllJSON(w http.ResponseWriter, r *http.Request) {
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, port, _ := net.SplitHostPort(r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		IPAddr     string `json:"ip_addr"`
+		RemoteHost string `json:"remote_host"`
+		UserAgent  string `json:"user_agent"`
+		Port       string `json:"port"`
+		Language   string `json:"language"`
+		Method     string `json:"method"`
+		Encoding   string `json:"encoding"`
+		Mime       string `json:"mime"`
+		Via        string `json:"via"`
+		Forwarded  string `json:"forwarded"`
+	}{
+		IPAddr:     ip,
+		RemoteHost: "unavailable",
+		UserAgent:  r.UserAgent(),
+		Port:       port,
+		Language:   r.Header.Get("Accept-Language"),
+		Method:     r.Method,
+		Encoding:   r.Header.Get("Accept-Encoding"),
+		Mime:       r.Header.Get("Accept"),
+		Via:        r.Header.Get("Via"),
+		Forwarded:  r.Header.Get("X-Forwarded-For"),
+	})
+}
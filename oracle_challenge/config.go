@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The settings struct provides the scaffolding for the optional JSON config file passed via -config
+type settings struct {
+	Listen            string                     `json:"listen"`
+	TLSCert           string                     `json:"tls_cert"`
+	TLSKey            string                     `json:"tls_key"`
+	DataDir           string                     `json:"data_dir"`
+	APIKeys           []string                   `json:"api_keys"`
+	AdminKeys         []string                   `json:"admin_keys"`
+	Outbound          outboundSettings           `json:"outbound"`
+	Quota             quotaSettings              `json:"quota"`
+	Maintenance       maintenanceSettings        `json:"maintenance"`
+	Features          map[string]bool            `json:"features"`
+	Adapters          []adapterSettings          `json:"adapters"`
+	Enrichment        enrichmentSettings         `json:"enrichment"`
+	Decision          decisionSettings           `json:"decision"`
+	SelfHistory       selfHistorySettings        `json:"self_history"`
+	Pricing           map[string]pricingSettings `json:"pricing"`
+	Cache             cacheSettings              `json:"cache"`
+	UnixSocket        string                     `json:"unix_socket"`
+	Output            outputSettings             `json:"output"`
+	OutputTemplates   map[string]outputSettings  `json:"output_templates"`
+	RedactionPolicies []redactionPolicy          `json:"redaction_policies"`
+	Stats             statsSettings              `json:"stats"`
+	Signing           signingSettings            `json:"signing"`
+	ProxyCheck        proxyCheckSettings         `json:"proxy_check"`
+	BGP               bgpSettings                `json:"bgp"`
+	RPKI              rpkiSettings               `json:"rpki"`
+	PeeringDB         peeringDBSettings          `json:"peeringdb"`
+	BogonStatus       int                        `json:"bogon_status"`
+	Providers         []providerSettings         `json:"providers"`
+	SelfConsistency   consistencySettings        `json:"self_consistency"`
+	Listeners         []listenerSettings         `json:"listeners"`
+	SelfDiscovery     selfDiscoverySettings      `json:"self_discovery"`
+	Connect           connectSettings            `json:"connect"`
+	Audit             auditSettings              `json:"audit"`
+	Retention         retentionSettings          `json:"retention"`
+	Encryption        encryptionSettings         `json:"encryption"`
+	Tenants           []tenantSettings           `json:"tenants"`
+	Sampling          samplingSettings           `json:"sampling"`
+	Merge             mergeSettings              `json:"merge"`
+	Snapshots         []snapshotSettings         `json:"snapshots"`
+	RDNS              rdnsSettings               `json:"rdns"`
+	DNSBL             dnsblSettings              `json:"dnsbl"`
+	ASN               asnSettings                `json:"asn"`
+	ShutdownGrace     int                        `json:"shutdown_grace_seconds"`
+	Pool              poolSettings               `json:"pool"`
+	RDAP              rdapSettings               `json:"rdap"`
+	Share             shareSettings              `json:"share"`
+	Notifications     notificationSettings       `json:"notifications"`
+	Latency           latencySettings            `json:"latency"`
+	SLOs              map[string]sloSettings     `json:"slos"`
+	Ticketing         ticketingSettings          `json:"ticketing"`
+	Degradation       degradationSettings        `json:"degradation"`
+	EmailHeaders      emailHeaderSettings        `json:"email_headers"`
+	IPInfo            ipinfoSettings             `json:"ipinfo"`
+}
+
+// config holds the effective settings for the running process, it is populated once by loadConfig() before the server starts
+var config = settings{
+	Listen: ":8080",
+}
+
+var (
+	// configFile is the absolute path of the config file loadConfig() read, "" when running on defaults
+	configFile string
+	// envOverrides names every environment variable that overrode a value from the config file
+	envOverrides []string
+)
+
+/*
+	The loadConfig function reads the JSON config file at path (when one is given) over the top of the defaults
+	Environment variables are applied last so that secrets like API keys don't have to live in the file:
+		ORACLE_LISTEN     - address the http.server binds to
+		ORACLE_API_KEYS   - comma separated list of keys accepted by authenticated endpoints
+		ORACLE_ADMIN_KEYS - comma separated list of keys accepted by the /admin/ endpoints
+*/
+func loadConfig(path string) error {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return err
+		}
+		if configFile, err = filepath.Abs(path); err != nil {
+			return err
+		}
+	}
+
+	if listen := os.Getenv("ORACLE_LISTEN"); listen != "" {
+		config.Listen = listen
+		envOverrides = append(envOverrides, "ORACLE_LISTEN")
+	}
+	if keys := os.Getenv("ORACLE_API_KEYS"); keys != "" {
+		config.APIKeys = splitList(keys)
+		envOverrides = append(envOverrides, "ORACLE_API_KEYS")
+	}
+	if keys := os.Getenv("ORACLE_ADMIN_KEYS"); keys != "" {
+		config.AdminKeys = splitList(keys)
+		envOverrides = append(envOverrides, "ORACLE_ADMIN_KEYS")
+	}
+	return nil
+}
+
+// The splitList function splits a comma separated environment value, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+/*
+	The requireAPIKey function wraps a handler so it is only served to clients presenting a configured API key
+	The key is accepted from either "Authorization: Bearer <key>" or the "X-API-Key" header
+	When no keys are configured the endpoint is effectively disabled rather than left open
+	Each key draws from its own token bucket, see quotaTracker.allowKey()
+*/
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		if !validAPIKey(key, config.APIKeys) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oracle"`)
+			http.Error(w, "a valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		if !quotas.allowKey(key) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(60/config.Quota.RatePerMinute))))
+			http.Error(w, "the quota for this API key has been exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// The requireAdminKey function wraps a handler so it is only served to clients presenting one of the configured admin keys
+func requireAdminKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validAPIKey(requestAPIKey(r), config.AdminKeys) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oracle-admin"`)
+			http.Error(w, "a valid admin key is required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// The requestAPIKey function pulls the presented API key out of the request headers, returning "" when none was sent
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return ""
+}
+
+// The validAPIKey function compares the presented key against every one of keys in constant time
+func validAPIKey(presented string, keys []string) bool {
+	if presented == "" {
+		return false
+	}
+	valid := false
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// configBundleFormat identifies a config bundle, and its version, so import can refuse anything else
+const configBundleFormat = "oracle-config-bundle/1"
+
+/*
+	The configBundle struct is the effective config of one instance as "oracle config export" writes it, for "oracle config import" on another
+	Config always has its secrets redacted as /debug/config shows them, so a bundle can be reviewed and diffed
+	With a key the complete config is also in Sealed, AES-256-GCM encrypted under that key, and import restores the secrets from it
+	EnvOverrides are the environment variables that went into Config, the target may want to set them again rather than keep their values
+*/
+type configBundle struct {
+	Format       string          `json:"format"`
+	Exported     time.Time       `json:"exported"`
+	Instance     string          `json:"instance"`
+	SourceFile   string          `json:"source_file,omitempty"`
+	EnvOverrides []string        `json:"env_overrides,omitempty"`
+	Secrets      string          `json:"secrets"`
+	Config       json.RawMessage `json:"config"`
+	Sealed       string          `json:"sealed,omitempty"`
+}
+
+// The bundleKey function reads the key a bundle is sealed with from keyEnv or keyFile, as encryption at rest reads its own, nil when neither is given
+func bundleKey(keyEnv, keyFile string) (cipher.AEAD, error) {
+	if keyEnv == "" && keyFile == "" {
+		return nil, nil
+	}
+	return loadStorageCipher(encryptionSettings{Enabled: true, KeyEnv: keyEnv, KeyFile: keyFile})
+}
+
+// The exportConfig function bundles the loaded config, sealing the complete one under key when there is one
+func exportConfig(key cipher.AEAD) (configBundle, error) {
+	bundle := configBundle{Format: configBundleFormat, Exported: time.Now().UTC(), SourceFile: configFile, EnvOverrides: envOverrides, Secrets: "redacted"}
+	bundle.Instance, _ = os.Hostname()
+	redacted, err := json.Marshal(redactedConfig())
+	if err != nil {
+		return bundle, err
+	}
+	bundle.Config = redacted
+	if key == nil {
+		return bundle, nil
+	}
+
+	complete, err := json.Marshal(config)
+	if err != nil {
+		return bundle, err
+	}
+	nonce := make([]byte, key.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return bundle, err
+	}
+	bundle.Sealed = base64.StdEncoding.EncodeToString(key.Seal(nonce, nonce, complete, []byte(configBundleFormat)))
+	bundle.Secrets = "encrypted"
+	return bundle, nil
+}
+
+/*
+	The importConfig function returns the config a bundle carries, the complete one when it is sealed and a key is given
+	The config is checked to be one this binary can load, a bundle from a newer version with settings this one doesn't know is refused
+*/
+func importConfig(bundle configBundle, key cipher.AEAD) (settings, error) {
+	var imported settings
+	if bundle.Format != configBundleFormat {
+		return imported, fmt.Errorf("config import: unknown bundle format %q, expected %q", bundle.Format, configBundleFormat)
+	}
+	source := []byte(bundle.Config)
+	if bundle.Sealed != "" {
+		if key == nil {
+			return imported, errors.New("config import: the bundle's secrets are encrypted, give the key with -key-env or -key-file")
+		}
+		sealed, err := base64.StdEncoding.DecodeString(bundle.Sealed)
+		if err != nil || len(sealed) < key.NonceSize() {
+			return imported, errors.New("config import: the sealed config is malformed")
+		}
+		if source, err = key.Open(nil, sealed[:key.NonceSize()], sealed[key.NonceSize():], []byte(configBundleFormat)); err != nil {
+			return imported, errors.New("config import: the sealed config can't be decrypted with this key")
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(source))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&imported); err != nil {
+		return imported, fmt.Errorf("config import: %w", err)
+	}
+	return imported, nil
+}
+
+// The redactedPaths function lists where value, a decoded JSON document, still holds redactedSecret, e.g. "api_keys[0]"
+func redactedPaths(value interface{}, path string) []string {
+	var paths []string
+	switch value := value.(type) {
+	case string:
+		if value == redactedSecret {
+			paths = append(paths, path)
+		}
+	case []interface{}:
+		for i, element := range value {
+			paths = append(paths, redactedPaths(element, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	case map[string]interface{}:
+		var names []string
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := name
+			if path != "" {
+				child = path + "." + name
+			}
+			paths = append(paths, redactedPaths(value[name], child)...)
+		}
+	}
+	return paths
+}
+
+/*
+	The runConfigCommand function implements "oracle config export|import"
+	export writes the bundle of the config given by -config (environment overrides applied) to -o or stdout,
+	import writes the config of the bundle given by -i to -o, ready to be passed to -config on this instance
+	Secrets come across only when the bundle is sealed with -key-env or -key-file (a base64 32 byte key, as encryption.key_env takes),
+	a redacted bundle is only imported with -allow-redacted, after which every placeholder it lists has to be filled in
+	It returns the process exit code
+*/
+func runConfigCommand(arguments []string) int {
+	if len(arguments) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: oracle config export|import [flags]")
+		return 2
+	}
+	action := arguments[0]
+
+	flags := flag.NewFlagSet("config "+action, flag.ContinueOnError)
+	configPath := flags.String("config", "", "config file to export")
+	input := flags.String("i", "", "bundle to import")
+	output := flags.String("o", "", "file to write the bundle (export) or the config (import) to, stdout by default")
+	keyEnv := flags.String("key-env", "", "environment variable holding the key the secrets are sealed with")
+	keyFile := flags.String("key-file", "", "file holding the key the secrets are sealed with")
+	allowRedacted := flags.Bool("allow-redacted", false, "import a config whose secrets are redacted placeholders")
+	if err := flags.Parse(arguments[1:]); err != nil {
+		return 2
+	}
+
+	key, err := bundleKey(*keyEnv, *keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var written interface{}
+	var placeholders []string
+	switch action {
+	case "export":
+		if err = loadConfig(*configPath); err == nil {
+			written, err = exportConfig(key)
+		}
+	case "import":
+		written, placeholders, err = importBundleFile(*input, key, *allowRedacted)
+	default:
+		err = fmt.Errorf("unknown config action %q", action)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	encoded, err := json.MarshalIndent(written, "", "  ")
+	if err == nil && *output != "" {
+		err = writeFileAtomic(*output, append(encoded, '\n'))
+	} else if err == nil {
+		_, err = os.Stdout.Write(append(encoded, '\n'))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, path := range placeholders {
+		fmt.Fprintf(os.Stderr, "config import: %s is %s, fill it in before starting\n", path, redactedSecret)
+	}
+	return 0
+}
+
+// The importBundleFile function reads the bundle at path and returns its config, along with where it still holds redacted placeholders
+func importBundleFile(path string, key cipher.AEAD, allowRedacted bool) (settings, []string, error) {
+	if path == "" {
+		return settings{}, nil, errors.New("config import: -i is required")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return settings{}, nil, err
+	}
+	var bundle configBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return settings{}, nil, fmt.Errorf("config import: %w", err)
+	}
+	imported, err := importConfig(bundle, key)
+	if err != nil {
+		return imported, nil, err
+	}
+
+	var document interface{}
+	encoded, err := json.Marshal(imported)
+	if err == nil {
+		err = json.Unmarshal(encoded, &document)
+	}
+	if err != nil {
+		return imported, nil, err
+	}
+	placeholders := redactedPaths(document, "")
+	if len(placeholders) > 0 && !allowRedacted {
+		return imported, nil, fmt.Errorf("config import: %d secrets are redacted in the bundle (%v), export it with a key or import it with -allow-redacted and fill them in", len(placeholders), placeholders)
+	}
+	return imported, placeholders, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// connectService is the fully-qualified name the lookup RPCs are served under, each method is at /{connectService}/{method}
+const connectService = "oracle.v1.LookupService"
+
+/*
+	The connectSettings struct configures the Connect protocol endpoint
+	AllowedOrigins lists the origins (or "*") browsers may call it from, without any only same-origin and non-browser clients can
+*/
+type connectSettings struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// The connectError struct is the error body of the Connect protocol, Code is one of its snake_case codes
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// connectStatus maps the Connect error codes this service returns to their HTTP statuses
+var connectStatus = map[string]int{
+	"invalid_argument":    http.StatusBadRequest,
+	"failed_precondition": http.StatusBadRequest,
+	"unauthenticated":     http.StatusUnauthorized,
+	"unimplemented":       http.StatusNotFound,
+	"resource_exhausted":  http.StatusTooManyRequests,
+	"internal":            http.StatusInternalServerError,
+	"unavailable":         http.StatusServiceUnavailable,
+}
+
+// The lookupRequest struct is the request message of the Lookup RPC, an empty IP looks up the caller
+type lookupRequest struct {
+	IP string `json:"ip"`
+}
+
+// connectMethods lists the unary RPCs of connectService, each takes the raw JSON request message and returns the response message
+var connectMethods = map[string]func(*http.Request, []byte) (interface{}, *connectError){
+	"Lookup": connectLookup,
+}
+
+/*
+	The handleConnect function serves connectService over the Connect protocol's unary JSON encoding, so browsers can call it with fetch:
+		POST /oracle.v1.LookupService/Lookup with Content-Type application/json and a body such as {"ip": "8.8.8.8"}
+		GET  /oracle.v1.LookupService/Lookup?encoding=json&message={"ip":"8.8.8.8"} (optionally base64=1), which caches like any GET
+	Errors are answered as {"code": ..., "message": ...} with the matching HTTP status, as Connect clients expect
+	Only the JSON codec is offered, a client asking for application/proto is told the media type is unsupported
+*/
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	setConnectCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	method, ok := connectMethods[strings.TrimPrefix(r.URL.Path, "/"+connectService+"/")]
+	if !ok {
+		writeConnectError(w, &connectError{Code: "unimplemented", Message: r.URL.Path + " is not a method of " + connectService})
+		return
+	}
+
+	var message []byte
+	switch r.Method {
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			w.Header().Set("Accept-Post", "application/json")
+			http.Error(w, "only the application/json codec is supported", http.StatusUnsupportedMediaType)
+			return
+		}
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+			writeConnectError(w, &connectError{Code: "unimplemented", Message: "request compression " + encoding + " is not supported"})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			writeConnectError(w, &connectError{Code: "invalid_argument", Message: err.Error()})
+			return
+		}
+		message = body
+	case http.MethodGet:
+		query := r.URL.Query()
+		if query.Get("encoding") != "json" {
+			writeConnectError(w, &connectError{Code: "invalid_argument", Message: "only encoding=json is supported"})
+			return
+		}
+		message = []byte(query.Get("message"))
+		if query.Get("base64") == "1" {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(query.Get("message"), "="))
+			if err != nil {
+				writeConnectError(w, &connectError{Code: "invalid_argument", Message: "message is not valid base64: " + err.Error()})
+				return
+			}
+			message = decoded
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response, failure := method(r, message)
+	if failure != nil {
+		writeConnectError(w, failure)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// The connectLookup function is the Lookup RPC, answering with the same canonical fields as /ip/json
+func connectLookup(r *http.Request, message []byte) (interface{}, *connectError) {
+	var request lookupRequest
+	if len(message) > 0 {
+		if err := json.Unmarshal(message, &request); err != nil {
+			return nil, &connectError{Code: "invalid_argument", Message: "the request message is not valid JSON: " + err.Error()}
+		}
+	}
+
+	ip := request.IP
+	if ip == "" {
+		caller, err := determineIP(r)
+		if err != nil {
+			return nil, &connectError{Code: "internal", Message: err.Error()}
+		}
+		ip = caller
+	} else if net.ParseIP(ip) == nil {
+		return nil, &connectError{Code: "invalid_argument", Message: "ip is not a valid IP address"}
+	}
+
+	location, _, err := lookupFor(r, ip)
+	var bogon *bogonError
+	if errors.As(err, &bogon) {
+		return nil, &connectError{Code: "failed_precondition", Message: bogon.Error()}
+	}
+	if err != nil {
+		return nil, &connectError{Code: "unavailable", Message: err.Error()}
+	}
+	location.IP = ip
+	return locationFields(location), nil
+}
+
+// The writeConnectError function writes failure in the Connect protocol's unary error shape
+func writeConnectError(w http.ResponseWriter, failure *connectError) {
+	status, ok := connectStatus[failure.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(failure)
+}
+
+/*
+	The setConnectCORS function adds the CORS headers a browser needs to call the RPCs from one of the allowed origins
+	Other origins get no headers, which leaves the browser to refuse the cross-origin call while same-origin calls still work
+*/
+func setConnectCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	allowed := false
+	for _, candidate := range config.Connect.AllowedOrigins {
+		if origin != "" && (candidate == "*" || candidate == origin) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Connect-Protocol-Version, Connect-Timeout-Ms, X-User-Agent")
+	w.Header().Set("Access-Control-Max-Age", "7200")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// forwardingHeaders are what /connection counts as a request having come through a proxy, the proxyHeaders of /proxy/check plus the ones a load balancer sets
+var forwardingHeaders = append([]string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Real-Ip"}, proxyHeaders...)
+
+/*
+	The connectionInfo struct is the answer of /connection
+	RemoteIP and RemotePort are the peer of the TCP connection, which is the last proxy rather than the client when Proxied is set,
+	RemotePort is omitted when the peer address has no port
+*/
+type connectionInfo struct {
+	RemoteIP     string   `json:"remote_ip"`
+	RemotePort   int      `json:"remote_port,omitempty"`
+	Protocol     string   `json:"protocol"`
+	TLS          bool     `json:"tls"`
+	Proxied      bool     `json:"proxied"`
+	ProxyHeaders []string `json:"proxy_headers,omitempty"`
+	KeepAlive    bool     `json:"keep_alive"`
+}
+
+/*
+	The handleConnection function serves /connection, what the server knows about the connection the request arrived on
+	HTTP/1.1 keeps the connection open unless the client sent "Connection: close", HTTP/1.0 only when it asked for keep-alive,
+	Go works both out into r.Close, and HTTP/2 and later always multiplex requests over a connection that stays open
+*/
+func handleConnection(w http.ResponseWriter, r *http.Request) {
+	info := connectionInfo{RemoteIP: r.RemoteAddr, Protocol: r.Proto, TLS: r.TLS != nil, KeepAlive: r.ProtoMajor >= 2 || !r.Close}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.RemoteIP = host
+		info.RemotePort, _ = strconv.Atoi(port)
+	}
+	for _, name := range forwardingHeaders {
+		if strings.TrimSpace(r.Header.Get(name)) != "" {
+			info.ProxyHeaders = append(info.ProxyHeaders, name)
+		}
+	}
+	info.Proxied = len(info.ProxyHeaders) > 0
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultConsistencyInterval applies when self_consistency.interval_seconds isn't configured
+	defaultConsistencyInterval = time.Hour
+	// defaultMaxDistanceKM applies when self_consistency.max_distance_km isn't configured
+	defaultMaxDistanceKM = 500
+	// consistencyAlertLimit is how many alerts /self/consistency keeps
+	consistencyAlertLimit = 50
+)
+
+/*
+	The consistencySettings struct configures the self-consistency checker
+	Providers disagree when they report different countries or coordinates more than MaxDistanceKM apart
+	Alerts are logged and, when AlertURL is set, POSTed there as JSON
+*/
+type consistencySettings struct {
+	IntervalSeconds int     `json:"interval_seconds"`
+	MaxDistanceKM   float64 `json:"max_distance_km"`
+	AlertURL        string  `json:"alert_url"`
+}
+
+// The providerAnswer struct is what one provider said about our own address
+type providerAnswer struct {
+	Provider string `json:"provider"`
+	Country  string `json:"country,omitempty"`
+	Region   string `json:"region,omitempty"`
+	City     string `json:"city,omitempty"`
+	Loc      string `json:"loc,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// The consistencyReport struct is the outcome of one check
+type consistencyReport struct {
+	IP            string           `json:"ip"`
+	CheckedAt     time.Time        `json:"checked_at"`
+	Answers       []providerAnswer `json:"answers"`
+	Disagreements []string         `json:"disagreements"`
+	Changes       []string         `json:"changes"`
+}
+
+// The consistencyAlert struct is a single alert, Kind is "disagreement" or "changed"
+type consistencyAlert struct {
+	At      time.Time `json:"at"`
+	Kind    string    `json:"kind"`
+	IP      string    `json:"ip"`
+	Message string    `json:"message"`
+}
+
+/*
+	The consistencyChecker struct geolocates this host's external address with every provider on a schedule
+	It is a canary for provider data quality: providers disagreeing with each other, or an answer changing between checks, raises an alert
+*/
+type consistencyChecker struct {
+	mutex     sync.Mutex
+	providers []geoProvider
+	last      *consistencyReport
+	lastError string
+	alerts    []consistencyAlert
+}
+
+// consistency is started by main() when the self_consistency feature is on
+var consistency *consistencyChecker
+
+// The check function runs one round, comparing the providers with each other and with the previous round
+func (checker *consistencyChecker) check() {
+	ip, err := acquireExternalIP()
+	if err != nil {
+		checker.mutex.Lock()
+		checker.lastError = err.Error()
+		checker.mutex.Unlock()
+		return
+	}
+
+	report := consistencyReport{IP: ip, CheckedAt: time.Now().UTC(), Disagreements: []string{}, Changes: []string{}}
+	for _, provider := range checker.providers {
+		answer := providerAnswer{Provider: provider.name}
+		location, err := provider.lookup(ip)
+		if err != nil {
+			answer.Error = err.Error()
+		} else {
+			answer.Country, answer.Region, answer.City, answer.Loc = location.Country, location.Region, location.City, location.Loc
+		}
+		report.Answers = append(report.Answers, answer)
+	}
+
+	maxDistance := config.SelfConsistency.MaxDistanceKM
+	if maxDistance <= 0 {
+		maxDistance = defaultMaxDistanceKM
+	}
+	for i, first := range report.Answers {
+		for _, second := range report.Answers[i+1:] {
+			if disagreement := compareAnswers(first, second, maxDistance); disagreement != "" {
+				report.Disagreements = append(report.Disagreements, disagreement)
+			}
+		}
+	}
+
+	checker.mutex.Lock()
+	if checker.last != nil {
+		if checker.last.IP != ip {
+			report.Changes = append(report.Changes, "the external address changed from "+checker.last.IP+" to "+ip)
+		}
+		for i, answer := range report.Answers {
+			if i < len(checker.last.Answers) && answer.Error == "" && checker.last.Answers[i].Error == "" {
+				previous := checker.last.Answers[i]
+				if previous.Country != answer.Country || previous.City != answer.City || previous.Loc != answer.Loc {
+					report.Changes = append(report.Changes, fmt.Sprintf("%s moved from %s/%s (%s) to %s/%s (%s)", answer.Provider, previous.Country, previous.City, previous.Loc, answer.Country, answer.City, answer.Loc))
+				}
+			}
+		}
+	}
+	checker.last = &report
+	checker.lastError = ""
+	checker.mutex.Unlock()
+
+	for _, message := range report.Disagreements {
+		checker.alert(consistencyAlert{At: report.CheckedAt, Kind: "disagreement", IP: ip, Message: message})
+	}
+	for _, message := range report.Changes {
+		checker.alert(consistencyAlert{At: report.CheckedAt, Kind: "changed", IP: ip, Message: message})
+	}
+}
+
+// The compareAnswers function describes how two answers disagree, "" when they agree or either failed
+func compareAnswers(first, second providerAnswer, maxDistance float64) string {
+	if first.Error != "" || second.Error != "" {
+		return ""
+	}
+	if !strings.EqualFold(first.Country, second.Country) {
+		return fmt.Sprintf("%s says %s but %s says %s", first.Provider, first.Country, second.Provider, second.Country)
+	}
+	if distance, ok := distanceKM(first.Loc, second.Loc); ok && distance > maxDistance {
+		return fmt.Sprintf("%s and %s place the address %.0f km apart", first.Provider, second.Provider, distance)
+	}
+	return ""
+}
+
+// The alert function logs an alert, keeps it for /self/consistency and posts it to the alert URL when one is configured
+func (checker *consistencyChecker) alert(alert consistencyAlert) {
+	log.Printf("self-consistency %s: %s", alert.Kind, alert.Message)
+	checker.mutex.Lock()
+	checker.alerts = append(checker.alerts, alert)
+	if len(checker.alerts) > consistencyAlertLimit {
+		checker.alerts = checker.alerts[len(checker.alerts)-consistencyAlertLimit:]
+	}
+	checker.mutex.Unlock()
+
+	if config.SelfConsistency.AlertURL == "" {
+		return
+	}
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(config.SelfConsistency.AlertURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("self-consistency alert: %v", err)
+		return
+	}
+	response.Body.Close()
+}
+
+// The watch function runs a check every interval until stop is closed
+func (checker *consistencyChecker) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checker.check()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The handleSelfConsistency function serves /self/consistency, the latest check and the recent alerts
+func handleSelfConsistency(w http.ResponseWriter, r *http.Request) {
+	consistency.mutex.Lock()
+	response := struct {
+		Last      *consistencyReport `json:"last"`
+		LastError string             `json:"last_error,omitempty"`
+		Alerts    []consistencyAlert `json:"alerts"`
+	}{consistency.last, consistency.lastError, append([]consistencyAlert{}, consistency.alerts...)}
+	consistency.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+/*
+	The pricingSettings struct describes how a provider bills, keyed by provider name in config
+	MonthlyFee is charged regardless of usage and covers IncludedCalls, every call beyond that costs CostPerCall
+*/
+type pricingSettings struct {
+	MonthlyFee    float64 `json:"monthly_fee"`
+	IncludedCalls int     `json:"included_calls"`
+	CostPerCall   float64 `json:"cost_per_call"`
+	Currency      string  `json:"currency"`
+}
+
+// The providerCost struct is the cost report for one provider, served by /stats
+type providerCost struct {
+	CallsThisMonth       int     `json:"calls_this_month"`
+	ProjectedCalls       int     `json:"projected_calls"`
+	IncludedCalls        int     `json:"included_calls"`
+	EstimatedMonthlyCost float64 `json:"estimated_monthly_cost"`
+	Currency             string  `json:"currency"`
+}
+
+/*
+	The estimateCosts function projects this month's calls for every provider from the rate seen so far,
+	and prices the projection with the provider's configured pricing (unpriced providers cost nothing)
+*/
+func estimateCosts(calls map[string]int, now time.Time) map[string]providerCost {
+	now = now.UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	elapsed := now.Sub(monthStart).Hours() / monthEnd.Sub(monthStart).Hours()
+
+	costs := map[string]providerCost{}
+	for provider, count := range calls {
+		projected := count
+		if elapsed > 0 {
+			projected = int(math.Ceil(float64(count) / elapsed))
+		}
+
+		pricing := config.Pricing[provider]
+		currency := pricing.Currency
+		if currency == "" {
+			currency = "USD"
+		}
+		billable := math.Max(0, float64(projected-pricing.IncludedCalls))
+		costs[provider] = providerCost{
+			CallsThisMonth:       count,
+			ProjectedCalls:       projected,
+			IncludedCalls:        pricing.IncludedCalls,
+			EstimatedMonthlyCost: math.Round((pricing.MonthlyFee+billable*pricing.CostPerCall)*100) / 100,
+			Currency:             currency,
+		}
+	}
+	return costs
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDatasetSize bounds a single dataset download
+	maxDatasetSize = 512 << 20
+	// datasetDownloadTimeout bounds a single dataset download
+	datasetDownloadTimeout = 5 * time.Minute
+	// datasetRetryInterval is how soon a failed download is retried
+	datasetRetryInterval = 5 * time.Minute
+)
+
+/*
+	The remoteDataset struct is a file downloaded from url every interval and handed to parse, which installs whatever it parsed
+	The last download is kept in config.DataDir under name so a restart can serve the data before the next download completes
+	A parse error keeps the previous data in place, gzip-compressed downloads are decompressed before parsing
+*/
+type remoteDataset struct {
+	name     string
+	url      string
+	interval time.Duration
+	parse    func([]byte) error
+
+	mutex       sync.Mutex
+	fetchedAt   time.Time
+	lastChecked time.Time
+	lastError   string
+}
+
+// The datasetAge struct reports where a dataset came from and how old it is, responses built from it include this
+type datasetAge struct {
+	Source     string     `json:"source"`
+	FetchedAt  *time.Time `json:"fetched_at"`
+	AgeSeconds int64      `json:"age_seconds"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// The newRemoteDataset function describes a dataset, nothing is loaded until load() or watch() is called
+func newRemoteDataset(name, url string, interval time.Duration, parse func([]byte) error) *remoteDataset {
+	return &remoteDataset{name: name, url: url, interval: interval, parse: parse}
+}
+
+// The cachePath function is where the last download is kept, "" when no data_dir is configured
+func (dataset *remoteDataset) cachePath() string {
+	if config.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(config.DataDir, dataset.name)
+}
+
+// The load function parses the cached copy of the dataset, if there is one
+func (dataset *remoteDataset) load() error {
+	path := dataset.cachePath()
+	if path == "" {
+		return nil
+	}
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := dataset.install(contents); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	dataset.mutex.Lock()
+	dataset.fetchedAt = info.ModTime()
+	dataset.mutex.Unlock()
+	return nil
+}
+
+// The install function decompresses contents when needed and parses them
+func (dataset *remoteDataset) install(contents []byte) error {
+	if bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			return err
+		}
+		if contents, err = io.ReadAll(io.LimitReader(reader, maxDatasetSize)); err != nil {
+			return err
+		}
+	}
+	return dataset.parse(contents)
+}
+
+// The refresh function downloads and parses the dataset, then replaces the cached copy
+func (dataset *remoteDataset) refresh() error {
+	err := dataset.download()
+
+	dataset.mutex.Lock()
+	defer dataset.mutex.Unlock()
+	dataset.lastChecked = time.Now().UTC()
+	dataset.lastError = ""
+	if err != nil {
+		dataset.lastError = err.Error()
+		return err
+	}
+	dataset.fetchedAt = dataset.lastChecked
+	return nil
+}
+
+// The download function fetches url, installs it and writes the cached copy
+func (dataset *remoteDataset) download() error {
+	client := egressClient(datasetDownloadTimeout)
+	response, err := client.Get(dataset.url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", dataset.url, response.Status)
+	}
+	contents, err := io.ReadAll(io.LimitReader(response.Body, maxDatasetSize))
+	if err != nil {
+		return err
+	}
+	if err := dataset.install(contents); err != nil {
+		return err
+	}
+	if path := dataset.cachePath(); path != "" {
+		return writeFileAtomic(path, contents)
+	}
+	return nil
+}
+
+// The watch function refreshes the dataset whenever it is older than its interval until stop is closed, failed downloads are retried every datasetRetryInterval
+func (dataset *remoteDataset) watch(stop <-chan struct{}) {
+	for {
+		dataset.mutex.Lock()
+		next := dataset.fetchedAt.Add(dataset.interval)
+		if dataset.lastError != "" {
+			next = dataset.lastChecked.Add(datasetRetryInterval)
+		}
+		dataset.mutex.Unlock()
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-stop:
+			return
+		}
+		if err := dataset.refresh(); err != nil {
+			log.Printf("dataset %s: %v", dataset.name, err)
+		}
+	}
+}
+
+// The age function reports the dataset's source and age
+func (dataset *remoteDataset) age() datasetAge {
+	dataset.mutex.Lock()
+	defer dataset.mutex.Unlock()
+	age := datasetAge{Source: dataset.url, LastError: dataset.lastError}
+	if !dataset.fetchedAt.IsZero() {
+		fetchedAt := dataset.fetchedAt.UTC()
+		age.FetchedAt = &fetchedAt
+		age.AgeSeconds = int64(time.Since(fetchedAt).Seconds())
+	}
+	return age
+}
+
+// The loaded function reports whether the dataset has ever been parsed successfully
+func (dataset *remoteDataset) loaded() bool {
+	dataset.mutex.Lock()
+	defer dataset.mutex.Unlock()
+	return !dataset.fetchedAt.IsZero()
+}
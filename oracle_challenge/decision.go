@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The decisionSettings struct configures the optional allow/deny check made before serving a request, by a webhook or an embedded Rego policy
+	The webhook receives a POST of {"ip": "...", "path": "...", "geo": {...}} (geo only when IncludeGeo is set)
+	and answers 200 with {"allow": true|false, "reason": "..."}
+	Policy instead names Rego loaded at startup (a .rego file, a directory of them or an OPA bundle .tar.gz, see loadRegoPolicy()),
+	evaluated in-process with the same document as input; Rule is the rule to evaluate, data.oracle.allow by default,
+	and may be a boolean or an object carrying allow and reason, a rule that is undefined for the input denying the request
+	Decisions are cached per IP and path for CacheSeconds; FailOpen decides whether requests are served when no decision can be made
+*/
+type decisionSettings struct {
+	URL          string            `json:"url"`
+	Policy       string            `json:"policy"`
+	Rule         string            `json:"rule"`
+	TimeoutMS    int               `json:"timeout_ms"`
+	CacheSeconds int               `json:"cache_seconds"`
+	FailOpen     bool              `json:"fail_open"`
+	IncludeGeo   bool              `json:"include_geo"`
+	Headers      map[string]string `json:"headers"`
+}
+
+// The decision struct is the verdict of the webhook or the policy
+type decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// The cachedDecision struct remembers a verdict until it expires
+type cachedDecision struct {
+	verdict decision
+	expires time.Time
+}
+
+// decisionCacheLimit bounds the cache, expired entries are swept whenever it fills up
+const decisionCacheLimit = 10000
+
+// defaultDecisionRule is evaluated when decision.rule isn't set
+const defaultDecisionRule = "data.oracle.allow"
+
+var (
+	decisionMutex sync.Mutex
+	decisionCache = map[string]cachedDecision{}
+	// decisionPolicy is loaded in main() when decision.policy is configured
+	decisionPolicy *regoPolicy
+)
+
+/*
+	The withDecision function wraps the mux so every request is vetted by the decision webhook or policy, when one is configured
+	/healthz, /readyz, /admin/ and /debug/ are left alone so a decision can't lock operators out of the service
+*/
+func withDecision(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (config.Decision.URL == "" && decisionPolicy == nil) || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A request whose address can't be determined is treated like a failed decision, not let through unvetted
+		ip, err := determineIP(r)
+		var verdict decision
+		if err == nil {
+			verdict, err = decide(r.Context(), ip, r.URL.Path)
+		}
+		if err != nil {
+			if config.Decision.FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "the request could not be authorized: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !verdict.Allow {
+			reason := verdict.Reason
+			if reason == "" {
+				reason = "the request was denied by policy"
+			}
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	The loadDecisionPolicy function loads the Rego policy of decision.policy and checks the rule to evaluate is one of its rules,
+	nil when no policy is configured
+*/
+func loadDecisionPolicy(settings decisionSettings) (*regoPolicy, error) {
+	if settings.Policy == "" {
+		if settings.Rule != "" {
+			return nil, errors.New("decision: rule is only used with policy")
+		}
+		return nil, nil
+	}
+	if settings.URL != "" {
+		return nil, errors.New("decision: set either url for a webhook or policy for a Rego policy, not both")
+	}
+	policy, err := loadRegoPolicy(settings.Policy)
+	recordComponent("decision_policy", "policy", settings.Policy, err)
+	if err != nil {
+		return nil, fmt.Errorf("decision: %w", err)
+	}
+	rule := settings.Rule
+	if rule == "" {
+		rule = defaultDecisionRule
+	}
+	if _, ok := policy.rules[strings.TrimPrefix(rule, "data.")]; !ok {
+		return nil, fmt.Errorf("decision: policy %s has no rule %s", settings.Policy, rule)
+	}
+	return policy, nil
+}
+
+// The decide function returns the cached verdict for ip requesting path, consulting the policy or the webhook when there isn't a fresh one
+func decide(ctx context.Context, ip, path string) (decision, error) {
+	cacheKey := ip + "\x00" + path
+	decisionMutex.Lock()
+	cached, ok := decisionCache[cacheKey]
+	decisionMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.verdict, nil
+	}
+
+	var verdict decision
+	var err error
+	if decisionPolicy != nil {
+		verdict, err = evaluateDecisionPolicy(ip, path)
+	} else {
+		verdict, err = askDecisionWebhook(ctx, ip, path)
+	}
+	if err != nil {
+		return decision{}, err
+	}
+
+	if config.Decision.CacheSeconds > 0 {
+		decisionMutex.Lock()
+		if len(decisionCache) >= decisionCacheLimit {
+			now := time.Now()
+			for key, entry := range decisionCache {
+				if now.After(entry.expires) {
+					delete(decisionCache, key)
+				}
+			}
+		}
+		if len(decisionCache) < decisionCacheLimit {
+			decisionCache[cacheKey] = cachedDecision{verdict: verdict, expires: time.Now().Add(time.Duration(config.Decision.CacheSeconds) * time.Second)}
+		}
+		decisionMutex.Unlock()
+	}
+	return verdict, nil
+}
+
+// The askDecisionWebhook function posts the request details to the webhook and decodes its verdict
+func askDecisionWebhook(ctx context.Context, ip, path string) (decision, error) {
+	timeout := 2 * time.Second
+	if config.Decision.TimeoutMS > 0 {
+		timeout = time.Duration(config.Decision.TimeoutMS) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := decisionInput(ip, path)
+	if err != nil {
+		return decision{}, err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return decision{}, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Decision.URL, bytes.NewReader(payload))
+	if err != nil {
+		return decision{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range config.Decision.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := egressClient(timeout).Do(request)
+	if err != nil {
+		return decision{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return decision{}, fmt.Errorf("decision webhook answered %s", response.Status)
+	}
+
+	var verdict decision
+	if err := json.NewDecoder(io.LimitReader(response.Body, 64<<10)).Decode(&verdict); err != nil {
+		return decision{}, fmt.Errorf("decision webhook returned an invalid verdict: %w", err)
+	}
+	return verdict, nil
+}
+
+// The decisionInput function builds the document a decision is made on, the webhook's request body and the policy's input
+func decisionInput(ip, path string) (map[string]interface{}, error) {
+	input := map[string]interface{}{"ip": ip, "path": path}
+	if config.Decision.IncludeGeo {
+		location, err := lookupGeolocation(ip)
+		if err != nil {
+			return nil, err
+		}
+		input["geo"] = locationFields(location)
+	}
+	return input, nil
+}
+
+/*
+	The evaluateDecisionPolicy function evaluates the configured rule of the Rego policy for ip requesting path
+	The rule may be a boolean or an object with allow and reason, a rule that is undefined for the input is a denial as it is in OPA
+*/
+func evaluateDecisionPolicy(ip, path string) (decision, error) {
+	input, err := decisionInput(ip, path)
+	if err != nil {
+		return decision{}, err
+	}
+	rule := config.Decision.Rule
+	if rule == "" {
+		rule = defaultDecisionRule
+	}
+	value, defined, err := decisionPolicy.evaluate(rule, input)
+	if err != nil {
+		return decision{}, fmt.Errorf("policy: %w", err)
+	}
+	if !defined {
+		return decision{Allow: false, Reason: "the policy is undefined for this request"}, nil
+	}
+
+	switch result := value.(type) {
+	case bool:
+		return decision{Allow: result}, nil
+	case map[string]interface{}:
+		allow, isBool := result["allow"].(bool)
+		reason, isString := result["reason"].(string)
+		if isBool && (isString || result["reason"] == nil) {
+			return decision{Allow: allow, Reason: reason}, nil
+		}
+	}
+	return decision{}, fmt.Errorf("policy: %s must be a boolean or an object with a boolean allow and a string reason, not %s", rule, regoKey(value))
+}
@@ -0,0 +1,73 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	The defaultRoutes function reads the IPv4 and IPv6 default routes out of /proc/net/route and /proc/net/ipv6_route
+	A host without IPv6 has no ipv6_route file, which just means it has no IPv6 default route
+*/
+func defaultRoutes() ([]defaultRoute, error) {
+	routes := []defaultRoute{}
+
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ..., addresses are little-endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		route := defaultRoute{Interface: fields[0], Family: "ipv4"}
+		route.Metric, _ = strconv.Atoi(fields[6])
+		if gateway, err := strconv.ParseUint(fields[2], 16, 32); err == nil && gateway != 0 {
+			ip := make(net.IP, net.IPv4len)
+			binary.LittleEndian.PutUint32(ip, uint32(gateway))
+			route.Gateway = ip.String()
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	file6, err := os.Open("/proc/net/ipv6_route")
+	if os.IsNotExist(err) {
+		return routes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file6.Close()
+	scanner = bufio.NewScanner(file6)
+	for scanner.Scan() {
+		// destination prefix_length source source_length next_hop metric refcount use flags interface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" || fields[9] == "lo" {
+			continue
+		}
+		route := defaultRoute{Interface: fields[9], Family: "ipv6"}
+		if metric, err := strconv.ParseUint(fields[5], 16, 32); err == nil {
+			route.Metric = int(metric)
+		}
+		if gateway, err := hex.DecodeString(fields[4]); err == nil && len(gateway) == net.IPv6len && !net.IP(gateway).IsUnspecified() {
+			route.Gateway = net.IP(gateway).String()
+		}
+		routes = append(routes, route)
+	}
+	return routes, scanner.Err()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// The defaultRoutes function has no portable way to read the routing table outside Linux, so it reports that instead
+func defaultRoutes() ([]defaultRoute, error) {
+	return nil, errors.New("default routes are only reported on Linux")
+}
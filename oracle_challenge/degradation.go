@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The failure states a lookup can be degraded by, one per row of the degradation matrix
+const (
+	stateHealthy      = "healthy"
+	stateProviderDown = "provider_down"
+	stateCacheDown    = "cache_down"
+	stateBothDown     = "both_down"
+)
+
+// The actions an operator can take for a failure state
+const (
+	// actionNormal keeps looking up as usual, the cache first and the provider on a miss
+	actionNormal = "normal"
+	// actionCacheOnly answers from the cache alone, entries past their TTL included, and fails a miss
+	actionCacheOnly = "cache_only"
+	// actionProviderOnly skips the cache and asks the provider every time
+	actionProviderOnly = "provider_only"
+	// actionIPOnly answers with the address and no location
+	actionIPOnly = "ip_only"
+	// actionUnavailable fails every lookup and takes the instance out of /readyz
+	actionUnavailable = "unavailable"
+)
+
+// defaultProbeInterval applies when degradation.probe_seconds isn't configured
+const defaultProbeInterval = 30 * time.Second
+
+/*
+	The degradationSettings struct is the degradation matrix, what to do with lookups while the provider, the cache or both are down
+	Each is one of the action constants, "normal" when not configured, e.g. cache_only for provider_down and ip_only for both_down
+	The provider is down once every upstream provider has failed notifications.outage_after calls in a row,
+	the cache is down when it is disabled (a negative cache.memory_budget_mb)
+	While the provider is down one lookup every ProbeSeconds (30 by default) still asks it, so it is noticed when it comes back
+*/
+type degradationSettings struct {
+	ProviderDown string `json:"provider_down"`
+	CacheDown    string `json:"cache_down"`
+	BothDown     string `json:"both_down"`
+	ProbeSeconds int    `json:"probe_seconds"`
+}
+
+// The degradationStatus struct is the failure state lookups are in and the action taken for it, as /readyz reports it
+type degradationStatus struct {
+	State         string   `json:"state"`
+	Action        string   `json:"action"`
+	ProvidersDown []string `json:"providers_down,omitempty"`
+	CacheDown     bool     `json:"cache_down"`
+}
+
+// The degradedError type is a lookup the degradation matrix refused to make
+type degradedError struct {
+	IP     string
+	Status degradationStatus
+}
+
+func (err *degradedError) Error() string {
+	if err.Status.Action == actionCacheOnly {
+		return fmt.Sprintf("%s is not cached and lookups are %s while %s", err.IP, actionCacheOnly, err.Status.State)
+	}
+	return fmt.Sprintf("lookups are %s while %s", err.Status.Action, err.Status.State)
+}
+
+// The degradationTracker struct remembers the last state lookups were in, to log changes, and when the provider was last probed
+type degradationTracker struct {
+	mutex     sync.Mutex
+	state     string
+	lastProbe time.Time
+}
+
+var degradation = &degradationTracker{state: stateHealthy}
+
+// The validateDegradation function checks every action of settings is one of the action constants
+func validateDegradation(settings degradationSettings) error {
+	actions := map[string]string{stateProviderDown: settings.ProviderDown, stateCacheDown: settings.CacheDown, stateBothDown: settings.BothDown}
+	for state, action := range actions {
+		switch action {
+		case "", actionNormal, actionCacheOnly, actionProviderOnly, actionIPOnly, actionUnavailable:
+		default:
+			return fmt.Errorf("degradation: %s: unknown action %q", state, action)
+		}
+	}
+	if settings.ProbeSeconds < 0 {
+		return fmt.Errorf("degradation: probe_seconds can't be negative")
+	}
+	return nil
+}
+
+// The action function returns the action configured for state, actionNormal when none is
+func (settings degradationSettings) action(state string) string {
+	action := map[string]string{stateProviderDown: settings.ProviderDown, stateCacheDown: settings.CacheDown, stateBothDown: settings.BothDown}[state]
+	if action == "" {
+		return actionNormal
+	}
+	return action
+}
+
+// The upstreamProviders function returns the names of the providers an upstream lookup asks, see fetchUpstream()
+func upstreamProviders() []string {
+	if merger == nil {
+		return []string{ipinfoProvider}
+	}
+	var names []string
+	for _, provider := range merger.providers {
+		names = append(names, provider.name)
+	}
+	return names
+}
+
+// The status function works out the failure state lookups are in now, logging when it changed since the last time it was asked
+func (tracker *degradationTracker) status() degradationStatus {
+	status := degradationStatus{State: stateHealthy, CacheDown: geoCache == nil}
+	providers := upstreamProviders()
+	for _, provider := range providers {
+		if providerOutages.out(provider) {
+			status.ProvidersDown = append(status.ProvidersDown, provider)
+		}
+	}
+	providerDown := len(status.ProvidersDown) == len(providers)
+	switch {
+	case providerDown && status.CacheDown:
+		status.State = stateBothDown
+	case providerDown:
+		status.State = stateProviderDown
+	case status.CacheDown:
+		status.State = stateCacheDown
+	}
+	status.Action = config.Degradation.action(status.State)
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if status.State != tracker.state {
+		log.Printf("degradation: lookups went from %s to %s, action %s", tracker.state, status.State, status.Action)
+		tracker.state = status.State
+	}
+	return status
+}
+
+// The probe function reports whether this lookup should ask the provider despite it being down, once every probe interval
+func (tracker *degradationTracker) probe() bool {
+	interval := defaultProbeInterval
+	if config.Degradation.ProbeSeconds > 0 {
+		interval = time.Duration(config.Degradation.ProbeSeconds) * time.Second
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if time.Since(tracker.lastProbe) < interval {
+		return false
+	}
+	tracker.lastProbe = time.Now()
+	return true
+}
+
+/*
+	The lookup function finds ip in the cache or asks the provider as the action of the current failure state allows
+	cached reports an answer from the cache and fetched one from the provider, which the caller still has to cache
+	A lookup refused by the action fails with a *degradedError, under ip_only the answer is just the address
+*/
+func (tracker *degradationTracker) lookup(ip string) (location geolocation, cached, fetched bool, err error) {
+	status := tracker.status()
+	providerDown := status.State == stateProviderDown || status.State == stateBothDown
+	if providerDown && status.Action != actionNormal && status.Action != actionProviderOnly && tracker.probe() {
+		if location, err := fetchUpstream(ip); err == nil {
+			return location, false, true, nil
+		}
+	}
+
+	switch status.Action {
+	case actionIPOnly:
+		return geolocation{IP: ip}, false, false, nil
+	case actionUnavailable:
+		return geolocation{}, false, false, &degradedError{IP: ip, Status: status}
+	case actionCacheOnly:
+		if location, ok := geoCache.getStale(ip); ok {
+			return location, true, false, nil
+		}
+		return geolocation{}, false, false, &degradedError{IP: ip, Status: status}
+	case actionNormal:
+		if location, ok := geoCache.get(ip); ok {
+			return location, true, false, nil
+		}
+	}
+	location, err = fetchUpstream(ip)
+	return location, false, err == nil, err
+}
+
+/*
+	The handleReadyz function reports whether this instance can answer lookups and the degradation state they are in
+	It answers 503 in maintenance mode and while the action of the current state is unavailable, degraded but answering is still ready
+*/
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := degradation.status()
+	ready := !maintenanceMode.Load() && status.Action != actionUnavailable
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, struct {
+		Ready       bool              `json:"ready"`
+		Maintenance bool              `json:"maintenance"`
+		Degradation degradationStatus `json:"degradation"`
+	}{ready, maintenanceMode.Load(), status})
+}
+
+// The writeMetrics function writes which failure state lookups are in, one series per state labelled with the action configured for it
+func (tracker *degradationTracker) writeMetrics(w io.Writer) {
+	current := tracker.status()
+	writeMetricHeader(w, "oracle_degradation_state", "gauge", "1 for the failure state lookups are currently in, labelled with the action configured for each state.")
+	for _, state := range []string{stateHealthy, stateProviderDown, stateCacheDown, stateBothDown} {
+		active := 0
+		if state == current.State {
+			active = 1
+		}
+		fmt.Fprintf(w, "oracle_degradation_state{state=%q,action=%q} %d\n", state, config.Degradation.action(state), active)
+	}
+}
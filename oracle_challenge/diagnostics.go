@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// redactedSecret replaces every secret value in diagnostic output
+const redactedSecret = "[redacted]"
+
+// The componentStatus struct records whether a provider or database was loaded successfully at startup
+type componentStatus struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Loaded bool   `json:"loaded"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	componentsMutex sync.Mutex
+	components      []componentStatus
+)
+
+// The recordComponent function notes the outcome of loading a provider or database for /debug/config
+func recordComponent(name, kind, detail string, err error) {
+	status := componentStatus{Name: name, Kind: kind, Loaded: err == nil, Detail: detail}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	componentsMutex.Lock()
+	components = append(components, status)
+	componentsMutex.Unlock()
+}
+
+/*
+	The redactedConfig function returns a copy of the effective config with every secret replaced by redactedSecret
+	Any new secret field added to settings must be blanked out here too
+*/
+func redactedConfig() settings {
+	redacted := config
+	redacted.APIKeys = redactList(config.APIKeys)
+	redacted.AdminKeys = redactList(config.AdminKeys)
+	redacted.Adapters = append([]adapterSettings(nil), config.Adapters...)
+	for i := range redacted.Adapters {
+		redacted.Adapters[i].APIKeys = redactList(config.Adapters[i].APIKeys)
+	}
+	redacted.Signing.Keys = map[string]string{}
+	for keyID := range config.Signing.Keys {
+		redacted.Signing.Keys[keyID] = redactedSecret
+	}
+	redacted.Providers = append([]providerSettings(nil), config.Providers...)
+	for i := range redacted.Providers {
+		redacted.Providers[i].Headers = redactHeaders(config.Providers[i].Headers)
+	}
+	redacted.Decision.Headers = redactHeaders(config.Decision.Headers)
+	redacted.Enrichment.Hooks = append([]hookSettings(nil), config.Enrichment.Hooks...)
+	for i := range redacted.Enrichment.Hooks {
+		redacted.Enrichment.Hooks[i].Headers = redactHeaders(config.Enrichment.Hooks[i].Headers)
+	}
+	redacted.RedactionPolicies = append([]redactionPolicy(nil), config.RedactionPolicies...)
+	for i := range redacted.RedactionPolicies {
+		redacted.RedactionPolicies[i].APIKeys = redactList(config.RedactionPolicies[i].APIKeys)
+	}
+	redacted.Tenants = append([]tenantSettings(nil), config.Tenants...)
+	for i := range redacted.Tenants {
+		redacted.Tenants[i].APIKeys = redactList(config.Tenants[i].APIKeys)
+	}
+	redacted.Notifications.Connectors = append([]notifierSettings(nil), config.Notifications.Connectors...)
+	for i := range redacted.Notifications.Connectors {
+		// A webhook URL is its own credential
+		redacted.Notifications.Connectors[i].URL = redactedSecret
+	}
+	redacted.Ticketing.Connectors = append([]ticketConnectorSettings(nil), config.Ticketing.Connectors...)
+	for i := range redacted.Ticketing.Connectors {
+		redacted.Ticketing.Connectors[i].Headers = redactHeaders(config.Ticketing.Connectors[i].Headers)
+	}
+	if config.Pool.Secret != "" {
+		redacted.Pool.Secret = redactedSecret
+	}
+	if config.Share.Secret != "" {
+		redacted.Share.Secret = redactedSecret
+	}
+	return redacted
+}
+
+// The redactList function keeps the number of configured secrets visible while hiding their values
+func redactList(secrets []string) []string {
+	var redacted []string
+	for range secrets {
+		redacted = append(redacted, redactedSecret)
+	}
+	return redacted
+}
+
+// The redactHeaders function keeps configured header names visible while hiding their values, which usually carry credentials
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := map[string]string{}
+	for name := range headers {
+		redacted[name] = redactedSecret
+	}
+	return redacted
+}
+
+/*
+	The handleDebugConfig function reports which config file was read, which environment variables overrode it,
+	the effective merged config (secrets redacted), the resolved state of every feature flag and which providers/databases loaded
+*/
+func handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	features := map[string]bool{}
+	for feature := range defaultFeatures {
+		features[feature] = featureEnabled(feature)
+	}
+
+	componentsMutex.Lock()
+	loaded := append([]componentStatus(nil), components...)
+	componentsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(struct {
+		ConfigFile   string            `json:"config_file"`
+		EnvOverrides []string          `json:"env_overrides"`
+		Effective    settings          `json:"effective"`
+		Features     map[string]bool   `json:"features"`
+		Components   []componentStatus `json:"components"`
+	}{
+		ConfigFile:   configFile,
+		EnvOverrides: envOverrides,
+		Effective:    redactedConfig(),
+		Features:     features,
+		Components:   loaded,
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// earthRadiusKM is the Earth's mean radius
+	earthRadiusKM = 6371.0
+	// kilometresPerMile converts /distance answers to miles
+	kilometresPerMile = 1.609344
+)
+
+// The parseLoc function splits a "lat,lon" coordinate as providers report it into degrees, reporting whether it was one
+func parseLoc(loc string) (float64, float64, bool) {
+	parts := strings.Split(loc, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	latitude, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	longitude, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
+
+// The greatCircleKM function is the great-circle distance between two coordinates in degrees, by the haversine formula
+func greatCircleKM(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	radians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	lat1, lat2 := radians(latitude1), radians(latitude2)
+	h := math.Pow(math.Sin((lat2-lat1)/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(radians(longitude2-longitude1)/2), 2)
+	return 2 * earthRadiusKM * math.Asin(math.Sqrt(h))
+}
+
+// The distanceKM function is the great-circle distance between two "lat,lon" coordinates
+func distanceKM(first, second string) (float64, bool) {
+	lat1, lon1, ok1 := parseLoc(first)
+	lat2, lon2, ok2 := parseLoc(second)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return greatCircleKM(lat1, lon1, lat2, lon2), true
+}
+
+// The distanceEndpoint struct is one end of a /distance answer
+type distanceEndpoint struct {
+	IP        string  `json:"ip"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	City      string  `json:"city,omitempty"`
+	Country   string  `json:"country,omitempty"`
+}
+
+// The distanceAnswer struct is the answer of /distance, the distances are rounded to a tenth
+type distanceAnswer struct {
+	From          distanceEndpoint `json:"from"`
+	To            distanceEndpoint `json:"to"`
+	DistanceKM    float64          `json:"distance_km"`
+	DistanceMiles float64          `json:"distance_miles"`
+}
+
+/*
+	The handleDistance function serves /distance?from=IP&to=IP, geolocating both addresses and answering with the great-circle distance between them
+	from defaults to the client's own address, either being a bogon is answered as one, and an address the provider has no coordinates for is a 422
+*/
+func handleDistance(w http.ResponseWriter, r *http.Request) {
+	inputs := map[string]string{"from": r.URL.Query().Get("from"), "to": r.URL.Query().Get("to")}
+	if inputs["to"] == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "?to= is required"})
+		return
+	}
+	if inputs["from"] == "" {
+		ip, err := determineIP(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inputs["from"] = ip
+	}
+
+	endpoints := map[string]distanceEndpoint{}
+	for _, end := range []string{"from", "to"} {
+		parsed := net.ParseIP(inputs[end])
+		if parsed == nil {
+			writeInvalidAddress(w, &invalidAddressError{Input: inputs[end]})
+			return
+		}
+		ip := parsed.String()
+		if writeBogon(w, checkBogon(ip)) {
+			return
+		}
+		location, _, err := lookupFor(r, ip)
+		if writeBogon(w, err) {
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"ip": ip, "error": "Error while attempting to get location data: " + err.Error()})
+			return
+		}
+		if !location.Located {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"ip": ip, "error": "there are no coordinates for " + ip})
+			return
+		}
+		endpoints[end] = distanceEndpoint{IP: ip, Latitude: location.Latitude, Longitude: location.Longitude, City: location.City, Country: location.Country}
+	}
+
+	from, to := endpoints["from"], endpoints["to"]
+	kilometres := greatCircleKM(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	writeJSON(w, http.StatusOK, distanceAnswer{
+		From:          from,
+		To:            to,
+		DistanceKM:    math.Round(kilometres*10) / 10,
+		DistanceMiles: math.Round(kilometres/kilometresPerMile*10) / 10,
+	})
+}
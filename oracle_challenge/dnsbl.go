@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDNSBLCacheTTL applies when dnsbl.cache_seconds isn't configured
+	defaultDNSBLCacheTTL = 5 * time.Minute
+	// defaultDNSBLTimeout bounds the queries of one list when dnsbl.timeout_ms isn't configured
+	defaultDNSBLTimeout = 3 * time.Second
+	// dnsblCacheLimit caps how many addresses the DNSBL cache holds before expired answers are swept
+	dnsblCacheLimit = 10000
+)
+
+/*
+	The dnsblSettings struct lists the DNS blocklists /dnsbl/{ip} checks, e.g. {"name": "Spamhaus ZEN", "zone": "zen.spamhaus.org"}
+	Resolver is a "host:port" DNS server to ask instead of the system's resolver, several lists refuse queries from public resolvers
+*/
+type dnsblSettings struct {
+	Lists        []dnsblList `json:"lists"`
+	Resolver     string      `json:"resolver"`
+	TimeoutMS    int         `json:"timeout_ms"`
+	CacheSeconds int         `json:"cache_seconds"`
+}
+
+// The dnsblList struct is one DNS blocklist, queried as <reversed address>.<zone>
+type dnsblList struct {
+	Name string `json:"name"`
+	Zone string `json:"zone"`
+}
+
+/*
+	The dnsblStatus struct is what one list says about an address, Status is "listed", "not_listed" or "error"
+	Codes are the 127.0.0.x answers, which each list documents the meaning of, and Reason is its TXT record when it has one
+*/
+type dnsblStatus struct {
+	Name   string   `json:"name"`
+	Zone   string   `json:"zone"`
+	Status string   `json:"status"`
+	Codes  []string `json:"codes,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// The dnsblReport struct is the answer of /dnsbl/{ip}
+type dnsblReport struct {
+	IP        string        `json:"ip"`
+	Listed    bool          `json:"listed"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Lists     []dnsblStatus `json:"lists"`
+}
+
+// dnsblCache holds recent reports by address, a report with an erroring list isn't cached so it is retried next time
+var dnsblCache = struct {
+	sync.Mutex
+	reports map[string]dnsblReport
+}{reports: map[string]dnsblReport{}}
+
+// The checkDNSBLSettings function rejects lists without a name or zone at startup
+func checkDNSBLSettings(settings dnsblSettings) error {
+	for _, list := range settings.Lists {
+		if list.Name == "" || list.Zone == "" {
+			return errors.New("dnsbl: every list needs a name and a zone")
+		}
+	}
+	return nil
+}
+
+// The queryDNSBL function asks list about the address whose reversed form is reversed
+func queryDNSBL(ctx context.Context, resolver *net.Resolver, list dnsblList, reversed string) dnsblStatus {
+	status := dnsblStatus{Name: list.Name, Zone: list.Zone, Status: "not_listed"}
+	name := reversed + "." + strings.TrimSuffix(list.Zone, ".")
+	answers, err := resolver.LookupHost(ctx, name)
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) && dnsError.IsNotFound {
+		return status
+	}
+	if err != nil {
+		status.Status, status.Error = "error", err.Error()
+		return status
+	}
+	for _, answer := range answers {
+		address := net.ParseIP(answer).To4()
+		// Answers outside 127.0.0.0/8, and Spamhaus' 127.255.255.x, report a refused or malformed query rather than a listing
+		if address == nil || address[0] != 127 || (address[1] == 255 && address[2] == 255) {
+			status.Status, status.Error = "error", list.Zone+" answered "+answer+", the query was refused"
+			return status
+		}
+		status.Codes = append(status.Codes, answer)
+	}
+	status.Status = "listed"
+	if reasons, err := resolver.LookupTXT(ctx, name); err == nil {
+		status.Reason = strings.Join(reasons, " ")
+	}
+	return status
+}
+
+// The checkDNSBLs function checks ip against every configured list at once, from the cache when it was checked recently
+func checkDNSBLs(ctx context.Context, ip string) dnsblReport {
+	ttl := defaultDNSBLCacheTTL
+	if config.DNSBL.CacheSeconds > 0 {
+		ttl = time.Duration(config.DNSBL.CacheSeconds) * time.Second
+	}
+	dnsblCache.Lock()
+	cached, ok := dnsblCache.reports[ip]
+	dnsblCache.Unlock()
+	if ok && time.Since(cached.CheckedAt) < ttl {
+		return cached
+	}
+
+	timeout := defaultDNSBLTimeout
+	if config.DNSBL.TimeoutMS > 0 {
+		timeout = time.Duration(config.DNSBL.TimeoutMS) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// The arpa name without its suffix is the reversed address every list is queried with
+	arpa := addressForms(ip)["ip_arpa"]
+	reversed := arpa[:strings.LastIndex(strings.TrimSuffix(arpa, ".arpa"), ".")]
+	resolver := dnsResolver(config.DNSBL.Resolver)
+
+	report := dnsblReport{IP: ip, CheckedAt: time.Now().UTC(), Lists: make([]dnsblStatus, len(config.DNSBL.Lists))}
+	var group sync.WaitGroup
+	for i, list := range config.DNSBL.Lists {
+		group.Add(1)
+		go func(i int, list dnsblList) {
+			defer group.Done()
+			report.Lists[i] = queryDNSBL(ctx, resolver, list, reversed)
+		}(i, list)
+	}
+	group.Wait()
+
+	complete := true
+	for _, status := range report.Lists {
+		report.Listed = report.Listed || status.Status == "listed"
+		complete = complete && status.Status != "error"
+	}
+	if complete {
+		dnsblCache.Lock()
+		if len(dnsblCache.reports) >= dnsblCacheLimit {
+			for address, stale := range dnsblCache.reports {
+				if time.Since(stale.CheckedAt) >= ttl {
+					delete(dnsblCache.reports, address)
+				}
+			}
+		}
+		if len(dnsblCache.reports) < dnsblCacheLimit {
+			dnsblCache.reports[ip] = report
+		}
+		dnsblCache.Unlock()
+	}
+	return report
+}
+
+// The handleDNSBL function serves /dnsbl/{ip}, whether the address is on each of the configured DNS blocklists
+func handleDNSBL(w http.ResponseWriter, r *http.Request) {
+	input := strings.TrimPrefix(r.URL.Path, "/dnsbl/")
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		writeInvalidAddress(w, &invalidAddressError{Input: input})
+		return
+	}
+	if len(config.DNSBL.Lists) == 0 {
+		http.Error(w, "no DNS blocklists are configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, checkDNSBLs(r.Context(), parsed.String()))
+}
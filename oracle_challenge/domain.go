@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// domainTimeout bounds a whole /domain request, the resolution, every lookup and the optional extras
+const domainTimeout = 30 * time.Second
+
+// domainIncludes lists the optional sections a /domain request can ask for with ?include=
+var domainIncludes = map[string]bool{"registration": true, "certificate": true}
+
+/*
+	The domainRegistration struct is what RDAP says about the registration of a domain, Domain is the registered name it was found under
+	AgeDays counts whole days since the registration, so a domain registered today is 0 days old
+*/
+type domainRegistration struct {
+	Domain      string   `json:"domain"`
+	Registered  string   `json:"registered,omitempty"`
+	AgeDays     *int     `json:"age_days,omitempty"`
+	Expires     string   `json:"expires,omitempty"`
+	LastChanged string   `json:"last_changed,omitempty"`
+	Registrar   string   `json:"registrar,omitempty"`
+	Status      []string `json:"status,omitempty"`
+}
+
+// The domainReport struct is the answer of /domain/{name}, each address is reported as /lookup reports it
+type domainReport struct {
+	Name              string              `json:"name"`
+	Addresses         []batchResult       `json:"addresses"`
+	Registration      *domainRegistration `json:"registration,omitempty"`
+	RegistrationError string              `json:"registration_error,omitempty"`
+	Certificate       *certificateReport  `json:"certificate,omitempty"`
+	CertificateError  string              `json:"certificate_error,omitempty"`
+}
+
+// The parseHostname function returns input as a lower case name without its trailing dot, or an error when it isn't a public host name
+func parseHostname(input string) (string, error) {
+	name := strings.TrimSuffix(strings.ToLower(input), ".")
+	if net.ParseIP(name) != nil {
+		return "", errors.New(strconv.Quote(input) + " is an IP address, not a host name")
+	}
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return "", errors.New(strconv.Quote(input) + " is not a valid host name")
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", errors.New(strconv.Quote(input) + " is not a valid host name")
+		}
+		for _, character := range label {
+			if (character < 'a' || character > 'z') && (character < '0' || character > '9') && character != '-' {
+				return "", errors.New(strconv.Quote(input) + " is not a valid host name")
+			}
+		}
+	}
+	return name, nil
+}
+
+// The requestedIncludes function returns the sections ?include= asks for, an unknown one is an error
+func requestedIncludes(r *http.Request, known map[string]bool) (map[string]bool, error) {
+	included := map[string]bool{}
+	for _, name := range strings.Split(r.URL.Query().Get("include"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, errors.New("unknown include " + name)
+		}
+		included[name] = true
+	}
+	return included, nil
+}
+
+/*
+	The lookupRegistration function asks RDAP about the registration of name
+	Registries only know registered domains, so the labels of a subdomain are dropped one at a time until a registry knows the rest
+*/
+func lookupRegistration(ctx context.Context, name string) (*domainRegistration, error) {
+	for labels := strings.Split(name, "."); len(labels) >= 2; labels = labels[1:] {
+		var document struct {
+			Name     string       `json:"ldhName"`
+			Events   []rdapEvent  `json:"events"`
+			Entities []rdapEntity `json:"entities"`
+			Status   []string     `json:"status"`
+		}
+		found, err := fetchRDAP(ctx, "domain", strings.Join(labels, "."), &document)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+
+		registration := &domainRegistration{
+			Domain:      strings.ToLower(document.Name),
+			Registered:  rdapEventDate(document.Events, "registration"),
+			Expires:     rdapEventDate(document.Events, "expiration"),
+			LastChanged: rdapEventDate(document.Events, "last changed"),
+			Status:      document.Status,
+		}
+		if registration.Domain == "" {
+			registration.Domain = strings.Join(labels, ".")
+		}
+		if registered, err := time.Parse(time.RFC3339, registration.Registered); err == nil {
+			days := int(time.Since(registered) / (24 * time.Hour))
+			registration.AgeDays = &days
+		}
+		if registrar, ok := rdapEntityWithRole(document.Entities, "registrar"); ok {
+			registration.Registrar = registrar.vcardValue("fn")
+		}
+		return registration, nil
+	}
+	return nil, errors.New("no registry knows " + name)
+}
+
+/*
+	The handleDomain function serves /domain/{name}, the addresses the name resolves to, each geolocated
+	?include=registration adds the domain's registration date, age and registrar from RDAP,
+	?include=certificate the certificate the domain presents on 443 (see inspectCertificate()), and both can be asked for at once
+	?fields= narrows every location as it does for /ip
+*/
+func handleDomain(w http.ResponseWriter, r *http.Request) {
+	name, err := parseHostname(strings.TrimPrefix(r.URL.Path, "/domain/"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	included, err := requestedIncludes(r, domainIncludes)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	fields, err := requestedFields(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), domainTimeout)
+	defer cancel()
+	resolved, err := resolveHostname(ctx, name)
+	if err != nil {
+		writeResolveError(w, name, err)
+		return
+	}
+
+	report := domainReport{Name: name, Addresses: make([]batchResult, len(resolved))}
+	for i, address := range resolved {
+		report.Addresses[i] = lookupBatchEntry(r, address.IP, fields)
+	}
+	if included["registration"] {
+		if report.Registration, err = lookupRegistration(ctx, name); err != nil {
+			report.RegistrationError = err.Error()
+		}
+	}
+	if included["certificate"] {
+		if report.Certificate, err = inspectCertificate(ctx, name); err != nil {
+			report.CertificateError = err.Error()
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
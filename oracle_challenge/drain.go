@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownGrace applies when shutdown_grace_seconds isn't configured
+const defaultShutdownGrace = 10 * time.Second
+
+/*
+	The serverActivity struct counts the requests being served and the connections open across every listener,
+	and once shutdown begins how far draining them has got
+*/
+type serverActivity struct {
+	inFlight    atomic.Int64
+	open        atomic.Int64
+	drainStart  atomic.Int64
+	openAtDrain atomic.Int64
+}
+
+// activity is shared by every listener's server
+var activity = &serverActivity{}
+
+// The track function wraps handler so the requests it is serving are counted, and timed by the country they resolved (see latencyTracker)
+func (activity *serverActivity) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activity.inFlight.Add(1)
+		defer activity.inFlight.Add(-1)
+		r, country := withCountrySlot(r)
+		started := time.Now()
+		handler.ServeHTTP(w, r)
+		latencies.observe(country.get(), time.Since(started))
+	})
+}
+
+// The connState function is the http.Server ConnState hook counting open connections, a hijacked one is no longer the server's to drain
+func (activity *serverActivity) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		activity.open.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		activity.open.Add(-1)
+	}
+}
+
+// The shutdownGrace function returns how long shutdown waits for connections to drain, shutdown_grace_seconds or defaultShutdownGrace
+func shutdownGrace() time.Duration {
+	if config.ShutdownGrace > 0 {
+		return time.Duration(config.ShutdownGrace) * time.Second
+	}
+	return defaultShutdownGrace
+}
+
+/*
+	The drain function shuts servers down within the grace period, logging its progress every second and how it ended
+	A drain that runs out of grace names the connections it had to cut, the sign that the orchestrator's grace period is too short
+*/
+func (activity *serverActivity) drain(servers []*http.Server) {
+	grace := shutdownGrace()
+	started := time.Now()
+	activity.openAtDrain.Store(activity.open.Load())
+	activity.drainStart.Store(started.UnixNano())
+	log.Printf("draining: %d requests in flight, %d connections open, %s grace", activity.inFlight.Load(), activity.open.Load(), grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	drained := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-drained:
+				return
+			case <-ticker.C:
+				log.Printf("draining: %d requests in flight, %d connections open after %s", activity.inFlight.Load(), activity.open.Load(), time.Since(started).Round(time.Second))
+			}
+		}
+	}()
+
+	// Every server drains at once, so the grace period bounds the whole shutdown rather than each listener's
+	results := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			results <- server.Shutdown(ctx)
+		}(server)
+	}
+	for range servers {
+		if err := <-results; err != nil {
+			log.Printf("shutting down: %v", err)
+		}
+	}
+	close(drained)
+
+	if ctx.Err() != nil {
+		log.Printf("draining: the %s grace ran out with %d requests in flight and %d connections open", grace, activity.inFlight.Load(), activity.open.Load())
+		return
+	}
+	log.Printf("draining: done in %s of the %s grace", time.Since(started).Round(time.Millisecond), grace)
+}
+
+// The writeMetrics function writes the in-flight and connection gauges, and the drain's progress once shutdown has begun
+func (activity *serverActivity) writeMetrics(w io.Writer) {
+	writeMetricHeader(w, "oracle_http_requests_in_flight", "gauge", "Requests currently being served.")
+	fmt.Fprintf(w, "oracle_http_requests_in_flight %d\n", activity.inFlight.Load())
+	writeMetricHeader(w, "oracle_http_connections_open", "gauge", "Client connections currently open.")
+	fmt.Fprintf(w, "oracle_http_connections_open %d\n", activity.open.Load())
+
+	draining, elapsed, progress := 0, 0.0, 0.0
+	if start := activity.drainStart.Load(); start != 0 {
+		draining = 1
+		elapsed = time.Since(time.Unix(0, start)).Seconds()
+		progress = 1
+		if atStart, open := activity.openAtDrain.Load(), activity.open.Load(); atStart > 0 && open > 0 {
+			progress = 1 - float64(open)/float64(atStart)
+		}
+	}
+	writeMetricHeader(w, "oracle_draining", "gauge", "1 once shutdown has begun and connections are being drained.")
+	fmt.Fprintf(w, "oracle_draining %d\n", draining)
+	writeMetricHeader(w, "oracle_drain_elapsed_seconds", "gauge", "Time since draining began, compare with oracle_drain_grace_seconds.")
+	fmt.Fprintf(w, "oracle_drain_elapsed_seconds %g\n", elapsed)
+	writeMetricHeader(w, "oracle_drain_grace_seconds", "gauge", "How long shutdown waits for connections to drain.")
+	fmt.Fprintf(w, "oracle_drain_grace_seconds %g\n", shutdownGrace().Seconds())
+	writeMetricHeader(w, "oracle_drain_progress_ratio", "gauge", "Share of the connections open when draining began that have since closed.")
+	fmt.Fprintf(w, "oracle_drain_progress_ratio %g\n", progress)
+}
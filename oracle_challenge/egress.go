@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The egressSource struct holds the local addresses outbound connections are bound to, at most one per family
+	With none configured connections leave however the routing table sends them
+	familyTransports are the transports of familyTransport(), built once per network so their connections are reused
+*/
+type egressSource struct {
+	ipv4 net.IP
+	ipv6 net.IP
+
+	mutex            sync.Mutex
+	familyTransports map[string]*http.Transport
+}
+
+// egress is built in main() from config.Outbound, the zero value binds nothing
+var egress = &egressSource{}
+
+// egressTransport is the shared http.Transport of every provider, dataset and discovery call, dialing through egress
+var egressTransport = func() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return egress.dialContext(ctx, &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, network, address)
+	}
+	return transport
+}()
+
+// The egressClient function returns an http.Client over egressTransport
+func egressClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: egressTransport}
+}
+
+/*
+	The familyTransport function returns the transport whose connections are forced onto network ("tcp4" or "tcp6") through source,
+	whatever the family the request would otherwise pick, for discovering the external address of each family
+*/
+func (source *egressSource) familyTransport(network string) *http.Transport {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if transport, ok := source.familyTransports[network]; ok {
+		return transport
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, address string) (net.Conn, error) {
+		return source.dialContext(ctx, dialer, network, address)
+	}
+	if source.familyTransports == nil {
+		source.familyTransports = map[string]*http.Transport{}
+	}
+	source.familyTransports[network] = transport
+	return transport
+}
+
+/*
+	The newEgressSource function picks the local addresses from SourceAddresses, or from the addresses of SourceInterface
+	An interface contributes its first IPv4 address and its first global unicast IPv6 address
+*/
+func newEgressSource(settings outboundSettings) (*egressSource, error) {
+	source := &egressSource{}
+	if len(settings.SourceAddresses) > 0 && settings.SourceInterface != "" {
+		return nil, errors.New("outbound: set source_addresses or source_interface, not both")
+	}
+
+	var candidates []net.IP
+	for _, address := range settings.SourceAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("outbound: source address %q is not an IP address", address)
+		}
+		candidates = append(candidates, ip)
+	}
+	if settings.SourceInterface != "" {
+		networkInterface, err := net.InterfaceByName(settings.SourceInterface)
+		if err != nil {
+			return nil, fmt.Errorf("outbound: %w", err)
+		}
+		addresses, err := networkInterface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("outbound: %w", err)
+		}
+		for _, address := range addresses {
+			if network, ok := address.(*net.IPNet); ok && (network.IP.To4() != nil || network.IP.IsGlobalUnicast()) {
+				candidates = append(candidates, network.IP)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("outbound: interface %q has no usable address", settings.SourceInterface)
+		}
+	}
+
+	for _, ip := range candidates {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			if source.ipv4 == nil {
+				source.ipv4 = ipv4
+			} else if settings.SourceInterface == "" {
+				return nil, errors.New("outbound: more than one IPv4 source address")
+			}
+		} else if source.ipv6 == nil {
+			source.ipv6 = ip
+		} else if settings.SourceInterface == "" {
+			return nil, errors.New("outbound: more than one IPv6 source address")
+		}
+	}
+	return source, nil
+}
+
+// The local function returns the address to bind for a connection to remote over network, nil when the family has no source configured
+func (source *egressSource) local(network string, remote net.IP) net.Addr {
+	ip := source.ipv6
+	if remote.To4() != nil {
+		ip = source.ipv4
+	}
+	if ip == nil {
+		return nil
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+/*
+	The dialContext function dials address through dialer bound to the configured source address of the destination's family
+	The hostname is resolved here so the family, and with it the source, is known before connecting
+	Once a source is configured, destinations in a family without one are skipped rather than left to the routing table,
+	so every connection takes the intended path
+*/
+func (source *egressSource) dialContext(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	if source.ipv4 == nil && source.ipv6 == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	family := "ip" + strings.TrimLeft(network, "tcpud")
+	remotes, err := net.DefaultResolver.LookupIP(ctx, family, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("no source address is configured for any address of %s", host)
+	for _, remote := range remotes {
+		local := source.local(network, remote)
+		if local == nil {
+			continue
+		}
+		bound := *dialer
+		bound.LocalAddr = local
+		var connection net.Conn
+		if connection, err = bound.DialContext(ctx, network, net.JoinHostPort(remote.String(), port)); err == nil {
+			return connection, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// maxHeaderBytes caps how much of a submitted header block we are willing to read
+const maxHeaderBytes = 1 << 20
+
+// Candidate addresses inside a Received header are usually wrapped like "[203.0.113.5]" or "(203.0.113.5)"
+var receivedIPPattern = regexp.MustCompile(`[\[(](?:IPv6:)?([0-9A-Fa-f:.]+)[\])]`)
+
+/*
+	The emailHeaderSettings struct configures /email/headers
+	TrustedRelays are the addresses or CIDRs of the operator's own mail relays, a Received header added by one of them is believed
+	Private, loopback and link-local hops are always trusted, they can only have been added inside the receiving network
+*/
+type emailHeaderSettings struct {
+	TrustedRelays []string `json:"trusted_relays"`
+}
+
+// trustedRelays are the parsed email_headers.trusted_relays, loaded once at startup
+var trustedRelays []*net.IPNet
+
+// The loadEmailHeaderSettings function parses the trusted relays, rejecting malformed entries at startup
+func loadEmailHeaderSettings(settings emailHeaderSettings) ([]*net.IPNet, error) {
+	ranges, err := parseAddressList(settings.TrustedRelays)
+	if err != nil {
+		return nil, fmt.Errorf("email_headers.trusted_relays: %w", err)
+	}
+	return ranges, nil
+}
+
+/*
+	The receivedHop struct describes a single relay found within the Received chain of an email, IP being the address the receiving server saw it connect from
+	Trust is "internal" for private addresses, "relay" for a configured trusted relay, "sender" for the hop the sender is taken to be
+	and "untrusted" for everything older, which the sender could have written itself
+*/
+type receivedHop struct {
+	IP    string
+	Trust string
+}
+
+// The internalAddress function reports whether ip can only belong to the receiving network: private (including IPv6 ULA), loopback, link-local or unspecified
+func internalAddress(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// The trustedRelay function reports whether ip is one of the configured trusted relays
+func trustedRelay(ip net.IP) bool {
+	for _, networkRange := range trustedRelays {
+		if networkRange.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	The handleEmailHeaders function accepts a raw block of email headers in the POST body.
+	The Received chain is walked from the newest hop, which our own mail server added, towards the oldest.
+	Every hop connecting from an internal address or a trusted relay vouches for the header before it, the first one that doesn't is the likely sender
+	and is geolocated via determineGeoLocation(), anything older is listed but not believed since the sender could have forged it
+*/
+func handleEmailHeaders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "email headers must be submitted with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHeaderBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	hops, err := parseReceivedChain(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprint(w, "Received Chain (newest first):")
+	senderIP := ""
+	for i, hop := range hops {
+		switch hop.Trust {
+		case "internal":
+			fmt.Fprintf(w, "\n%d. %s (private, skipped)", i+1, hop.IP)
+		case "relay":
+			fmt.Fprintf(w, "\n%d. %s (trusted relay, skipped)", i+1, hop.IP)
+		case "sender":
+			fmt.Fprintf(w, "\n%d. %s", i+1, hop.IP)
+			senderIP = hop.IP
+		default:
+			fmt.Fprintf(w, "\n%d. %s (untrusted, may be forged)", i+1, hop.IP)
+		}
+	}
+
+	if senderIP == "" {
+		fmt.Fprint(w, "\nError while attempting to find the sender: no public IP address was found in the Received chain")
+		return
+	}
+
+	fmt.Fprint(w, "\nLikely Sender IP: "+senderIP)
+	locationData, err := determineGeoLocation(r, senderIP)
+	if err != nil {
+		fmt.Fprint(w, "\nError while attempting to get location data: "+err.Error())
+	} else {
+		fmt.Fprint(w, "\n"+locationData)
+	}
+}
+
+/*
+	The parseReceivedChain function parses a raw header block and returns the relay IP of every Received header, newest first as mail servers prepend them.
+	Only the "from" clause of each header is inspected, since the "by" clause names the receiving server rather than the sender.
+	Within it the last address is taken, the one the receiving server saw the connection come from (e.g. "from helo (rdns [203.0.113.5])"),
+	an earlier one is usually the HELO name the connecting client chose itself
+*/
+func parseReceivedChain(raw []byte) ([]receivedHop, error) {
+	// net/mail expects a full message, so make sure the header block is terminated before the (empty) body
+	raw = bytes.TrimRight(raw, "\r\n")
+	message, err := mail.ReadMessage(bytes.NewReader(append(raw, "\r\n\r\n"...)))
+	if err != nil {
+		return nil, err
+	}
+
+	received := message.Header["Received"]
+	if len(received) == 0 {
+		return nil, errors.New("no Received headers were found")
+	}
+
+	var hops []receivedHop
+	trust := "internal"
+	for _, header := range received {
+		fromClause := header
+		if index := strings.Index(strings.ToLower(fromClause), " by "); index != -1 {
+			fromClause = fromClause[:index]
+		}
+
+		var ip net.IP
+		for _, match := range receivedIPPattern.FindAllStringSubmatch(fromClause, -1) {
+			if parsed := net.ParseIP(match[1]); parsed != nil {
+				ip = parsed
+			}
+		}
+		if ip == nil {
+			continue
+		}
+
+		// Once the sender is found, every older hop is one it may have written
+		switch {
+		case trust == "sender" || trust == "untrusted":
+			trust = "untrusted"
+		case internalAddress(ip):
+			trust = "internal"
+		case trustedRelay(ip):
+			trust = "relay"
+		default:
+			trust = "sender"
+		}
+		hops = append(hops, receivedHop{IP: ip.String(), Trust: trust})
+	}
+
+	if len(hops) == 0 {
+		return nil, errors.New("no IP addresses were found in the Received headers")
+	}
+	return hops, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReceivedChain(t *testing.T) {
+	_, relays, _ := net.ParseCIDR("198.51.100.0/24")
+	trustedRelays = []*net.IPNet{relays}
+	defer func() { trustedRelays = nil }()
+
+	tests := []struct {
+		name    string
+		headers string
+		want    []receivedHop
+		wantErr string
+	}{
+		{
+			name: "relay, sender and a forged hop",
+			headers: "Received: from mx.example.net (mx.example.net [198.51.100.7]) by mail.example.com with ESMTPS\r\n" +
+				"Received: from sender.example (host.example [203.0.113.9]) by mx.example.net with ESMTP\r\n" +
+				"Received: from forged (forged [192.0.2.66]) by sender.example\r\n",
+			want: []receivedHop{{IP: "198.51.100.7", Trust: "relay"}, {IP: "203.0.113.9", Trust: "sender"}, {IP: "192.0.2.66", Trust: "untrusted"}},
+		},
+		{
+			name: "internal hops before the sender",
+			headers: "Received: from filter (localhost [127.0.0.1]) by mail.example.com\r\n" +
+				"Received: from mx (mx.internal [10.0.0.5]) by filter\r\n" +
+				"Received: from client ([203.0.113.9]) by mx\r\n",
+			want: []receivedHop{{IP: "127.0.0.1", Trust: "internal"}, {IP: "10.0.0.5", Trust: "internal"}, {IP: "203.0.113.9", Trust: "sender"}},
+		},
+		{
+			name:    "HELO address comes before the connecting address",
+			headers: "Received: from [192.0.2.1] (rdns.example [203.0.113.9]) by mx.example.com\r\n",
+			want:    []receivedHop{{IP: "203.0.113.9", Trust: "sender"}},
+		},
+		{
+			name:    "address of the receiving server isn't taken",
+			headers: "Received: from client (client.example [203.0.113.9]) by mx.example.com ([198.51.100.1])\r\n",
+			want:    []receivedHop{{IP: "203.0.113.9", Trust: "sender"}},
+		},
+		{
+			name:    "IPv6",
+			headers: "Received: from client (client.example [IPv6:2001:db8::25]) by mx.example.com\r\n",
+			want:    []receivedHop{{IP: "2001:db8::25", Trust: "sender"}},
+		},
+		{
+			name: "folded header",
+			headers: "Received: from client (client.example\r\n" +
+				"\t[203.0.113.9]) by mx.example.com;\r\n" +
+				"\tMon, 1 Jan 2024 00:00:00 +0000\r\n",
+			want: []receivedHop{{IP: "203.0.113.9", Trust: "sender"}},
+		},
+		{
+			name: "hop without an address is skipped",
+			headers: "Received: by mail.example.com (Postfix, from userid 1000)\r\n" +
+				"Received: from client (client.example [203.0.113.9]) by mail.example.com\r\n",
+			want: []receivedHop{{IP: "203.0.113.9", Trust: "sender"}},
+		},
+		{
+			name:    "brackets that aren't an address",
+			headers: "Received: from client ([not-an-ip] [999.1.1.1]) by mx.example.com\r\n",
+			wantErr: "no IP addresses",
+		},
+		{
+			name:    "no Received headers",
+			headers: "From: someone@example.com\r\nSubject: hello\r\n",
+			wantErr: "no Received headers",
+		},
+		{
+			name:    "not a header block",
+			headers: "this is not a header\r\n",
+			wantErr: "malformed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseReceivedChain([]byte(test.headers))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseReceivedChain() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseReceivedChain() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseReceivedChain() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks a stored line as encrypted, lines without it are plaintext JSON written before encryption was enabled
+const sealedPrefix = "enc1:"
+
+/*
+	The encryptionSettings struct turns on encryption at rest of the records kept in data_dir (the audit log and the self history),
+	which hold client addresses
+	The key is 32 random bytes, base64 encoded, read from the environment variable KeyEnv or the file KeyFile and never from
+	the config itself, so it can be delivered by a KMS or secrets manager (an injected variable or a mounted secret)
+*/
+type encryptionSettings struct {
+	Enabled bool   `json:"enabled"`
+	KeyEnv  string `json:"key_env"`
+	KeyFile string `json:"key_file"`
+}
+
+// storageCipher seals every line a jsonlStore writes, nil when encryption at rest is off
+var storageCipher cipher.AEAD
+
+/*
+	The loadStorageCipher function reads the key settings point at and returns the AES-256-GCM cipher made from it,
+	or nil when encryption is off
+*/
+func loadStorageCipher(settings encryptionSettings) (cipher.AEAD, error) {
+	if !settings.Enabled {
+		return nil, nil
+	}
+	var encoded string
+	switch {
+	case settings.KeyEnv != "" && settings.KeyFile != "":
+		return nil, errors.New("encryption: set only one of key_env and key_file")
+	case settings.KeyEnv != "":
+		encoded = os.Getenv(settings.KeyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("encryption: the environment variable %s is empty", settings.KeyEnv)
+		}
+	case settings.KeyFile != "":
+		contents, err := os.ReadFile(settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: reading the key: %w", err)
+		}
+		encoded = string(contents)
+	default:
+		return nil, errors.New("encryption: one of key_env and key_file is required")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encryption: the key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption: the key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The sealLine function encrypts a stored line when encryption is on, returning it unchanged otherwise
+func sealLine(line []byte) ([]byte, error) {
+	if storageCipher == nil {
+		return line, nil
+	}
+	nonce := make([]byte, storageCipher.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := storageCipher.Seal(nonce, nonce, line, nil)
+	return append([]byte(sealedPrefix), base64.StdEncoding.EncodeToString(sealed)...), nil
+}
+
+/*
+	The openLine function decrypts a stored line, passing plaintext lines through so encryption can be turned on over existing data
+	An encrypted line can't be read without the key, and one that fails authentication is an error rather than being skipped
+*/
+func openLine(line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(sealedPrefix)) {
+		return line, nil
+	}
+	if storageCipher == nil {
+		return nil, errors.New("the data is encrypted and encryption isn't configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line[len(sealedPrefix):]))
+	if err != nil || len(sealed) < storageCipher.NonceSize() {
+		return nil, errors.New("an encrypted record is corrupt")
+	}
+	nonce, ciphertext := sealed[:storageCipher.NonceSize()], sealed[storageCipher.NonceSize():]
+	plaintext, err := storageCipher.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("an encrypted record doesn't match the key")
+	}
+	return plaintext, nil
+}
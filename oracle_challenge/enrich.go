@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	The enrichmentSettings struct configures the lookup pipeline
+	Stages switches individual stages on or off (every stage runs unless set to false)
+	Blocklist is the list of CIDRs the reputation stage reports matches against, Feeds adds downloaded threat feeds to it (see feedSettings)
+	Hooks adds operator-run HTTP services as extra stages, see hookSettings
+	Advisories adds an advisory stage of per-country compliance hints, see advisoryRule
+	BudgetMS bounds the whole pipeline, TimeoutsMS gives individual stages a tighter limit (DefaultTimeoutMS for the rest)
+	MaxParallel bounds how many stages run at once, FatalStages lists the stages whose failure abandons the rest of the pipeline
+*/
+type enrichmentSettings struct {
+	Stages           map[string]bool `json:"stages"`
+	Blocklist        []string        `json:"blocklist"`
+	BudgetMS         int             `json:"budget_ms"`
+	DefaultTimeoutMS int             `json:"default_timeout_ms"`
+	TimeoutsMS       map[string]int  `json:"timeouts_ms"`
+	MaxParallel      int             `json:"max_parallel"`
+	FatalStages      []string        `json:"fatal_stages"`
+	Hooks            []hookSettings  `json:"hooks"`
+	Feeds            []feedSettings  `json:"feeds"`
+	Advisories       []advisoryRule  `json:"advisories"`
+}
+
+const (
+	// defaultEnrichmentBudget applies when enrichment.budget_ms isn't configured
+	defaultEnrichmentBudget = 5 * time.Second
+	// defaultStageTimeout applies to stages without their own entry in enrichment.timeouts_ms
+	defaultStageTimeout = 3 * time.Second
+	// defaultStageParallelism applies when enrichment.max_parallel isn't configured, it only holds back pipelines with many hooks
+	defaultStageParallelism = 8
+)
+
+/*
+	The enrichmentStage struct is a single step of the pipeline
+	Run receives the blocks of every stage listed in After (and only those), and returns the block it contributes under Name
+	Stages without a dependency between them run concurrently
+*/
+type enrichmentStage struct {
+	Name  string
+	After []string
+	Run   func(ctx context.Context, ip string, inputs map[string]interface{}) (interface{}, error)
+}
+
+/*
+	The stageStatus struct reports how a single stage went: "ok", "error", "timeout", "skipped" (a dependency didn't finish)
+	or "cancelled" (a fatal stage failed first)
+*/
+type stageStatus struct {
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+/*
+	The enrichmentResult struct is the response document, each stage's block is namespaced under its name and every stage reports a status
+	ResultHash covers the IP and blocks only, so timings don't change it between otherwise identical observations
+	Error is set when a fatal stage failed, the blocks are then whatever completed before it did
+*/
+type enrichmentResult struct {
+	IP         string                 `json:"ip"`
+	ResultHash string                 `json:"result_hash"`
+	Error      string                 `json:"error,omitempty"`
+	Blocks     map[string]interface{} `json:"blocks"`
+	Stages     map[string]stageStatus `json:"stages"`
+}
+
+// Parses ipinfo's org field, e.g. "AS15169 Google LLC"
+var orgPattern = regexp.MustCompile(`^AS(\d+)\s*(.*)$`)
+
+// The allStages function declares every stage in pipeline order: client-ip → geo → asn → rdns → privacy → reputation → peeringdb and advisory (when configured) → configured hooks
+func allStages(request *http.Request) []enrichmentStage {
+	stages := []enrichmentStage{
+		{Name: "client_ip", Run: clientIPStage(request)},
+		{Name: "geo", Run: geoStage(request)},
+		{Name: "asn", After: []string{"geo"}, Run: asnStage},
+		{Name: "rdns", Run: rdnsStage},
+		{Name: "privacy", Run: privacyStage},
+		{Name: "reputation", Run: reputationStage},
+	}
+	if config.PeeringDB.URL != "" {
+		stages = append(stages, enrichmentStage{Name: "peeringdb", After: []string{"asn"}, Run: peeringDBStage})
+	}
+	if len(config.Enrichment.Advisories) > 0 {
+		stages = append(stages, enrichmentStage{Name: "advisory", After: []string{"geo"}, Run: advisoryStage})
+	}
+	for _, hook := range config.Enrichment.Hooks {
+		stages = append(stages, hookStage(hook))
+	}
+	return stages
+}
+
+// The pipeline function returns the stages enabled in config, in their declared order
+func pipeline(request *http.Request) []enrichmentStage {
+	var enabled []enrichmentStage
+	for _, stage := range allStages(request) {
+		if on, ok := config.Enrichment.Stages[stage.Name]; !ok || on {
+			enabled = append(enabled, stage)
+		}
+	}
+	return enabled
+}
+
+/*
+	The checkEnrichmentSettings function rejects unknown stage names and malformed blocklist ranges at startup
+	Hooks must have a unique name and may only depend on stages declared before them
+*/
+func checkEnrichmentSettings(settings enrichmentSettings) error {
+	known := map[string]bool{}
+	for _, stage := range allStages(nil) {
+		if known[stage.Name] {
+			return fmt.Errorf("enrichment stage %q is declared twice", stage.Name)
+		}
+		if stage.Name == "" {
+			return errors.New("every enrichment hook needs a name")
+		}
+		for _, dependency := range stage.After {
+			if !known[dependency] {
+				return fmt.Errorf("enrichment stage %q depends on %q, which is not declared before it", stage.Name, dependency)
+			}
+		}
+		known[stage.Name] = true
+	}
+	for name := range settings.Stages {
+		if !known[name] {
+			return fmt.Errorf("unknown enrichment stage %q in config", name)
+		}
+	}
+	for name := range settings.TimeoutsMS {
+		if !known[name] {
+			return fmt.Errorf("unknown enrichment stage %q in timeouts_ms", name)
+		}
+	}
+	for _, name := range settings.FatalStages {
+		if !known[name] {
+			return fmt.Errorf("unknown enrichment stage %q in fatal_stages", name)
+		}
+	}
+	if settings.MaxParallel < 0 {
+		return errors.New("enrichment.max_parallel can't be negative")
+	}
+	if err := checkAdvisoryRules(settings.Advisories); err != nil {
+		return err
+	}
+	for _, stringCIDR := range settings.Blocklist {
+		if _, _, err := net.ParseCIDR(stringCIDR); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	The enrich function runs stages against ip, each in its own goroutine once the stages it depends on have finished
+	and a slot of enrichment.max_parallel is free
+	Every stage gets its own timeout, cut short by whatever remains of the overall budget, and whatever completed in time is assembled
+	A stage that overruns is abandoned rather than waited on, so one slow lookup (e.g. rDNS) can't hold up the response
+	A stage whose dependency didn't produce a block (disabled, failed or timed out) is skipped
+	A fatal stage (enrichment.fatal_stages) that fails cancels every stage still running or waiting, and the result carries its error
+*/
+func enrich(ctx context.Context, ip string, stages []enrichmentStage) enrichmentResult {
+	result := enrichmentResult{IP: ip, Blocks: map[string]interface{}{}, Stages: map[string]stageStatus{}}
+
+	budget := defaultEnrichmentBudget
+	if config.Enrichment.BudgetMS > 0 {
+		budget = time.Duration(config.Enrichment.BudgetMS) * time.Millisecond
+	}
+	ctx, cancelBudget := context.WithTimeout(ctx, budget)
+	defer cancelBudget()
+	ctx, abandon := context.WithCancelCause(ctx)
+	defer abandon(nil)
+
+	fatal := map[string]bool{}
+	for _, name := range config.Enrichment.FatalStages {
+		fatal[name] = true
+	}
+	parallel := defaultStageParallelism
+	if config.Enrichment.MaxParallel > 0 {
+		parallel = config.Enrichment.MaxParallel
+	}
+	slots := make(chan struct{}, parallel)
+
+	var mutex sync.Mutex
+	record := func(name string, status stageStatus, block interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		result.Stages[name] = status
+		if status.Status == "ok" {
+			result.Blocks[name] = block
+		}
+		if fatal[name] && (status.Status == "error" || status.Status == "timeout") && result.Error == "" {
+			result.Error = "the " + name + " stage failed: " + status.Error
+			abandon(errors.New(result.Error))
+		}
+	}
+	// interrupted records a stage that stopped waiting because ctx ended, cancelled by a fatal stage or out of budget
+	interrupted := func(name, waitingFor string) {
+		if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.DeadlineExceeded) {
+			record(name, stageStatus{Status: "cancelled", Error: cause.Error()}, nil)
+			return
+		}
+		record(name, stageStatus{Status: "skipped", Error: "the request budget ran out waiting for " + waitingFor}, nil)
+	}
+
+	done := map[string]chan struct{}{}
+	for _, stage := range stages {
+		done[stage.Name] = make(chan struct{})
+	}
+
+	var group sync.WaitGroup
+	for _, stage := range stages {
+		group.Add(1)
+		go func(stage enrichmentStage) {
+			defer group.Done()
+			defer close(done[stage.Name])
+
+			inputs := map[string]interface{}{}
+			for _, dependency := range stage.After {
+				finished, ok := done[dependency]
+				if !ok {
+					record(stage.Name, stageStatus{Status: "skipped", Error: "the " + dependency + " stage is disabled"}, nil)
+					return
+				}
+				select {
+				case <-finished:
+				case <-ctx.Done():
+					interrupted(stage.Name, "the "+dependency+" stage")
+					return
+				}
+
+				mutex.Lock()
+				block, ok := result.Blocks[dependency]
+				mutex.Unlock()
+				if !ok {
+					record(stage.Name, stageStatus{Status: "skipped", Error: "the " + dependency + " stage did not complete"}, nil)
+					return
+				}
+				inputs[dependency] = block
+			}
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				interrupted(stage.Name, "a free slot")
+				return
+			}
+			block, status := runStage(ctx, stage, ip, inputs)
+			record(stage.Name, status, block)
+		}(stage)
+	}
+	group.Wait()
+
+	result.ResultHash, _ = canonicalHash(struct {
+		IP     string                 `json:"ip"`
+		Blocks map[string]interface{} `json:"blocks"`
+	}{result.IP, result.Blocks})
+	return result
+}
+
+/*
+	The runStage function runs a single stage under its own timeout
+	The stage runs in a goroutine of its own so that a stage which ignores its context is still abandoned on time
+*/
+func runStage(ctx context.Context, stage enrichmentStage, ip string, inputs map[string]interface{}) (interface{}, stageStatus) {
+	timeout := defaultStageTimeout
+	if config.Enrichment.DefaultTimeoutMS > 0 {
+		timeout = time.Duration(config.Enrichment.DefaultTimeoutMS) * time.Millisecond
+	}
+	if milliseconds, ok := config.Enrichment.TimeoutsMS[stage.Name]; ok && milliseconds > 0 {
+		timeout = time.Duration(milliseconds) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type outcome struct {
+		block interface{}
+		err   error
+	}
+	finished := make(chan outcome, 1)
+	started := time.Now()
+	go func() {
+		block, err := stage.Run(ctx, ip, inputs)
+		finished <- outcome{block, err}
+	}()
+
+	select {
+	case result := <-finished:
+		status := stageStatus{Status: "ok", DurationMS: time.Since(started).Milliseconds()}
+		if result.err != nil {
+			status.Status = "error"
+			status.Error = result.err.Error()
+		}
+		if cause := context.Cause(ctx); result.err != nil && errors.Is(ctx.Err(), context.Canceled) && cause != nil {
+			status.Status, status.Error = "cancelled", cause.Error()
+		}
+		return result.block, status
+	case <-ctx.Done():
+		status := stageStatus{Status: "timeout", DurationMS: time.Since(started).Milliseconds(), Error: ctx.Err().Error()}
+		if cause := context.Cause(ctx); errors.Is(ctx.Err(), context.Canceled) && cause != nil {
+			status.Status, status.Error = "cancelled", cause.Error()
+		}
+		return nil, status
+	}
+}
+
+// The handleEnrich function runs the enrichment pipeline against the client's IP address and returns every block as JSON
+func handleEnrich(w http.ResponseWriter, r *http.Request) {
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := enrich(r.Context(), ip, pipeline(r))
+	if tickets != nil {
+		tickets.flag(result)
+	}
+	w.Header().Set(resultHashHeader, result.ResultHash)
+	w.Header().Set("Content-Type", "application/json")
+	if result.Error != "" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
+
+// The clientIPStage function reports how the address was determined for request, it has no lookups of its own
+func clientIPStage(request *http.Request) func(context.Context, string, map[string]interface{}) (interface{}, error) {
+	return func(_ context.Context, ip string, _ map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{
+			"address":   ip,
+			"forwarded": request.Header.Get("X-FORWARDED-FOR") != "",
+		}, nil
+	}
+}
+
+// The geoStage function contributes the provider's geolocation fields, as far as the redaction policy of request allows
+func geoStage(request *http.Request) func(context.Context, string, map[string]interface{}) (interface{}, error) {
+	return func(_ context.Context, ip string, _ map[string]interface{}) (interface{}, error) {
+		location, _, err := lookupFor(request, ip)
+		if err != nil {
+			return nil, err
+		}
+		return locationFields(location), nil
+	}
+}
+
+// The asnStage function derives the autonomous system from the geo stage's org field
+func asnStage(_ context.Context, _ string, inputs map[string]interface{}) (interface{}, error) {
+	fields, _ := inputs["geo"].(map[string]string)
+	match := orgPattern.FindStringSubmatch(fields["org"])
+	if match == nil {
+		return nil, errors.New("the provider did not report an autonomous system")
+	}
+	number, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"number": number, "name": match[2]}, nil
+}
+
+/*
+	The rdnsStage function contributes the PTR names for the address, and whether they are forward-confirmed:
+	fcrdns is true when at least one of the names resolves back to the address, the ones that do are listed under confirmed
+*/
+func rdnsStage(ctx context.Context, ip string, _ map[string]interface{}) (interface{}, error) {
+	names, err := reverseLookup(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	confirmed := forwardConfirmed(ctx, ip, names)
+	return map[string]interface{}{"hostnames": names, "fcrdns": len(confirmed) > 0, "confirmed": confirmed}, nil
+}
+
+// The privacyStage function reports whether the address sits in a private range, as judged by determinePrivacy(), and how classifyAddress() labels it
+func privacyStage(_ context.Context, ip string, _ map[string]interface{}) (interface{}, error) {
+	isInPrivateSubnet, err := determinePrivacy(net.ParseIP(ip))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"private": isInPrivateSubnet, "classification": classifyAddress(ip).Classification}, nil
+}
+
+// The reputationStage function lists every blocklist and feed range containing the address, along with the feeds that listed it
+func reputationStage(_ context.Context, ip string, _ map[string]interface{}) (interface{}, error) {
+	address := net.ParseIP(ip)
+	matches := []string{}
+	listedBy := []string{}
+	for _, feed := range feeds {
+		if matched := feed.match(address); len(matched) > 0 {
+			matches = append(matches, matched...)
+			listedBy = append(listedBy, feed.settings.Name)
+		}
+	}
+	return map[string]interface{}{"listed": len(matches) > 0, "matches": matches, "feeds": listedBy}, nil
+}
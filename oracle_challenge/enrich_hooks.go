@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxHookResponseBytes caps how much of a hook's reply is read
+const maxHookResponseBytes = 1 << 20
+
+/*
+	The hookSettings struct registers an operator-run HTTP service as an enrichment stage, e.g. to consult an internal CMDB
+	The contract is a POST of {"ip": "...", "inputs": {"<stage>": <block>, ...}} carrying the blocks of the stages listed in After,
+	answered by 200 and a JSON object which becomes the stage's block under Name; any other status is reported as a stage error
+	Hooks are trusted operator configuration, so unlike user-supplied URLs they may point at internal addresses
+*/
+type hookSettings struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	After   []string          `json:"after"`
+	Headers map[string]string `json:"headers"`
+}
+
+// The hookStage function turns a configured hook into an enrichmentStage, called through the egress client with the stage's own timeout bounding the call
+func hookStage(hook hookSettings) enrichmentStage {
+	return enrichmentStage{
+		Name:  hook.Name,
+		After: hook.After,
+		Run: func(ctx context.Context, ip string, inputs map[string]interface{}) (interface{}, error) {
+			payload, err := json.Marshal(map[string]interface{}{"ip": ip, "inputs": inputs})
+			if err != nil {
+				return nil, err
+			}
+
+			request, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+			if err != nil {
+				return nil, err
+			}
+			request.Header.Set("Content-Type", "application/json")
+			for name, value := range hook.Headers {
+				request.Header.Set(name, value)
+			}
+
+			response, err := egressClient(0).Do(request)
+			if err != nil {
+				return nil, err
+			}
+			defer response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("hook answered %s", response.Status)
+			}
+
+			var block map[string]interface{}
+			if err := json.NewDecoder(io.LimitReader(response.Body, maxHookResponseBytes)).Decode(&block); err != nil {
+				return nil, fmt.Errorf("hook returned an invalid block: %w", err)
+			}
+			return block, nil
+		},
+	}
+}
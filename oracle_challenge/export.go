@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The subjectExport struct is everything stored about one address or result hash, the answer to a data-subject access request
+type subjectExport struct {
+	GeneratedAt time.Time            `json:"generated_at"`
+	IP          string               `json:"ip,omitempty"`
+	Hash        string               `json:"hash,omitempty"`
+	History     []ipChange           `json:"history"`
+	Cache       []cachedLocationJSON `json:"cache"`
+	Tenant      string               `json:"tenant,omitempty"`
+	Audit       []auditRecord        `json:"audit"`
+}
+
+// The cachedLocationJSON struct is a cache entry as exported, with the canonical field names and the address it was cached for
+type cachedLocationJSON struct {
+	Location map[string]string `json:"location"`
+	Expires  time.Time         `json:"expires"`
+}
+
+/*
+	The exportSubject function gathers every stored record about ip, or about the lookups whose result hashed to hash
+	A hash names a geolocation rather than an address, so it matches audit records directly and reaches the cache and history
+	through the addresses those records name
+	A tenant other than "" limits the export to that tenant's audit records and the cache entries they reach, the cache is shared
+	and the self history isn't any tenant's, so neither is reached through ip alone
+*/
+func exportSubject(ip, hash, tenant string) (subjectExport, error) {
+	export := subjectExport{GeneratedAt: time.Now().UTC(), IP: ip, Hash: hash, Tenant: tenant, History: []ipChange{}, Cache: []cachedLocationJSON{}, Audit: []auditRecord{}}
+	addresses := map[string]bool{}
+	if ip != "" && tenant == "" {
+		addresses[ip] = true
+	}
+
+	if auditLog != nil {
+		err := auditLog.each(func(line []byte) error {
+			var record auditRecord
+			if json.Unmarshal(line, &record) != nil {
+				return nil
+			}
+			if tenant != "" && record.Tenant != tenant {
+				return nil
+			}
+			if record.IP == ip || (hash != "" && record.Hash == hash) {
+				export.Audit = append(export.Audit, record)
+				addresses[record.IP] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return export, err
+		}
+	}
+
+	for address := range addresses {
+		if entry, ok := geoCache.peek(address); ok && (hash == "" || locationHash(entry.location) == hash) {
+			location := locationFields(entry.location)
+			location["ip"] = address
+			export.Cache = append(export.Cache, cachedLocationJSON{Location: location, Expires: entry.expires.UTC()})
+		}
+	}
+	if history != nil && tenant == "" {
+		history.mutex.Lock()
+		for _, change := range history.changes {
+			if addresses[change.IP] {
+				export.History = append(export.History, change)
+			}
+		}
+		history.mutex.Unlock()
+	}
+	return export, nil
+}
+
+/*
+	The handleExport function serves /admin/export?ip=... or ?hash=..., a JSON bundle of the self history rows, cache entry
+	and audit log records about the subject, served as an attachment so it can be handed over as is
+	&tenant= narrows it to one tenant's records, as /tenant/export does for the tenant itself
+*/
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	ip, hash, ok := exportSubjectQuery(w, r)
+	if !ok {
+		return
+	}
+	export, err := exportSubject(ip, hash, r.URL.Query().Get("tenant"))
+	if err != nil {
+		http.Error(w, "Error while reading the stored records: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="subject-export.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// The exportSubjectQuery function reads the ip or hash an export is about, answering the request itself when neither is valid
+func exportSubjectQuery(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	query := r.URL.Query()
+	ip, hash := query.Get("ip"), query.Get("hash")
+	if (ip == "") == (hash == "") {
+		http.Error(w, "give either ip or hash", http.StatusBadRequest)
+		return "", "", false
+	}
+	if ip != "" {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			http.Error(w, "ip must be a valid IP address", http.StatusBadRequest)
+			return "", "", false
+		}
+		ip = parsed.String()
+	}
+	return ip, hash, true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultFeedRefresh applies to feeds without refresh_minutes
+const defaultFeedRefresh = time.Hour
+
+// Feed names end up in file names and metric labels
+var feedNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+/*
+	The feedSettings struct defines a threat feed ingested into the reputation stage
+	Format picks the parser:
+		plain  one address or CIDR per line, the first word is used and # or ; start a comment (Spamhaus DROP, FireHOL, ...)
+		csv    the address or CIDR is in column Column (counting from 0), lines that don't parse are skipped
+		json   an array of strings, or of objects carrying the address or CIDR under Field
+	Entries that don't parse are skipped and counted rather than failing the whole feed
+*/
+type feedSettings struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	Format         string `json:"format"`
+	Column         int    `json:"column"`
+	Field          string `json:"field"`
+	RefreshMinutes int    `json:"refresh_minutes"`
+}
+
+// The threatFeed struct is a loaded feed, its ranges live in a prefix trie so matching costs the same however long the feed is
+type threatFeed struct {
+	settings feedSettings
+	dataset  *remoteDataset
+	hits     atomic.Int64
+
+	mutex   sync.RWMutex
+	ranges  *prefixTrie
+	skipped int
+}
+
+// The feedStatus struct is a feed's entry in /admin/feeds
+type feedStatus struct {
+	Name    string      `json:"name"`
+	Format  string      `json:"format"`
+	Entries int         `json:"entries"`
+	Skipped int         `json:"skipped"`
+	Hits    int64       `json:"hits"`
+	Data    *datasetAge `json:"data,omitempty"`
+}
+
+// feeds is built in main() by loadFeeds()
+var feeds []*threatFeed
+
+/*
+	The loadFeeds function builds every feed, the static enrichment.blocklist becomes a feed named "blocklist"
+	Remote feeds are loaded from their cached copy, the caller starts their downloads with watchFeeds()
+*/
+func loadFeeds(settings enrichmentSettings) ([]*threatFeed, error) {
+	static := &threatFeed{settings: feedSettings{Name: "blocklist", Format: "config"}, ranges: &prefixTrie{}}
+	ranges, err := parseAddressList(settings.Blocklist)
+	if err != nil {
+		return nil, err
+	}
+	for _, networkRange := range ranges {
+		static.ranges.insert(networkRange, nil)
+	}
+	loaded := []*threatFeed{static}
+
+	names := map[string]bool{static.settings.Name: true}
+	for _, feedConfig := range settings.Feeds {
+		if !feedNamePattern.MatchString(feedConfig.Name) {
+			return nil, fmt.Errorf("feed name %q must be lowercase letters, digits, _ or -", feedConfig.Name)
+		}
+		if names[feedConfig.Name] {
+			return nil, fmt.Errorf("feed %q is declared twice", feedConfig.Name)
+		}
+		names[feedConfig.Name] = true
+		switch feedConfig.Format {
+		case "plain", "csv", "json":
+		default:
+			return nil, fmt.Errorf("feed %q: unknown format %q", feedConfig.Name, feedConfig.Format)
+		}
+		if feedConfig.URL == "" {
+			return nil, fmt.Errorf("feed %q needs a url", feedConfig.Name)
+		}
+
+		feed := &threatFeed{settings: feedConfig, ranges: &prefixTrie{}}
+		interval := defaultFeedRefresh
+		if feedConfig.RefreshMinutes > 0 {
+			interval = time.Duration(feedConfig.RefreshMinutes) * time.Minute
+		}
+		feed.dataset = newRemoteDataset("feed_"+feedConfig.Name, feedConfig.URL, interval, feed.parse)
+		err := feed.dataset.load()
+		recordComponent("feed_"+feedConfig.Name, "feed", feedConfig.URL, err)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, feed)
+	}
+	return loaded, nil
+}
+
+// The watchFeeds function keeps every remote feed refreshed until stop is closed
+func watchFeeds(loaded []*threatFeed, stop <-chan struct{}) {
+	for _, feed := range loaded {
+		if feed.dataset != nil {
+			go feed.dataset.watch(stop)
+		}
+	}
+}
+
+// The parse function replaces the feed's ranges with those in a download
+func (feed *threatFeed) parse(contents []byte) error {
+	entries, err := feedEntries(contents, feed.settings)
+	if err != nil {
+		return err
+	}
+	ranges := &prefixTrie{}
+	skipped := 0
+	for _, entry := range entries {
+		parsed, err := parseAddressList([]string{entry})
+		if err != nil {
+			skipped++
+			continue
+		}
+		ranges.insert(parsed[0], nil)
+	}
+	if ranges.size == 0 {
+		return errors.New("the feed has no usable entries")
+	}
+
+	feed.mutex.Lock()
+	feed.ranges = ranges
+	feed.skipped = skipped
+	feed.mutex.Unlock()
+	return nil
+}
+
+// The feedEntries function pulls the raw address and CIDR strings out of a download according to the feed's format
+func feedEntries(contents []byte, settings feedSettings) ([]string, error) {
+	var entries []string
+	switch settings.Format {
+	case "plain":
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if cut := strings.IndexAny(line, "#;"); cut >= 0 {
+				line = line[:cut]
+			}
+			if fields := strings.Fields(line); len(fields) > 0 {
+				entries = append(entries, fields[0])
+			}
+		}
+		return entries, scanner.Err()
+
+	case "csv":
+		reader := csv.NewReader(bytes.NewReader(contents))
+		reader.FieldsPerRecord = -1
+		reader.Comment = '#'
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if settings.Column < len(record) {
+				entries = append(entries, strings.TrimSpace(record[settings.Column]))
+			}
+		}
+
+	case "json":
+		var items []json.RawMessage
+		if err := json.Unmarshal(contents, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			var entry string
+			if json.Unmarshal(item, &entry) != nil {
+				var object map[string]interface{}
+				if json.Unmarshal(item, &object) != nil {
+					continue
+				}
+				entry, _ = object[settings.Field].(string)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", settings.Format)
+}
+
+// The match function returns every range of the feed containing ip, counting a hit when there is one
+func (feed *threatFeed) match(ip net.IP) []string {
+	feed.mutex.RLock()
+	nodes := feed.ranges.matches(ip)
+	feed.mutex.RUnlock()
+
+	var matched []string
+	for _, node := range nodes {
+		matched = append(matched, node.prefix.String())
+	}
+	if len(matched) > 0 {
+		feed.hits.Add(1)
+	}
+	return matched
+}
+
+// The status function reports the feed's size, hits and, for remote feeds, the age of its data
+func (feed *threatFeed) status() feedStatus {
+	feed.mutex.RLock()
+	defer feed.mutex.RUnlock()
+	status := feedStatus{Name: feed.settings.Name, Format: feed.settings.Format, Entries: feed.ranges.size, Skipped: feed.skipped, Hits: feed.hits.Load()}
+	if feed.dataset != nil {
+		age := feed.dataset.age()
+		status.Data = &age
+	}
+	return status
+}
+
+// The handleFeeds function serves /admin/feeds, the status and hit count of every feed
+func handleFeeds(w http.ResponseWriter, r *http.Request) {
+	statuses := []feedStatus{}
+	for _, feed := range feeds {
+		statuses = append(statuses, feed.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(statuses)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+	The requestedFields function parses the fields query parameter, e.g. ?fields=ip,city,country, into canonical field names
+	and forms of the address such as ip_version
+	It returns nil when the parameter is absent, meaning every field, and an error naming the first unknown field
+*/
+func requestedFields(r *http.Request) ([]string, error) {
+	if !r.URL.Query().Has("fields") {
+		return nil, nil
+	}
+	known := documentFields(geolocation{})
+	for _, name := range addressFieldOrder {
+		known[name] = ""
+	}
+	var fields []string
+	for _, name := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := known[name]; !ok {
+			return nil, errors.New("unknown field " + name + ", the fields are " + strings.Join(documentFieldOrder, ","))
+		}
+		fields = append(fields, name)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("fields must name at least one of " + strings.Join(documentFieldOrder, ","))
+	}
+	return fields, nil
+}
+
+// The onlyAddress function reports whether fields asks for nothing but the address and its forms, which need no geolocation lookup
+func onlyAddress(fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	for _, name := range fields {
+		if !isAddressField(name) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	The lookupFields function is lookupFor() for a request that selected fields, setting the cache and hash headers as it goes
+	When only the address was selected the provider isn't asked at all, so ipinfo.io quota isn't spent on callers that don't need it
+*/
+func lookupFields(w http.ResponseWriter, r *http.Request, ip string, fields []string) (geolocation, error) {
+	if onlyAddress(fields) {
+		return geolocation{IP: ip}, nil
+	}
+	location, hit, err := lookupFor(r, ip)
+	setCacheStatus(w, hit)
+	if err == nil {
+		setResultHash(w, location)
+	}
+	return location, err
+}
+
+// The selectFields function removes every field of document that isn't in fields, keeping "error", fields of nil keeps them all
+func selectFields(document map[string]string, fields []string) map[string]string {
+	if fields == nil {
+		return document
+	}
+	selected := map[string]string{}
+	for _, name := range fields {
+		if value, ok := document[name]; ok {
+			selected[name] = value
+		}
+	}
+	if value, ok := document["error"]; ok {
+		selected["error"] = value
+	}
+	return selected
+}
+
+// The writeFieldValues function is the plain text answer to a request that selected fields, the value of each on its own line
+func writeFieldValues(w http.ResponseWriter, r *http.Request, ip string, fields []string) {
+	location, err := lookupFields(w, r, ip, fields)
+	if err != nil {
+		fmt.Fprint(w, "Error while attempting to get location data: "+err.Error())
+		return
+	}
+	location.IP = ip
+	document := documentFields(location)
+	for _, name := range fields {
+		fmt.Fprint(w, document[name]+"\n")
+	}
+}
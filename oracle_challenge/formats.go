@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+// The handleXMLIP function serves /ip?format=xml, for consumers that only read XML
+func handleXMLIP(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, writeXMLDocument)
+}
+
+/*
+	The writeXMLDocument function writes document as a <geolocation> element with one child per field in documentFieldOrder,
+	followed by <error> when the lookup failed
+*/
+func writeXMLDocument(w http.ResponseWriter, status int, document map[string]string) {
+	var body strings.Builder
+	body.WriteString(xml.Header + "<geolocation>\n")
+	element := func(name, value string) {
+		body.WriteString("  <" + name + ">")
+		xml.EscapeText(&body, []byte(value))
+		body.WriteString("</" + name + ">\n")
+	}
+	for _, name := range documentFieldOrder {
+		if value, ok := document[name]; ok {
+			element(name, value)
+		}
+	}
+	if document["error"] != "" {
+		element("error", document["error"])
+	}
+	body.WriteString("</geolocation>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(body.String()))
+}
+
+// The handleYAMLIP function serves /ip?format=yaml, for yq and Ansible
+func handleYAMLIP(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, writeYAMLDocument)
+}
+
+/*
+	The writeYAMLDocument function writes document as a YAML mapping in documentFieldOrder, followed by error when the lookup failed
+	Every value is double-quoted (a JSON string is a valid YAML one), so values like "NO" or "01234" stay strings
+*/
+func writeYAMLDocument(w http.ResponseWriter, status int, document map[string]string) {
+	var body strings.Builder
+	entry := func(name, value string) {
+		quoted, _ := json.Marshal(value)
+		body.WriteString(name + ": " + string(quoted) + "\n")
+	}
+	for _, name := range documentFieldOrder {
+		if value, ok := document[name]; ok {
+			entry(name, value)
+		}
+	}
+	if document["error"] != "" {
+		entry("error", document["error"])
+	}
+
+	w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(body.String()))
+}
+
+// csvColumns are the columns of the CSV representation, a failed lookup is written as ip and error instead
+var csvColumns = []string{"ip", "country", "region", "city", "postal", "timezone"}
+
+/*
+	The handleCSVIP function serves /ip?format=csv, a header row and one row of csvColumns, or of the ?fields= selected
+	header=false leaves out the header row, for appending result after result to the same file
+*/
+func handleCSVIP(w http.ResponseWriter, r *http.Request) {
+	header := r.URL.Query().Get("header") != "false"
+	columns, _ := requestedFields(r)
+	if columns == nil {
+		columns = csvColumns
+	}
+	serveDocument(w, r, func(w http.ResponseWriter, status int, document map[string]string) {
+		if document["error"] != "" {
+			columns = []string{"ip", "error"}
+		}
+		row := make([]string, len(columns))
+		for i, name := range columns {
+			row[i] = document[name]
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(status)
+		writer := csv.NewWriter(w)
+		if header {
+			writer.Write(columns)
+		}
+		writer.Write(row)
+		writer.Flush()
+	})
+}
+
+// The handleProtobufIP function serves /ip?format=protobuf, the oracle.v1.Location message of proto/lookup.proto
+func handleProtobufIP(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, func(w http.ResponseWriter, status int, document map[string]string) {
+		w.Header().Set("Content-Type", "application/x-protobuf; messageType=oracle.v1.Location")
+		w.WriteHeader(status)
+		w.Write(encodeLocationProto(document))
+	})
+}
+
+/*
+	The encodeLocationProto function encodes document in the protobuf wire format, every field being a string
+	The field numbers are the positions in locationFieldOrder counting from 1, then error, then the address forms of addressFieldOrder and the fields of timeFieldOrder,
+	as in proto/lookup.proto
+	Empty fields are left out as proto3 does
+*/
+func encodeLocationProto(document map[string]string) []byte {
+	var message []byte
+	field := func(number int, value string) {
+		if value == "" {
+			return
+		}
+		// Tag: the field number shifted past the wire type, 2 being length-delimited
+		message = binary.AppendUvarint(message, uint64(number)<<3|2)
+		message = binary.AppendUvarint(message, uint64(len(value)))
+		message = append(message, value...)
+	}
+	for i, name := range locationFieldOrder {
+		field(i+1, document[name])
+	}
+	field(len(locationFieldOrder)+1, document["error"])
+	for i, name := range addressFieldOrder {
+		field(len(locationFieldOrder)+2+i, document[name])
+	}
+	for i, name := range timeFieldOrder {
+		field(len(locationFieldOrder)+2+len(addressFieldOrder)+i, document[name])
+	}
+	return message
+}
+
+// The handleMessagePackIP function serves /ip?format=msgpack, the document as a MessagePack map of strings
+func handleMessagePackIP(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, func(w http.ResponseWriter, status int, document map[string]string) {
+		w.Header().Set("Content-Type", "application/msgpack")
+		w.WriteHeader(status)
+		w.Write(encodeMessagePack(document))
+	})
+}
+
+// The encodeMessagePack function encodes document as a MessagePack map, keys in documentFieldOrder followed by error when set
+func encodeMessagePack(document map[string]string) []byte {
+	var names []string
+	for _, name := range documentFieldOrder {
+		if _, ok := document[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if document["error"] != "" {
+		names = append(names, "error")
+	}
+
+	var encoded []byte
+	if len(names) < 16 {
+		encoded = []byte{0x80 | byte(len(names))}
+	} else {
+		encoded = binary.BigEndian.AppendUint16([]byte{0xde}, uint16(len(names)))
+	}
+	str := func(value string) {
+		switch length := len(value); {
+		case length < 32:
+			encoded = append(encoded, 0xa0|byte(length))
+		case length < 1<<8:
+			encoded = append(encoded, 0xd9, byte(length))
+		case length < 1<<16:
+			encoded = binary.BigEndian.AppendUint16(append(encoded, 0xda), uint16(length))
+		default:
+			encoded = binary.BigEndian.AppendUint32(append(encoded, 0xdb), uint32(length))
+		}
+		encoded = append(encoded, value...)
+	}
+	for _, name := range names {
+		str(name)
+		str(document[name])
+	}
+	return encoded
+}
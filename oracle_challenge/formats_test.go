@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeTestMessagePack decodes a MessagePack map of strings, the only shape encodeMessagePack writes
+func decodeTestMessagePack(encoded []byte) (map[string]string, error) {
+	take := func(n int) ([]byte, error) {
+		if len(encoded) < n {
+			return nil, errors.New("truncated")
+		}
+		taken := encoded[:n]
+		encoded = encoded[n:]
+		return taken, nil
+	}
+	length := func(size int) (int, error) {
+		bytes, err := take(size)
+		if err != nil {
+			return 0, err
+		}
+		var n uint64
+		for _, b := range bytes {
+			n = n<<8 | uint64(b)
+		}
+		return int(n), nil
+	}
+	str := func() (string, error) {
+		header, err := take(1)
+		if err != nil {
+			return "", err
+		}
+		var n int
+		switch {
+		case header[0]&0xe0 == 0xa0:
+			n = int(header[0] & 0x1f)
+		case header[0] == 0xd9:
+			n, err = length(1)
+		case header[0] == 0xda:
+			n, err = length(2)
+		case header[0] == 0xdb:
+			n, err = length(4)
+		default:
+			return "", errors.New("not a string")
+		}
+		if err != nil {
+			return "", err
+		}
+		value, err := take(n)
+		return string(value), err
+	}
+
+	header, err := take(1)
+	if err != nil {
+		return nil, err
+	}
+	var entries int
+	switch {
+	case header[0]&0xf0 == 0x80:
+		entries = int(header[0] & 0x0f)
+	case header[0] == 0xde:
+		entries, err = length(2)
+	default:
+		return nil, errors.New("not a map")
+	}
+	if err != nil {
+		return nil, err
+	}
+	document := map[string]string{}
+	for i := 0; i < entries; i++ {
+		name, err := str()
+		if err != nil {
+			return nil, err
+		}
+		if document[name], err = str(); err != nil {
+			return nil, err
+		}
+	}
+	if len(encoded) != 0 {
+		return nil, errors.New("trailing bytes")
+	}
+	return document, nil
+}
+
+func TestEncodeMessagePack(t *testing.T) {
+	full := map[string]string{"error": "the lookup failed"}
+	for _, name := range documentFieldOrder {
+		full[name] = name + " value"
+	}
+	fifteen := map[string]string{}
+	for _, name := range documentFieldOrder[:15] {
+		fifteen[name] = "x"
+	}
+	sixteen := map[string]string{}
+	for _, name := range documentFieldOrder[:16] {
+		sixteen[name] = "x"
+	}
+
+	tests := []struct {
+		name       string
+		document   map[string]string
+		wantHeader []byte
+	}{
+		{name: "empty", document: map[string]string{}, wantHeader: []byte{0x80}},
+		{name: "one field", document: map[string]string{"country": "NL"}, wantHeader: []byte{0x81}},
+		{name: "fifteen fields", document: fifteen, wantHeader: []byte{0x8f}},
+		{name: "sixteen fields", document: sixteen, wantHeader: []byte{0xde, 0, 16}},
+		{name: "every field and an error", document: full, wantHeader: binary.BigEndian.AppendUint16([]byte{0xde}, uint16(len(full)))},
+		{name: "long values", document: map[string]string{"city": strings.Repeat("a", 40), "region": strings.Repeat("b", 300), "timezone": strings.Repeat("c", 70000)}, wantHeader: []byte{0x83}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := encodeMessagePack(test.document)
+			if !strings.HasPrefix(string(encoded), string(test.wantHeader)) {
+				t.Fatalf("encodeMessagePack() starts % x, want % x", encoded[:min(len(encoded), 3)], test.wantHeader)
+			}
+			got, err := decodeTestMessagePack(encoded)
+			if err != nil {
+				t.Fatalf("decoding encodeMessagePack() = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.document) {
+				t.Fatalf("encodeMessagePack() decodes to %v, want %v", got, test.document)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The geofenceAnswer struct is the answer of /geofence, Allowed is whether Country is one of Countries
+type geofenceAnswer struct {
+	IP        string   `json:"ip"`
+	Country   string   `json:"country"`
+	Allowed   bool     `json:"allowed"`
+	Countries []string `json:"countries"`
+}
+
+/*
+	The handleGeofence function serves /geofence?ip=X&countries=US,CA,DE, whether the address resolves to one of the allowed countries,
+	for compliance tooling that wants a yes or no rather than a location
+	Without ?ip= the client's own address is checked, a bogon is answered as one and an address the provider places in no country is a 422,
+	so a caller can't mistake an unknown location for a verdict
+*/
+func handleGeofence(w http.ResponseWriter, r *http.Request) {
+	ip, err := targetIP(r)
+	if writeInvalidAddress(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	countries := splitList(r.URL.Query().Get("countries"))
+	if len(countries) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "?countries= is required, a comma separated list of country codes"})
+		return
+	}
+	for i, country := range countries {
+		if len(country) != 2 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": country + " is not a two-letter country code"})
+			return
+		}
+		countries[i] = strings.ToUpper(country)
+	}
+
+	if writeBogon(w, checkBogon(ip)) {
+		return
+	}
+	location, _, err := lookupFor(r, ip)
+	if writeBogon(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"ip": ip, "error": "Error while attempting to get location data: " + err.Error()})
+		return
+	}
+	if location.Country == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"ip": ip, "error": "the provider did not report a country for " + ip})
+		return
+	}
+
+	answer := geofenceAnswer{IP: ip, Country: strings.ToUpper(location.Country), Countries: countries}
+	for _, country := range countries {
+		if country == answer.Country {
+			answer.Allowed = true
+		}
+	}
+	writeJSON(w, http.StatusOK, answer)
+}
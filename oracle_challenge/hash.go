@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// resultHashHeader carries the canonical hash of the lookup result a response was built from
+const resultHashHeader = "X-Result-Hash"
+
+/*
+	The canonicalHash function returns a stable "sha256:<hex>" digest of a lookup result
+	The result is serialized as JSON first, which sorts map keys and keeps struct fields in declaration order,
+	so the same data always hashes the same regardless of how (or in what order) it was assembled
+*/
+func canonicalHash(result interface{}) (string, error) {
+	serialized, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(serialized)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// The locationHash function hashes a geolocation through its canonical fields, so it matches what every renderer shows
+func locationHash(location geolocation) string {
+	hash, _ := canonicalHash(locationFields(location))
+	return hash
+}
+
+/*
+	The setResultHash function adds the X-Result-Hash header, it must be called before anything is written to w
+	A result merged from several providers also gets the X-Field-Sources header naming where each field came from
+*/
+func setResultHash(w http.ResponseWriter, location geolocation) {
+	w.Header().Set(resultHashHeader, locationHash(location))
+	if location.Sources != "" {
+		w.Header().Set(fieldSourcesHeader, location.Sources)
+	}
+}
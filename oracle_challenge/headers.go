@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// credentialHeaders are the headers ?redact= blanks out, they carry the caller's session or credentials
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-Signature"}
+
+// The headersEcho struct is the answer of /headers, Headers is keyed by the canonical header name as Go received it
+type headersEcho struct {
+	Method     string              `json:"method"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+	Redacted   []string            `json:"redacted,omitempty"`
+}
+
+/*
+	The handleHeaders function serves /headers, every header of the request as it arrived, before determineIP() looks at any of them,
+	which shows what the proxies in front of the service add
+	?redact=true replaces the values of credentialHeaders with "[redacted]"
+*/
+func handleHeaders(w http.ResponseWriter, r *http.Request) {
+	redact := false
+	if value := r.URL.Query().Get("redact"); value != "" {
+		var err error
+		if redact, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "redact must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	echo := headersEcho{Method: r.Method, Host: r.Host, RemoteAddr: r.RemoteAddr, Headers: map[string][]string{}}
+	for name, values := range r.Header {
+		echo.Headers[name] = append([]string{}, values...)
+	}
+	if redact {
+		for _, name := range credentialHeaders {
+			values, ok := echo.Headers[name]
+			if !ok {
+				continue
+			}
+			for i := range values {
+				values[i] = "[redacted]"
+			}
+			echo.Redacted = append(echo.Redacted, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, echo)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// The interfaceReport struct is one network interface of the host as served by /self/interfaces
+type interfaceReport struct {
+	Name      string   `json:"name"`
+	Index     int      `json:"index"`
+	MTU       int      `json:"mtu"`
+	MAC       string   `json:"mac,omitempty"`
+	Flags     string   `json:"flags"`
+	Addresses []string `json:"addresses"`
+}
+
+// The defaultRoute struct is a route to 0.0.0.0/0 or ::/0, Gateway is "" for an on-link default route
+type defaultRoute struct {
+	Interface string `json:"interface"`
+	Gateway   string `json:"gateway,omitempty"`
+	Family    string `json:"family"`
+	Metric    int    `json:"metric"`
+}
+
+/*
+	The handleSelfInterfaces function serves /self/interfaces, the host's interfaces, their local addresses and its default routes
+	It is the local counterpart of /self for working out which way a multi-homed server's traffic leaves
+	Default routes are only read on Linux (see defaultRoutes), elsewhere routes_error explains why they are missing
+*/
+func handleSelfInterfaces(w http.ResponseWriter, r *http.Request) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		http.Error(w, "Error while listing the network interfaces: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := []interfaceReport{}
+	for _, networkInterface := range interfaces {
+		entry := interfaceReport{
+			Name:      networkInterface.Name,
+			Index:     networkInterface.Index,
+			MTU:       networkInterface.MTU,
+			MAC:       networkInterface.HardwareAddr.String(),
+			Flags:     networkInterface.Flags.String(),
+			Addresses: []string{},
+		}
+		addresses, err := networkInterface.Addrs()
+		if err != nil {
+			http.Error(w, "Error while listing the addresses of "+networkInterface.Name+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, address := range addresses {
+			entry.Addresses = append(entry.Addresses, address.String())
+		}
+		report = append(report, entry)
+	}
+
+	response := map[string]interface{}{"interfaces": report}
+	routes, err := defaultRoutes()
+	if err != nil {
+		response["routes_error"] = err.Error()
+	} else {
+		response["default_routes"] = routes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+	The pointInTimeAnswer struct is the answer of /history/ip, the recorded geolocation nearest to the time asked about
+	Snapshot is the date of the MaxMind snapshot the answer was read from, "" when it came from the audit log
+	Coverage says what an answer from the audit log can't see, so a client doesn't take RecordedAt for the last time the address was looked up
+*/
+type pointInTimeAnswer struct {
+	IP         string            `json:"ip"`
+	At         time.Time         `json:"at"`
+	RecordedAt time.Time         `json:"recorded_at"`
+	Snapshot   string            `json:"snapshot,omitempty"`
+	Coverage   string            `json:"coverage,omitempty"`
+	Location   map[string]string `json:"location"`
+}
+
+// auditCoverage is the Coverage of answers from the audit log, which records upstream lookups but not the cache hits in between
+const auditCoverage = "only upstream lookups are recorded, answers served from the cache in between them are not"
+
+/*
+	The handleIPHistory function serves /history/ip?ip=...&at=..., where an address was geolocated at a point in time,
+	answered from the lookup recorded in the audit log nearest to at (an RFC 3339 timestamp, now when left out)
+	Only lookups made under the caller's own tenant are searched, and 404 means no lookup of the address was recorded
+	The audit log only holds upstream lookups, so the answer is the nearest one of those rather than the nearest time the address was asked about
+	The location is redacted by the caller's redaction policy, as lookupFor() would redact a live lookup
+	?as_of=YYYY-MM-DD answers from the newest configured snapshot published by then instead, see snapshotSettings
+*/
+func handleIPHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	parsed := net.ParseIP(query.Get("ip"))
+	if parsed == nil {
+		http.Error(w, "ip must be a valid IP address", http.StatusBadRequest)
+		return
+	}
+	if query.Has("as_of") {
+		answerFromSnapshot(w, r, parsed, query.Get("as_of"))
+		return
+	}
+	if auditLog == nil {
+		http.Error(w, "point-in-time queries need the audit log, which isn't enabled", http.StatusNotFound)
+		return
+	}
+	ip := parsed.String()
+	at := time.Now().UTC()
+	if value := query.Get("at"); value != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "at must be an RFC 3339 timestamp such as 2024-05-01T12:00:00Z", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tenant := tenantFor(r)
+	var nearest *auditRecord
+	err := auditLog.each(func(line []byte) error {
+		var record auditRecord
+		if json.Unmarshal(line, &record) != nil || record.IP != ip || record.Tenant != tenant || record.Location == nil {
+			return nil
+		}
+		if nearest == nil || record.Time.Sub(at).Abs() < nearest.Time.Sub(at).Abs() {
+			nearest = &record
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Error while reading the audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if nearest == nil {
+		http.Error(w, "no lookup of "+ip+" has been recorded", http.StatusNotFound)
+		return
+	}
+	location := nearest.Location
+	if policy := policyFor(r); policy != nil {
+		location = redactFields(location, policy.Hide)
+	}
+	writeJSON(w, http.StatusOK, pointInTimeAnswer{IP: ip, At: at.UTC(), RecordedAt: nearest.Time, Coverage: auditCoverage, Location: location})
+}
+
+// The answerFromSnapshot function answers /history/ip?as_of= with ip's geolocation in the snapshot that was current on that day, redacted by r's policy
+func answerFromSnapshot(w http.ResponseWriter, r *http.Request, ip net.IP, value string) {
+	asOf, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		http.Error(w, "as_of must be a date such as 2024-05-01", http.StatusBadRequest)
+		return
+	}
+	snapshot := snapshotAsOf(asOf)
+	if snapshot == nil {
+		http.Error(w, "no snapshot was published by "+value, http.StatusNotFound)
+		return
+	}
+	date := snapshot.date.Format(time.DateOnly)
+	location, found, err := snapshot.lookup(ip)
+	if err != nil {
+		http.Error(w, "Error while reading the snapshot of "+date+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "the snapshot of "+date+" has no record of "+ip.String(), http.StatusNotFound)
+		return
+	}
+	if policy := policyFor(r); policy != nil {
+		location = redactLocation(location, policy.Hide)
+	}
+	fields := locationFields(location)
+	writeJSON(w, http.StatusOK, pointInTimeAnswer{IP: ip.String(), At: asOf, RecordedAt: snapshot.date, Snapshot: date, Location: fields})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+	The ipinfoSettings struct configures the ipinfo feature
+	Databases are MaxMind DB files (e.g. a GeoLite2-City and GeoLite2-ASN pair) the emulation answers from instead of the upstream provider,
+	each filling the fields the others left empty as a snapshot's do
+*/
+type ipinfoSettings struct {
+	Databases []string `json:"databases"`
+}
+
+// ipinfoDatabase holds the databases of ipinfo.databases, nil when the emulation goes to the upstream provider
+var ipinfoDatabase *geoSnapshot
+
+// The openIPInfoDatabase function reads the configured databases at startup, so a missing or corrupt file is reported before serving
+func openIPInfoDatabase(settings ipinfoSettings) (*geoSnapshot, error) {
+	if len(settings.Databases) == 0 {
+		return nil, nil
+	}
+	database := &geoSnapshot{files: settings.Databases}
+	err := database.open()
+	recordComponent("ipinfo", "database", strings.Join(settings.Databases, ","), err)
+	if err != nil {
+		return nil, fmt.Errorf("ipinfo.databases: %w", err)
+	}
+	return database, nil
+}
+
+/*
+	The lookupIPInfo function geolocates ip for the emulation, from the local databases when they are configured and through lookupFor() otherwise
+	A local answer gets the same bogon check, hostname fill and redaction policy lookupFor() applies, an address the databases don't know
+	is answered with its empty fields as ipinfo.io does
+*/
+func lookupIPInfo(r *http.Request, ip string) (geolocation, error) {
+	if ipinfoDatabase == nil {
+		location, _, err := lookupFor(r, ip)
+		return location, err
+	}
+	if err := checkBogon(ip); err != nil {
+		return geolocation{}, err
+	}
+	location, _, err := ipinfoDatabase.lookup(net.ParseIP(ip))
+	if err != nil {
+		return geolocation{}, err
+	}
+	if config.RDNS.FillHostname {
+		location.Hostname = ptrHostname(ip)
+	}
+	if policy := policyFor(r); policy != nil {
+		location = redactLocation(location, policy.Hide)
+	}
+	location.Latitude, location.Longitude, location.Located = parseLoc(location.Loc)
+	noteCountry(r, location.Country)
+	return location, nil
+}
+
+// The ipinfoResponse struct is the JSON schema served by ipinfo.io for a single address
+type ipinfoResponse struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	City     string `json:"city"`
+	Region   string `json:"region"`
+	Country  string `json:"country"`
+	Loc      string `json:"loc"`
+	Org      string `json:"org,omitempty"`
+	Postal   string `json:"postal"`
+	Timezone string `json:"timezone"`
+}
+
+/*
+	The handleIPInfoEmulation function mimics the ipinfo.io API paths so its clients can be pointed at this service unchanged:
+		/ and /json                - the caller's own details
+		/{ip} and /{ip}/json       - details for any address
+		/{field} and /{ip}/{field} - a single field as plain text with a trailing newline
+	Lookups are answered from ipinfo.databases when configured, and otherwise through lookupFor() so the same quotas and upstream provider apply,
+	the redaction policies apply either way
+*/
+func handleIPInfoEmulation(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	target, field := "", ""
+	switch {
+	case segments[0] == "" || segments[0] == "json":
+	case isIPInfoField(segments[0]) && len(segments) == 1:
+		field = segments[0]
+	default:
+		target = segments[0]
+		if len(segments) == 2 && segments[1] != "json" {
+			field = segments[1]
+		}
+	}
+
+	if target == "" {
+		ip, err := determineIP(r)
+		if err != nil {
+			writeIPInfoError(w, http.StatusInternalServerError, "Lookup failed", err.Error())
+			return
+		}
+		target = ip
+	}
+	if net.ParseIP(target) == nil {
+		writeIPInfoError(w, http.StatusNotFound, "Wrong ip", "Please provide a valid IP address")
+		return
+	}
+	if field != "" && !isIPInfoField(field) {
+		writeIPInfoError(w, http.StatusNotFound, "Wrong field", "Please provide a valid field name")
+		return
+	}
+
+	location, err := lookupIPInfo(r, target)
+	if writeBogon(w, err) {
+		return
+	}
+	if err != nil {
+		writeIPInfoError(w, http.StatusBadGateway, "Lookup failed", err.Error())
+		return
+	}
+	setResultHash(w, location)
+	response := ipinfoResponse{
+		IP:       target,
+		Hostname: location.Hostname,
+		City:     location.City,
+		Region:   location.Region,
+		Country:  location.Country,
+		Loc:      location.Loc,
+		Org:      location.Org,
+		Postal:   location.Postal,
+		Timezone: location.Timezone,
+	}
+
+	if field != "" {
+		values := map[string]string{
+			"ip":       response.IP,
+			"hostname": response.Hostname,
+			"city":     response.City,
+			"region":   response.Region,
+			"country":  response.Country,
+			"loc":      response.Loc,
+			"org":      response.Org,
+			"postal":   response.Postal,
+			"timezone": response.Timezone,
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, values[field]+"\n")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response)
+}
+
+// The isIPInfoField function reports whether name is one of the single-field paths ipinfo.io serves
+func isIPInfoField(name string) bool {
+	switch name {
+	case "ip", "hostname", "city", "region", "country", "loc", "org", "postal", "timezone":
+		return true
+	}
+	return false
+}
+
+// The writeIPInfoError function writes an error in the same shape ipinfo.io uses
+func writeIPInfoError(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"error":  map[string]string{"title": title, "message": message},
+	})
+}
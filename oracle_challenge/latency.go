@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLatencyCountries applies when latency.max_countries isn't configured
+	defaultLatencyCountries = 50
+	// otherCountry labels the countries past latency.max_countries
+	otherCountry = "other"
+)
+
+// latencyBounds are the upper bounds of the histogram buckets in seconds, doubling from 1ms to about 16s
+var latencyBounds = func() []float64 {
+	bounds := make([]float64, 15)
+	for i := range bounds {
+		bounds[i] = 0.001 * math.Pow(2, float64(i))
+	}
+	return bounds
+}()
+
+/*
+	continentCountries lists the ISO 3166 country codes of each continent, continentOf is built from it
+	Countries spanning two continents are listed where their capital is
+*/
+var continentCountries = map[string]string{
+	"AF": "DZ AO BJ BW BF BI CV CM CF TD KM CG CD CI DJ EG GQ ER SZ ET GA GM GH GN GW KE LS LR LY MG MW ML MR MU YT MA MZ NA NE NG RE RW SH ST SN SC SL SO ZA SS SD TZ TG TN UG EH ZM ZW",
+	"AN": "AQ BV GS HM TF",
+	"AS": "AF AM AZ BH BD BT BN KH CN CY GE HK IN ID IO IR IQ IL JP JO KZ KW KG LA LB MO MY MV MN MM NP KP OM PK PS PH QA SA SG KR LK SY TW TJ TH TL TR TM AE UZ VN YE CC CX",
+	"EU": "AX AL AD AT BY BE BA BG HR CZ DK EE FO FI FR DE GI GR GG HU IS IE IM IT JE XK LV LI LT LU MT MD MC ME NL MK NO PL PT RO RU SM RS SK SI ES SJ SE CH UA GB VA",
+	"NA": "AI AG AW BS BB BZ BM BQ VG CA KY CR CU CW DM DO SV GL GD GP GT HT HN JM MQ MX MS NI PA PR BL KN LC MF PM VC SX TT TC US VI UM",
+	"OC": "AS AU CK FJ PF GU KI MH FM NR NC NZ NU NF MP PW PG PN WS SB TK TO TV VU WF",
+	"SA": "AR BO BR CL CO EC FK GF GY PY PE SR UY VE",
+}
+
+// continentOf maps a country code to its continent code
+var continentOf = func() map[string]string {
+	continents := map[string]string{}
+	for continent, countries := range continentCountries {
+		for _, country := range strings.Fields(countries) {
+			continents[country] = continent
+		}
+	}
+	return continents
+}()
+
+// The latencySettings struct bounds the per-country latency histograms, MaxCountries is how many countries get one of their own
+type latencySettings struct {
+	MaxCountries int `json:"max_countries"`
+}
+
+// The latencyHistogram struct counts request durations into latencyBounds, the last count is the +Inf bucket
+type latencyHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+/*
+	The latencyTracker struct keeps a histogram per country a request resolved, only requests that looked up a location are tracked
+	Once MaxCountries countries have one, requests from further countries go to "other", which keeps /metrics to a bounded number of series
+*/
+type latencyTracker struct {
+	mutex     sync.Mutex
+	countries map[string]*latencyHistogram
+}
+
+var latencies = &latencyTracker{countries: map[string]*latencyHistogram{}}
+
+// The resolvedCountry struct is where lookupFor() leaves the country of the first location a request looked up, for track() to read
+type resolvedCountry struct {
+	mutex   sync.Mutex
+	country string
+}
+
+// The resolvedCountryKey type is the context key of a request's *resolvedCountry
+type resolvedCountryKey struct{}
+
+// The withCountrySlot function returns r with somewhere for lookupFor() to leave the country it resolved
+func withCountrySlot(r *http.Request) (*http.Request, *resolvedCountry) {
+	slot := &resolvedCountry{}
+	return r.WithContext(context.WithValue(r.Context(), resolvedCountryKey{}, slot)), slot
+}
+
+// The noteCountry function records country as the one r resolved, unless it already resolved one
+func noteCountry(r *http.Request, country string) {
+	slot, ok := r.Context().Value(resolvedCountryKey{}).(*resolvedCountry)
+	if !ok || country == "" {
+		return
+	}
+	slot.mutex.Lock()
+	defer slot.mutex.Unlock()
+	if slot.country == "" {
+		slot.country = strings.ToUpper(country)
+	}
+}
+
+// The get function returns the country recorded in the slot, "" when the request didn't resolve one
+func (slot *resolvedCountry) get() string {
+	slot.mutex.Lock()
+	defer slot.mutex.Unlock()
+	return slot.country
+}
+
+// The observe function counts a request from country that took duration
+func (tracker *latencyTracker) observe(country string, duration time.Duration) {
+	if country == "" {
+		return
+	}
+	limit := config.Latency.MaxCountries
+	if limit <= 0 {
+		limit = defaultLatencyCountries
+	}
+	seconds := duration.Seconds()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	histogram, ok := tracker.countries[country]
+	if !ok {
+		if len(tracker.countries) >= limit {
+			country = otherCountry
+		}
+		if histogram, ok = tracker.countries[country]; !ok {
+			histogram = &latencyHistogram{counts: make([]uint64, len(latencyBounds)+1)}
+			tracker.countries[country] = histogram
+		}
+	}
+	histogram.counts[sort.SearchFloat64s(latencyBounds, seconds)]++
+	histogram.sum += seconds
+	histogram.count++
+}
+
+// The add function merges other into histogram
+func (histogram *latencyHistogram) add(other *latencyHistogram) {
+	for i, count := range other.counts {
+		histogram.counts[i] += count
+	}
+	histogram.sum += other.sum
+	histogram.count += other.count
+}
+
+/*
+	The quantile function estimates the q quantile in seconds from the buckets, interpolating linearly within the bucket it falls in
+	It is the upper bound of the last bucket when the quantile falls past it
+*/
+func (histogram *latencyHistogram) quantile(q float64) float64 {
+	if histogram.count == 0 {
+		return 0
+	}
+	rank := q * float64(histogram.count)
+	seen := 0.0
+	for i, count := range histogram.counts {
+		if count == 0 || seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		if i == len(latencyBounds) {
+			return latencyBounds[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		return lower + (latencyBounds[i]-lower)*(rank-seen)/float64(count)
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// The latencySummary struct is a histogram as /stats reports it, in milliseconds, only the count is published when /stats is noised
+type latencySummary struct {
+	Count  int     `json:"count"`
+	MeanMS float64 `json:"mean_ms,omitempty"`
+	P50MS  float64 `json:"p50_ms,omitempty"`
+	P90MS  float64 `json:"p90_ms,omitempty"`
+	P99MS  float64 `json:"p99_ms,omitempty"`
+}
+
+// The latencyReport struct is the latency section of /stats, continents aggregate the countries within them
+type latencyReport struct {
+	Countries  map[string]latencySummary `json:"countries"`
+	Continents map[string]latencySummary `json:"continents"`
+}
+
+// The summary function condenses histogram for /stats
+func (histogram *latencyHistogram) summary() latencySummary {
+	milliseconds := func(seconds float64) float64 { return math.Round(seconds*10000) / 10 }
+	summary := latencySummary{Count: int(histogram.count)}
+	if histogram.count > 0 {
+		summary.MeanMS = milliseconds(histogram.sum / float64(histogram.count))
+		summary.P50MS, summary.P90MS, summary.P99MS = milliseconds(histogram.quantile(0.5)), milliseconds(histogram.quantile(0.9)), milliseconds(histogram.quantile(0.99))
+	}
+	return summary
+}
+
+/*
+	The byContinent function returns a copy of every country's histogram and the histograms of the continents they add up to
+	"other" has no continent of its own, so the continents only cover the countries tracked individually
+*/
+func (tracker *latencyTracker) byContinent() (map[string]*latencyHistogram, map[string]*latencyHistogram) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	countries, continents := map[string]*latencyHistogram{}, map[string]*latencyHistogram{}
+	for country, histogram := range tracker.countries {
+		copied := &latencyHistogram{counts: make([]uint64, len(histogram.counts))}
+		copied.add(histogram)
+		countries[country] = copied
+		continent, ok := continentOf[country]
+		if !ok {
+			continue
+		}
+		if continents[continent] == nil {
+			continents[continent] = &latencyHistogram{counts: make([]uint64, len(latencyBounds)+1)}
+		}
+		continents[continent].add(histogram)
+	}
+	return countries, continents
+}
+
+// The report function summarises every histogram for /stats
+func (tracker *latencyTracker) report() latencyReport {
+	countries, continents := tracker.byContinent()
+	report := latencyReport{Countries: map[string]latencySummary{}, Continents: map[string]latencySummary{}}
+	for country, histogram := range countries {
+		report.Countries[country] = histogram.summary()
+	}
+	for continent, histogram := range continents {
+		report.Continents[continent] = histogram.summary()
+	}
+	return report
+}
+
+// The writeMetrics function writes a Prometheus histogram per country, labelled with its continent as well so it can be summed by continent
+func (tracker *latencyTracker) writeMetrics(w io.Writer) {
+	countries, _ := tracker.byContinent()
+	var names []string
+	for country := range countries {
+		names = append(names, country)
+	}
+	sort.Strings(names)
+
+	writeMetricHeader(w, "oracle_http_request_duration_seconds", "histogram", "Time to serve requests that looked up a location, by the country they resolved.")
+	for _, country := range names {
+		histogram := countries[country]
+		continent := continentOf[country]
+		if continent == "" {
+			continent = "unknown"
+		}
+		labels := fmt.Sprintf("country=%q,continent=%q", country, continent)
+		cumulative := uint64(0)
+		for i, bound := range latencyBounds {
+			cumulative += histogram.counts[i]
+			fmt.Fprintf(w, "oracle_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "oracle_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, histogram.count)
+		fmt.Fprintf(w, "oracle_http_request_duration_seconds_sum{%s} %g\n", labels, histogram.sum)
+		fmt.Fprintf(w, "oracle_http_request_duration_seconds_count{%s} %d\n", labels, histogram.count)
+	}
+}
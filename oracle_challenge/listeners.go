@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+	The listenerSettings struct is one address the service listens on, each with its own routes and middleware
+	Features overrides the top-level features config for this listener only, so e.g. a public listener can serve /ip alone
+	while an internal one adds admin and metrics
+	Middleware names the wrappers this listener applies, out of maintenance, signatures and decision (all of them when unset);
+	they always run in that order whatever order they are listed in
+	VirtualHosts serve requests for their hostnames differently, anything else gets the listener's own routes
+	TLSCert and TLSKey are PEM files to serve HTTPS with instead of plain HTTP
+*/
+type listenerSettings struct {
+	Name         string                `json:"name"`
+	Address      string                `json:"address"`
+	Features     map[string]bool       `json:"features"`
+	Middleware   []string              `json:"middleware"`
+	VirtualHosts []virtualHostSettings `json:"virtual_hosts"`
+	TLSCert      string                `json:"tls_cert"`
+	TLSKey       string                `json:"tls_key"`
+
+	// output and requireAPIKey are filled in by handler() for the routes of the listener or one of its virtual hosts
+	output        *compiledOutput
+	requireAPIKey bool
+}
+
+/*
+	The virtualHostSettings struct serves one or more hostnames of a listener with their own routes, matched against the Host header
+	Features applies over the top of the listener's, Output replaces the top-level output config for /ip
+	and RequireAPIKey puts every endpoint but /healthz behind an API key,
+	e.g. ip.example.com answering in plain text while api.example.com requires a key and uses a JSON template
+*/
+type virtualHostSettings struct {
+	Name          string          `json:"name"`
+	Hosts         []string        `json:"hosts"`
+	Features      map[string]bool `json:"features"`
+	Output        *outputSettings `json:"output"`
+	RequireAPIKey bool            `json:"require_api_key"`
+}
+
+// middlewareOrder lists every middleware, outermost first
+var middlewareOrder = []struct {
+	Name string
+	Wrap func(http.Handler) http.Handler
+}{
+	{"maintenance", withMaintenance},
+	{"signatures", withSignatures},
+	{"decision", withDecision},
+}
+
+// The configuredListeners function returns the listeners from config, or a single listener on config.Listen when none are configured
+func configuredListeners() []listenerSettings {
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	return []listenerSettings{{Name: "default", Address: config.Listen, TLSCert: config.TLSCert, TLSKey: config.TLSKey}}
+}
+
+/*
+	The checkListeners function rejects duplicate names and addresses, unknown middleware and unknown feature names
+	Unknown names in a features config are rejected so a typo can't silently leave a feature in its default state
+	A hostname may only belong to one virtual host of a listener
+*/
+func checkListeners(listeners []listenerSettings) error {
+	for feature := range config.Features {
+		if _, ok := defaultFeatures[feature]; !ok {
+			return fmt.Errorf("unknown feature %q in config", feature)
+		}
+	}
+
+	known := map[string]bool{}
+	for _, middleware := range middlewareOrder {
+		known[middleware.Name] = true
+	}
+	names, addresses := map[string]bool{}, map[string]bool{}
+	for _, listener := range listeners {
+		if listener.Name == "" || names[listener.Name] {
+			return fmt.Errorf("listener name %q is empty or used twice", listener.Name)
+		}
+		if listener.Address == "" || addresses[listener.Address] {
+			return fmt.Errorf("listener %q: address %q is empty or used twice", listener.Name, listener.Address)
+		}
+		names[listener.Name], addresses[listener.Address] = true, true
+		if (listener.TLSCert == "") != (listener.TLSKey == "") {
+			return fmt.Errorf("listener %q: tls_cert and tls_key go together", listener.Name)
+		}
+		for feature := range listener.Features {
+			if _, ok := defaultFeatures[feature]; !ok {
+				return fmt.Errorf("listener %q: unknown feature %q", listener.Name, feature)
+			}
+		}
+		for _, name := range listener.Middleware {
+			if !known[name] {
+				return fmt.Errorf("listener %q: unknown middleware %q", listener.Name, name)
+			}
+		}
+
+		hosts := map[string]bool{}
+		for _, virtualHost := range listener.VirtualHosts {
+			if virtualHost.Name == "" || len(virtualHost.Hosts) == 0 {
+				return fmt.Errorf("listener %q: every virtual host needs a name and at least one host", listener.Name)
+			}
+			for _, host := range virtualHost.Hosts {
+				host = strings.ToLower(host)
+				if hosts[host] {
+					return fmt.Errorf("listener %q: host %q belongs to more than one virtual host", listener.Name, host)
+				}
+				hosts[host] = true
+			}
+			for feature := range virtualHost.Features {
+				if _, ok := defaultFeatures[feature]; !ok {
+					return fmt.Errorf("listener %q virtual host %q: unknown feature %q", listener.Name, virtualHost.Name, feature)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The featureEnabled function reports whether feature is switched on for this listener: its own features, then the top-level config, then the default
+func (listener listenerSettings) featureEnabled(feature string) bool {
+	if feature == "" {
+		return true
+	}
+	if enabled, ok := listener.Features[feature]; ok {
+		return enabled
+	}
+	if enabled, ok := config.Features[feature]; ok {
+		return enabled
+	}
+	return defaultFeatures[feature]
+}
+
+/*
+	The virtualHost function returns the listener as seen by requests for virtualHost,
+	with the virtual host's features layered over the listener's
+*/
+func (listener listenerSettings) virtualHost(virtualHost virtualHostSettings) (listenerSettings, error) {
+	features := map[string]bool{}
+	for feature, enabled := range listener.Features {
+		features[feature] = enabled
+	}
+	for feature, enabled := range virtualHost.Features {
+		features[feature] = enabled
+	}
+	host := listenerSettings{
+		Name:          listener.Name + "/" + virtualHost.Name,
+		Address:       listener.Address,
+		Features:      features,
+		output:        customOutput,
+		requireAPIKey: virtualHost.RequireAPIKey,
+	}
+	if virtualHost.Output != nil {
+		output, err := compileOutputTemplate(*virtualHost.Output)
+		if err != nil {
+			return host, fmt.Errorf("listener %q: %w", host.Name, err)
+		}
+		host.output = output
+	}
+	return host, nil
+}
+
+/*
+	The handler function builds the listener's mux from its enabled routes and wraps it in its middleware
+	With virtual hosts configured the Host header (without its port, case-insensitively) picks which mux serves the request
+*/
+func (listener listenerSettings) handler() (http.Handler, error) {
+	listener.output = customOutput
+	mux := http.NewServeMux()
+	if err := registerRoutes(mux, listener); err != nil {
+		return nil, fmt.Errorf("listener %q: %w", listener.Name, err)
+	}
+
+	var handler http.Handler = mux
+	if len(listener.VirtualHosts) > 0 {
+		hosts := map[string]http.Handler{}
+		for _, settings := range listener.VirtualHosts {
+			virtualHost, err := listener.virtualHost(settings)
+			if err != nil {
+				return nil, err
+			}
+			hostMux := http.NewServeMux()
+			if err := registerRoutes(hostMux, virtualHost); err != nil {
+				return nil, fmt.Errorf("listener %q: %w", virtualHost.Name, err)
+			}
+			for _, host := range settings.Hosts {
+				hosts[strings.ToLower(host)] = hostMux
+			}
+		}
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if name, _, err := net.SplitHostPort(host); err == nil {
+				host = name
+			}
+			if hostMux, ok := hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+				hostMux.ServeHTTP(w, r)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+
+	applied := map[string]bool{}
+	for _, name := range listener.Middleware {
+		applied[name] = true
+	}
+	for i := len(middlewareOrder) - 1; i >= 0; i-- {
+		if listener.Middleware == nil || applied[middlewareOrder[i].Name] {
+			handler = middlewareOrder[i].Wrap(handler)
+		}
+	}
+	return handler, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// The zone database is built in so local times don't depend on the host having one installed
+	_ "time/tzdata"
+)
+
+/*
+	timeFieldOrder lists the fields structured /ip responses carry after the address forms, worked out from the location's timezone:
+	the current time there (RFC 3339) and its offset from UTC (+hh:mm)
+*/
+var timeFieldOrder = []string{"local_time", "utc_offset"}
+
+// zones caches the *time.Location of every timezone name loaded so far, a nil value marks a name the zone database doesn't know
+var zones sync.Map
+
+// The loadZone function returns the location of the IANA timezone name, nil when it is empty or unknown
+func loadZone(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+	if zone, ok := zones.Load(name); ok {
+		return zone.(*time.Location)
+	}
+	zone, err := time.LoadLocation(name)
+	if err != nil {
+		zone = nil
+	}
+	zones.Store(name, zone)
+	return zone
+}
+
+// The timeFields function derives the fields of timeFieldOrder from timezone at now, both empty when the timezone is unknown
+func timeFields(timezone string, now time.Time) map[string]string {
+	fields := map[string]string{"local_time": "", "utc_offset": ""}
+	if zone := loadZone(timezone); zone != nil {
+		local := now.In(zone)
+		fields["local_time"] = local.Format(time.RFC3339)
+		fields["utc_offset"] = local.Format("-07:00")
+	}
+	return fields
+}
+
+// The localTimeAnswer struct is the answer of /time/{ip}, Abbreviation is the zone's abbreviation as the zone database has it, e.g. "CEST"
+type localTimeAnswer struct {
+	IP           string `json:"ip"`
+	Timezone     string `json:"timezone"`
+	LocalTime    string `json:"local_time"`
+	UTCOffset    string `json:"utc_offset"`
+	OffsetSecs   int    `json:"utc_offset_seconds"`
+	Abbreviation string `json:"abbreviation"`
+	DST          bool   `json:"dst"`
+}
+
+/*
+	The handleTime function serves /time/{ip}, the current time in the timezone of the address, and /time for the client's own
+	An address whose location has no timezone the zone database knows is answered 422
+*/
+func handleTime(w http.ResponseWriter, r *http.Request) {
+	input := strings.Trim(strings.TrimPrefix(r.URL.Path, "/time"), "/")
+	if input == "" {
+		ip, err := determineIP(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		input = ip
+	}
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		writeInvalidAddress(w, &invalidAddressError{Input: input})
+		return
+	}
+	ip := parsed.String()
+	if writeBogon(w, checkBogon(ip)) {
+		return
+	}
+	location, _, err := lookupFor(r, ip)
+	if writeBogon(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"ip": ip, "error": "Error while attempting to get location data: " + err.Error()})
+		return
+	}
+	zone := loadZone(location.Timezone)
+	if zone == nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"ip": ip, "timezone": location.Timezone, "error": "there is no known timezone for " + ip})
+		return
+	}
+
+	local := time.Now().In(zone)
+	abbreviation, offset := local.Zone()
+	writeJSON(w, http.StatusOK, localTimeAnswer{
+		IP:           ip,
+		Timezone:     location.Timezone,
+		LocalTime:    local.Format(time.RFC3339),
+		UTCOffset:    local.Format("-07:00"),
+		OffsetSecs:   offset,
+		Abbreviation: abbreviation,
+		DST:          local.IsDST(),
+	})
+}
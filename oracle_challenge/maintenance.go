@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	The maintenanceSettings struct configures the static payload served while maintenance mode is on
+	Enabled only sets the state at startup, operators flip it at runtime through /admin/maintenance
+*/
+type maintenanceSettings struct {
+	Enabled     bool   `json:"enabled"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+	RetryAfter  int    `json:"retry_after"`
+}
+
+// maintenanceMode is read on every request, so it is kept outside of config where it can be flipped without locking
+var maintenanceMode atomic.Bool
+
+/*
+	The withMaintenance function wraps the whole mux, answering every request with the configured payload while maintenance mode is on
+	/healthz, /readyz and the /admin/ endpoints are always passed through, so load balancers can see the state and operators can turn it back off,
+	as is any request carrying an admin key, which keeps the admin endpoints outside /admin/ (/debug/config, /self/interfaces, /pool/members) reachable
+*/
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenanceMode.Load() || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/admin/") || validAPIKey(requestAPIKey(r), config.AdminKeys) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		settings := config.Maintenance
+		status := settings.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		contentType := settings.ContentType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		body := settings.Body
+		if body == "" {
+			body = "The service is down for maintenance, please try again later\n"
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		if settings.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(settings.RetryAfter))
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})
+}
+
+/*
+	The handleHealthz function reports whether this instance should receive traffic
+	Maintenance mode answers 503 with a distinct "maintenance" body, so a draining instance can be told apart from a broken one
+*/
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if maintenanceMode.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "maintenance\n")
+		return
+	}
+	fmt.Fprint(w, "ok\n")
+}
+
+/*
+	The handleMaintenance function lets an admin inspect (GET), enable (POST) or disable (DELETE) maintenance mode
+	The response always reports the resulting state
+*/
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		maintenanceMode.Store(true)
+	case http.MethodDelete:
+		maintenanceMode.Store(false)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "use POST to enable maintenance mode and DELETE to disable it", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if maintenanceMode.Load() {
+		fmt.Fprint(w, "Maintenance Mode: enabled\n")
+	} else {
+		fmt.Fprint(w, "Maintenance Mode: disabled\n")
+	}
+}
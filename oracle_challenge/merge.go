@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// fieldSourcesHeader reports which provider each field of a merged result came from, e.g. "country=ipinfo, org=maxmind"
+const fieldSourcesHeader = "X-Field-Sources"
+
+/*
+	The mergeSettings struct asks several providers about every upstream lookup and merges their answers field by field
+	Providers lists the providers to ask, "ipinfo" or any of providers, and Weights gives each a confidence per canonical field
+	(or "*" for its other fields), 1 when not configured
+	Providers answering the same value pool their weights, and the value with the most weight behind it wins the field,
+	so one provider with better ASN data can supply org while the others still decide the city
+*/
+type mergeSettings struct {
+	Providers []string                      `json:"providers"`
+	Weights   map[string]map[string]float64 `json:"weights"`
+}
+
+// The providerMerger struct is a compiled mergeSettings
+type providerMerger struct {
+	providers []geoProvider
+	weights   map[string]map[string]float64
+}
+
+// merger is built by main() when merge.providers is configured, nil keeps the single ipinfo lookup
+var merger *providerMerger
+
+// The newProviderMerger function finds each provider settings names among providers, it returns nil when merging is off
+func newProviderMerger(settings mergeSettings, providers []geoProvider) (*providerMerger, error) {
+	if len(settings.Providers) == 0 {
+		return nil, nil
+	}
+	if len(settings.Providers) < 2 {
+		return nil, errors.New("merge: providers needs at least two providers to merge")
+	}
+	known := locationFields(geolocation{})
+	for provider, fields := range settings.Weights {
+		for field, weight := range fields {
+			if _, ok := known[field]; (!ok && field != "*") || field == "ip" {
+				return nil, fmt.Errorf("merge: provider %q: unknown field %q", provider, field)
+			}
+			if weight < 0 {
+				return nil, fmt.Errorf("merge: provider %q: the weight of %q can't be negative", provider, field)
+			}
+		}
+	}
+
+	merged := &providerMerger{weights: settings.Weights}
+	listed := map[string]bool{}
+	for _, name := range settings.Providers {
+		listed[name] = true
+		found := false
+		for _, provider := range providers {
+			if provider.name == name {
+				merged.providers = append(merged.providers, provider)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("merge: provider %q isn't configured", name)
+		}
+	}
+	for name := range settings.Weights {
+		if !listed[name] {
+			return nil, fmt.Errorf("merge: weights names %q, which isn't one of providers", name)
+		}
+	}
+	return merged, nil
+}
+
+// The weight function is the confidence in provider's value of field
+func (merger *providerMerger) weight(provider, field string) float64 {
+	if weight, ok := merger.weights[provider][field]; ok {
+		return weight
+	}
+	if weight, ok := merger.weights[provider]["*"]; ok {
+		return weight
+	}
+	return 1
+}
+
+/*
+	The lookup function asks every provider about ip at once and merges the answers, recording the winning provider of each field in Sources
+	It fails only when every provider does, a weight tie goes to the provider listed first
+*/
+func (merger *providerMerger) lookup(ip string) (geolocation, error) {
+	answers := make([]geolocation, len(merger.providers))
+	failures := make([]error, len(merger.providers))
+	var wait sync.WaitGroup
+	for i, provider := range merger.providers {
+		wait.Add(1)
+		go func(i int, provider geoProvider) {
+			defer wait.Done()
+			answers[i], failures[i] = provider.lookup(ip)
+		}(i, provider)
+	}
+	wait.Wait()
+
+	merged := map[string]string{}
+	var sources []string
+	var errs []string
+	for _, field := range locationFieldOrder {
+		if field == "ip" {
+			continue
+		}
+		// The weight behind each value, and the first provider to answer it
+		support := map[string]float64{}
+		first := map[string]string{}
+		var order []string
+		for i, provider := range merger.providers {
+			if failures[i] != nil {
+				continue
+			}
+			value := locationFields(answers[i])[field]
+			if value == "" {
+				continue
+			}
+			if _, ok := first[value]; !ok {
+				first[value] = provider.name
+				order = append(order, value)
+			}
+			support[value] += merger.weight(provider.name, field)
+		}
+		best := ""
+		for _, value := range order {
+			if best == "" || support[value] > support[best] {
+				best = value
+			}
+		}
+		if best != "" {
+			merged[field] = best
+			sources = append(sources, field+"="+first[best])
+		}
+	}
+	for i, provider := range merger.providers {
+		if failures[i] != nil {
+			errs = append(errs, provider.name+": "+failures[i].Error())
+		}
+	}
+	if len(errs) == len(merger.providers) {
+		return geolocation{}, errors.New("every merged provider failed: " + strings.Join(errs, "; "))
+	}
+
+	return geolocation{
+		IP:       ip,
+		Hostname: merged["hostname"],
+		Country:  merged["country"],
+		Region:   merged["region"],
+		City:     merged["city"],
+		Postal:   merged["postal"],
+		Timezone: merged["timezone"],
+		Loc:      merged["loc"],
+		Org:      merged["org"],
+		Sources:  strings.Join(sources, ", "),
+	}, nil
+}
+
+// The fetchUpstream function looks ip up with the merged providers when merging is configured, with ipinfo alone otherwise
+func fetchUpstream(ip string) (geolocation, error) {
+	if merger != nil {
+		return merger.lookup(ip)
+	}
+	return fetchGeolocation(ip)
+}
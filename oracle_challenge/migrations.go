@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// schemaFile is where data_dir records the schema version its persisted files are at
+	schemaFile = "schema.json"
+	// schemaBackupDir inside data_dir holds the persisted files as they were before the last migration run
+	schemaBackupDir = "schema_backup"
+)
+
+/*
+	The persistedPaths struct is where each persisted file lives, the paths a migration reads and rewrites
+	A path is "" when the file isn't configured, it may also not exist yet
+*/
+type persistedPaths struct {
+	DataDir     string
+	AuditLog    string
+	SelfHistory string
+	QuotaState  string
+}
+
+/*
+	The migration struct is one step of the persisted schema, Up moves the files from Version-1 to Version and Down moves them back
+	A migration without Down can't be rolled back past, "oracle migrate -to" refuses before touching anything
+*/
+type migration struct {
+	Version int
+	Name    string
+	Up      func(paths persistedPaths) error
+	Down    func(paths persistedPaths) error
+}
+
+/*
+	migrations lists every schema version in order, a change to the layout of a persisted file is added here as the next version
+	rather than read both ways by the code that loads it
+*/
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up:      func(paths persistedPaths) error { return nil },
+		Down:    func(paths persistedPaths) error { return nil },
+	},
+}
+
+// The schemaChange struct is one migration applied or rolled back, as the schema file records it
+type schemaChange struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Direction string    `json:"direction"`
+	At        time.Time `json:"at"`
+}
+
+// The schemaState struct is the schema file, Version is the last migration applied and History every change made so far
+type schemaState struct {
+	Version int            `json:"version"`
+	History []schemaChange `json:"history"`
+}
+
+// The currentPersistedPaths function returns the persisted files of the loaded config
+func currentPersistedPaths() persistedPaths {
+	paths := persistedPaths{DataDir: config.DataDir, QuotaState: config.Quota.StateFile}
+	if config.DataDir != "" {
+		paths.AuditLog = filepath.Join(config.DataDir, "audit.jsonl")
+		paths.SelfHistory = filepath.Join(config.DataDir, "self_history.jsonl")
+	}
+	return paths
+}
+
+// The files function returns every persisted path that is configured
+func (paths persistedPaths) files() []string {
+	var files []string
+	for _, path := range []string{paths.AuditLog, paths.SelfHistory, paths.QuotaState} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// The latestSchema function returns the version of the last migration this binary knows
+func latestSchema() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// The loadSchemaState function reads the schema file of dataDir, a missing file means nothing was migrated yet
+func loadSchemaState(dataDir string) (schemaState, error) {
+	var state schemaState
+	data, err := os.ReadFile(filepath.Join(dataDir, schemaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+// The migrationPlan function returns the migrations taking from to target, applied in order or rolled back newest first
+func migrationPlan(from, target int) ([]migration, error) {
+	if target < 0 || target > latestSchema() {
+		return nil, fmt.Errorf("migrate: there is no schema version %d, this binary knows up to %d", target, latestSchema())
+	}
+	if from > latestSchema() {
+		return nil, fmt.Errorf("migrate: the data is at schema version %d, newer than the %d this binary knows, roll it back with the binary that migrated it", from, latestSchema())
+	}
+	var plan []migration
+	if target >= from {
+		for _, step := range migrations {
+			if step.Version > from && step.Version <= target {
+				plan = append(plan, step)
+			}
+		}
+		return plan, nil
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		step := migrations[i]
+		if step.Version > target && step.Version <= from {
+			if step.Down == nil {
+				return nil, fmt.Errorf("migrate: version %d (%s) can't be rolled back", step.Version, step.Name)
+			}
+			plan = append(plan, step)
+		}
+	}
+	return plan, nil
+}
+
+// The copyPersisted function copies each file of files over the path it maps to, a file that doesn't exist removes that path instead
+func copyPersisted(files map[string]string) error {
+	for source, target := range files {
+		data, err := os.ReadFile(source)
+		if errors.Is(err, os.ErrNotExist) {
+			os.Remove(target)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(target, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	The migrate function moves the persisted files of paths to schema version target, logging each step to out
+	Every file is copied to schema_backup in data_dir first, and if a step fails the files and schema file are put back as they were,
+	so a failed upgrade leaves the previous version something it can still read
+	A dry run only logs the plan
+	Without a data_dir there is nowhere to record the schema version and nothing is migrated
+*/
+func migrate(paths persistedPaths, target int, dryRun bool, out io.Writer) error {
+	if paths.DataDir == "" {
+		return nil
+	}
+	state, err := loadSchemaState(paths.DataDir)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	plan, err := migrationPlan(state.Version, target)
+	if err != nil || len(plan) == 0 {
+		return err
+	}
+
+	direction := "up"
+	if target < state.Version {
+		direction = "down"
+	}
+	for _, step := range plan {
+		fmt.Fprintf(out, "migrate: %s %d %s\n", direction, step.Version, step.Name)
+	}
+	if dryRun {
+		fmt.Fprintf(out, "migrate: dry run, schema version %d left as it is\n", state.Version)
+		return nil
+	}
+
+	backupDir := filepath.Join(paths.DataDir, schemaBackupDir)
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	backups := map[string]string{filepath.Join(paths.DataDir, schemaFile): filepath.Join(backupDir, schemaFile)}
+	for _, file := range paths.files() {
+		backups[file] = filepath.Join(backupDir, filepath.Base(file))
+	}
+	if err := copyPersisted(backups); err != nil {
+		return fmt.Errorf("migrate: backing up: %w", err)
+	}
+	restore := map[string]string{}
+	for source, backup := range backups {
+		restore[backup] = source
+	}
+
+	for _, step := range plan {
+		run, version := step.Up, step.Version
+		if direction == "down" {
+			run, version = step.Down, step.Version-1
+		}
+		if err := run(paths); err != nil {
+			if restoreErr := copyPersisted(restore); restoreErr != nil {
+				return fmt.Errorf("migrate: %s %d %s: %v, and restoring the backup in %s failed: %v", direction, step.Version, step.Name, err, backupDir, restoreErr)
+			}
+			return fmt.Errorf("migrate: %s %d %s: %w, the files were restored as they were", direction, step.Version, step.Name, err)
+		}
+		state.Version = version
+		state.History = append(state.History, schemaChange{Version: step.Version, Name: step.Name, Direction: direction, At: time.Now().UTC()})
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(filepath.Join(paths.DataDir, schemaFile), data)
+		}
+		if err != nil {
+			copyPersisted(restore)
+			return fmt.Errorf("migrate: recording version %d: %w", state.Version, err)
+		}
+	}
+	fmt.Fprintf(out, "migrate: schema version %d\n", state.Version)
+	return nil
+}
+
+// The logWriter type sends what migrate() writes at startup to the log, one line per write
+type logWriter struct{}
+
+func (logWriter) Write(line []byte) (int, error) {
+	log.Print(string(line))
+	return len(line), nil
+}
+
+/*
+	The runMigrateCommand function implements "oracle migrate", which moves data_dir to a schema version without starting the server
+	-to picks the version (the latest by default), a lower one rolls back, -dry-run prints the plan and -status the current version
+	It returns the process exit code
+*/
+func runMigrateCommand(arguments []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON config file")
+	target := flags.Int("to", latestSchema(), "schema version to migrate to, lower than the current one rolls back")
+	dryRun := flags.Bool("dry-run", false, "print the migrations without running them")
+	status := flags.Bool("status", false, "print the current schema version and history")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if err := loadConfig(*configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if config.DataDir == "" {
+		fmt.Fprintln(os.Stderr, "migrate: data_dir isn't configured, there is nothing to migrate")
+		return 1
+	}
+	var err error
+	if storageCipher, err = loadStorageCipher(config.Encryption); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *status {
+		state, err := loadSchemaState(config.DataDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("schema version %d, this binary knows up to %d\n", state.Version, latestSchema())
+		for _, change := range state.History {
+			fmt.Printf("%s %s %d %s\n", change.At.Format(time.RFC3339), change.Direction, change.Version, change.Name)
+		}
+		return 0
+	}
+	if err := migrate(currentPersistedPaths(), *target, *dryRun, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
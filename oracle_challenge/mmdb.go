@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+/*
+	The mmdbReader struct reads a MaxMind DB (.mmdb) file held in memory, as described by the MaxMind DB format spec:
+	a binary search tree over the address bits whose leaves point into a data section of self-describing values
+	Only lookups are supported, which is all the snapshots and the ASN database need
+*/
+type mmdbReader struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+}
+
+// The openMMDB function reads the file at path and parses its metadata
+func openMMDB(path string) (*mmdbReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	marker := bytes.LastIndex(data, mmdbMetadataMarker)
+	if marker < 0 {
+		return nil, fmt.Errorf("%s isn't a MaxMind DB file", path)
+	}
+	metadataStart := uint(marker + len(mmdbMetadataMarker))
+	decoded, _, err := (&mmdbDecoder{buffer: data[metadataStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading the metadata: %w", path, err)
+	}
+	metadata, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: the metadata isn't a map", path)
+	}
+	number := func(key string) uint {
+		value, _ := metadata[key].(uint64)
+		return uint(value)
+	}
+
+	reader := &mmdbReader{data: data, nodeCount: number("node_count"), recordSize: number("record_size"), ipVersion: number("ip_version")}
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, reader.recordSize)
+	}
+	// The tree is followed by 16 zero bytes, then the data section
+	reader.dataStart = reader.nodeCount*reader.recordSize/4 + 16
+	if reader.dataStart > metadataStart {
+		return nil, fmt.Errorf("%s: the search tree runs past the metadata", path)
+	}
+	// IPv4 addresses live under ::/96 of an IPv6 tree
+	if reader.ipVersion == 6 {
+		for i := 0; i < 96 && reader.ipv4Start < reader.nodeCount; i++ {
+			reader.ipv4Start = reader.record(reader.ipv4Start, 0)
+		}
+	}
+	return reader, nil
+}
+
+// The record function returns the left (bit 0) or right (bit 1) record of node
+func (reader *mmdbReader) record(node uint, bit uint) uint {
+	switch reader.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		return uint(reader.data[offset])<<16 | uint(reader.data[offset+1])<<8 | uint(reader.data[offset+2])
+	case 28:
+		offset := node * 7
+		if bit == 0 {
+			return uint(reader.data[offset+3]&0xf0)<<20 | uint(reader.data[offset])<<16 | uint(reader.data[offset+1])<<8 | uint(reader.data[offset+2])
+		}
+		return uint(reader.data[offset+3]&0x0f)<<24 | uint(reader.data[offset+4])<<16 | uint(reader.data[offset+5])<<8 | uint(reader.data[offset+6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(reader.data[offset:]))
+	}
+}
+
+// The lookup function returns the record for ip, nil when the database has none
+func (reader *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	record, _, err := reader.lookupNetwork(ip)
+	return record, err
+}
+
+// The lookupNetwork function returns the record for ip along with the network the database files it under, nil for both when it has none
+func (reader *mmdbReader) lookupNetwork(ip net.IP) (interface{}, *net.IPNet, error) {
+	address, node := ip.To4(), uint(0)
+	if address != nil {
+		node = reader.ipv4Start
+	} else if address = ip.To16(); address == nil || reader.ipVersion == 4 {
+		return nil, nil, nil
+	}
+
+	depth := 0
+	for ; depth < len(address)*8 && node < reader.nodeCount; depth++ {
+		node = reader.record(node, uint(address[depth/8]>>(7-uint(depth%8)))&1)
+	}
+	if node == reader.nodeCount {
+		return nil, nil, nil
+	}
+	if node < reader.nodeCount {
+		return nil, nil, errors.New("the search tree is deeper than an address")
+	}
+	if node < reader.nodeCount+16 {
+		return nil, nil, errors.New("a search tree record points into the separator before the data section")
+	}
+	offset := node - reader.nodeCount - 16
+	if reader.dataStart+offset >= uint(len(reader.data)) {
+		return nil, nil, errors.New("a search tree record points past the data section")
+	}
+	value, _, err := (&mmdbDecoder{buffer: reader.data[reader.dataStart:]}).decode(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := net.CIDRMask(depth, len(address)*8)
+	return value, &net.IPNet{IP: address.Mask(mask), Mask: mask}, nil
+}
+
+// The mmdbDecoder struct decodes values out of a data section, offsets and pointers are relative to the start of buffer
+type mmdbDecoder struct {
+	buffer []byte
+	depth  int
+}
+
+// The decode function decodes the value at offset, returning it and the offset just past it
+func (decoder *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	decoder.depth++
+	defer func() { decoder.depth-- }()
+	if decoder.depth > 32 {
+		return nil, 0, errors.New("values are nested too deeply")
+	}
+	take := func(count uint) ([]byte, error) {
+		if offset+count > uint(len(decoder.buffer)) {
+			return nil, errors.New("a value runs past the end of the data")
+		}
+		taken := decoder.buffer[offset : offset+count]
+		offset += count
+		return taken, nil
+	}
+
+	control, err := take(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	kind, size := uint(control[0]>>5), uint(control[0]&0x1f)
+	if kind == 1 {
+		// A pointer, whose size bits hold the pointer's length and its top bits
+		length := size>>3 + 1
+		pointer, err := take(length)
+		if err != nil {
+			return nil, 0, err
+		}
+		target := uint(0)
+		if length < 4 {
+			target = size & 0x7
+		}
+		for _, b := range pointer {
+			target = target<<8 | uint(b)
+		}
+		target += [...]uint{0, 2048, 526336, 0}[length-1]
+		value, _, err := decoder.decode(target)
+		return value, offset, err
+	}
+	if kind == 0 {
+		extended, err := take(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(extended[0])
+	}
+	if size >= 29 {
+		extra, err := take(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = [...]uint{29, 285, 65821}[len(extra)-1]
+		base := uint(0)
+		for _, b := range extra {
+			base = base<<8 | uint(b)
+		}
+		size += base
+	}
+
+	switch kind {
+	case 7: // map
+		values := map[string]interface{}{}
+		for i := uint(0); i < size; i++ {
+			key, next, err := decoder.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("a map key isn't a string")
+			}
+			if values[name], offset, err = decoder.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return values, offset, nil
+	case 11: // array
+		// Every element takes at least a byte, a size claiming more than the data holds mustn't get to allocate for it
+		values := make([]interface{}, 0, min(size, uint(len(decoder.buffer))-offset))
+		for i := uint(0); i < size; i++ {
+			value, next, err := decoder.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			values, offset = append(values, value), next
+		}
+		return values, offset, nil
+	case 14: // boolean, its value is its size
+		return size != 0, offset, nil
+	}
+
+	raw, err := take(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case 2: // UTF-8 string
+		return string(raw), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("a double isn't 8 bytes")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("a float isn't 4 bytes")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		value := uint64(0)
+		for _, b := range raw {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case 8: // int32
+		value := uint32(0)
+		for _, b := range raw {
+			value = value<<8 | uint32(b)
+		}
+		if size == 4 {
+			return int64(int32(value)), offset, nil
+		}
+		return int64(value), offset, nil
+	case 4, 10: // bytes and uint128, which nothing here needs as a number
+		return raw, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encodeMMDBString encodes s as an MMDB UTF-8 string shorter than 29 bytes
+func encodeMMDBString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// encodeMMDBUint16 encodes value as a two byte MMDB uint16
+func encodeMMDBUint16(value uint16) []byte {
+	return []byte{5<<5 | 2, byte(value >> 8), byte(value)}
+}
+
+// encodeMMDBMap encodes the header of an MMDB map with size pairs, which follow it
+func encodeMMDBMap(size int) []byte {
+	return []byte{7<<5 | byte(size)}
+}
+
+/*
+	testMMDB builds an IPv4 database with record_size 24 and nodes given as left/right record pairs,
+	its data section holds {"country": "NL"} at offset 0
+*/
+func testMMDB(nodes [][2]uint, metadata []byte) []byte {
+	var file []byte
+	for _, node := range nodes {
+		for _, record := range node {
+			file = append(file, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, encodeMMDBMap(1)...)
+	file = append(file, encodeMMDBString("country")...)
+	file = append(file, encodeMMDBString("NL")...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, metadata...)
+}
+
+// testMMDBMetadata encodes the metadata map of a database
+func testMMDBMetadata(nodeCount, recordSize, ipVersion uint16) []byte {
+	var metadata []byte
+	metadata = append(metadata, encodeMMDBMap(3)...)
+	metadata = append(metadata, encodeMMDBString("node_count")...)
+	metadata = append(metadata, encodeMMDBUint16(nodeCount)...)
+	metadata = append(metadata, encodeMMDBString("record_size")...)
+	metadata = append(metadata, encodeMMDBUint16(recordSize)...)
+	metadata = append(metadata, encodeMMDBString("ip_version")...)
+	return append(metadata, encodeMMDBUint16(ipVersion)...)
+}
+
+// writeTestMMDB writes data to a file in a test's temporary directory and returns its path
+func writeTestMMDB(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		buffer  []byte
+		want    interface{}
+		wantErr string
+	}{
+		{name: "string", buffer: encodeMMDBString("NL"), want: "NL"},
+		{name: "uint16", buffer: encodeMMDBUint16(443), want: uint64(443)},
+		{name: "negative int32", buffer: []byte{0 | 4, 1, 0xff, 0xff, 0xff, 0xfe}, want: int64(-2)},
+		{name: "double", buffer: []byte{3<<5 | 8, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, want: 1.5},
+		{name: "boolean", buffer: []byte{0 | 1, 7}, want: true},
+		{name: "map", buffer: append(append(encodeMMDBMap(1), encodeMMDBString("a")...), encodeMMDBString("b")...), want: map[string]interface{}{"a": "b"}},
+		{name: "array", buffer: append([]byte{0 | 2, 4}, append(encodeMMDBString("a"), encodeMMDBString("b")...)...), want: []interface{}{"a", "b"}},
+		{name: "pointer", buffer: append([]byte{1 << 5, 2}, encodeMMDBString("NL")...), want: "NL"},
+
+		{name: "empty", buffer: nil, wantErr: "runs past the end"},
+		{name: "string longer than the data", buffer: []byte{2<<5 | 10, 'N', 'L'}, wantErr: "runs past the end"},
+		{name: "truncated extended type", buffer: []byte{0}, wantErr: "runs past the end"},
+		{name: "truncated size", buffer: []byte{2<<5 | 30, 0}, wantErr: "runs past the end"},
+		{name: "huge size", buffer: []byte{2<<5 | 31, 0xff, 0xff, 0xff}, wantErr: "runs past the end"},
+		{name: "truncated pointer", buffer: []byte{1<<5 | 3<<3}, wantErr: "runs past the end"},
+		{name: "pointer past the end", buffer: []byte{1<<5 | 3<<3, 0xff, 0xff, 0xff, 0xff}, wantErr: "runs past the end"},
+		{name: "pointer to itself", buffer: []byte{1 << 5, 0}, wantErr: "nested too deeply"},
+		{name: "map missing its value", buffer: append(encodeMMDBMap(1), encodeMMDBString("a")...), wantErr: "runs past the end"},
+		{name: "map claiming more pairs than it has", buffer: append(append(encodeMMDBMap(28), encodeMMDBString("a")...), encodeMMDBString("b")...), wantErr: "runs past the end"},
+		{name: "array claiming more entries than it has", buffer: []byte{0 | 31, 4, 0xff, 0xff, 0xff, 2<<5 | 1, 'a'}, wantErr: "runs past the end"},
+		{name: "map key that isn't a string", buffer: append(append(encodeMMDBMap(1), encodeMMDBUint16(1)...), encodeMMDBString("b")...), wantErr: "isn't a string"},
+		{name: "maps nested too deeply", buffer: bytes.Repeat(append(encodeMMDBMap(1), encodeMMDBString("a")...), 40), wantErr: "nested too deeply"},
+		{name: "short double", buffer: []byte{3<<5 | 4, 0, 0, 0, 0}, wantErr: "isn't 8 bytes"},
+		{name: "short float", buffer: []byte{0 | 2, 8, 0, 0}, wantErr: "isn't 4 bytes"},
+		{name: "unknown type", buffer: []byte{0, 200}, wantErr: "unsupported data type"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _, err := (&mmdbDecoder{buffer: test.buffer}).decode(0)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("decode() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("decode() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenMMDB(t *testing.T) {
+	valid := testMMDB([][2]uint{{1 + 16, 1}}, testMMDBMetadata(1, 24, 4))
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "valid", data: valid},
+		{name: "empty", data: nil, wantErr: "isn't a MaxMind DB file"},
+		{name: "no metadata", data: valid[:bytes.LastIndex(valid, mmdbMetadataMarker)], wantErr: "isn't a MaxMind DB file"},
+		{name: "truncated metadata", data: valid[:len(valid)-4], wantErr: "reading the metadata"},
+		{name: "metadata that isn't a map", data: append(testMMDB(nil, nil), encodeMMDBString("x")...), wantErr: "isn't a map"},
+		{name: "unsupported record size", data: testMMDB([][2]uint{{1, 1}}, testMMDBMetadata(1, 20, 4)), wantErr: "unsupported record size"},
+		{name: "missing record size", data: testMMDB([][2]uint{{1, 1}}, encodeMMDBMap(0)), wantErr: "unsupported record size"},
+		{name: "tree past the metadata", data: testMMDB([][2]uint{{1, 1}}, testMMDBMetadata(60000, 24, 4)), wantErr: "runs past the metadata"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := openMMDB(writeTestMMDB(t, test.data))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("openMMDB() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("openMMDB() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMMDBLookup(t *testing.T) {
+	tests := []struct {
+		name        string
+		nodes       [][2]uint
+		ip          string
+		want        interface{}
+		wantNetwork string
+		wantErr     string
+	}{
+		{name: "record", nodes: [][2]uint{{1 + 16, 1}}, ip: "10.0.0.1", want: map[string]interface{}{"country": "NL"}, wantNetwork: "0.0.0.0/1"},
+		{name: "no record", nodes: [][2]uint{{1 + 16, 1}}, ip: "200.0.0.1"},
+		{name: "IPv6 in an IPv4 database", nodes: [][2]uint{{1 + 16, 1}}, ip: "2001:db8::1"},
+		{name: "deeper tree", nodes: [][2]uint{{1, 2}, {2 + 16, 2}}, ip: "10.0.0.1", want: map[string]interface{}{"country": "NL"}, wantNetwork: "0.0.0.0/2"},
+		{name: "loop in the tree", nodes: [][2]uint{{0, 0}}, ip: "10.0.0.1", wantErr: "deeper than an address"},
+		{name: "record past the data section", nodes: [][2]uint{{1 + 16 + 5000, 1}}, ip: "10.0.0.1", wantErr: "past the data section"},
+		{name: "record into the separator", nodes: [][2]uint{{1 + 4, 1}}, ip: "10.0.0.1", wantErr: "into the separator"},
+		{name: "record into the middle of a value", nodes: [][2]uint{{1 + 16 + 3, 1}}, ip: "10.0.0.1", wantErr: "isn't 8 bytes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := openMMDB(writeTestMMDB(t, testMMDB(test.nodes, testMMDBMetadata(uint16(len(test.nodes)), 24, 4))))
+			if err != nil {
+				t.Fatalf("openMMDB() error = %v", err)
+			}
+			got, network, err := reader.lookupNetwork(net.ParseIP(test.ip))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("lookupNetwork(%s) error = %v, want one containing %q", test.ip, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupNetwork(%s) error = %v", test.ip, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("lookupNetwork(%s) = %#v, want %#v", test.ip, got, test.want)
+			}
+			gotNetwork := ""
+			if network != nil {
+				gotNetwork = network.String()
+			}
+			if gotNetwork != test.wantNetwork {
+				t.Fatalf("lookupNetwork(%s) network = %q, want %q", test.ip, gotNetwork, test.wantNetwork)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// htmlIPPage is the built-in text/html representation of /ip, rendered against the canonical fields of locationFields()
+var htmlIPPage = template.Must(template.New("ip").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.ip}}</title></head>
+<body>
+<h1>{{.ip}}</h1>
+{{if .error}}<p>{{.error}}</p>{{else}}<dl>
+<dt>Country</dt><dd>{{.country}}</dd>
+<dt>State(region)</dt><dd>{{.region}}</dd>
+<dt>City</dt><dd>{{.city}}</dd>
+<dt>Zip</dt><dd>{{.postal}}</dd>
+<dt>Time Zone</dt><dd>{{.timezone}}</dd>
+</dl>{{end}}
+</body>
+</html>
+`))
+
+// The handleHTMLIP function serves /ip as an HTML page for browsers
+func handleHTMLIP(w http.ResponseWriter, r *http.Request) {
+	data := locationFields(geolocation{})
+	data["error"] = ""
+	ip, err := targetIP(r)
+	if err == nil {
+		var location geolocation
+		var hit bool
+		location, hit, err = lookupFor(r, ip)
+		setCacheStatus(w, hit)
+		if err == nil {
+			setResultHash(w, location)
+			data = locationFields(location)
+			data["error"] = ""
+		}
+	}
+	data["ip"] = ip
+	if err != nil {
+		data["error"] = "Error while attempting to get location data: " + err.Error()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	htmlIPPage.Execute(w, data)
+}
+
+/*
+	The preferredType function picks the media type the Accept header ranks highest out of offered, "" when it accepts none of them
+	Ties go to whichever comes first in offered, and a wildcard range matches at its own quality
+*/
+func preferredType(accept string, offered []string) string {
+	best, bestQuality := "", 0.0
+	for _, offer := range offered {
+		quality := 0.0
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, parameters, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if value, ok := parameters["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+			major, _, _ := strings.Cut(offer, "/")
+			if (mediaType == offer || mediaType == "*/*" || mediaType == major+"/*") && q > quality {
+				quality = q
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
+
+/*
+	The withNegotiation function wraps the /ip handler so the representation follows the client:
+	?format=json|html|xml|yaml|csv|protobuf|msgpack|text wins, otherwise the Accept header chooses between application/json, text/html,
+	application/xml, application/yaml, text/csv, application/x-protobuf, application/msgpack and text/plain
+	Plain text (next, which may be a configured template or a bare address) is served when neither asks for anything else,
+	so curl's default Accept header keeps getting text while browsers get HTML
+	?template=name renders one of output_templates instead, ahead of any format
+	Whichever representation is chosen, /ip/{address} and ?ip= look up that address rather than the client's, a malformed one is a 400
+*/
+func withNegotiation(next http.HandlerFunc) http.HandlerFunc {
+	// Representations in order of preference when the Accept header ranks several equally, plain text first for */*
+	representations := []struct {
+		MediaType string
+		Handler   http.HandlerFunc
+	}{
+		{"text/plain", next},
+		{"application/json", handleJSONIP},
+		{"text/html", handleHTMLIP},
+		{"application/xml", handleXMLIP},
+		{"text/xml", handleXMLIP},
+		{"application/yaml", handleYAMLIP},
+		{"application/x-yaml", handleYAMLIP},
+		{"text/yaml", handleYAMLIP},
+		{"text/csv", handleCSVIP},
+		{"application/x-protobuf", handleProtobufIP},
+		{"application/protobuf", handleProtobufIP},
+		{"application/msgpack", handleMessagePackIP},
+		{"application/x-msgpack", handleMessagePackIP},
+	}
+	formats := map[string]string{
+		"text":     "text/plain",
+		"json":     "application/json",
+		"html":     "text/html",
+		"xml":      "application/xml",
+		"yaml":     "application/yaml",
+		"csv":      "text/csv",
+		"protobuf": "application/x-protobuf",
+		"msgpack":  "application/msgpack",
+	}
+	handlers := map[string]http.HandlerFunc{}
+	var offered []string
+	for _, representation := range representations {
+		handlers[representation.MediaType] = representation.Handler
+		offered = append(offered, representation.MediaType)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if _, _, err := explicitIP(r); writeInvalidAddress(w, err) {
+			return
+		}
+		if name := r.URL.Query().Get("template"); name != "" {
+			output, ok := namedOutputs[name]
+			if !ok {
+				http.Error(w, "there is no output template named "+name, http.StatusBadRequest)
+				return
+			}
+			output.serveIP(w, r)
+			return
+		}
+		mediaType, ok := formats[r.URL.Query().Get("format")]
+		if !ok {
+			mediaType = preferredType(r.Header.Get("Accept"), offered)
+		}
+		if handler, ok := handlers[mediaType]; ok {
+			handler(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
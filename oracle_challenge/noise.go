@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultNoiseRefresh applies when stats.noise_refresh_seconds isn't configured
+const defaultNoiseRefresh = time.Minute
+
+/*
+	The statsSettings struct configures what /stats publishes
+	A NoiseEpsilon above zero adds Laplace noise to every count (sensitivity 1, one visitor moves a count by at most one),
+	smaller values mean more noise and stronger privacy, NoiseEpsilon is the budget of the whole report and is split evenly across its counts
+	A count keeps its noised value for as long as it doesn't change, so polling /stats repeatedly can't average the noise away,
+	and the report is rebuilt at most once per NoiseRefreshSeconds
+*/
+type statsSettings struct {
+	NoiseEpsilon        float64 `json:"noise_epsilon"`
+	NoiseRefreshSeconds int     `json:"noise_refresh_seconds"`
+}
+
+/*
+	The noiseInfo struct tells /stats readers how the counts were perturbed
+	Epsilon is the budget of the report, EpsilonPerCount what each of its Counts was noised with,
+	and Suppressed lists what is left out of a noised report altogether
+*/
+type noiseInfo struct {
+	Mechanism       string    `json:"mechanism"`
+	Epsilon         float64   `json:"epsilon"`
+	Counts          int       `json:"counts"`
+	EpsilonPerCount float64   `json:"epsilon_per_count"`
+	Suppressed      []string  `json:"suppressed"`
+	DrawnAt         time.Time `json:"drawn_at"`
+}
+
+// The noisedValue struct is a count's noised value, reused until the exact count or the epsilon it was drawn with changes
+type noisedValue struct {
+	exact   int
+	epsilon float64
+	noisy   int
+}
+
+var (
+	noisyStatsMutex sync.Mutex
+	noisyStats      *statsReport
+	// noisyValues are the noised value of every count in the last report, by the count's name
+	noisyValues = map[string]noisedValue{}
+)
+
+/*
+	The uniformFloat function returns a uniformly distributed number in (0, 1) read from crypto/rand,
+	the noise is what protects the counts so it mustn't be predictable from earlier draws
+*/
+func uniformFloat() float64 {
+	var buffer [8]byte
+	for {
+		if _, err := rand.Read(buffer[:]); err != nil {
+			panic("crypto/rand: " + err.Error())
+		}
+		// 53 random bits fill a float64's mantissa, zero is redrawn since its logarithm is infinite
+		if value := binary.BigEndian.Uint64(buffer[:]) >> 11; value != 0 {
+			return float64(value) / (1 << 53)
+		}
+	}
+}
+
+// The laplaceNoise function draws from a Laplace distribution centred on zero with scale 1/epsilon
+func laplaceNoise(epsilon float64) float64 {
+	uniform := uniformFloat() - 0.5
+	sign := 1.0
+	if uniform < 0 {
+		sign = -1.0
+	}
+	return -sign / epsilon * math.Log(1-2*math.Abs(uniform))
+}
+
+// The noisyCount function adds Laplace noise to count, rounding and clamping at zero since a negative count would give the noise away
+func noisyCount(count int, epsilon float64) int {
+	noisy := int(math.Round(float64(count) + laplaceNoise(epsilon)))
+	if noisy < 0 {
+		return 0
+	}
+	return noisy
+}
+
+// The countNoiser struct noises the counts of one report, reusing the previous report's value of every count that hasn't changed
+type countNoiser struct {
+	epsilon  float64
+	previous map[string]noisedValue
+	drawn    map[string]noisedValue
+}
+
+// The noise function returns the noised value of the count called name
+func (noiser *countNoiser) noise(name string, exact int) int {
+	value, ok := noiser.previous[name]
+	if !ok || value.exact != exact || value.epsilon != noiser.epsilon {
+		value = noisedValue{exact: exact, epsilon: noiser.epsilon, noisy: noisyCount(exact, noiser.epsilon)}
+	}
+	noiser.drawn[name] = value
+	return value.noisy
+}
+
+/*
+	The noisedStats function returns report with every visitor-dependent count noised, rebuilt at most once per refresh period
+	The budget is split across every count the report publishes (basic composition), and a count that hasn't changed keeps its noised value
+	Latency means and percentiles are suppressed, they aren't counts and a single slow request moves them by an unbounded amount
+	Costs are recomputed from the noised call counts so they don't leak the true ones, configured values (budget, capacity) are left alone
+*/
+func noisedStats(build func() statsReport, settings statsSettings, now time.Time) statsReport {
+	refresh := defaultNoiseRefresh
+	if settings.NoiseRefreshSeconds > 0 {
+		refresh = time.Duration(settings.NoiseRefreshSeconds) * time.Second
+	}
+
+	noisyStatsMutex.Lock()
+	defer noisyStatsMutex.Unlock()
+	if noisyStats != nil && now.Sub(noisyStats.Noise.DrawnAt) < refresh {
+		return *noisyStats
+	}
+
+	report := build()
+	// upstream_calls_today, the five cache counts, and one per provider, latency group and SLO
+	counts := 6 + len(report.Providers) + len(report.Latency.Countries) + len(report.Latency.Continents) + len(report.SLOs)
+	noiser := &countNoiser{epsilon: settings.NoiseEpsilon / float64(counts), previous: noisyValues, drawn: map[string]noisedValue{}}
+
+	report.UpstreamCallsToday = noiser.noise("upstream_calls_today", report.UpstreamCallsToday)
+	calls := map[string]int{}
+	for provider, cost := range report.Providers {
+		calls[provider] = noiser.noise("providers."+provider, cost.CallsThisMonth)
+	}
+	report.Providers = estimateCosts(calls, now)
+
+	cache := &report.Cache
+	cache.Entries = noiser.noise("cache.entries", cache.Entries)
+	cache.EstimatedBytes = int64(cache.Entries) * cache.AverageEntrySize
+	cache.Hits = int64(noiser.noise("cache.hits", int(cache.Hits)))
+	cache.Misses = int64(noiser.noise("cache.misses", int(cache.Misses)))
+	cache.Evictions = int64(noiser.noise("cache.evictions", int(cache.Evictions)))
+	cache.Expirations = int64(noiser.noise("cache.expirations", int(cache.Expirations)))
+
+	for section, groups := range map[string]map[string]latencySummary{"countries": report.Latency.Countries, "continents": report.Latency.Continents} {
+		for group, summary := range groups {
+			groups[group] = latencySummary{Count: noiser.noise("latency."+section+"."+group, summary.Count)}
+		}
+	}
+
+	for provider, status := range report.SLOs {
+		status.Calls = noiser.noise("slos."+provider, status.Calls)
+		report.SLOs[provider] = status
+	}
+
+	noisyValues = noiser.drawn
+	report.Noise = &noiseInfo{
+		Mechanism:       "laplace",
+		Epsilon:         settings.NoiseEpsilon,
+		Counts:          counts,
+		EpsilonPerCount: noiser.epsilon,
+		Suppressed:      []string{"latency mean_ms, p50_ms, p90_ms and p99_ms"},
+		DrawnAt:         now,
+	}
+	noisyStats = &report
+	return report
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The events a notification connector can be sent
+const (
+	eventExternalIPChange = "external_ip_change"
+	eventProviderOutage   = "provider_outage"
+	eventProviderRecovery = "provider_recovery"
+	eventQuotaExhausted   = "quota_exhausted"
+	eventSLOBurn          = "slo_burn"
+)
+
+const (
+	// defaultOutageAfter applies when notifications.outage_after isn't configured
+	defaultOutageAfter = 3
+	// notificationTimeout bounds a single webhook call
+	notificationTimeout = 10 * time.Second
+	// notificationQueueLength bounds the notifications waiting to be sent, more than that are dropped and logged
+	notificationQueueLength = 100
+)
+
+// defaultMessages is the text of each event unless a connector's templates say otherwise, rendered against a notification
+var defaultMessages = map[string]string{
+	eventExternalIPChange: "The external IP address of {{.Instance}} changed from {{.Previous}} to {{.IP}}",
+	eventProviderOutage:   "{{.Provider}} is failing on {{.Instance}}, {{.Failures}} calls in a row: {{.Error}}",
+	eventProviderRecovery: "{{.Provider}} is answering {{.Instance}} again after {{.Failures}} failed calls",
+	eventQuotaExhausted:   "{{.Instance}} has spent its daily upstream lookup limit of {{.Limit}}, lookups fail until {{.Resets}}",
+	eventSLOBurn:          "{{.Provider}} is burning its {{.SLI}} error budget at {{.BurnRate}}x on {{.Instance}}, {{.Budget}} of it is left",
+}
+
+/*
+	The notificationSettings struct sends chat messages when something an operator should know about happens, see defaultMessages for the events
+	OutageAfter is how many calls in a row must fail before a provider counts as out, 3 by default
+*/
+type notificationSettings struct {
+	Connectors  []notifierSettings `json:"connectors"`
+	OutageAfter int                `json:"outage_after"`
+}
+
+/*
+	The notifierSettings struct is one incoming webhook, Kind is "slack" or "teams"
+	Events lists the events it is sent (every event by default), Templates replaces the text of an event with a text/template of its own
+*/
+type notifierSettings struct {
+	Name      string            `json:"name"`
+	Kind      string            `json:"kind"`
+	URL       string            `json:"url"`
+	Events    []string          `json:"events"`
+	Templates map[string]string `json:"templates"`
+}
+
+// The notification struct is an event as the message templates see it, only the fields the event is about are set
+type notification struct {
+	Event    string
+	Instance string
+	Time     string
+	IP       string
+	Previous string
+	Provider string
+	Error    string
+	Failures int
+	Limit    int
+	Resets   string
+	SLI      string
+	BurnRate float64
+	Budget   float64
+}
+
+// The notifier struct is a webhook with the parsed text of every event it is sent
+type notifier struct {
+	settings notifierSettings
+	messages map[string]*template.Template
+}
+
+// The notificationSender struct sends queued notifications one at a time, so a slow webhook never holds up whatever raised the event
+type notificationSender struct {
+	notifiers []*notifier
+	queue     chan notification
+	instance  string
+}
+
+// notifications is built in main() when notification connectors are configured, nil otherwise
+var notifications *notificationSender
+
+// The newNotificationSender function validates settings and parses every connector's templates, nil when no connectors are configured
+func newNotificationSender(settings notificationSettings) (*notificationSender, error) {
+	if len(settings.Connectors) == 0 {
+		return nil, nil
+	}
+	if settings.OutageAfter < 0 {
+		return nil, fmt.Errorf("notifications: outage_after can't be negative")
+	}
+	sender := &notificationSender{queue: make(chan notification, notificationQueueLength)}
+	sender.instance, _ = os.Hostname()
+	names := map[string]bool{}
+	for _, connector := range settings.Connectors {
+		if connector.Name == "" || names[connector.Name] {
+			return nil, fmt.Errorf("notifications: connector name %q is empty or already taken", connector.Name)
+		}
+		names[connector.Name] = true
+		if connector.Kind != "slack" && connector.Kind != "teams" {
+			return nil, fmt.Errorf("notifications: connector %q: kind must be slack or teams", connector.Name)
+		}
+		if !strings.HasPrefix(connector.URL, "https://") && !strings.HasPrefix(connector.URL, "http://") {
+			return nil, fmt.Errorf("notifications: connector %q: url must be an http or https URL", connector.Name)
+		}
+		events := connector.Events
+		if len(events) == 0 {
+			for event := range defaultMessages {
+				events = append(events, event)
+			}
+		}
+		for event := range connector.Templates {
+			if _, ok := defaultMessages[event]; !ok {
+				return nil, fmt.Errorf("notifications: connector %q: there is no event %q to template", connector.Name, event)
+			}
+		}
+
+		parsed := &notifier{settings: connector, messages: map[string]*template.Template{}}
+		for _, event := range events {
+			source, ok := defaultMessages[event]
+			if !ok {
+				return nil, fmt.Errorf("notifications: connector %q: unknown event %q", connector.Name, event)
+			}
+			if custom := connector.Templates[event]; custom != "" {
+				source = custom
+			}
+			message, err := template.New(event).Option("missingkey=error").Parse(source)
+			if err != nil {
+				return nil, fmt.Errorf("notifications: connector %q: %w", connector.Name, err)
+			}
+			parsed.messages[event] = message
+		}
+		sender.notifiers = append(sender.notifiers, parsed)
+	}
+	return sender, nil
+}
+
+// The notify function queues event for every connector that is sent it, it never blocks and does nothing when notifications are off
+func notify(event notification) {
+	if notifications == nil {
+		return
+	}
+	event.Instance = notifications.instance
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+	select {
+	case notifications.queue <- event:
+	default:
+		log.Printf("notifications: the queue is full, dropping a %s notification", event.Event)
+	}
+}
+
+// The run function sends queued notifications until stop is closed
+func (sender *notificationSender) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event := <-sender.queue:
+			for _, connector := range sender.notifiers {
+				if message, ok := connector.messages[event.Event]; ok {
+					if err := connector.send(message, event); err != nil {
+						log.Printf("notifications: %s: sending %s: %v", connector.settings.Name, event.Event, err)
+					}
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The send function renders message for event and posts it to the webhook in the shape its kind expects
+func (connector *notifier) send(message *template.Template, event notification) error {
+	var text strings.Builder
+	if err := message.Execute(&text, event); err != nil {
+		return err
+	}
+	var payload interface{} = map[string]string{"text": text.String()}
+	if connector.settings.Kind == "teams" {
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  strings.ReplaceAll(event.Event, "_", " "),
+			"text":     text.String(),
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	response, err := egressClient(notificationTimeout).Post(connector.settings.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("the webhook answered %s", response.Status)
+	}
+	return nil
+}
+
+// The providerHealth struct counts each provider's failed calls in a row, to notify once when it goes out and once when it comes back
+type providerHealth struct {
+	mutex    sync.Mutex
+	failures map[string]int
+}
+
+var providerOutages = &providerHealth{failures: map[string]int{}}
+
+// The record function counts the outcome of a call to provider, err being nil for a call that got an answer
+func (health *providerHealth) record(provider string, err error) {
+	threshold := outageThreshold()
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	failures := health.failures[provider]
+	if err == nil {
+		if failures >= threshold {
+			notify(notification{Event: eventProviderRecovery, Provider: provider, Failures: failures})
+		}
+		delete(health.failures, provider)
+		return
+	}
+	health.failures[provider] = failures + 1
+	if failures+1 == threshold {
+		notify(notification{Event: eventProviderOutage, Provider: provider, Failures: threshold, Error: err.Error()})
+	}
+}
+
+// The outageThreshold function returns how many calls in a row must fail before a provider counts as out
+func outageThreshold() int {
+	if config.Notifications.OutageAfter > 0 {
+		return config.Notifications.OutageAfter
+	}
+	return defaultOutageAfter
+}
+
+// The out function reports whether provider has failed at least outageThreshold() calls in a row
+func (health *providerHealth) out(provider string) bool {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return health.failures[provider] >= outageThreshold()
+}
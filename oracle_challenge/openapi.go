@@ -0,0 +1,261 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	The routeDoc struct documents one route for /openapi.json, keyed in routeDocs by the route's feature and pattern
+	Path is the OpenAPI path when it isn't the pattern itself, its {parameters} become required path parameters
+	Methods are GET when not set, Query maps each query parameter to its description
+*/
+type routeDoc struct {
+	Summary string
+	Path    string
+	Methods []string
+	Query   map[string]string
+}
+
+// Query parameters shared by several routes
+var (
+	ipQuery     = map[string]string{"ip": "The address to look up, the client's own when left out"}
+	fieldsQuery = map[string]string{"fields": "Comma separated fields to answer with, e.g. ip,city,country"}
+	pageQuery   = map[string]string{"cursor": "The next_cursor of the previous page", "limit": "How many items to answer with"}
+)
+
+// The mergeQuery function combines query parameter descriptions into one map
+func mergeQuery(queries ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, query := range queries {
+		for name, description := range query {
+			merged[name] = description
+		}
+	}
+	return merged
+}
+
+/*
+	routeDocs describes the routes of routes() for /openapi.json, the key being the route's feature, a space and its pattern
+	A route without an entry is still listed, by its pattern and feature, so the document never leaves out something that is served
+*/
+var routeDocs = map[string]routeDoc{
+	" /ip": {Summary: "The client's IP address and geolocation, in the format the Accept header or ?format= asks for",
+		Query: mergeQuery(ipQuery, fieldsQuery, map[string]string{"format": "json, xml, yaml, csv, protobuf, msgpack or html", "template": "A named output template"})},
+	" /ip/":                  {Summary: "The IP address and geolocation of any address", Path: "/ip/{ip}", Query: mergeQuery(fieldsQuery, map[string]string{"format": "json, xml, yaml, csv, protobuf, msgpack or html"})},
+	" /ip/json":              {Summary: "The client's IP address and geolocation as JSON", Query: mergeQuery(ipQuery, fieldsQuery)},
+	" /ip/raw":               {Summary: "Nothing but the client's IP address"},
+	" /healthz":              {Summary: "Whether this instance should receive traffic, 503 in maintenance mode"},
+	" /readyz":               {Summary: "Whether this instance can answer lookups and the degradation state they are in"},
+	"version /version":       {Summary: "The build of this instance"},
+	"headers /headers":       {Summary: "Every header of the request as it arrived", Query: map[string]string{"redact": "true hides the values of credential headers"}},
+	"ua /ua":                 {Summary: "The client's User-Agent broken down"},
+	"tls /tls":               {Summary: "What the client's TLS connection negotiated", Query: map[string]string{"fingerprint": "true adds the JA3 fingerprint"}},
+	"connection /connection": {Summary: "The remote port, protocol, proxy headers and keep-alive of the request's connection"},
+	"cidr /cidr/contains":    {Summary: "Whether an address falls inside each of the given ranges", Query: mergeQuery(ipQuery, map[string]string{"cidr": "A range to check, repeated or comma separated for several"})},
+	"cidr /cidr/info/":       {Summary: "Subnet calculator for an IPv4 or IPv6 prefix, e.g. 192.0.2.0/24", Path: "/cidr/info/{prefix}"},
+	"classify /classify":     {Summary: "Which special-purpose range the client's address is in"},
+	"classify /classify/":    {Summary: "Which special-purpose range the address is in", Path: "/classify/{ip}"},
+	"enrich /enrich":         {Summary: "Every enrichment block for the client's address"},
+	"connect /" + connectService + "/": {Summary: "The lookup RPC over the Connect protocol's JSON encoding", Path: "/" + connectService + "/Lookup", Methods: []string{http.MethodGet, http.MethodPost},
+		Query: map[string]string{"encoding": "json, for GET", "message": "The request message, for GET"}},
+	"self /self":                         {Summary: "The host's own external IPv4 and IPv6 addresses"},
+	"self_history /self/history":         {Summary: "The recorded changes of the host's external IP", Query: pageQuery},
+	"self_consistency /self/consistency": {Summary: "The latest consistency check of the host's external IP and the recent alerts"},
+	"aggregate /aggregate":               {Summary: "Counts per country and ASN of a posted list of addresses", Methods: []string{http.MethodPost}},
+	"batch /lookup":                      {Summary: "Geolocates a posted JSON array of addresses", Methods: []string{http.MethodPost}, Query: fieldsQuery},
+	"share /share":                       {Summary: "Looks up an address and answers with a link to a read-only view of the result", Methods: []string{http.MethodPost}, Query: mergeQuery(ipQuery, fieldsQuery, map[string]string{"ttl": "Seconds the link lives for"})},
+	"share /shared/":                     {Summary: "The read-only view of a shared result", Path: "/shared/{token}", Query: map[string]string{"format": "json instead of HTML"}},
+	"rdns /rdns/":                        {Summary: "The PTR names of the address and whether they are forward-confirmed", Path: "/rdns/{ip}"},
+	"dnsbl /dnsbl/":                      {Summary: "Whether the address is on each configured DNS blocklist", Path: "/dnsbl/{ip}"},
+	"asn /asn/":                          {Summary: "The autonomous system announcing the address, /asn/{n}/prefixes as well with the bgp feature on", Path: "/asn/{ip}"},
+	"bgp /asn/":                          {Summary: "Every prefix the BGP dump shows originated by the AS", Path: "/asn/{n}/prefixes"},
+	"domain /domain/":                    {Summary: "The addresses a domain resolves to, each geolocated", Path: "/domain/{name}", Query: mergeQuery(fieldsQuery, map[string]string{"include": "registration, certificate or both, comma separated"})},
+	"whois /whois/":                      {Summary: "The registration data of the address' network along with its geolocation", Path: "/whois/{ip}", Query: fieldsQuery},
+	"resolve /resolve/":                  {Summary: "The A and AAAA records of a name, each geolocated", Path: "/resolve/{hostname}", Query: fieldsQuery},
+	"distance /distance":                 {Summary: "The great-circle distance between two addresses", Query: map[string]string{"from": "The first address, the client's own when left out", "to": "The second address"}},
+	"geofence /geofence":                 {Summary: "Whether the address resolves to one of the allowed countries", Query: mergeQuery(ipQuery, map[string]string{"countries": "Comma separated ISO 3166 country codes"})},
+	"time /time":                         {Summary: "The current time in the timezone of the client's address"},
+	"time /time/":                        {Summary: "The current time in the timezone of the address", Path: "/time/{ip}"},
+	"pool /pool/register":                {Summary: "Another instance joining the pool", Methods: []string{http.MethodPost}},
+	"pool /pool/members":                 {Summary: "Every member of the pool and how its last probe went"},
+	"bgp /origin/":                       {Summary: "The most specific prefix announcing the address and its origin ASNs", Path: "/origin/{ip}"},
+	"stats /stats":                       {Summary: "Usage counters, costs, cache size, latency and SLOs", Query: pageQuery},
+	"metrics /metrics":                   {Summary: "Metrics in the Prometheus text exposition format"},
+	"checkip /checkip":                   {Summary: "The client's address as checkip.dyndns.com answers it"},
+	"compat /":                           {Summary: "Nothing but the client's IP address, as icanhazip.com answers it"},
+	"compat /all.json":                   {Summary: "The client's details in the shape of ifconfig.me/all.json"},
+	"ipinfo /":                           {Summary: "The client's details in the shape of the ipinfo.io API, /{ip}, /{ip}/json and /{ip}/{field} as well"},
+	"email_headers /email/headers":       {Summary: "The likely sender location of a posted block of email headers", Methods: []string{http.MethodPost}},
+	"proxy_check /proxy/check":           {Summary: "Whether the client's connection looks like it passes through a proxy"},
+	"url_analysis /url/analyze":          {Summary: "Every hop of a URL's redirect chain, geolocated", Query: map[string]string{"url": "The URL to follow"}},
+	"admin /admin/maintenance":           {Summary: "Inspect, enable or disable maintenance mode", Methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}},
+	"admin /debug/config":                {Summary: "The effective config with secrets redacted, the feature flags and what loaded"},
+	"admin /admin/bench":                 {Summary: "A short load test of this instance", Query: map[string]string{"path": "The path to load", "n": "Total requests", "c": "Concurrent workers", "ips": "random, pool or none", "pool": "Distinct client addresses for ips=pool"}},
+	"admin /admin/feeds":                 {Summary: "The status and hit count of every threat feed"},
+	"admin /admin/forget":                {Summary: "Deletes everything stored about an address", Methods: []string{http.MethodPost}, Query: map[string]string{"ip": "The address to forget"}},
+	"admin /admin/export":                {Summary: "Everything stored about an address or result hash", Query: map[string]string{"ip": "The address", "hash": "The result hash", "tenant": "Only this tenant's records"}},
+	"admin /admin/backup":                {Summary: "An online backup of the persisted files as a gzipped tarball"},
+	"ip_history /history/ip":             {Summary: "Where an address was geolocated at a point in time", Query: map[string]string{"ip": "The address", "at": "RFC 3339 timestamp, now when left out", "as_of": "YYYY-MM-DD to answer from a dataset snapshot instead"}},
+	"tenant_export /tenant/export":       {Summary: "Everything the caller's tenant stored about an address or result hash", Query: map[string]string{"ip": "The address", "hash": "The result hash"}},
+	"admin /self/interfaces":             {Summary: "The host's interfaces, local addresses and default routes"},
+	"adapters /shaped":                   {Summary: "The client's geolocation in the shape assigned to the API key"},
+	"openapi /openapi.json":              {Summary: "This document"},
+	"openapi /docs":                      {Summary: "An API explorer for this document"},
+}
+
+// The OpenAPI document /openapi.json serves, only what the generated clients need is modelled
+type (
+	openAPIDocument struct {
+		OpenAPI    string                                 `json:"openapi"`
+		Info       openAPIInfo                            `json:"info"`
+		Paths      map[string]map[string]openAPIOperation `json:"paths"`
+		Components openAPIComponents                      `json:"components"`
+	}
+	openAPIInfo struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	}
+	openAPIOperation struct {
+		OperationID string                     `json:"operationId"`
+		Summary     string                     `json:"summary"`
+		Tags        []string                   `json:"tags"`
+		Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+		Security    []map[string][]string      `json:"security,omitempty"`
+		Responses   map[string]openAPIResponse `json:"responses"`
+	}
+	openAPIParameter struct {
+		Name        string            `json:"name"`
+		In          string            `json:"in"`
+		Required    bool              `json:"required"`
+		Description string            `json:"description,omitempty"`
+		Schema      map[string]string `json:"schema"`
+	}
+	openAPIResponse struct {
+		Description string `json:"description"`
+	}
+	openAPIComponents struct {
+		SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+	}
+	openAPISecurityScheme struct {
+		Type        string `json:"type"`
+		In          string `json:"in"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+)
+
+// pathParameter finds the {parameters} of an OpenAPI path
+var pathParameter = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// operationIDSeparators are the characters of a method and path that become underscores in an operationId
+var operationIDSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+/*
+	The buildOpenAPI function describes every route registerRoutes() serves on listener, with the key each one requires
+	The paths come from routes() itself, so a route can't be served without being documented, routeDocs only adds the prose
+*/
+func buildOpenAPI(listener listenerSettings) openAPIDocument {
+	document := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "oracle", Version: version},
+		Paths:   map[string]map[string]openAPIOperation{},
+		Components: openAPIComponents{SecuritySchemes: map[string]openAPISecurityScheme{
+			"apiKey":   {Type: "apiKey", In: "header", Name: "X-API-Key", Description: "One of api_keys, also accepted as Authorization: Bearer <key>"},
+			"adminKey": {Type: "apiKey", In: "header", Name: "X-API-Key", Description: "One of admin_keys, also accepted as Authorization: Bearer <key>"},
+		}},
+	}
+	for _, endpoint := range routes(listener) {
+		if !listener.featureEnabled(endpoint.Feature) {
+			continue
+		}
+		doc, ok := routeDocs[endpoint.Feature+" "+endpoint.Pattern]
+		if !ok {
+			doc = routeDoc{Summary: endpoint.Pattern}
+		}
+		path := doc.Path
+		if path == "" {
+			path = endpoint.Pattern
+		}
+		methods := doc.Methods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet}
+		}
+		tag := endpoint.Feature
+		if tag == "" {
+			tag = "core"
+		}
+
+		var parameters []openAPIParameter
+		for _, match := range pathParameter.FindAllStringSubmatch(path, -1) {
+			parameters = append(parameters, openAPIParameter{Name: match[1], In: "path", Required: true, Schema: map[string]string{"type": "string"}})
+		}
+		var names []string
+		for name := range doc.Query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			parameters = append(parameters, openAPIParameter{Name: name, In: "query", Description: doc.Query[name], Schema: map[string]string{"type": "string"}})
+		}
+
+		// The same key registerRoutes() puts the route behind
+		auth := endpoint.Auth
+		if auth == authNone && listener.requireAPIKey && endpoint.Pattern != "/healthz" && endpoint.Pattern != "/readyz" {
+			auth = authAPIKey
+		}
+		responses := map[string]openAPIResponse{"200": {Description: "OK"}}
+		var security []map[string][]string
+		switch auth {
+		case authAPIKey:
+			security = []map[string][]string{{"apiKey": {}}}
+			responses["401"] = openAPIResponse{Description: "The API key is missing or not accepted"}
+		case authAdmin:
+			security = []map[string][]string{{"adminKey": {}}}
+			responses["401"] = openAPIResponse{Description: "The admin key is missing or not accepted"}
+		}
+
+		if document.Paths[path] == nil {
+			document.Paths[path] = map[string]openAPIOperation{}
+		}
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			document.Paths[path][method] = openAPIOperation{
+				OperationID: strings.Trim(operationIDSeparators.ReplaceAllString(method+path, "_"), "_"),
+				Summary:     doc.Summary,
+				Tags:        []string{tag},
+				Parameters:  parameters,
+				Security:    security,
+				Responses:   responses,
+			}
+		}
+	}
+	return document
+}
+
+// The openAPIHandler function serves /openapi.json for listener, built on every request so it follows the features of the listener it is asked on
+func openAPIHandler(listener listenerSettings) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, buildOpenAPI(listener))
+	}
+}
+
+/*
+	docsPage is the page /docs serves, an API explorer for /openapi.json that lists every operation and can send it
+	It is built into the binary with its script and styles inline, so it works offline and loads nothing from anywhere else
+*/
+//go:embed docs/index.html
+var docsPage []byte
+
+// docsPolicy is the Content-Security-Policy of /docs, the page's own inline script and styles and requests back to this origin
+const docsPolicy = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; img-src 'self'"
+
+// The handleDocs function serves /docs, the API explorer for /openapi.json
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", docsPolicy)
+	w.Write(docsPage)
+}
@@ -27,21 +27,39 @@ https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// ipinfoProvider names the ipinfo API wherever calls are counted or priced per provider
+const ipinfoProvider = "ipinfo"
+
 // The geolocation struct provides the scaffolding necessary for the JSON response received by ipinfo API
 type geolocation struct {
 	IP       string
+	Hostname string
 	Country  string
 	Region   string
 	Timezone string
 	Postal   string
 	City     string
+	Loc      string
+	Org      string
+	// Sources names the provider of each field when several were merged, see providerMerger.lookup()
+	Sources string `json:"-"`
+
+	// Latitude and Longitude are Loc as numbers, filled in by lookupFor() and only meaningful when Located is set
+	Latitude  float64 `json:"-"`
+	Longitude float64 `json:"-"`
+	Located   bool    `json:"-"`
 }
 
 /*
@@ -49,46 +67,422 @@ type geolocation struct {
 	When a request is served, data is pulled from the client to determine it's IP address and geolocation
 	The IP address and geo location are then returned back to the client via fmt.FprintF (easily visible through a web browser)
 	Any errors encountered while processing the IP address / geo location, bubble up to the surface and are displayed for the client
+	Every other endpoint is listed in routes(), non-core endpoints are switched on and off through the features config
+	Several listeners can be configured, each with its own features and middleware, see listenerSettings
+	The listen address, API keys and feature flags are read from the file given by -config, see loadConfig()
+	"oracle bench" load tests a running instance instead of starting the server, see runBenchCommand()
+	When unix_socket is configured lookups are also answered over a line protocol on that socket, see serveUnixSocket()
+	"oracle service" generates or installs a systemd unit, launchd plist or Windows service, see runServiceCommand()
+	Started by the Windows service control manager the process answers it, stopping as it does on SIGTERM, see startServiceDispatcher()
+	"oracle migrate" moves the persisted files to a schema version, which also happens to the latest one on every start, see migrate()
+	"oracle backup" and "oracle restore" save the persisted files to a tarball or S3 and put them back, see runBackupCommand()
+	"oracle config export" bundles the effective config for "oracle config import" on another instance, see runConfigCommand()
+	On SIGINT/SIGTERM in-flight requests are given time to finish and quota counters are saved before exiting
+	On SIGHUP the binary on disk is started with the listening socket handed over and this process exits once it is serving, see upgrade()
 */
 func main() {
-	http.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
-		ip, err := determineIP(r)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBenchCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		os.Exit(runServiceCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(runBackupCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestoreCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+	startServiceDispatcher()
+	defer reportServiceStopped()
+	if err := loadConfig(*configPath); err != nil {
+		log.Fatal(err)
+	}
+	guard, err := newOutboundGuard(config.Outbound)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outbound = guard
+	if egress, err = newEgressSource(config.Outbound); err != nil {
+		log.Fatal(err)
+	}
+	if config.DataDir != "" {
+		if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if storageCipher, err = loadStorageCipher(config.Encryption); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrate(currentPersistedPaths(), latestSchema(), false, logWriter{}); err != nil {
+		log.Fatal(err)
+	}
+	quotas = newQuotaTracker(config.Quota)
+	err = quotas.load()
+	recordComponent("quota_state", "database", config.Quota.StateFile, err)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recordComponent(ipinfoProvider, "provider", "http://ipinfo.io", nil)
+	stopBackground := make(chan struct{})
+	go quotas.persistEvery(30*time.Second, stopBackground)
+	maintenanceMode.Store(config.Maintenance.Enabled)
+	geoCache = newLocationCache(config.Cache)
+	if adapters, err = compileAdapters(config.Adapters); err != nil {
+		log.Fatal(err)
+	}
+	if customOutput, err = compileOutputTemplate(config.Output); err != nil {
+		log.Fatal(err)
+	}
+	if namedOutputs, err = compileNamedOutputs(config.OutputTemplates); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkListeners(configuredListeners()); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkSelfDiscovery(config.SelfDiscovery); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkBogonStatus(config.BogonStatus); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkRedactionPolicies(config.RedactionPolicies); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkTenants(config.Tenants); err != nil {
+		log.Fatal(err)
+	}
+	if openProxies, err = loadProxySettings(config.ProxyCheck); err != nil {
+		log.Fatal(err)
+	}
+	if trustedRelays, err = loadEmailHeaderSettings(config.EmailHeaders); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkEnrichmentSettings(config.Enrichment); err != nil {
+		log.Fatal(err)
+	}
+	if feeds, err = loadFeeds(config.Enrichment); err != nil {
+		log.Fatal(err)
+	}
+	watchFeeds(feeds, stopBackground)
+	if decisionPolicy, err = loadDecisionPolicy(config.Decision); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkDNSBLSettings(config.DNSBL); err != nil {
+		log.Fatal(err)
+	}
+	if notifications, err = newNotificationSender(config.Notifications); err != nil {
+		log.Fatal(err)
+	}
+	if notifications != nil {
+		go notifications.run(stopBackground)
+	}
+	if err := validateDegradation(config.Degradation); err != nil {
+		log.Fatal(err)
+	}
+	if tickets, err = newTicketFiler(config.Ticketing); err != nil {
+		log.Fatal(err)
+	}
+	if tickets != nil {
+		go tickets.run(stopBackground)
+	}
+	if featureEnabled("share") {
+		if err := loadShareSecret(config.Share); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if featureEnabled("self_history") {
+		history, err = loadSelfHistory()
+		recordComponent("self_history", "database", history.store.path, err)
 		if err != nil {
-			fmt.Fprintf(w, err.Error())
-		} else {
-			fmt.Fprintf(w, "Current IP Address: "+ip)
-			locationData, err := determineGeoLocation(ip)
+			log.Fatal(err)
+		}
+		interval := 5 * time.Minute
+		if config.SelfHistory.IntervalSeconds > 0 {
+			interval = time.Duration(config.SelfHistory.IntervalSeconds) * time.Second
+		}
+		go history.watch(interval, stopBackground)
+	}
+	if config.Audit.Enabled {
+		if config.DataDir == "" {
+			log.Fatal("audit: the audit log is kept in data_dir, which isn't configured")
+		}
+		auditLog = newJSONLStore("audit.jsonl")
+		recordComponent("audit_log", "database", auditLog.path, nil)
+	}
+	go purgeEvery(stopBackground)
+
+	providers, err := configuredProviders(config.Providers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, provider := range config.Providers {
+		recordComponent(provider.Name, "provider", provider.URL, nil)
+	}
+	if slos, err = newSLOTracker(config.SLOs, providers); err != nil {
+		log.Fatal(err)
+	}
+	if len(config.SLOs) > 0 {
+		go slos.watch(stopBackground)
+	}
+	if sampler, err = newProviderSampler(config.Sampling, providers); err != nil {
+		log.Fatal(err)
+	}
+	if merger, err = newProviderMerger(config.Merge, providers); err != nil {
+		log.Fatal(err)
+	}
+	if snapshots, err = loadSnapshots(config.Snapshots); err != nil {
+		log.Fatal(err)
+	}
+	if asnDatabase, err = openASNDatabase(config.ASN); err != nil {
+		log.Fatal(err)
+	}
+	if featureEnabled("ipinfo") {
+		if ipinfoDatabase, err = openIPInfoDatabase(config.IPInfo); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if featureEnabled("self_consistency") {
+		consistency = &consistencyChecker{providers: providers}
+		interval := defaultConsistencyInterval
+		if config.SelfConsistency.IntervalSeconds > 0 {
+			interval = time.Duration(config.SelfConsistency.IntervalSeconds) * time.Second
+		}
+		go consistency.watch(interval, stopBackground)
+	}
+	if featureEnabled("bgp") {
+		bgp, err = newBGPTable(config.BGP)
+		recordComponent("bgp", "database", config.BGP.URL, err)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go bgp.dataset.watch(stopBackground)
+		if config.RPKI.URL != "" {
+			rpki, err = newRPKITable(config.RPKI)
+			recordComponent("rpki", "database", config.RPKI.URL, err)
 			if err != nil {
-				fmt.Fprintf(w, "\nError while attempting to get location data: "+err.Error())
-			} else {
-				fmt.Fprintf(w, "\n"+locationData)
+				log.Fatal(err)
 			}
+			go rpki.dataset.watch(stopBackground)
 		}
-	})
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	}
+	if config.PeeringDB.URL != "" {
+		peering, err = newPeeringDB(config.PeeringDB)
+		recordComponent("peeringdb", "database", config.PeeringDB.URL, err)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peering.watch(stopBackground)
+	}
+	if featureEnabled("pool") {
+		if pool, err = newInstancePool(config.Pool); err != nil {
+			log.Fatal(err)
+		}
+		err = pool.servePoolDNS(stopBackground)
+		recordComponent("pool_dns", "listener", config.Pool.DNSListen, err)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go pool.watch(stopBackground)
+	}
+	if config.UnixSocket != "" {
+		err := serveUnixSocket(config.UnixSocket, stopBackground)
+		recordComponent("unix_socket", "listener", config.UnixSocket, err)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	listeners := configuredListeners()
+	var servers []*http.Server
+	var addresses []string
+	for _, listener := range listeners {
+		handler, err := listener.handler()
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig, err := listener.tlsConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		servers = append(servers, &http.Server{
+			Handler:     activity.track(handler),
+			TLSConfig:   tlsConfig,
+			ConnContext: rememberClientHello,
+			ConnState: func(connection net.Conn, state http.ConnState) {
+				activity.connState(connection, state)
+				forgetClientHello(connection, state)
+			},
+		})
+		addresses = append(addresses, listener.Address)
+	}
+	sockets, err := listenAll(addresses)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownComplete := make(chan struct{})
+	upgraded := false
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, upgradeSignals...)...)
+		forwardServiceStop(signals)
+		for received := range signals {
+			if received == os.Interrupt || received == syscall.SIGTERM {
+				break
+			}
+			// Counters are saved before the new process loads them, and this process stops persisting so it can't overwrite the new one's
+			if err := quotas.save(); err != nil {
+				log.Printf("saving quota state: %v", err)
+			}
+			if err := upgrade(sockets); err != nil {
+				log.Printf("upgrade failed, still serving: %v", err)
+				continue
+			}
+			log.Printf("upgrade: the new process is serving, shutting down")
+			upgraded = true
+			close(stopBackground)
+			break
+		}
+		activity.drain(servers)
+		close(shutdownComplete)
+	}()
+
+	notifyReady()
+	reportServiceRunning()
+	served := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, socket net.Listener) {
+			if server.TLSConfig != nil {
+				served <- server.ServeTLS(helloListener{socket}, "", "")
+				return
+			}
+			served <- server.Serve(socket)
+		}(server, sockets[i])
+	}
+	for range servers {
+		if err := <-served; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-shutdownComplete
+	if upgraded {
+		return
+	}
+	close(stopBackground)
+	if err := quotas.save(); err != nil {
+		log.Printf("saving quota state: %v", err)
+	}
 }
 
 /*
-	The determineGeoLocation function takes an IP address and sends a request to the ipinfo API
-	When a successful response is received from the API the JSON array is decoded through use of buildGeolocation()
-	Location data is then concatenated and returned
+	The handleIP function serves /ip, the client's IP address followed by its geolocation, with the result's hash in the X-Result-Hash header
+	/ip/{address} and /ip?ip={address} serve any other address the same way
+	A configured output template takes over the formatting, see outputSettings
+	With ?fields= only the values of the selected fields are written, one per line in the order they were asked for
 */
-func determineGeoLocation(ip string) (string, error) {
+func handleIP(w http.ResponseWriter, r *http.Request) {
+	fields, err := requestedFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := targetIP(r)
+	if err != nil {
+		fmt.Fprint(w, err.Error())
+	} else if fields != nil {
+		writeFieldValues(w, r, ip, fields)
+	} else {
+		location, hit, err := lookupFor(r, ip)
+		setCacheStatus(w, hit)
+		if err == nil {
+			setResultHash(w, location)
+		}
+		fmt.Fprint(w, "Current IP Address: "+ip)
+		if err != nil {
+			fmt.Fprint(w, "\nError while attempting to get location data: "+err.Error())
+		} else {
+			fmt.Fprint(w, "\n"+formatLocation(location))
+		}
+	}
+}
 
-	url := "http://ipinfo.io/" + ip
+/*
+	The determineGeoLocation function takes an IP address and looks it up through lookupFor(), applying the redaction policy of request
+	Location data is then concatenated and returned
+*/
+func determineGeoLocation(request *http.Request, ip string) (string, error) {
 
-	response, err := getAPIData(url)
+	jsonResponse, _, err := lookupFor(request, ip)
 	if err != nil {
 		return "", err
 	}
 
-	jsonResponse, err := buildGeolocation(response)
+	return formatLocation(jsonResponse), nil
+}
+
+// The formatLocation function concatenates the location data shown by the plain text endpoints
+func formatLocation(location geolocation) string {
+	return "Country: " + location.Country + "\nState(region): " + location.Region + "\nCity: " + location.City + "\nZip: " + location.Postal + "\nTime Zone: " + location.Timezone
+}
+
+// The lookupGeolocation function takes an IP address and returns its geolocation, from the cache when possible
+func lookupGeolocation(ip string) (geolocation, error) {
+	location, _, err := lookupCached(ip)
+	return location, err
+}
+
+/*
+	The lookupCached function is lookupGeolocation() that also reports whether the answer came from the cache, every upstream lookup is logged along with the canonical hash of its result
+	Bogons are answered with a *bogonError without asking the provider, see writeBogon()
+*/
+func lookupCached(ip string) (geolocation, bool, error) {
+	return lookupCachedFor("", ip)
+}
+
+// The lookupCachedFor function is lookupCached() on behalf of tenant, whose name the audit log records against an upstream lookup
+func lookupCachedFor(tenant, ip string) (geolocation, bool, error) {
+	if err := checkBogon(ip); err != nil {
+		return geolocation{}, false, err
+	}
+	location, hit, fetched, err := degradation.lookup(ip)
+	if err != nil || !fetched {
+		return location, hit, err
+	}
+	if config.RDNS.FillHostname && location.Hostname == "" {
+		location.Hostname = ptrHostname(ip)
+	}
+	hash := locationHash(location)
+	log.Printf("lookup ip=%s hash=%s", ip, hash)
+	recordLookup(tenant, ip, hash, location)
+	sampler.sample(ip, location)
+	geoCache.put(ip, location)
+	return location, false, nil
+}
+
+/*
+	The fetchGeolocation function takes an IP address and sends a request to the ipinfo API
+	When a successful response is received from the API the JSON array is decoded through use of buildGeolocation()
+*/
+func fetchGeolocation(ip string) (geolocation, error) {
+
+	url := "http://ipinfo.io/" + ip
+
+	response, err := getAPIData(url)
 	if err != nil {
-		return "", err
+		return geolocation{}, err
 	}
-	locationData := "Country: " + jsonResponse.Country + "\nState(region): " + jsonResponse.Region + "\nCity: " + jsonResponse.City + "\nZip: " + jsonResponse.Postal + "\nTime Zone: " + jsonResponse.Timezone
 
-	return locationData, nil
+	return buildGeolocation(response)
 }
 
 /*
@@ -172,18 +566,10 @@ func determinePrivacy(ip net.IP) (bool, error) {
 	return false, nil
 }
 
-// The acquireExternalIP() function queries ipinfo.io API and acquires the returned IP address through use of getAPIData() and buildGeolocation()
+// The acquireExternalIP() function finds the host's external IP address through the configured self_discovery methods, see selfDiscoverySettings
 func acquireExternalIP() (string, error) {
-	url := "http://ipinfo.io/json"
-	response, err := getAPIData(url)
-	if err != nil {
-		return "", err
-	}
-	jsonResponse, err := buildGeolocation(response)
-	if err != nil {
-		return "", err
-	}
-	return jsonResponse.IP, nil
+	ip, _, err := discoverExternalIP("tcp")
+	return ip, err
 }
 
 /*
@@ -200,11 +586,21 @@ func buildGeolocation(response *http.Response) (geolocation, error) {
 	return jsonResponse, nil
 }
 
-// The getAPIData is a simple function that takes a url and returns the response of an http.Get
+// The getAPIData is a simple function that takes an ipinfo API url and returns the response of an http.Get, each call counts against the upstream daily limit
 func getAPIData(url string) (*http.Response, error) {
-	response, err := http.Get(url)
+	if err := quotas.allowUpstream(ipinfoProvider); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	response, err := egressClient(0).Get(url)
 	if err != nil {
+		recordProviderCall(ipinfoProvider, time.Since(started), err)
 		return response, err
 	}
+	if response.StatusCode >= http.StatusInternalServerError {
+		recordProviderCall(ipinfoProvider, time.Since(started), fmt.Errorf("%s answered %s", ipinfoProvider, response.Status))
+	} else {
+		recordProviderCall(ipinfoProvider, time.Since(started), nil)
+	}
 	return response, nil
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/*
+	The outboundSettings struct configures which destinations features fetching user-supplied URLs/hosts may reach
+	SourceAddresses (one per family) or SourceInterface picks the local address provider, dataset, discovery and probe connections
+	leave from, see egressSource
+*/
+type outboundSettings struct {
+	AllowedSchemes  []string `json:"allowed_schemes"`
+	AllowedPorts    []int    `json:"allowed_ports"`
+	SourceAddresses []string `json:"source_addresses"`
+	SourceInterface string   `json:"source_interface"`
+}
+
+/*
+	Ranges that are never a legitimate destination for a user-supplied URL, on top of the private ranges known to determinePrivacy()
+	Cloud metadata services live at 169.254.169.254 (link-local, already covered), 100.100.100.200 (CGNAT) and fd00:ec2::254 (ULA)
+*/
+var blockedOutboundCIDR = []string{
+	"0.0.0.0/8",          // "this" network
+	"100.64.0.0/10",      // RFC6598 CGNAT, includes the Alibaba Cloud metadata service
+	"192.0.0.0/24",       // IETF protocol assignments
+	"198.18.0.0/15",      // RFC2544 benchmarking
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved, includes broadcast
+	"::/128",             // IPv6 unspecified
+	"::1/128",            // IPv6 loopback
+	"64:ff9b::/96",       // NAT64, could be translated into any IPv4 range
+	"fc00::/7",           // IPv6 unique local, includes the AWS IPv6 metadata service
+	"fe80::/10",          // IPv6 link-local
+	"ff00::/8",           // IPv6 multicast
+	"2001:db8::/32",      // IPv6 documentation
+	"169.254.169.254/32", // cloud metadata, listed explicitly for readers of this table
+}
+
+// outbound is the guard shared by every feature that fetches user-supplied URLs/hosts, it is built in main() from config.Outbound
+var outbound *outboundGuard
+
+/*
+	The outboundGuard struct is the shared gatekeeper for every outbound request built from user input
+	Use checkURL before a request is made and newClient (or dialContext) to make it, so the address is re-checked at connect time
+*/
+type outboundGuard struct {
+	schemes map[string]bool
+	ports   map[int]bool
+	blocked []*net.IPNet
+}
+
+/*
+	The newOutboundGuard function builds an outboundGuard from the configured allowlists
+	When nothing is configured only http/https on their default ports are allowed
+*/
+func newOutboundGuard(settings outboundSettings) (*outboundGuard, error) {
+	guard := &outboundGuard{schemes: map[string]bool{}, ports: map[int]bool{}}
+
+	schemes := settings.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	for _, scheme := range schemes {
+		guard.schemes[scheme] = true
+	}
+
+	ports := settings.AllowedPorts
+	if len(ports) == 0 {
+		ports = []int{80, 443}
+	}
+	for _, port := range ports {
+		guard.ports[port] = true
+	}
+
+	for _, stringCIDR := range blockedOutboundCIDR {
+		_, networkRange, err := net.ParseCIDR(stringCIDR)
+		if err != nil {
+			return nil, err
+		}
+		guard.blocked = append(guard.blocked, networkRange)
+	}
+	return guard, nil
+}
+
+// The checkURL function enforces the scheme and port allowlists for target
+func (guard *outboundGuard) checkURL(target *url.URL) error {
+	if !guard.schemes[target.Scheme] {
+		return fmt.Errorf("URL scheme %q is not allowed", target.Scheme)
+	}
+	if target.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+
+	port := target.Port()
+	if port == "" {
+		switch target.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || !guard.ports[number] {
+		return fmt.Errorf("port %q is not allowed", port)
+	}
+	return nil
+}
+
+// 6to4 (RFC3056) and Teredo (RFC4380) addresses carry an IPv4 address that traffic to them is relayed to
+var (
+	sixToFourPrefix = &net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+	teredoPrefix    = &net.IPNet{IP: net.ParseIP("2001::"), Mask: net.CIDRMask(32, 128)}
+)
+
+/*
+	The embeddedIPv4 function returns the IPv4 addresses a 6to4 or Teredo address carries, nil for any other address
+	6to4 holds its address right after the prefix, Teredo its server's after the prefix and its client's inverted in the last 32 bits
+*/
+func embeddedIPv4(ip net.IP) []net.IP {
+	ip = ip.To16()
+	switch {
+	case ip == nil || ip.To4() != nil:
+		return nil
+	case sixToFourPrefix.Contains(ip):
+		return []net.IP{net.IPv4(ip[2], ip[3], ip[4], ip[5])}
+	case teredoPrefix.Contains(ip):
+		return []net.IP{net.IPv4(ip[4], ip[5], ip[6], ip[7]), net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15])}
+	}
+	return nil
+}
+
+/*
+	The checkIP function returns an error when ip is private (per determinePrivacy) or within one of the blocked ranges
+	IPv4-mapped IPv6 addresses are unwrapped first so "::ffff:127.0.0.1" can't slip past the IPv4 checks,
+	and the IPv4 addresses inside 6to4 and Teredo addresses are checked the same way
+*/
+func (guard *outboundGuard) checkIP(ip net.IP) error {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	for _, embedded := range embeddedIPv4(ip) {
+		if err := guard.checkIP(embedded); err != nil {
+			return fmt.Errorf("%s embeds %s: %w", ip, embedded, err)
+		}
+	}
+
+	isInPrivateSubnet, err := determinePrivacy(ip)
+	if err != nil {
+		return err
+	}
+	if isInPrivateSubnet {
+		return fmt.Errorf("%s is a private address", ip)
+	}
+	for _, networkRange := range guard.blocked {
+		if networkRange.Contains(ip) {
+			return fmt.Errorf("%s is within the blocked range %s", ip, networkRange)
+		}
+	}
+	return nil
+}
+
+/*
+	The resolve function looks up host and vets every address it resolves to
+	Checking all of them (not just the first) stops a hostname from mixing a public and an internal record
+*/
+func (guard *outboundGuard) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no addresses were found for " + host)
+	}
+
+	var ips []net.IP
+	for _, address := range addresses {
+		if err := guard.checkIP(address.IP); err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		ips = append(ips, address.IP)
+	}
+	return ips, nil
+}
+
+/*
+	The dialContext function dials like net.Dialer but refuses the connection if the address being connected to is blocked
+	The check runs in the dialer's Control hook, after DNS resolution, so a rebinding answer can't bypass it
+*/
+func (guard *outboundGuard) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("refusing to dial unresolved address %q", host)
+			}
+			return guard.checkIP(ip)
+		},
+	}
+	return egress.dialContext(ctx, dialer, network, address)
+}
+
+/*
+	The newClient function returns an http.Client whose every connection goes through dialContext
+	Redirects are checked against the allowlists too, callers wanting to follow them by hand can still return http.ErrUseLastResponse
+*/
+func (guard *outboundGuard) newClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           guard.dialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirectHops {
+				return fmt.Errorf("stopped after %d redirects", maxRedirectHops)
+			}
+			return guard.checkURL(request.URL)
+		},
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOutboundCheckIP(t *testing.T) {
+	guard, err := newOutboundGuard(outboundSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{ip: "93.184.216.34"},
+		{ip: "2606:2800:220:1::1"},
+		{ip: "127.0.0.1", blocked: true},
+		{ip: "10.1.2.3", blocked: true},
+		{ip: "169.254.169.254", blocked: true},
+		{ip: "100.100.100.200", blocked: true},
+		{ip: "::ffff:127.0.0.1", blocked: true},
+		{ip: "::1", blocked: true},
+		{ip: "fd00:ec2::254", blocked: true},
+		{ip: "64:ff9b::a00:1", blocked: true},
+		// 6to4, 2002:AABB:CCDD::/48 relays to AA.BB.CC.DD
+		{ip: "2002:5db8:d822::1"},
+		{ip: "2002:7f00:1::1", blocked: true},
+		{ip: "2002:a9fe:a9fe::1", blocked: true},
+		{ip: "2002:c0a8:101::", blocked: true},
+		// Teredo, 2001:0:<server>:<flags>:<port>:<client>, the client's address and port inverted
+		{ip: "2001:0:5db8:d822:0:0:a247:27dd"},
+		{ip: "2001:0:5db8:d822:0:0:80ff:fffe", blocked: true},
+		{ip: "2001:0:5db8:d822:0:0:f5fe:fffe", blocked: true},
+		{ip: "2001:0:a00:1:0:0:a247:27dd", blocked: true},
+	}
+	for _, test := range tests {
+		err := guard.checkIP(net.ParseIP(test.ip))
+		if blocked := err != nil; blocked != test.blocked {
+			t.Errorf("checkIP(%s) = %v, want blocked %t", test.ip, err, test.blocked)
+		}
+	}
+}
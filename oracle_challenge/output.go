@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+/*
+	The outputSettings struct replaces the built-in /ip text with an operator's template
+	Template (or the contents of TemplateFile) is a Go template rendered against the canonical field names of locationFields(),
+	e.g. "{{.ip}} is in {{.city}}, {{.country}}", along with "error" which holds the reason when the lookup failed
+	A ContentType of text/html switches to html/template so values are escaped, it defaults to text/plain
+*/
+type outputSettings struct {
+	Template     string `json:"template"`
+	TemplateFile string `json:"template_file"`
+	ContentType  string `json:"content_type"`
+}
+
+// The outputTemplate interface is satisfied by both text/template and html/template templates
+type outputTemplate interface {
+	Execute(io.Writer, interface{}) error
+}
+
+// The compiledOutput struct is an outputSettings with its template parsed
+type compiledOutput struct {
+	template    outputTemplate
+	contentType string
+}
+
+// customOutput is the compiled top-level output config, nil keeps the built-in format
+var customOutput *compiledOutput
+
+// namedOutputs are the compiled output_templates, chosen per request with ?template=name
+var namedOutputs map[string]*compiledOutput
+
+/*
+	The compileNamedOutputs function parses every template of output_templates once at startup
+	A name is used in URLs, so it is limited to letters, digits, "-" and "_"
+*/
+func compileNamedOutputs(configured map[string]outputSettings) (map[string]*compiledOutput, error) {
+	compiled := map[string]*compiledOutput{}
+	for name, settings := range configured {
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "" {
+			return nil, fmt.Errorf("output template %q: names may only contain letters, digits, - and _", name)
+		}
+		output, err := compileOutputTemplate(settings)
+		if err != nil {
+			return nil, fmt.Errorf("output template %q: %w", name, err)
+		}
+		if output == nil {
+			return nil, fmt.Errorf("output template %q: template or template_file is required", name)
+		}
+		compiled[name] = output
+	}
+	return compiled, nil
+}
+
+// The compileOutputTemplate function parses the configured template once at startup, it returns nil when none is configured
+func compileOutputTemplate(settings outputSettings) (*compiledOutput, error) {
+	source := settings.Template
+	if settings.TemplateFile != "" {
+		contents, err := os.ReadFile(settings.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		source = string(contents)
+	}
+	if source == "" {
+		return nil, nil
+	}
+
+	output := &compiledOutput{contentType: settings.ContentType}
+	if output.contentType == "" {
+		output.contentType = "text/plain; charset=utf-8"
+	}
+	var err error
+	if strings.HasPrefix(settings.ContentType, "text/html") {
+		output.template, err = htmltemplate.New("output").Option("missingkey=error").Parse(source)
+	} else {
+		output.template, err = template.New("output").Option("missingkey=error").Parse(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// The serveIP function is handleIP() with the response rendered through the output's template
+func (output *compiledOutput) serveIP(w http.ResponseWriter, r *http.Request) {
+	location := geolocation{}
+	fields, err := requestedFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := targetIP(r)
+	if err == nil {
+		location, err = lookupFields(w, r, ip, fields)
+		location.IP = ip
+	}
+
+	// Unselected fields render as empty, the template may still refer to them
+	data := documentFields(geolocation{})
+	for _, name := range addressFieldOrder {
+		data[name] = ""
+	}
+	for name, value := range selectFields(documentFields(location), fields) {
+		data[name] = value
+	}
+	data["error"] = ""
+	if err != nil {
+		data["error"] = err.Error()
+	}
+
+	var rendered bytes.Buffer
+	if err := output.template.Execute(&rendered, data); err != nil {
+		http.Error(w, "Error while rendering the output template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", output.contentType)
+	w.Write(rendered.Bytes())
+}
+
+// The documentWriter type writes a flat document of canonical fields with status, it is how each structured /ip format differs
+type documentWriter func(w http.ResponseWriter, status int, document map[string]string)
+
+/*
+	The serveDocument function looks up the client, or the address it asks about, and hands the result to write, shared by every structured /ip format
+	The document's keys are the canonical field names of locationFields() and the address forms of addressFieldOrder,
+	with "error" holding the reason when the lookup failed, narrowed to the ?fields= the client selected
+*/
+func serveDocument(w http.ResponseWriter, r *http.Request, write documentWriter) {
+	fields, err := requestedFields(r)
+	if err != nil {
+		write(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ip, err := targetIP(r)
+	var invalid *invalidAddressError
+	if errors.As(err, &invalid) {
+		write(w, http.StatusBadRequest, map[string]string{"ip": invalid.Input, "error": invalid.Error()})
+		return
+	}
+	if err != nil {
+		write(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	location, err := lookupFields(w, r, ip, fields)
+	if writeBogon(w, err) {
+		return
+	}
+	if err != nil {
+		document := selectFields(addressForms(ip), fields)
+		document["ip"], document["error"] = ip, "Error while attempting to get location data: "+err.Error()
+		write(w, http.StatusBadGateway, document)
+		return
+	}
+	location.IP = ip
+	write(w, http.StatusOK, selectFields(documentFields(location), fields))
+}
+
+/*
+	The handleJSONIP function serves /ip/json (and /ip?format=json), the client's IP address and geolocation as one JSON document
+	ip_version is a number, every other field a string (ip_decimal included, an IPv6 address doesn't fit a JSON number)
+*/
+func handleJSONIP(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, func(w http.ResponseWriter, status int, document map[string]string) {
+		typed := map[string]interface{}{}
+		for name, value := range document {
+			typed[name] = value
+		}
+		if version, err := strconv.Atoi(document["ip_version"]); err == nil {
+			typed["ip_version"] = version
+		}
+		writeJSON(w, status, typed)
+	})
+}
+
+// The writeJSON function writes document as indented JSON with status
+func writeJSON(w http.ResponseWriter, status int, document interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(document)
+}
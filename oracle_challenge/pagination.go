@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultPageLimit is how many items a paginated endpoint returns when the client doesn't ask for a limit
+	defaultPageLimit = 100
+	// maxPageLimit caps the limit a client may ask for
+	maxPageLimit = 1000
+)
+
+/*
+	The page struct is a client's position in a paginated list, parsed from the "cursor" and "limit" query parameters
+	After is the sort key of the last item the client has already seen, "" for the first page
+*/
+type page struct {
+	After string
+	Limit int
+}
+
+/*
+	The parsePage function reads the cursor and limit of request
+	Cursors are opaque to clients, they are the base64 of a sort key so they can be passed back in a URL unchanged
+*/
+func parsePage(request *http.Request) (page, error) {
+	query := request.URL.Query()
+	current := page{Limit: defaultPageLimit}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return current, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+		current.Limit = limit
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 {
+			return current, errors.New("cursor is not one this service returned")
+		}
+		current.After = string(after)
+	}
+	return current, nil
+}
+
+/*
+	The paginate function returns the indexes [start, end) of the page within a list of count items sorted by key,
+	along with the cursor of the following page ("" on the last one)
+	key must be strictly increasing so that items added or removed between requests can't shift a later page
+*/
+func paginate(current page, count int, key func(int) string) (int, int, string) {
+	start := 0
+	if current.After != "" {
+		// Binary search for the first item past the cursor
+		low, high := 0, count
+		for low < high {
+			middle := (low + high) / 2
+			if key(middle) <= current.After {
+				low = middle + 1
+			} else {
+				high = middle
+			}
+		}
+		start = low
+	}
+	end := start + current.Limit
+	if end >= count {
+		return start, count, ""
+	}
+	return start, end, base64.RawURLEncoding.EncodeToString([]byte(key(end - 1)))
+}
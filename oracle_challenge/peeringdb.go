@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPeeringDBRefresh applies when peeringdb.refresh_hours isn't configured
+const defaultPeeringDBRefresh = 24 * time.Hour
+
+/*
+	The peeringDBSettings struct points at the PeeringDB API (normally https://www.peeringdb.com/api)
+	The net, org and netixlan collections are downloaded whole, cached in data_dir and refreshed every RefreshHours,
+	so enrichment never waits on PeeringDB and stays within its anonymous rate limits
+*/
+type peeringDBSettings struct {
+	URL          string `json:"url"`
+	RefreshHours int    `json:"refresh_hours"`
+}
+
+// The peeringNetwork struct is the part of a PeeringDB net record the enrichment uses
+type peeringNetwork struct {
+	OrgID         int    `json:"org_id"`
+	ASN           int    `json:"asn"`
+	Name          string `json:"name"`
+	AKA           string `json:"aka"`
+	Website       string `json:"website"`
+	IRRASSet      string `json:"irr_as_set"`
+	InfoType      string `json:"info_type"`
+	PolicyGeneral string `json:"policy_general"`
+}
+
+// The peeringOrg struct is the part of a PeeringDB org record the enrichment uses
+type peeringOrg struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Website string `json:"website"`
+	City    string `json:"city"`
+	Country string `json:"country"`
+}
+
+// The peeringPresence struct is a network's port at an exchange, a PeeringDB netixlan record
+type peeringPresence struct {
+	ASN      int    `json:"asn"`
+	Exchange string `json:"name"`
+	Speed    int    `json:"speed"`
+	IPv4     string `json:"ipaddr4"`
+	IPv6     string `json:"ipaddr6"`
+}
+
+// The peeringDB struct holds the three collections, networks and exchange presence are keyed by ASN
+type peeringDB struct {
+	mutex    sync.RWMutex
+	networks map[int]peeringNetwork
+	orgs     map[int]peeringOrg
+	presence map[int][]peeringPresence
+	datasets []*remoteDataset
+}
+
+// peering is built in main() when peeringdb.url is configured
+var peering *peeringDB
+
+// The newPeeringDB function builds the collections and loads their cached copies, downloads happen through each dataset's watch()
+func newPeeringDB(settings peeringDBSettings) (*peeringDB, error) {
+	interval := defaultPeeringDBRefresh
+	if settings.RefreshHours > 0 {
+		interval = time.Duration(settings.RefreshHours) * time.Hour
+	}
+	base := strings.TrimSuffix(settings.URL, "/")
+	db := &peeringDB{networks: map[int]peeringNetwork{}, orgs: map[int]peeringOrg{}, presence: map[int][]peeringPresence{}}
+	db.datasets = []*remoteDataset{
+		newRemoteDataset("peeringdb_net.json", base+"/net", interval, db.parseNetworks),
+		newRemoteDataset("peeringdb_org.json", base+"/org", interval, db.parseOrgs),
+		newRemoteDataset("peeringdb_netixlan.json", base+"/netixlan", interval, db.parsePresence),
+	}
+	for _, dataset := range db.datasets {
+		if err := dataset.load(); err != nil {
+			return db, err
+		}
+	}
+	return db, nil
+}
+
+// The watch function keeps every collection refreshed until stop is closed
+func (db *peeringDB) watch(stop <-chan struct{}) {
+	for _, dataset := range db.datasets {
+		go dataset.watch(stop)
+	}
+}
+
+// The decodeCollection function unwraps the {"data": [...]} envelope every PeeringDB response uses
+func decodeCollection(contents []byte, records interface{}) error {
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{records}
+	if err := json.Unmarshal(contents, &envelope); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The parseNetworks function replaces the networks with a downloaded net collection
+func (db *peeringDB) parseNetworks(contents []byte) error {
+	var records []peeringNetwork
+	if err := decodeCollection(contents, &records); err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("the net collection is empty")
+	}
+	networks := map[int]peeringNetwork{}
+	for _, record := range records {
+		networks[record.ASN] = record
+	}
+	db.mutex.Lock()
+	db.networks = networks
+	db.mutex.Unlock()
+	return nil
+}
+
+// The parseOrgs function replaces the organizations with a downloaded org collection
+func (db *peeringDB) parseOrgs(contents []byte) error {
+	var records []peeringOrg
+	if err := decodeCollection(contents, &records); err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("the org collection is empty")
+	}
+	orgs := map[int]peeringOrg{}
+	for _, record := range records {
+		orgs[record.ID] = record
+	}
+	db.mutex.Lock()
+	db.orgs = orgs
+	db.mutex.Unlock()
+	return nil
+}
+
+// The parsePresence function replaces the exchange presence with a downloaded netixlan collection
+func (db *peeringDB) parsePresence(contents []byte) error {
+	var records []peeringPresence
+	if err := decodeCollection(contents, &records); err != nil {
+		return err
+	}
+	presence := map[int][]peeringPresence{}
+	for _, record := range records {
+		presence[record.ASN] = append(presence[record.ASN], record)
+	}
+	db.mutex.Lock()
+	db.presence = presence
+	db.mutex.Unlock()
+	return nil
+}
+
+// The describe function assembles what PeeringDB knows about asn, false when it has no record of the network
+func (db *peeringDB) describe(asn int) (map[string]interface{}, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	network, ok := db.networks[asn]
+	if !ok {
+		return nil, false
+	}
+	exchanges := db.presence[asn]
+	if exchanges == nil {
+		exchanges = []peeringPresence{}
+	}
+	return map[string]interface{}{
+		"name":           network.Name,
+		"aka":            network.AKA,
+		"website":        network.Website,
+		"irr_as_set":     network.IRRASSet,
+		"type":           network.InfoType,
+		"policy_general": network.PolicyGeneral,
+		"organization":   db.orgs[network.OrgID],
+		"exchanges":      exchanges,
+	}, true
+}
+
+// The peeringDBStage function contributes the PeeringDB record of the network the asn stage found
+func peeringDBStage(_ context.Context, _ string, inputs map[string]interface{}) (interface{}, error) {
+	block, _ := inputs["asn"].(map[string]interface{})
+	asn, _ := block["number"].(int)
+	description, ok := peering.describe(asn)
+	if !ok {
+		return map[string]interface{}{"listed": false}, nil
+	}
+	description["listed"] = true
+	return description, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPoolInterval applies when pool.interval_seconds isn't configured
+	defaultPoolInterval = 5 * time.Second
+	// defaultPoolExpiry applies when pool.expire_seconds isn't configured
+	defaultPoolExpiry = time.Minute
+	// poolSecretHeader carries the pool's shared secret on registrations
+	poolSecretHeader = "X-Pool-Secret"
+)
+
+/*
+	The poolSettings struct makes instances without a load balancer in front of them a pool that answers DNS for ServiceName
+	with the addresses of its healthy members, see instancePool
+	Advertise is this instance's base URL as the others reach it, its host must be an IP address since that is what DNS hands out
+	Seeds are base URLs of other instances to register with at startup, every member learns the rest from whoever it registers with
+	Secret is shared by the pool and required, a registration without it is refused
+	DNSListen is the UDP address of the DNS server, ":5353" by default, TTLSeconds the TTL of its answers
+*/
+type poolSettings struct {
+	ServiceName     string   `json:"service_name"`
+	Advertise       string   `json:"advertise"`
+	Seeds           []string `json:"seeds"`
+	Secret          string   `json:"secret"`
+	DNSListen       string   `json:"dns_listen"`
+	TTLSeconds      int      `json:"ttl_seconds"`
+	IntervalSeconds int      `json:"interval_seconds"`
+	ExpireSeconds   int      `json:"expire_seconds"`
+}
+
+// The poolMember struct is an instance of the pool as this one sees it, Healthy is the outcome of the last probe of its /healthz
+type poolMember struct {
+	URL       string    `json:"url"`
+	IP        net.IP    `json:"ip"`
+	Healthy   bool      `json:"healthy"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	Seed      bool      `json:"seed"`
+}
+
+/*
+	The instancePool struct is this instance's view of the pool
+	Every interval it registers with every member it knows (learning theirs in return) and probes their /healthz,
+	a member that neither registered nor passed a probe for expire_seconds is forgotten, unless it is a seed
+*/
+type instancePool struct {
+	settings poolSettings
+	self     string
+	mutex    sync.Mutex
+	members  map[string]*poolMember
+}
+
+// pool is built in main() when the pool feature is enabled
+var pool *instancePool
+
+// The memberIP function returns the IP address in the host of base, the address DNS will answer with for that member
+func memberIP(base string) (net.IP, error) {
+	parsed, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("%q must be an http or https URL", base)
+	}
+	ip := net.ParseIP(parsed.Hostname())
+	if ip == nil {
+		return nil, fmt.Errorf("the host of %q must be an IP address", base)
+	}
+	return ip, nil
+}
+
+// The newInstancePool function validates settings and returns a pool of this instance and its seeds
+func newInstancePool(settings poolSettings) (*instancePool, error) {
+	if settings.ServiceName == "" || settings.Advertise == "" || settings.Secret == "" {
+		return nil, errors.New("the pool feature needs pool.service_name, pool.advertise and pool.secret")
+	}
+	pool := &instancePool{settings: settings, self: strings.TrimSuffix(settings.Advertise, "/"), members: map[string]*poolMember{}}
+	for _, base := range append([]string{settings.Advertise}, settings.Seeds...) {
+		ip, err := memberIP(base)
+		if err != nil {
+			return nil, fmt.Errorf("pool: %w", err)
+		}
+		base = strings.TrimSuffix(base, "/")
+		pool.members[base] = &poolMember{URL: base, IP: ip, LastSeen: time.Now(), Seed: base != pool.self}
+	}
+	return pool, nil
+}
+
+// The interval function returns how often the pool registers and probes
+func (pool *instancePool) interval() time.Duration {
+	if pool.settings.IntervalSeconds > 0 {
+		return time.Duration(pool.settings.IntervalSeconds) * time.Second
+	}
+	return defaultPoolInterval
+}
+
+/*
+	The learn function adds the member at base unless it is already known, reporting whether it was new
+	heard says base registered itself, which counts as hearing from it, rather than being listed by another member
+*/
+func (pool *instancePool) learn(base string, heard bool) bool {
+	ip, err := memberIP(base)
+	if err != nil {
+		return false
+	}
+	base = strings.TrimSuffix(base, "/")
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if member, ok := pool.members[base]; ok {
+		if heard {
+			member.LastSeen = time.Now()
+		}
+		return false
+	}
+	pool.members[base] = &poolMember{URL: base, IP: ip, LastSeen: time.Now()}
+	return true
+}
+
+// The known function returns the base URLs of every member, sorted
+func (pool *instancePool) known() []string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return sortedMemberKeys(pool.members)
+}
+
+// The register function announces this instance to the member at base and learns the members it knows
+func (pool *instancePool) register(base string) error {
+	payload, _ := json.Marshal(map[string]string{"url": pool.self})
+	request, err := http.NewRequest(http.MethodPost, base+"/pool/register", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(poolSecretHeader, pool.settings.Secret)
+	response, err := egressClient(pool.interval()).Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("registering answered %s", response.Status)
+	}
+	var members []string
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&members); err != nil {
+		return err
+	}
+	for _, member := range members {
+		pool.learn(member, false)
+	}
+	return nil
+}
+
+// The probe function checks the /healthz of the member at base, an instance in maintenance mode counts as unhealthy
+func (pool *instancePool) probe(base string) error {
+	response, err := egressClient(pool.interval()).Get(base + "/healthz")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("/healthz answered %s", response.Status)
+	}
+	return nil
+}
+
+// The round function registers with and probes every member at once, then forgets the ones gone for longer than expire_seconds
+func (pool *instancePool) round() {
+	expiry := defaultPoolExpiry
+	if pool.settings.ExpireSeconds > 0 {
+		expiry = time.Duration(pool.settings.ExpireSeconds) * time.Second
+	}
+
+	var group sync.WaitGroup
+	for _, base := range pool.known() {
+		group.Add(1)
+		go func(base string) {
+			defer group.Done()
+			if base != pool.self {
+				if err := pool.register(base); err != nil {
+					log.Printf("pool: registering with %s: %v", base, err)
+				}
+			}
+			err := pool.probe(base)
+
+			pool.mutex.Lock()
+			defer pool.mutex.Unlock()
+			member, ok := pool.members[base]
+			if !ok {
+				return
+			}
+			member.Healthy, member.LastCheck, member.LastError = err == nil, time.Now(), ""
+			if err != nil {
+				member.LastError = err.Error()
+			} else {
+				member.LastSeen = member.LastCheck
+			}
+		}(base)
+	}
+	group.Wait()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for base, member := range pool.members {
+		if base != pool.self && !member.Seed && time.Since(member.LastSeen) > expiry {
+			log.Printf("pool: forgetting %s, not heard from since %s", base, member.LastSeen.Format(time.RFC3339))
+			delete(pool.members, base)
+		}
+	}
+}
+
+// The watch function runs a round immediately and then every interval until stop is closed
+func (pool *instancePool) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(pool.interval())
+	defer ticker.Stop()
+	for {
+		pool.round()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The healthyAddresses function returns the addresses of the healthy members, IPv4 or IPv6 ones as v6 says
+func (pool *instancePool) healthyAddresses(v6 bool) []net.IP {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var addresses []net.IP
+	for _, base := range sortedMemberKeys(pool.members) {
+		member := pool.members[base]
+		if member.Healthy && (member.IP.To4() == nil) == v6 {
+			addresses = append(addresses, member.IP)
+		}
+	}
+	return addresses
+}
+
+// The sortedMemberKeys function returns the keys of members in a stable order so DNS answers don't shuffle between queries
+func sortedMemberKeys(members map[string]*poolMember) []string {
+	var keys []string
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+	The handlePoolRegister function serves POST /pool/register, another instance announcing its base URL as {"url": ...}
+	It answers with every member this instance knows, so a new instance learns the pool from any one of them
+*/
+func handlePoolRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST {\"url\": ...} to register", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(poolSecretHeader)), []byte(pool.settings.Secret)) != 1 {
+		http.Error(w, "the pool secret is missing or wrong", http.StatusForbidden)
+		return
+	}
+	var registration struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&registration); err != nil {
+		http.Error(w, "Error while reading the registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := memberIP(registration.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pool.learn(registration.URL, true) {
+		log.Printf("pool: %s registered", registration.URL)
+	}
+	writeJSON(w, http.StatusOK, pool.known())
+}
+
+// The handlePoolMembers function serves /pool/members, every member this instance knows and how its last probe went
+func handlePoolMembers(w http.ResponseWriter, r *http.Request) {
+	pool.mutex.Lock()
+	members := []poolMember{}
+	for _, base := range sortedMemberKeys(pool.members) {
+		members = append(members, *pool.members[base])
+	}
+	pool.mutex.Unlock()
+	writeJSON(w, http.StatusOK, struct {
+		ServiceName string       `json:"service_name"`
+		Self        string       `json:"self"`
+		Members     []poolMember `json:"members"`
+	}{pool.settings.ServiceName, pool.self, members})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	// defaultPoolDNSListen applies when pool.dns_listen isn't configured
+	defaultPoolDNSListen = ":5353"
+	// defaultPoolTTL applies when pool.ttl_seconds isn't configured, short so clients move off an instance soon after it fails
+	defaultPoolTTL = 5
+)
+
+// DNS record types and response codes the pool's DNS server deals in (RFC 1035, RFC 3596)
+const (
+	dnsTypeA       = 1
+	dnsTypeAAAA    = 28
+	dnsClassIN     = 1
+	dnsRcodeOK     = 0
+	dnsRcodeFormat = 1
+	dnsRcodeRefuse = 5
+)
+
+/*
+	The servePoolDNS function answers DNS queries over UDP on pool.dns_listen until stop is closed
+	A/AAAA queries for the service name are answered with the healthy members' addresses, other types with no records,
+	and names other than the service name are refused, it is authoritative for that one name and nothing else
+	The socket is opened with listenPacket() so an upgrade hands it over to the new process
+*/
+func (pool *instancePool) servePoolDNS(stop <-chan struct{}) error {
+	address := pool.settings.DNSListen
+	if address == "" {
+		address = defaultPoolDNSListen
+	}
+	connection, err := listenPacket(address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stop
+		connection.Close()
+	}()
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			length, client, err := connection.ReadFrom(buffer)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("pool: DNS: %v", err)
+				continue
+			}
+			if answer := pool.answerDNS(buffer[:length]); answer != nil {
+				connection.WriteTo(answer, client)
+			}
+		}
+	}()
+	return nil
+}
+
+// The answerDNS function builds the response to query, nil when it is too malformed to answer at all
+func (pool *instancePool) answerDNS(query []byte) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	// Header: the query's ID and RD bit, QR and AA set
+	response := []byte{query[0], query[1], 0x84 | query[2]&0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		response[3] = dnsRcodeFormat
+		return response
+	}
+
+	var labels []string
+	offset := 12
+	for offset < len(query) && query[offset] != 0 {
+		length := int(query[offset])
+		if length > 63 || offset+1+length >= len(query) {
+			response[3] = dnsRcodeFormat
+			return response
+		}
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	if offset+5 > len(query) {
+		response[3] = dnsRcodeFormat
+		return response
+	}
+	question := query[12 : offset+5]
+	recordType, class := binary.BigEndian.Uint16(query[offset+1:]), binary.BigEndian.Uint16(query[offset+3:])
+	binary.BigEndian.PutUint16(response[4:], 1)
+	response = append(response, question...)
+
+	if !strings.EqualFold(strings.Join(labels, "."), strings.TrimSuffix(pool.settings.ServiceName, ".")) || class != dnsClassIN {
+		response[3] = dnsRcodeRefuse
+		return response
+	}
+	response[3] = dnsRcodeOK
+	if recordType != dnsTypeA && recordType != dnsTypeAAAA {
+		return response
+	}
+
+	ttl := uint32(defaultPoolTTL)
+	if pool.settings.TTLSeconds > 0 {
+		ttl = uint32(pool.settings.TTLSeconds)
+	}
+	addresses := pool.healthyAddresses(recordType == dnsTypeAAAA)
+	for _, ip := range addresses {
+		data := ip.To4()
+		if recordType == dnsTypeAAAA {
+			data = ip.To16()
+		}
+		// The name is a pointer back to the question's, at offset 12
+		record := []byte{0xc0, 12, 0, byte(recordType), 0, dnsClassIN, 0, 0, 0, 0, 0, byte(len(data))}
+		binary.BigEndian.PutUint32(record[6:], ttl)
+		if len(response)+len(record)+len(data) > 512 {
+			// Set TC rather than send a partial answer set that looks complete
+			response[2] |= 0x02
+			break
+		}
+		response = append(append(response, record...), data...)
+		binary.BigEndian.PutUint16(response[6:], binary.BigEndian.Uint16(response[6:])+1)
+	}
+	return response
+}
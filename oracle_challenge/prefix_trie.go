@@ -0,0 +1,89 @@
+package main
+
+import "net"
+
+// The trieNode struct is one bit of a prefix, value is only meaningful where set is true
+type trieNode struct {
+	children [2]*trieNode
+	prefix   *net.IPNet
+	value    interface{}
+	set      bool
+}
+
+/*
+	The prefixTrie struct is a binary radix trie of IPv4 and IPv6 prefixes, used for longest-prefix and containment matching
+	Lookups cost at most one step per address bit no matter how many prefixes are stored
+	It isn't safe for concurrent modification, callers build a new trie and swap it in under their own lock
+*/
+type prefixTrie struct {
+	v4   trieNode
+	v6   trieNode
+	size int
+}
+
+// The root function picks the IPv4 or IPv6 tree for ip, returning the address in its canonical length
+func (trie *prefixTrie) root(ip net.IP) (*trieNode, net.IP) {
+	if v4 := ip.To4(); v4 != nil {
+		return &trie.v4, v4
+	}
+	return &trie.v6, ip.To16()
+}
+
+// The insert function stores value under prefix, replacing whatever was stored under the same prefix
+func (trie *prefixTrie) insert(prefix *net.IPNet, value interface{}) {
+	node, address := trie.root(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	for bit := 0; bit < ones; bit++ {
+		next := address[bit/8] >> (7 - uint(bit%8)) & 1
+		if node.children[next] == nil {
+			node.children[next] = &trieNode{}
+		}
+		node = node.children[next]
+	}
+	if !node.set {
+		trie.size++
+	}
+	node.prefix, node.value, node.set = prefix, value, true
+}
+
+// The get function returns the value stored under exactly prefix
+func (trie *prefixTrie) get(prefix *net.IPNet) (interface{}, bool) {
+	node, address := trie.root(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	for bit := 0; bit < ones && node != nil; bit++ {
+		node = node.children[address[bit/8]>>(7-uint(bit%8))&1]
+	}
+	if node == nil || !node.set {
+		return nil, false
+	}
+	return node.value, true
+}
+
+// The lookup function returns the most specific prefix containing ip and its value
+func (trie *prefixTrie) lookup(ip net.IP) (*net.IPNet, interface{}, bool) {
+	matches := trie.matches(ip)
+	if len(matches) == 0 {
+		return nil, nil, false
+	}
+	last := matches[len(matches)-1]
+	return last.prefix, last.value, true
+}
+
+// The matches function returns every stored prefix containing ip, least specific first
+func (trie *prefixTrie) matches(ip net.IP) []*trieNode {
+	if ip == nil {
+		return nil
+	}
+	node, address := trie.root(ip)
+	var found []*trieNode
+	for bit := 0; node != nil; bit++ {
+		if node.set {
+			found = append(found, node)
+		}
+		if bit == len(address)*8 {
+			break
+		}
+		node = node.children[address[bit/8]>>(7-uint(bit%8))&1]
+	}
+	return found
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// providerTimeout bounds a single lookup against a configured provider
+const providerTimeout = 10 * time.Second
+
+/*
+	The providerSettings struct adds a geolocation provider besides ipinfo, e.g. for the self-consistency checker
+	URL contains {ip} where the address goes, Fields maps a canonical field name (see locationFields, plus latitude and longitude
+	which are combined into loc) to the dotted path of the value in the provider's JSON response
+	Each call counts against the upstream quota under Name, so pricing can be configured for it like ipinfo
+*/
+type providerSettings struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Fields  map[string]string `json:"fields"`
+	Headers map[string]string `json:"headers"`
+}
+
+// The geoProvider struct is any source of geolocations
+type geoProvider struct {
+	name   string
+	lookup func(ip string) (geolocation, error)
+}
+
+// The configuredProviders function returns ipinfo followed by every provider in config, validating them on the way
+func configuredProviders(configured []providerSettings) ([]geoProvider, error) {
+	providers := []geoProvider{{name: ipinfoProvider, lookup: fetchGeolocation}}
+	known := locationFields(geolocation{})
+	known["latitude"], known["longitude"] = "", ""
+	names := map[string]bool{ipinfoProvider: true}
+	for _, settings := range configured {
+		if settings.Name == "" || names[settings.Name] {
+			return nil, fmt.Errorf("provider name %q is empty or already taken", settings.Name)
+		}
+		names[settings.Name] = true
+		if !strings.Contains(settings.URL, "{ip}") {
+			return nil, fmt.Errorf("provider %q: url must contain {ip}", settings.Name)
+		}
+		for field := range settings.Fields {
+			if _, ok := known[field]; !ok || field == "ip" {
+				return nil, fmt.Errorf("provider %q: unknown field %q", settings.Name, field)
+			}
+		}
+		providers = append(providers, geoProvider{name: settings.Name, lookup: settings.lookup})
+	}
+	return providers, nil
+}
+
+// The lookup function asks the provider about ip and maps its response onto a geolocation
+func (settings providerSettings) lookup(ip string) (geolocation, error) {
+	if err := quotas.allowUpstream(settings.Name); err != nil {
+		return geolocation{}, err
+	}
+	request, err := http.NewRequest(http.MethodGet, strings.ReplaceAll(settings.URL, "{ip}", url.PathEscape(ip)), nil)
+	if err != nil {
+		return geolocation{}, err
+	}
+	for name, value := range settings.Headers {
+		request.Header.Set(name, value)
+	}
+	client := egressClient(providerTimeout)
+	started := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		recordProviderCall(settings.Name, time.Since(started), err)
+		return geolocation{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s answered %s", settings.Name, response.Status)
+		recordProviderCall(settings.Name, time.Since(started), err)
+		return geolocation{}, err
+	}
+	recordProviderCall(settings.Name, time.Since(started), nil)
+	var document interface{}
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		return geolocation{}, err
+	}
+
+	values := map[string]string{}
+	for field, path := range settings.Fields {
+		values[field] = jsonPath(document, path)
+	}
+	if values["loc"] == "" && values["latitude"] != "" && values["longitude"] != "" {
+		values["loc"] = values["latitude"] + "," + values["longitude"]
+	}
+	location := geolocation{
+		IP:       ip,
+		Hostname: values["hostname"],
+		Country:  values["country"],
+		Region:   values["region"],
+		City:     values["city"],
+		Postal:   values["postal"],
+		Timezone: values["timezone"],
+		Loc:      values["loc"],
+		Org:      values["org"],
+	}
+	if location == (geolocation{IP: ip}) {
+		return location, errors.New(settings.Name + " returned none of the configured fields")
+	}
+	return location, nil
+}
+
+// The jsonPath function follows a dotted path through decoded JSON objects, formatting whatever it finds as a string
+func jsonPath(document interface{}, path string) string {
+	node := document
+	for _, key := range strings.Split(path, ".") {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		node = object[key]
+	}
+	switch value := node.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
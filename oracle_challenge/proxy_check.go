@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	The proxyCheckSettings struct configures /proxy/check
+	OpenProxies lists known open proxies as addresses or CIDRs
+	ProbePorts are ports on the client's address to try a SOCKS5 handshake against, none are probed unless configured
+*/
+type proxyCheckSettings struct {
+	OpenProxies    []string `json:"open_proxies"`
+	ProbePorts     []int    `json:"probe_ports"`
+	ProbeTimeoutMS int      `json:"probe_timeout_ms"`
+}
+
+// defaultProbeTimeout applies when proxy_check.probe_timeout_ms isn't configured
+const defaultProbeTimeout = 2 * time.Second
+
+// proxyHeaders are request headers that proxies commonly add, X-Forwarded-For is left out since our own load balancer may set it
+var proxyHeaders = []string{"Via", "Forwarded", "X-Proxy-ID", "Proxy-Connection", "X-Proxy-Connection", "Client-IP", "X-BlueCoat-Via", "X-Forwarded-Host", "X-Originating-IP"}
+
+// The proxyHeuristic struct reports one check, Description documents what it looks at so consumers can weigh it themselves
+type proxyHeuristic struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Triggered   bool     `json:"triggered"`
+	Evidence    []string `json:"evidence"`
+}
+
+// The proxyReport struct is the /proxy/check response, LikelyProxied is set when any heuristic triggered
+type proxyReport struct {
+	IP            string           `json:"ip"`
+	LikelyProxied bool             `json:"likely_proxied"`
+	Heuristics    []proxyHeuristic `json:"heuristics"`
+}
+
+// The parseAddressList function parses a list of addresses and CIDRs, single addresses become host-sized ranges
+func parseAddressList(entries []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, networkRange, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, networkRange)
+	}
+	return ranges, nil
+}
+
+// openProxies are the parsed proxy_check.open_proxies, loaded once at startup
+var openProxies []*net.IPNet
+
+// The loadProxySettings function parses the open proxy entries and rejects malformed ones and probe ports at startup
+func loadProxySettings(settings proxyCheckSettings) ([]*net.IPNet, error) {
+	ranges, err := parseAddressList(settings.OpenProxies)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_check.open_proxies: %w", err)
+	}
+	for _, port := range settings.ProbePorts {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("proxy_check.probe_ports: %d is not a port", port)
+		}
+	}
+	return ranges, nil
+}
+
+/*
+	The handleProxyCheck function serves /proxy/check, reporting whether the client's connection looks like it passes through a proxy
+	The heuristics are tell-tale request headers, membership of the configured open proxy list
+	and an open SOCKS5 server on the client's address (only on configured ports, and never on private addresses)
+	The SOCKS5 probe only targets the peer of the TCP connection, never an address taken from X-Forwarded-For,
+	so a client can't point the probe at a host of its choosing, behind a load balancer the peer is private and isn't probed
+*/
+func handleProxyCheck(w http.ResponseWriter, r *http.Request) {
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := proxyReport{IP: ip, Heuristics: []proxyHeuristic{
+		proxyHeaderHeuristic(r),
+		openProxyHeuristic(net.ParseIP(ip)),
+		socksProbeHeuristic(r.Context(), peerIP(r)),
+	}}
+	for _, heuristic := range report.Heuristics {
+		report.LikelyProxied = report.LikelyProxied || heuristic.Triggered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// The proxyHeaderHeuristic function lists every proxy header present on the request
+func proxyHeaderHeuristic(r *http.Request) proxyHeuristic {
+	heuristic := proxyHeuristic{
+		Name:        "proxy_headers",
+		Description: "Triggers when the request carries headers proxies add: " + strings.Join(proxyHeaders, ", ") + ". X-Forwarded-For is ignored since load balancers in front of this service set it",
+		Evidence:    []string{},
+	}
+	for _, name := range proxyHeaders {
+		if value := r.Header.Get(name); value != "" {
+			heuristic.Evidence = append(heuristic.Evidence, name+": "+value)
+		}
+	}
+	heuristic.Triggered = len(heuristic.Evidence) > 0
+	return heuristic
+}
+
+// The openProxyHeuristic function reports which configured open proxy entries contain ip
+func openProxyHeuristic(ip net.IP) proxyHeuristic {
+	heuristic := proxyHeuristic{
+		Name:        "known_open_proxy",
+		Description: "Triggers when the address is on the operator's list of known open proxies (" + strconv.Itoa(len(config.ProxyCheck.OpenProxies)) + " entries)",
+		Evidence:    []string{},
+	}
+	for _, networkRange := range openProxies {
+		if networkRange.Contains(ip) {
+			heuristic.Evidence = append(heuristic.Evidence, networkRange.String())
+		}
+	}
+	heuristic.Triggered = len(heuristic.Evidence) > 0
+	return heuristic
+}
+
+// The peerIP function returns the address of the TCP peer of r, ignoring any forwarding headers, empty when it has none
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+/*
+	The socksProbeHeuristic function offers a no-authentication SOCKS5 handshake to each configured port on the connection's peer ip
+	A server accepting it is an open SOCKS5 proxy, connections go through the outbound guard so private addresses are never probed
+*/
+func socksProbeHeuristic(ctx context.Context, ip string) proxyHeuristic {
+	heuristic := proxyHeuristic{
+		Name:        "open_socks5",
+		Description: "Triggers when a SOCKS5 server on the connection's peer address accepts unauthenticated clients, probed on ports " + joinPorts(config.ProxyCheck.ProbePorts),
+		Evidence:    []string{},
+	}
+	if ip == "" {
+		return heuristic
+	}
+	timeout := defaultProbeTimeout
+	if config.ProxyCheck.ProbeTimeoutMS > 0 {
+		timeout = time.Duration(config.ProxyCheck.ProbeTimeoutMS) * time.Millisecond
+	}
+
+	for _, port := range config.ProxyCheck.ProbePorts {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		open := probeSOCKS5(probeCtx, net.JoinHostPort(ip, strconv.Itoa(port)))
+		cancel()
+		if open {
+			heuristic.Evidence = append(heuristic.Evidence, "port "+strconv.Itoa(port))
+		}
+	}
+	heuristic.Triggered = len(heuristic.Evidence) > 0
+	return heuristic
+}
+
+// The probeSOCKS5 function reports whether address answers a SOCKS5 greeting offering no authentication by accepting it
+func probeSOCKS5(ctx context.Context, address string) bool {
+	connection, err := outbound.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	defer connection.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+	}
+
+	// Version 5, one method offered: 0x00 (no authentication)
+	if _, err := connection.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return false
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(connection, reply); err != nil {
+		return false
+	}
+	return reply[0] == 0x05 && reply[1] == 0x00
+}
+
+// The joinPorts function lists ports for a description, "none" when there are none
+func joinPorts(ports []int) string {
+	if len(ports) == 0 {
+		return "none"
+	}
+	var listed []string
+	for _, port := range ports {
+		listed = append(listed, strconv.Itoa(port))
+	}
+	return strings.Join(listed, ", ")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// errUpstreamQuota is returned instead of calling the upstream API once the configured daily limit has been spent
+var errUpstreamQuota = errors.New("the daily upstream lookup limit has been reached")
+
+/*
+	The quotaSettings struct configures the per API key token buckets and the upstream daily cap
+	A zero RatePerMinute or UpstreamDailyLimit disables that limit
+	StateFile is where counters are persisted so a restart doesn't hand every key a fresh bucket
+*/
+type quotaSettings struct {
+	RatePerMinute      float64 `json:"rate_per_minute"`
+	Burst              int     `json:"burst"`
+	UpstreamDailyLimit int     `json:"upstream_daily_limit"`
+	StateFile          string  `json:"state_file"`
+}
+
+// The tokenBucket struct is a single API key's bucket, exported fields so it can be persisted as-is
+type tokenBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+/*
+	The quotaState struct is everything written to quotaSettings.StateFile, buckets are keyed by a hash of the API key
+	ProviderCalls counts billable calls per provider for UsageMonth, which is what cost estimates are based on
+	ExhaustedDay is the day the upstream limit was last found spent, so exhaustion is notified once a day even across restarts
+*/
+type quotaState struct {
+	Buckets       map[string]*tokenBucket `json:"buckets"`
+	UpstreamDay   string                  `json:"upstream_day"`
+	UpstreamCalls int                     `json:"upstream_calls"`
+	UsageMonth    string                  `json:"usage_month"`
+	ProviderCalls map[string]int          `json:"provider_calls"`
+	ExhaustedDay  string                  `json:"exhausted_day,omitempty"`
+}
+
+// The quotaTracker struct guards the quotaState and remembers whether it changed since it was last saved
+type quotaTracker struct {
+	mutex    sync.Mutex
+	settings quotaSettings
+	state    quotaState
+	dirty    bool
+}
+
+// quotas is shared by requireAPIKey() and getAPIData(), it is built in main() from config.Quota
+var quotas = newQuotaTracker(quotaSettings{})
+
+// The newQuotaTracker function returns an empty tracker for settings, use load() to pick up persisted counters
+func newQuotaTracker(settings quotaSettings) *quotaTracker {
+	return &quotaTracker{settings: settings, state: quotaState{Buckets: map[string]*tokenBucket{}}}
+}
+
+/*
+	The allowKey function takes a token from the bucket belonging to key, returning false when the bucket is empty
+	Buckets refill continuously at RatePerMinute up to Burst (which defaults to one minute's worth of tokens)
+*/
+func (tracker *quotaTracker) allowKey(key string) bool {
+	if tracker.settings.RatePerMinute <= 0 {
+		return true
+	}
+	burst := float64(tracker.settings.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, tracker.settings.RatePerMinute)
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	id := hashKey(key)
+	now := time.Now()
+	bucket, ok := tracker.state.Buckets[id]
+	if !ok {
+		bucket = &tokenBucket{Tokens: burst, Updated: now}
+		tracker.state.Buckets[id] = bucket
+	}
+	elapsed := now.Sub(bucket.Updated).Minutes()
+	bucket.Tokens = math.Min(burst, bucket.Tokens+elapsed*tracker.settings.RatePerMinute)
+	bucket.Updated = now
+	tracker.dirty = true
+
+	if bucket.Tokens < 1 {
+		return false
+	}
+	bucket.Tokens--
+	return true
+}
+
+/*
+	The allowUpstream function counts one call to provider against today's (UTC) limit, returning errUpstreamQuota once it is spent
+	Allowed calls are also counted against provider's usage for the month
+*/
+func (tracker *quotaTracker) allowUpstream(provider string) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+	if tracker.state.UpstreamDay != today {
+		tracker.state.UpstreamDay = today
+		tracker.state.UpstreamCalls = 0
+	}
+	if tracker.settings.UpstreamDailyLimit > 0 && tracker.state.UpstreamCalls >= tracker.settings.UpstreamDailyLimit {
+		if tracker.state.ExhaustedDay != today {
+			tracker.state.ExhaustedDay = today
+			tracker.dirty = true
+			resets := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			notify(notification{Event: eventQuotaExhausted, Limit: tracker.settings.UpstreamDailyLimit, Resets: resets.Format(time.RFC3339)})
+		}
+		return errUpstreamQuota
+	}
+	tracker.state.UpstreamCalls++
+
+	month := now.Format("2006-01")
+	if tracker.state.UsageMonth != month || tracker.state.ProviderCalls == nil {
+		tracker.state.UsageMonth = month
+		tracker.state.ProviderCalls = map[string]int{}
+	}
+	tracker.state.ProviderCalls[provider]++
+	tracker.dirty = true
+	return nil
+}
+
+// The usage function returns today's upstream call count and a copy of this month's per provider counts
+func (tracker *quotaTracker) usage() (int, map[string]int) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	now := time.Now().UTC()
+	callsToday := 0
+	if tracker.state.UpstreamDay == now.Format("2006-01-02") {
+		callsToday = tracker.state.UpstreamCalls
+	}
+	calls := map[string]int{}
+	if tracker.state.UsageMonth == now.Format("2006-01") {
+		for provider, count := range tracker.state.ProviderCalls {
+			calls[provider] = count
+		}
+	}
+	return callsToday, calls
+}
+
+// The load function reads previously persisted counters, a missing state file just means a first start
+func (tracker *quotaTracker) load() error {
+	if tracker.settings.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(tracker.settings.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state := quotaState{Buckets: map[string]*tokenBucket{}}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Buckets == nil {
+		state.Buckets = map[string]*tokenBucket{}
+	}
+
+	tracker.mutex.Lock()
+	tracker.state = state
+	tracker.mutex.Unlock()
+	return nil
+}
+
+/*
+	The save function writes the counters to StateFile when they changed since the last save
+	The file is written beside the target and renamed over it, so a crash mid-write can't leave a truncated state behind
+*/
+func (tracker *quotaTracker) save() error {
+	if tracker.settings.StateFile == "" {
+		return nil
+	}
+
+	tracker.mutex.Lock()
+	if !tracker.dirty {
+		tracker.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(tracker.state)
+	tracker.dirty = false
+	tracker.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(tracker.settings.StateFile, data); err != nil {
+		tracker.mutex.Lock()
+		tracker.dirty = true
+		tracker.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// The persistEvery function saves the counters every interval until stop is closed
+func (tracker *quotaTracker) persistEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := tracker.save(); err != nil {
+				log.Printf("saving quota state: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The hashKey function identifies an API key in persisted state without writing the secret itself to disk
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+	persisting is held for reading while a persisted file is written, by writeFileAtomic() and jsonlStore's append,
+	and for writing by an online backup, so no file changes while the backup reads them
+*/
+var persisting sync.RWMutex
+
+// The writeFileAtomic function writes data to a temporary file in the same directory as path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	persisting.RLock()
+	defer persisting.RUnlock()
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
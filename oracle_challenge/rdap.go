@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRDAPURL is a bootstrap service that redirects each query to the registry responsible for it
+	defaultRDAPURL = "https://rdap.org"
+	// defaultRDAPTimeout bounds an RDAP query, redirects included, when rdap.timeout_ms isn't configured
+	defaultRDAPTimeout = 10 * time.Second
+)
+
+// The rdapSettings struct points RDAP queries at URL, which must answer /domain/{name} and /ip/{address} as RFC 9082 describes
+type rdapSettings struct {
+	URL       string `json:"url"`
+	TimeoutMS int    `json:"timeout_ms"`
+}
+
+// The rdapEvent struct is an entry of the events of an RDAP object, e.g. {"eventAction": "registration", "eventDate": "1995-08-14T04:00:00Z"}
+type rdapEvent struct {
+	Action string `json:"eventAction"`
+	Date   string `json:"eventDate"`
+}
+
+// The rdapEntity struct is a contact of an RDAP object, Roles says what it is to the object (registrar, registrant, abuse...)
+type rdapEntity struct {
+	Roles    []string        `json:"roles"`
+	Handle   string          `json:"handle"`
+	VCard    json.RawMessage `json:"vcardArray"`
+	Entities []rdapEntity    `json:"entities"`
+}
+
+/*
+	The fetchRDAP function queries the RDAP service for query of kind ("domain" or "ip") and decodes the answer into document
+	It reports false without an error when the service has no such object
+*/
+func fetchRDAP(ctx context.Context, kind, query string, document interface{}) (bool, error) {
+	base, timeout := defaultRDAPURL, defaultRDAPTimeout
+	if config.RDAP.URL != "" {
+		base = config.RDAP.URL
+	}
+	if config.RDAP.TimeoutMS > 0 {
+		timeout = time.Duration(config.RDAP.TimeoutMS) * time.Millisecond
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/"+kind+"/"+url.PathEscape(query), nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Accept", "application/rdap+json, application/json")
+	response, err := egressClient(timeout).Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("the RDAP service answered %s", response.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(document); err != nil {
+		return false, fmt.Errorf("reading the RDAP answer: %w", err)
+	}
+	return true, nil
+}
+
+// The rdapEventDate function returns the date of the first event with action, "" when there is none
+func rdapEventDate(events []rdapEvent, action string) string {
+	for _, event := range events {
+		if event.Action == action {
+			return event.Date
+		}
+	}
+	return ""
+}
+
+// The rdapEntityWithRole function returns the first entity with role, searching the entities nested in them too
+func rdapEntityWithRole(entities []rdapEntity, role string) (rdapEntity, bool) {
+	for _, entity := range entities {
+		for _, candidate := range entity.Roles {
+			if candidate == role {
+				return entity, true
+			}
+		}
+		if nested, ok := rdapEntityWithRole(entity.Entities, role); ok {
+			return nested, true
+		}
+	}
+	return rdapEntity{}, false
+}
+
+// The vcardValue function returns the text of property (e.g. "fn" or "email") in the entity's jCard, "" when it has none
+func (entity rdapEntity) vcardValue(property string) string {
+	var card []json.RawMessage
+	if json.Unmarshal(entity.VCard, &card) != nil || len(card) < 2 {
+		return ""
+	}
+	var properties [][]json.RawMessage
+	if json.Unmarshal(card[1], &properties) != nil {
+		return ""
+	}
+	for _, entry := range properties {
+		var name, value string
+		if len(entry) < 4 || json.Unmarshal(entry[0], &name) != nil || name != property {
+			continue
+		}
+		if json.Unmarshal(entry[3], &value) == nil {
+			return value
+		}
+	}
+	return ""
+}
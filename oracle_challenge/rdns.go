@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultRDNSTimeout bounds a reverse lookup when rdns.timeout_ms isn't configured
+const defaultRDNSTimeout = 2 * time.Second
+
+/*
+	The rdnsSettings struct configures reverse DNS, for /rdns/{ip} and the rdns enrichment stage
+	Resolver is a "host:port" DNS server to ask instead of the system's resolver
+	FillHostname fills in the hostname of a geolocation from its PTR record when the provider didn't report one
+*/
+type rdnsSettings struct {
+	Resolver     string `json:"resolver"`
+	TimeoutMS    int    `json:"timeout_ms"`
+	FillHostname bool   `json:"fill_hostname"`
+}
+
+// The rdnsAnswer struct is the answer of /rdns/{ip}, Hostname is the first of Hostnames or "" when there are none
+type rdnsAnswer struct {
+	IP        string   `json:"ip"`
+	Hostname  string   `json:"hostname"`
+	Hostnames []string `json:"hostnames"`
+	FCrDNS    bool     `json:"fcrdns"`
+	Confirmed []string `json:"confirmed"`
+}
+
+// The rdnsResolver function returns the resolver configured for reverse DNS, the system's when none is
+func rdnsResolver() *net.Resolver {
+	return dnsResolver(config.RDNS.Resolver)
+}
+
+// The dnsResolver function returns a resolver asking the DNS server at "host:port" through the egress source, the system's for ""
+func dnsResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return egress.dialContext(ctx, dialer, network, server)
+		},
+	}
+}
+
+// The rdnsContext function bounds a reverse lookup by rdns.timeout_ms
+func rdnsContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := defaultRDNSTimeout
+	if config.RDNS.TimeoutMS > 0 {
+		timeout = time.Duration(config.RDNS.TimeoutMS) * time.Millisecond
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// The reverseLookup function returns the PTR names of ip, none (rather than an error) when it has no PTR record
+func reverseLookup(ctx context.Context, ip string) ([]string, error) {
+	names, err := rdnsResolver().LookupAddr(ctx, ip)
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) && dnsError.IsNotFound {
+		return []string{}, nil
+	}
+	return names, err
+}
+
+// The forwardConfirmed function returns the names that resolve back to ip, a name that doesn't resolve simply isn't confirmed
+func forwardConfirmed(ctx context.Context, ip string, names []string) []string {
+	address := net.ParseIP(ip)
+	confirmed := []string{}
+	for _, name := range names {
+		resolved, err := rdnsResolver().LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, candidate := range resolved {
+			if candidate.IP.Equal(address) {
+				confirmed = append(confirmed, name)
+				break
+			}
+		}
+	}
+	return confirmed
+}
+
+// The ptrHostname function returns the first PTR name of ip without its trailing dot, "" when it has none or the lookup fails
+func ptrHostname(ip string) string {
+	ctx, cancel := rdnsContext(context.Background())
+	defer cancel()
+	names, err := reverseLookup(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// The handleRDNS function serves /rdns/{ip}, the PTR names of the address and whether they are forward-confirmed
+func handleRDNS(w http.ResponseWriter, r *http.Request) {
+	input := strings.TrimPrefix(r.URL.Path, "/rdns/")
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		writeInvalidAddress(w, &invalidAddressError{Input: input})
+		return
+	}
+	ip := parsed.String()
+
+	ctx, cancel := rdnsContext(r.Context())
+	defer cancel()
+	names, err := reverseLookup(ctx, ip)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			status = http.StatusGatewayTimeout
+		}
+		writeJSON(w, status, map[string]string{"ip": ip, "error": "Error while looking up the PTR record: " + err.Error()})
+		return
+	}
+	answer := rdnsAnswer{IP: ip, Hostnames: names, Confirmed: forwardConfirmed(ctx, ip, names)}
+	if len(names) > 0 {
+		answer.Hostname = strings.TrimSuffix(names[0], ".")
+	}
+	answer.FCrDNS = len(answer.Confirmed) > 0
+	writeJSON(w, http.StatusOK, answer)
+}
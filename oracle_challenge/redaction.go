@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+/*
+	The redactionPolicy struct lists the location fields hidden from the API keys it names
+	Anonymous applies the policy to requests that present no valid API key, a missing key and a made-up one alike
+	Hidden fields are blanked by lookupFor() before any endpoint renders them, so every output format honours the same policy
+*/
+type redactionPolicy struct {
+	Name      string   `json:"name"`
+	APIKeys   []string `json:"api_keys"`
+	Anonymous bool     `json:"anonymous"`
+	Hide      []string `json:"hide"`
+}
+
+// The checkRedactionPolicies function rejects unknown field names at startup, the address itself can't be hidden since it is what was asked about
+func checkRedactionPolicies(policies []redactionPolicy) error {
+	known := locationFields(geolocation{})
+	for _, policy := range policies {
+		if policy.Name == "" {
+			return errors.New("every redaction policy needs a name")
+		}
+		for _, field := range policy.Hide {
+			if _, ok := known[field]; !ok || field == "ip" {
+				return fmt.Errorf("redaction policy %q: cannot hide field %q", policy.Name, field)
+			}
+		}
+	}
+	return nil
+}
+
+// The policyFor function returns the first policy that applies to the request, nil when it may see everything
+func policyFor(r *http.Request) *redactionPolicy {
+	if r == nil {
+		return nil
+	}
+	key := requestAPIKey(r)
+	anonymous := !validAPIKey(key, config.APIKeys) && !validAPIKey(key, config.AdminKeys)
+	for i, policy := range config.RedactionPolicies {
+		if (anonymous && policy.Anonymous) || (!anonymous && validAPIKey(key, policy.APIKeys)) {
+			return &config.RedactionPolicies[i]
+		}
+	}
+	return nil
+}
+
+// The redactLocation function blanks every field listed in hide
+func redactLocation(location geolocation, hide []string) geolocation {
+	targets := map[string]*string{
+		"hostname": &location.Hostname,
+		"country":  &location.Country,
+		"region":   &location.Region,
+		"city":     &location.City,
+		"postal":   &location.Postal,
+		"timezone": &location.Timezone,
+		"loc":      &location.Loc,
+		"org":      &location.Org,
+	}
+	for _, field := range hide {
+		if target, ok := targets[field]; ok {
+			*target = ""
+		}
+	}
+	return location
+}
+
+// The redactFields function returns a copy of fields, a location in canonical fields, with every field listed in hide blanked
+func redactFields(fields map[string]string, hide []string) map[string]string {
+	redacted := make(map[string]string, len(fields))
+	for name, value := range fields {
+		redacted[name] = value
+	}
+	for _, field := range hide {
+		if _, ok := redacted[field]; ok {
+			redacted[field] = ""
+		}
+	}
+	return redacted
+}
+
+/*
+	The lookupFor function is lookupCached() with the redaction policy of the request's API key applied, every endpoint answering a client goes through it
+	Upstream lookups are recorded against the tenant of the request's API key
+	The coordinates are parsed from Loc once it is redacted, so a policy hiding loc hides them too
+*/
+func lookupFor(r *http.Request, ip string) (geolocation, bool, error) {
+	location, hit, err := lookupCachedFor(tenantFor(r), ip)
+	if err != nil {
+		return location, hit, err
+	}
+	if policy := policyFor(r); policy != nil {
+		location = redactLocation(location, policy.Hide)
+	}
+	location.Latitude, location.Longitude, location.Located = parseLoc(location.Loc)
+	noteCountry(r, location.Country)
+	return location, hit, nil
+}
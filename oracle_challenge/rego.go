@@ -0,0 +1,1414 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	The regoPolicy struct holds the Rego modules and data documents of a policy loaded by loadRegoPolicy()
+	Rules are keyed by their full path without the data. prefix, e.g. "oracle.allow", every definition of a rule in one slice
+	The evaluator is embedded and covers the subset of Rego that access and geo-fencing policies need:
+	  - package and import (rego.v1 and future.keywords only), default rules, complete rules (name := value if {...}, name if {...})
+	    and partial set rules (name contains value if {...}, or name[value] {...})
+	  - bodies of expressions, x := value, some x in collection, some k, v in collection, not and iteration with _ in references
+	  - ==, !=, <, <=, >, >=, in, + - * /, strings, numbers, booleans, null, arrays, objects, sets and references to input, data and rules
+	  - the builtins count, startswith, endswith, contains, lower, upper, trim_space, split, concat, sprintf, object.get and net.cidr_contains
+	Anything else (functions, comprehensions, else, every, with) is rejected when the policy is loaded rather than misread
+*/
+type regoPolicy struct {
+	rules    map[string][]*regoRule
+	packages map[string]bool
+	data     map[string]interface{}
+}
+
+// The regoRule struct is one definition of a rule, Key is the element of a partial set rule and Value the value of a complete one
+type regoRule struct {
+	name      string
+	pkg       string
+	isDefault bool
+	isSet     bool
+	key       *regoExpr
+	value     *regoExpr
+	body      []*regoLiteral
+}
+
+/*
+	The regoExpr struct is a node of a Rego expression, kind is one of "value" (a constant in value), "ref" (name followed by the path in args),
+	"call" (the builtin name applied to args), "array", "set", "object" (keys and values alternating in args) and "binary" (the operator name on args)
+*/
+type regoExpr struct {
+	kind  string
+	value interface{}
+	name  string
+	args  []*regoExpr
+}
+
+// The regoLiteral struct is one statement of a rule body, kind is "expr", "assign" (vars[0] := expr) or "some" (some vars in expr)
+type regoLiteral struct {
+	kind    string
+	negated bool
+	vars    []string
+	expr    *regoExpr
+}
+
+// regoSet is a Rego set, its elements keyed by their canonical JSON
+type regoSet map[string]interface{}
+
+// The MarshalJSON method writes a set as an array sorted by the canonical JSON of its elements, which also makes equal sets encode alike
+func (set regoSet) MarshalJSON() ([]byte, error) {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return []byte("[" + strings.Join(keys, ",") + "]"), nil
+}
+
+// The regoKey function returns the canonical JSON of value, equal Rego values having equal keys
+func regoKey(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%#v", value)
+	}
+	return string(encoded)
+}
+
+// errRegoStop ends a search early once its answer is known, it never escapes the evaluator
+var errRegoStop = errors.New("stop")
+
+/*
+	The loadRegoPolicy function reads the .rego files and data.json documents at path: a single .rego file, a directory searched recursively
+	or an OPA bundle (.tar.gz or .tgz), a data.json being placed in data at the directory it sits in as OPA does
+*/
+func loadRegoPolicy(policyPath string) (*regoPolicy, error) {
+	policy := &regoPolicy{rules: map[string][]*regoRule{}, packages: map[string]bool{}, data: map[string]interface{}{}}
+	add := func(name string, contents []byte) error {
+		name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+		switch {
+		case strings.HasSuffix(name, ".rego"):
+			if err := policy.parseModule(string(contents)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		case path.Base(name) == "data.json":
+			var document interface{}
+			if err := json.Unmarshal(contents, &document); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			var segments []string
+			if directory := path.Dir(name); directory != "." {
+				segments = strings.Split(directory, "/")
+			}
+			if err := mergeRegoData(policy.data, segments, document); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	}
+
+	info, err := os.Stat(policyPath)
+	switch {
+	case err != nil:
+		return nil, err
+	case info.IsDir():
+		err = filepath.WalkDir(policyPath, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			contents, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			relative, _ := filepath.Rel(policyPath, name)
+			return add(relative, contents)
+		})
+	case strings.HasSuffix(policyPath, ".tar.gz") || strings.HasSuffix(policyPath, ".tgz"):
+		err = readRegoBundle(policyPath, add)
+	default:
+		var contents []byte
+		if contents, err = os.ReadFile(policyPath); err == nil {
+			err = add(filepath.Base(policyPath), contents)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", policyPath, err)
+	}
+	if len(policy.rules) == 0 {
+		return nil, fmt.Errorf("policy %s: no rules found in any .rego file", policyPath)
+	}
+	if err := policy.check(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", policyPath, err)
+	}
+	return policy, nil
+}
+
+// The readRegoBundle function hands every regular file of the gzipped tarball at bundlePath to add
+func readRegoBundle(bundlePath string, add func(name string, contents []byte) error) error {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		contents, err := io.ReadAll(archive)
+		if err != nil {
+			return err
+		}
+		if err := add(header.Name, contents); err != nil {
+			return err
+		}
+	}
+}
+
+// The mergeRegoData function places document in data under segments, merging objects that two data.json files both fill in
+func mergeRegoData(data map[string]interface{}, segments []string, document interface{}) error {
+	if len(segments) == 0 {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return errors.New("a data.json at the root of a policy must hold an object")
+		}
+		for key, value := range object {
+			if err := mergeRegoData(data, []string{key}, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	existing, ok := data[segments[0]]
+	if !ok {
+		for i := len(segments) - 1; i > 0; i-- {
+			document = map[string]interface{}{segments[i]: document}
+		}
+		data[segments[0]] = document
+		return nil
+	}
+	nested, isObject := existing.(map[string]interface{})
+	if !isObject {
+		return fmt.Errorf("data.%s is set twice", segments[0])
+	}
+	if len(segments) == 1 {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("data.%s is set twice", segments[0])
+		}
+		return mergeRegoData(nested, nil, object)
+	}
+	return mergeRegoData(nested, segments[1:], document)
+}
+
+// The regoToken struct is a lexical token, kind is "ident", "string", "number", "\n", "eof" or the punctuation itself
+type regoToken struct {
+	kind  string
+	text  string
+	value interface{}
+	line  int
+}
+
+// regoPunctuation lists the operators and delimiters of the subset, longest first so := isn't read as :
+var regoPunctuation = []string{":=", "==", "!=", "<=", ">=", "{", "}", "[", "]", "(", ")", ",", ";", ".", ":", "=", "<", ">", "+", "-", "*", "/", "|", "&"}
+
+// The lexRego function splits source into tokens, newlines are kept since they separate the statements of a body
+func lexRego(source string) ([]regoToken, error) {
+	var tokens []regoToken
+	line := 1
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			tokens = append(tokens, regoToken{kind: "\n", line: line})
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				if end < len(source) && source[end] == '\n' {
+					break
+				}
+				end++
+			}
+			if end >= len(source) || source[end] != '"' {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			var value string
+			if err := json.Unmarshal([]byte(source[i:end+1]), &value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid string %s", line, source[i:end+1])
+			}
+			tokens = append(tokens, regoToken{kind: "string", text: source[i : end+1], value: value, line: line})
+			i = end + 1
+		case c == '`':
+			end := strings.IndexByte(source[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated raw string", line)
+			}
+			value := source[i+1 : i+1+end]
+			tokens = append(tokens, regoToken{kind: "string", text: "`" + value + "`", value: value, line: line})
+			line += strings.Count(value, "\n")
+			i += end + 2
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(source) && (source[end] >= '0' && source[end] <= '9' || source[end] == '.' || source[end] == 'e' || source[end] == 'E' ||
+				(source[end] == '+' || source[end] == '-') && (source[end-1] == 'e' || source[end-1] == 'E')) {
+				end++
+			}
+			value, err := strconv.ParseFloat(source[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number %s", line, source[i:end])
+			}
+			tokens = append(tokens, regoToken{kind: "number", text: source[i:end], value: value, line: line})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(source) && (source[end] == '_' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			tokens = append(tokens, regoToken{kind: "ident", text: source[i:end], line: line})
+			i = end
+		default:
+			matched := ""
+			for _, punctuation := range regoPunctuation {
+				if strings.HasPrefix(source[i:], punctuation) {
+					matched = punctuation
+					break
+				}
+			}
+			if matched == "" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+			tokens = append(tokens, regoToken{kind: matched, text: matched, line: line})
+			i += len(matched)
+		}
+	}
+	return append(tokens, regoToken{kind: "eof", line: line}), nil
+}
+
+// The regoParser struct walks the tokens of one module
+type regoParser struct {
+	tokens []regoToken
+	next   int
+}
+
+// regoKeywords can't be used as names, those of them outside the subset are rejected where they appear
+var regoKeywords = map[string]bool{"package": true, "import": true, "default": true, "if": true, "contains": true, "not": true, "some": true,
+	"in": true, "true": true, "false": true, "null": true, "else": true, "every": true, "with": true, "as": true}
+
+func (parser *regoParser) peek() regoToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *regoParser) take() regoToken {
+	token := parser.tokens[parser.next]
+	if token.kind != "eof" {
+		parser.next++
+	}
+	return token
+}
+
+// The is method reports whether the next token is the punctuation or keyword text
+func (parser *regoParser) is(text string) bool {
+	token := parser.peek()
+	return token.kind == text || token.kind == "ident" && token.text == text
+}
+
+// The accept method takes the next token when it is text
+func (parser *regoParser) accept(text string) bool {
+	if parser.is(text) {
+		parser.take()
+		return true
+	}
+	return false
+}
+
+func (parser *regoParser) expect(text string) error {
+	if !parser.accept(text) {
+		return parser.unexpected("expected " + text)
+	}
+	return nil
+}
+
+func (parser *regoParser) unexpected(want string) error {
+	token := parser.peek()
+	found := token.text
+	if token.kind == "\n" || token.kind == "eof" {
+		found = "end of " + map[string]string{"\n": "line", "eof": "file"}[token.kind]
+	}
+	return fmt.Errorf("line %d: %s, found %s", token.line, want, found)
+}
+
+func (parser *regoParser) skipNewlines() {
+	for parser.peek().kind == "\n" {
+		parser.take()
+	}
+}
+
+// The name method takes an identifier that isn't a keyword
+func (parser *regoParser) name() (string, error) {
+	token := parser.peek()
+	if token.kind != "ident" || regoKeywords[token.text] {
+		return "", parser.unexpected("expected a name")
+	}
+	parser.take()
+	return token.text, nil
+}
+
+// The dottedName method takes a name such as oracle.policy, as package and import use, keywords being allowed after the first dot
+func (parser *regoParser) dottedName() (string, error) {
+	name, err := parser.name()
+	for err == nil && parser.accept(".") {
+		if parser.peek().kind != "ident" {
+			return "", parser.unexpected("expected a name")
+		}
+		name += "." + parser.take().text
+	}
+	return name, err
+}
+
+// The parseModule method adds the rules of one module to the policy
+func (policy *regoPolicy) parseModule(source string) error {
+	tokens, err := lexRego(source)
+	if err != nil {
+		return err
+	}
+	parser := &regoParser{tokens: tokens}
+	parser.skipNewlines()
+	if err := parser.expect("package"); err != nil {
+		return err
+	}
+	pkg, err := parser.dottedName()
+	if err != nil {
+		return err
+	}
+	pkg = strings.TrimPrefix(pkg, "data.")
+	policy.packages[pkg] = true
+
+	for {
+		parser.skipNewlines()
+		if parser.peek().kind == "eof" {
+			return nil
+		}
+		if parser.accept("import") {
+			imported, err := parser.dottedName()
+			if err != nil {
+				return err
+			}
+			if imported != "rego.v1" && imported != "future.keywords" && !strings.HasPrefix(imported, "future.keywords.") {
+				return fmt.Errorf("import %s isn't supported, only rego.v1 and future.keywords are", imported)
+			}
+			continue
+		}
+		rule, err := parser.rule()
+		if err != nil {
+			return err
+		}
+		rule.pkg = pkg
+		policy.rules[pkg+"."+rule.name] = append(policy.rules[pkg+"."+rule.name], rule)
+	}
+}
+
+// The rule method parses one rule, from its optional default keyword to the end of its body
+func (parser *regoParser) rule() (*regoRule, error) {
+	rule := &regoRule{isDefault: parser.accept("default")}
+	var err error
+	if rule.name, err = parser.name(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case parser.accept("contains"):
+		rule.isSet = true
+		rule.key, err = parser.expression()
+	case parser.accept("["):
+		rule.isSet = true
+		if rule.key, err = parser.expression(); err == nil {
+			err = parser.expect("]")
+		}
+	case parser.accept(":=") || parser.accept("="):
+		rule.value, err = parser.expression()
+	case parser.is("("):
+		return nil, parser.unexpected("functions aren't supported")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rule.isDefault {
+		if rule.isSet || rule.value == nil {
+			return nil, fmt.Errorf("default %s must be given a value", rule.name)
+		}
+		return rule, parser.endOfStatement()
+	}
+
+	hasIf := parser.accept("if")
+	switch {
+	case parser.is("{"):
+		if rule.body, err = parser.body(); err != nil {
+			return nil, err
+		}
+	case hasIf:
+		literal, err := parser.literal()
+		if err != nil {
+			return nil, err
+		}
+		rule.body = []*regoLiteral{literal}
+	case rule.value == nil && !rule.isSet:
+		return nil, parser.unexpected("expected a value or a body for " + rule.name)
+	}
+	if parser.is("else") {
+		return nil, parser.unexpected("else isn't supported")
+	}
+	return rule, parser.endOfStatement()
+}
+
+func (parser *regoParser) endOfStatement() error {
+	if parser.peek().kind != "\n" && parser.peek().kind != "eof" && parser.peek().kind != ";" {
+		return parser.unexpected("expected the end of the rule")
+	}
+	parser.accept(";")
+	return nil
+}
+
+// The body method parses { literal ... }, the literals separated by semicolons or newlines
+func (parser *regoParser) body() ([]*regoLiteral, error) {
+	if err := parser.expect("{"); err != nil {
+		return nil, err
+	}
+	var body []*regoLiteral
+	for {
+		for parser.accept(";") || parser.accept("\n") {
+		}
+		if parser.accept("}") {
+			if len(body) == 0 {
+				return nil, errors.New("a rule body can't be empty")
+			}
+			return body, nil
+		}
+		literal, err := parser.literal()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, literal)
+		if parser.is("with") {
+			return nil, parser.unexpected("with isn't supported")
+		}
+		if !parser.is(";") && !parser.is("\n") && !parser.is("}") {
+			return nil, parser.unexpected("expected the end of the statement")
+		}
+	}
+}
+
+// The literal method parses one statement of a body
+func (parser *regoParser) literal() (*regoLiteral, error) {
+	for _, unsupported := range []string{"every", "with", "else"} {
+		if parser.is(unsupported) {
+			return nil, parser.unexpected(unsupported + " isn't supported")
+		}
+	}
+	if parser.accept("some") {
+		literal := &regoLiteral{kind: "some"}
+		for {
+			name, err := parser.name()
+			if err != nil {
+				return nil, err
+			}
+			literal.vars = append(literal.vars, name)
+			if !parser.accept(",") {
+				break
+			}
+		}
+		if len(literal.vars) > 2 {
+			return nil, parser.unexpected("some takes a value or a key and a value")
+		}
+		if err := parser.expect("in"); err != nil {
+			return nil, err
+		}
+		var err error
+		literal.expr, err = parser.additive()
+		return literal, err
+	}
+
+	literal := &regoLiteral{kind: "expr", negated: parser.accept("not")}
+	if !literal.negated && parser.peek().kind == "ident" && !regoKeywords[parser.peek().text] && parser.tokens[parser.next+1].kind == ":=" {
+		literal.kind = "assign"
+		literal.vars = []string{parser.take().text}
+		parser.take()
+	}
+	var err error
+	literal.expr, err = parser.expression()
+	return literal, err
+}
+
+// regoComparisons are the operators of the lowest precedence, at most one of them per expression
+var regoComparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "=": true, "in": true}
+
+// The expression method parses a comparison, or a lone additive expression
+func (parser *regoParser) expression() (*regoExpr, error) {
+	left, err := parser.additive()
+	if err != nil {
+		return nil, err
+	}
+	operator := parser.peek()
+	if !regoComparisons[operator.kind] && !(operator.kind == "ident" && operator.text == "in") {
+		return left, nil
+	}
+	parser.take()
+	parser.skipNewlines()
+	right, err := parser.additive()
+	if err != nil {
+		return nil, err
+	}
+	return &regoExpr{kind: "binary", name: operator.text, args: []*regoExpr{left, right}}, nil
+}
+
+func (parser *regoParser) additive() (*regoExpr, error) {
+	left, err := parser.multiplicative()
+	for err == nil && (parser.is("+") || parser.is("-")) {
+		operator := parser.take().text
+		parser.skipNewlines()
+		var right *regoExpr
+		right, err = parser.multiplicative()
+		left = &regoExpr{kind: "binary", name: operator, args: []*regoExpr{left, right}}
+	}
+	return left, err
+}
+
+func (parser *regoParser) multiplicative() (*regoExpr, error) {
+	left, err := parser.term()
+	for err == nil && (parser.is("*") || parser.is("/")) {
+		operator := parser.take().text
+		parser.skipNewlines()
+		var right *regoExpr
+		right, err = parser.term()
+		left = &regoExpr{kind: "binary", name: operator, args: []*regoExpr{left, right}}
+	}
+	return left, err
+}
+
+// The term method parses a constant, a collection, a parenthesised expression, a reference or a builtin call
+func (parser *regoParser) term() (*regoExpr, error) {
+	token := parser.peek()
+	switch {
+	case token.kind == "string" || token.kind == "number":
+		parser.take()
+		return &regoExpr{kind: "value", value: token.value}, nil
+	case token.kind == "-" && parser.tokens[parser.next+1].kind == "number":
+		parser.take()
+		return &regoExpr{kind: "value", value: -parser.take().value.(float64)}, nil
+	case token.kind == "ident" && (token.text == "true" || token.text == "false"):
+		parser.take()
+		return &regoExpr{kind: "value", value: token.text == "true"}, nil
+	case token.kind == "ident" && token.text == "null":
+		parser.take()
+		return &regoExpr{kind: "value"}, nil
+	case token.kind == "(":
+		parser.take()
+		parser.skipNewlines()
+		inner, err := parser.expression()
+		if err != nil {
+			return nil, err
+		}
+		parser.skipNewlines()
+		return inner, parser.expect(")")
+	case token.kind == "[":
+		parser.take()
+		items, err := parser.items("]")
+		return &regoExpr{kind: "array", args: items}, err
+	case token.kind == "{":
+		return parser.braces()
+	// contains is a keyword of rule heads as well as the name of a builtin
+	case token.kind == "ident" && (!regoKeywords[token.text] || token.text == "contains" && parser.tokens[parser.next+1].kind == "("):
+		return parser.reference()
+	}
+	return nil, parser.unexpected("expected a value")
+}
+
+// The items method parses a comma separated list up to the closing delimiter, newlines and a trailing comma allowed
+func (parser *regoParser) items(closing string) ([]*regoExpr, error) {
+	var items []*regoExpr
+	for {
+		parser.skipNewlines()
+		if parser.accept(closing) {
+			return items, nil
+		}
+		item, err := parser.expression()
+		if err != nil {
+			return nil, err
+		}
+		if parser.is("|") {
+			return nil, parser.unexpected("comprehensions aren't supported")
+		}
+		items = append(items, item)
+		parser.skipNewlines()
+		if !parser.accept(",") {
+			parser.skipNewlines()
+			return items, parser.expect(closing)
+		}
+	}
+}
+
+// The braces method parses an object {k: v, ...} or a set {a, b, ...}, {} being the empty object
+func (parser *regoParser) braces() (*regoExpr, error) {
+	parser.take()
+	parser.skipNewlines()
+	if parser.accept("}") {
+		return &regoExpr{kind: "object"}, nil
+	}
+	first, err := parser.expression()
+	if err != nil {
+		return nil, err
+	}
+	if parser.is("|") {
+		return nil, parser.unexpected("comprehensions aren't supported")
+	}
+	if !parser.accept(":") {
+		parser.skipNewlines()
+		rest := []*regoExpr{}
+		if parser.accept(",") {
+			rest, err = parser.items("}")
+		} else {
+			err = parser.expect("}")
+		}
+		return &regoExpr{kind: "set", args: append([]*regoExpr{first}, rest...)}, err
+	}
+
+	object := &regoExpr{kind: "object"}
+	key := first
+	for {
+		parser.skipNewlines()
+		value, err := parser.expression()
+		if err != nil {
+			return nil, err
+		}
+		object.args = append(object.args, key, value)
+		parser.skipNewlines()
+		if !parser.accept(",") {
+			return object, parser.expect("}")
+		}
+		parser.skipNewlines()
+		if parser.accept("}") {
+			return object, nil
+		}
+		if key, err = parser.expression(); err != nil {
+			return nil, err
+		}
+		if err := parser.expect(":"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// The reference method parses name.field[expr]..., or a builtin call such as net.cidr_contains(a, b) and set()
+func (parser *regoParser) reference() (*regoExpr, error) {
+	ref := &regoExpr{kind: "ref", name: parser.take().text}
+	for {
+		switch {
+		case parser.accept("."):
+			field := parser.take()
+			if field.kind != "ident" {
+				return nil, fmt.Errorf("line %d: expected a field name after .", field.line)
+			}
+			ref.args = append(ref.args, &regoExpr{kind: "value", value: field.text})
+		case parser.accept("["):
+			parser.skipNewlines()
+			index, err := parser.expression()
+			if err != nil {
+				return nil, err
+			}
+			parser.skipNewlines()
+			if err := parser.expect("]"); err != nil {
+				return nil, err
+			}
+			ref.args = append(ref.args, index)
+		case parser.is("("):
+			name := ref.name
+			for _, segment := range ref.args {
+				text, ok := segment.value.(string)
+				if segment.kind != "value" || !ok {
+					return nil, parser.unexpected("expected a function name")
+				}
+				name += "." + text
+			}
+			parser.take()
+			args, err := parser.items(")")
+			return &regoExpr{kind: "call", name: name, args: args}, err
+		default:
+			return ref, nil
+		}
+	}
+}
+
+// The regoBuiltin struct is a builtin function, called with its arguments already evaluated
+type regoBuiltin struct {
+	arity int
+	call  func(args []interface{}) (interface{}, error)
+}
+
+// regoBuiltins are the builtin functions the evaluator knows, a call to any other is rejected when the policy is loaded
+var regoBuiltins = map[string]regoBuiltin{
+	"count": {1, func(args []interface{}) (interface{}, error) {
+		switch collection := args[0].(type) {
+		case string:
+			return float64(len([]rune(collection))), nil
+		case []interface{}:
+			return float64(len(collection)), nil
+		case map[string]interface{}:
+			return float64(len(collection)), nil
+		case regoSet:
+			return float64(len(collection)), nil
+		}
+		return nil, fmt.Errorf("count: %s isn't a string or a collection", regoKey(args[0]))
+	}},
+	"startswith": {2, regoStrings(func(s []string) interface{} { return strings.HasPrefix(s[0], s[1]) })},
+	"endswith":   {2, regoStrings(func(s []string) interface{} { return strings.HasSuffix(s[0], s[1]) })},
+	"contains":   {2, regoStrings(func(s []string) interface{} { return strings.Contains(s[0], s[1]) })},
+	"lower":      {1, regoStrings(func(s []string) interface{} { return strings.ToLower(s[0]) })},
+	"upper":      {1, regoStrings(func(s []string) interface{} { return strings.ToUpper(s[0]) })},
+	"trim_space": {1, regoStrings(func(s []string) interface{} { return strings.TrimSpace(s[0]) })},
+	"split": {2, regoStrings(func(s []string) interface{} {
+		var parts []interface{}
+		for _, part := range strings.Split(s[0], s[1]) {
+			parts = append(parts, part)
+		}
+		return parts
+	})},
+	"concat": {2, func(args []interface{}) (interface{}, error) {
+		delimiter, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("concat: the delimiter must be a string")
+		}
+		switch args[1].(type) {
+		case []interface{}, regoSet:
+		default:
+			return nil, errors.New("concat: the elements must be an array or a set")
+		}
+		var parts []string
+		err := regoEach(args[1], func(_, value interface{}) error {
+			part, ok := value.(string)
+			if !ok {
+				return errors.New("concat: every element must be a string")
+			}
+			parts = append(parts, part)
+			return nil
+		})
+		return strings.Join(parts, delimiter), err
+	}},
+	"sprintf": {2, func(args []interface{}) (interface{}, error) {
+		format, ok := args[0].(string)
+		values, isArray := args[1].([]interface{})
+		if !ok || !isArray {
+			return nil, errors.New("sprintf: expected a format string and an array of values")
+		}
+		converted := make([]interface{}, len(values))
+		for i, value := range values {
+			converted[i] = value
+			if number, ok := value.(float64); ok && number == math.Trunc(number) && math.Abs(number) < 1<<53 {
+				converted[i] = int64(number)
+			}
+		}
+		return fmt.Sprintf(format, converted...), nil
+	}},
+	"object.get": {3, func(args []interface{}) (interface{}, error) {
+		object, ok := args[0].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("object.get: the first argument must be an object")
+		}
+		key, ok := args[1].(string)
+		if value, found := object[key]; ok && found {
+			return value, nil
+		}
+		return args[2], nil
+	}},
+	"net.cidr_contains": {2, func(args []interface{}) (interface{}, error) {
+		cidr, ok := args[0].(string)
+		inner, isString := args[1].(string)
+		if !ok || !isString {
+			return nil, errors.New("net.cidr_contains: both arguments must be strings")
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("net.cidr_contains: %w", err)
+		}
+		if ip := net.ParseIP(inner); ip != nil {
+			return network.Contains(ip), nil
+		}
+		_, subnet, err := net.ParseCIDR(inner)
+		if err != nil {
+			return nil, fmt.Errorf("net.cidr_contains: %q is neither an address nor a CIDR range", inner)
+		}
+		outerOnes, outerBits := network.Mask.Size()
+		innerOnes, innerBits := subnet.Mask.Size()
+		return outerBits == innerBits && innerOnes >= outerOnes && network.Contains(subnet.IP), nil
+	}},
+	"set": {0, func(args []interface{}) (interface{}, error) {
+		return regoSet{}, nil
+	}},
+}
+
+// The regoStrings function adapts a function of string arguments into a builtin that rejects anything else
+func regoStrings(call func(args []string) interface{}) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		strs := make([]string, len(args))
+		for i, arg := range args {
+			str, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %s", regoKey(arg))
+			}
+			strs[i] = str
+		}
+		return call(strs), nil
+	}
+}
+
+/*
+	The check method rejects what would otherwise only fail while a request is being decided: rules defined as both complete and partial sets,
+	two defaults for one rule, unknown builtins or builtins given the wrong number of arguments, and names that are neither a variable
+	assigned earlier in the body, input, data nor a rule of the package
+	It also turns x = value into an assignment when x isn't defined yet, as Rego's unification would bind it
+*/
+func (policy *regoPolicy) check() error {
+	for name, definitions := range policy.rules {
+		defaults := 0
+		for _, rule := range definitions {
+			if rule.isSet != definitions[0].isSet {
+				return fmt.Errorf("%s is defined both as a partial set and as a complete rule", name)
+			}
+			if rule.isDefault {
+				defaults++
+				if err := policy.checkExpr(rule.value, rule.pkg, map[string]bool{}); err != nil {
+					return fmt.Errorf("default %s: %w", name, err)
+				}
+				if !regoGround(rule.value) {
+					return fmt.Errorf("default %s must be given a constant", name)
+				}
+			}
+		}
+		if defaults > 1 {
+			return fmt.Errorf("%s has more than one default", name)
+		}
+		if defaults > 0 && definitions[0].isSet {
+			return fmt.Errorf("%s is a partial set and can't have a default", name)
+		}
+
+		for _, rule := range definitions {
+			if rule.isDefault {
+				continue
+			}
+			vars := map[string]bool{}
+			for _, literal := range rule.body {
+				if err := policy.checkLiteral(literal, rule.pkg, vars); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			for _, head := range []*regoExpr{rule.key, rule.value} {
+				if head != nil {
+					if err := policy.checkExpr(head, rule.pkg, vars); err != nil {
+						return fmt.Errorf("%s: %w", name, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (policy *regoPolicy) checkLiteral(literal *regoLiteral, pkg string, vars map[string]bool) error {
+	if literal.kind == "expr" && !literal.negated && literal.expr.kind == "binary" && literal.expr.name == "=" {
+		if target := literal.expr.args[0]; target.kind == "ref" && len(target.args) == 0 && !policy.defined(target.name, pkg, vars) {
+			literal.kind, literal.vars, literal.expr = "assign", []string{target.name}, literal.expr.args[1]
+		}
+	}
+	if err := policy.checkExpr(literal.expr, pkg, vars); err != nil {
+		return err
+	}
+	for _, name := range literal.vars {
+		if vars[name] || name == "input" || name == "data" {
+			return fmt.Errorf("%s is assigned twice", name)
+		}
+		if name != "_" {
+			vars[name] = true
+		}
+	}
+	return nil
+}
+
+// The defined method reports whether name can head a reference at this point of a rule body
+func (policy *regoPolicy) defined(name, pkg string, vars map[string]bool) bool {
+	_, isRule := policy.rules[pkg+"."+name]
+	return vars[name] || isRule || name == "input" || name == "data"
+}
+
+func (policy *regoPolicy) checkExpr(expr *regoExpr, pkg string, vars map[string]bool) error {
+	switch expr.kind {
+	case "ref":
+		if !policy.defined(expr.name, pkg, vars) {
+			return fmt.Errorf("%s is undefined, neither a variable assigned earlier, input, data nor a rule of package %s", expr.name, pkg)
+		}
+	case "call":
+		builtin, ok := regoBuiltins[expr.name]
+		if !ok {
+			return fmt.Errorf("%s() isn't a supported builtin", expr.name)
+		}
+		if len(expr.args) != builtin.arity {
+			return fmt.Errorf("%s() takes %d arguments, not %d", expr.name, builtin.arity, len(expr.args))
+		}
+	}
+	for _, arg := range expr.args {
+		// The _ of input.list[_] iterates rather than naming a variable
+		if expr.kind == "ref" && regoWildcard(arg) {
+			continue
+		}
+		if err := policy.checkExpr(arg, pkg, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The regoWildcard function reports whether expr is the _ that iterates over a collection in a reference
+func regoWildcard(expr *regoExpr) bool {
+	return expr.kind == "ref" && expr.name == "_" && len(expr.args) == 0
+}
+
+// The regoGround function reports whether expr is made only of constants
+func regoGround(expr *regoExpr) bool {
+	if expr.kind == "ref" || expr.kind == "call" && expr.name != "set" {
+		return false
+	}
+	for _, arg := range expr.args {
+		if !regoGround(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// The regoEval struct evaluates rules against one input, each rule at most once
+type regoEval struct {
+	policy  *regoPolicy
+	input   interface{}
+	values  map[string]interface{}
+	defined map[string]bool
+	active  map[string]bool
+}
+
+// regoEnv holds the variables a body has assigned so far, it is copied rather than changed so backtracking needs no undo
+type regoEnv map[string]interface{}
+
+func (env regoEnv) with(name string, value interface{}) regoEnv {
+	copied := make(regoEnv, len(env)+1)
+	for key, existing := range env {
+		copied[key] = existing
+	}
+	if name != "_" {
+		copied[name] = value
+	}
+	return copied
+}
+
+/*
+	The evaluate method returns the value of the rule at rulePath (e.g. "data.oracle.allow") for input, defined is false when no definition
+	of the rule applies and it has no default
+	input is converted to its JSON form first, so numbers are float64 and structs are objects as they would be in OPA
+*/
+func (policy *regoPolicy) evaluate(rulePath string, input interface{}) (value interface{}, defined bool, err error) {
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return nil, false, err
+	}
+	var document interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return nil, false, err
+	}
+	evaluation := &regoEval{policy: policy, input: document, values: map[string]interface{}{}, defined: map[string]bool{}, active: map[string]bool{}}
+	return evaluation.rule(strings.TrimPrefix(rulePath, "data."))
+}
+
+// The rule method evaluates every definition of the rule at name, remembering the result for the rest of the evaluation
+func (evaluation *regoEval) rule(name string) (interface{}, bool, error) {
+	if defined, done := evaluation.defined[name]; done {
+		return evaluation.values[name], defined, nil
+	}
+	if evaluation.active[name] {
+		return nil, false, fmt.Errorf("%s depends on itself", name)
+	}
+	evaluation.active[name] = true
+	defer delete(evaluation.active, name)
+
+	definitions := evaluation.policy.rules[name]
+	var fallback *regoRule
+	results := regoSet{}
+	for _, rule := range definitions {
+		if rule.isDefault {
+			fallback = rule
+			continue
+		}
+		head := rule.value
+		if rule.isSet {
+			head = rule.key
+		}
+		err := evaluation.body(rule.body, 0, regoEnv{}, rule.pkg, func(env regoEnv) error {
+			if head == nil {
+				results["true"] = true
+				return nil
+			}
+			return evaluation.eval(head, env, rule.pkg, func(value interface{}) error {
+				results[regoKey(value)] = value
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var value interface{}
+	defined := true
+	switch {
+	case len(definitions) > 0 && definitions[0].isSet:
+		value = results
+	case len(results) > 1:
+		return nil, false, fmt.Errorf("%s has conflicting values %s", name, regoKey(results))
+	case len(results) == 1:
+		for _, only := range results {
+			value = only
+		}
+	case fallback != nil:
+		err := evaluation.eval(fallback.value, regoEnv{}, fallback.pkg, func(constant interface{}) error {
+			value = constant
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	default:
+		defined = false
+	}
+	evaluation.values[name], evaluation.defined[name] = value, defined
+	return value, defined, nil
+}
+
+// The body method finds every way the literals from i onwards hold, handing the variables of each to yield
+func (evaluation *regoEval) body(literals []*regoLiteral, i int, env regoEnv, pkg string, yield func(regoEnv) error) error {
+	if i == len(literals) {
+		return yield(env)
+	}
+	literal := literals[i]
+	next := func(env regoEnv) error {
+		return evaluation.body(literals, i+1, env, pkg, yield)
+	}
+
+	switch {
+	case literal.kind == "assign":
+		return evaluation.eval(literal.expr, env, pkg, func(value interface{}) error {
+			return next(env.with(literal.vars[0], value))
+		})
+	case literal.kind == "some":
+		return evaluation.eval(literal.expr, env, pkg, func(collection interface{}) error {
+			return regoEach(collection, func(key, value interface{}) error {
+				bound := env.with(literal.vars[len(literal.vars)-1], value)
+				if len(literal.vars) == 2 {
+					bound = bound.with(literal.vars[0], key)
+				}
+				return next(bound)
+			})
+		})
+	case literal.negated:
+		holds := false
+		err := evaluation.eval(literal.expr, env, pkg, func(value interface{}) error {
+			if value != false {
+				holds = true
+				return errRegoStop
+			}
+			return nil
+		})
+		if err != nil && err != errRegoStop {
+			return err
+		}
+		if holds {
+			return nil
+		}
+		return next(env)
+	}
+	return evaluation.eval(literal.expr, env, pkg, func(value interface{}) error {
+		if value == false {
+			return nil
+		}
+		return next(env)
+	})
+}
+
+/*
+	The eval method hands every value expr takes to yield: none when it is undefined (a missing field, say),
+	several when a reference iterates with _ or a rule's partial set is indexed by one
+*/
+func (evaluation *regoEval) eval(expr *regoExpr, env regoEnv, pkg string, yield func(interface{}) error) error {
+	switch expr.kind {
+	case "value":
+		return yield(expr.value)
+	case "ref":
+		return evaluation.ref(expr, env, pkg, yield)
+	case "array", "set", "call":
+		return evaluation.evalAll(expr.args, env, pkg, nil, func(values []interface{}) error {
+			switch expr.kind {
+			case "array":
+				return yield(append([]interface{}{}, values...))
+			case "set":
+				set := regoSet{}
+				for _, value := range values {
+					set[regoKey(value)] = value
+				}
+				return yield(set)
+			}
+			result, err := regoBuiltins[expr.name].call(values)
+			if err != nil {
+				return fmt.Errorf("%s(): %w", expr.name, err)
+			}
+			return yield(result)
+		})
+	case "object":
+		return evaluation.evalAll(expr.args, env, pkg, nil, func(values []interface{}) error {
+			object := map[string]interface{}{}
+			for i := 0; i < len(values); i += 2 {
+				key, ok := values[i].(string)
+				if !ok {
+					return fmt.Errorf("object keys must be strings, not %s", regoKey(values[i]))
+				}
+				object[key] = values[i+1]
+			}
+			return yield(object)
+		})
+	}
+	return evaluation.evalAll(expr.args, env, pkg, nil, func(values []interface{}) error {
+		result, ok, err := regoOperate(expr.name, values[0], values[1])
+		if err != nil || !ok {
+			return err
+		}
+		return yield(result)
+	})
+}
+
+// The evalAll method hands yield every combination of the values of exprs, evaluated in order
+func (evaluation *regoEval) evalAll(exprs []*regoExpr, env regoEnv, pkg string, values []interface{}, yield func([]interface{}) error) error {
+	if len(values) == len(exprs) {
+		return yield(values)
+	}
+	return evaluation.eval(exprs[len(values)], env, pkg, func(value interface{}) error {
+		return evaluation.evalAll(exprs, env, pkg, append(values[:len(values):len(values)], value), yield)
+	})
+}
+
+// The ref method resolves a reference: a variable, input, a rule of pkg or a path below data, then follows its path
+func (evaluation *regoEval) ref(expr *regoExpr, env regoEnv, pkg string, yield func(interface{}) error) error {
+	path := expr.args
+	var start interface{}
+	switch value, isVar := env[expr.name]; {
+	case isVar:
+		start = value
+	case expr.name == "input":
+		start = evaluation.input
+	case expr.name == "data":
+		return evaluation.data("", evaluation.policy.data, path, env, pkg, yield)
+	default:
+		value, defined, err := evaluation.rule(pkg + "." + expr.name)
+		if err != nil || !defined {
+			return err
+		}
+		start = value
+	}
+	return evaluation.walk(start, path, env, pkg, yield)
+}
+
+/*
+	The data method follows path below data, where prefix is the path taken so far: segments naming a package or a rule
+	are looked up among the rules, anything else in the documents of the data.json files
+*/
+func (evaluation *regoEval) data(prefix string, document interface{}, path []*regoExpr, env regoEnv, pkg string, yield func(interface{}) error) error {
+	if len(path) == 0 {
+		return yield(document)
+	}
+	if regoWildcard(path[0]) {
+		return evaluation.walk(document, path, env, pkg, yield)
+	}
+	return evaluation.eval(path[0], env, pkg, func(segment interface{}) error {
+		name, ok := segment.(string)
+		if !ok {
+			return evaluation.walk(document, path, env, pkg, yield)
+		}
+		full := strings.TrimPrefix(prefix+"."+name, ".")
+		if _, isRule := evaluation.policy.rules[full]; isRule {
+			value, defined, err := evaluation.rule(full)
+			if err != nil || !defined {
+				return err
+			}
+			return evaluation.walk(value, path[1:], env, pkg, yield)
+		}
+		var nested interface{}
+		if object, ok := document.(map[string]interface{}); ok {
+			nested = object[name]
+		}
+		if nested == nil && !evaluation.policy.isPackagePrefix(full) {
+			return nil
+		}
+		return evaluation.data(full, nested, path[1:], env, pkg, yield)
+	})
+}
+
+// The isPackagePrefix method reports whether some package of the policy is name or lies below it
+func (policy *regoPolicy) isPackagePrefix(name string) bool {
+	for pkg := range policy.packages {
+		if pkg == name || strings.HasPrefix(pkg, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// The walk method follows path from value, a _ in it iterating over every element
+func (evaluation *regoEval) walk(value interface{}, path []*regoExpr, env regoEnv, pkg string, yield func(interface{}) error) error {
+	if len(path) == 0 {
+		return yield(value)
+	}
+	if regoWildcard(path[0]) {
+		return regoEach(value, func(_, element interface{}) error {
+			return evaluation.walk(element, path[1:], env, pkg, yield)
+		})
+	}
+	return evaluation.eval(path[0], env, pkg, func(index interface{}) error {
+		var element interface{}
+		found := false
+		switch collection := value.(type) {
+		case map[string]interface{}:
+			if key, ok := index.(string); ok {
+				element, found = collection[key]
+			}
+		case []interface{}:
+			if position, ok := index.(float64); ok && position == math.Trunc(position) && position >= 0 && position < float64(len(collection)) {
+				element, found = collection[int(position)], true
+			}
+		case regoSet:
+			element, found = collection[regoKey(index)]
+		}
+		if !found {
+			return nil
+		}
+		return evaluation.walk(element, path[1:], env, pkg, yield)
+	})
+}
+
+// The regoEach function calls visit with the key and value of every element of an array, object or set, a set's keys being its elements
+func regoEach(collection interface{}, visit func(key, value interface{}) error) error {
+	switch collection := collection.(type) {
+	case []interface{}:
+		for i, value := range collection {
+			if err := visit(float64(i), value); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(collection))
+		for key := range collection {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := visit(key, collection[key]); err != nil {
+				return err
+			}
+		}
+	case regoSet:
+		keys := make([]string, 0, len(collection))
+		for key := range collection {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := visit(collection[key], collection[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The regoOperate function applies a binary operator, ok is false when the result is undefined as dividing by zero is
+func regoOperate(operator string, left, right interface{}) (result interface{}, ok bool, err error) {
+	switch operator {
+	case "==", "=":
+		return regoKey(left) == regoKey(right), true, nil
+	case "!=":
+		return regoKey(left) != regoKey(right), true, nil
+	case "in":
+		found := false
+		regoEach(right, func(_, element interface{}) error {
+			found = found || regoKey(element) == regoKey(left)
+			return nil
+		})
+		return found, true, nil
+	}
+
+	leftNumber, leftIsNumber := left.(float64)
+	rightNumber, rightIsNumber := right.(float64)
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+	switch {
+	case leftIsString && rightIsString && operator != "+" && operator != "-" && operator != "*" && operator != "/":
+		return map[string]bool{"<": leftString < rightString, "<=": leftString <= rightString, ">": leftString > rightString, ">=": leftString >= rightString}[operator], true, nil
+	case !leftIsNumber || !rightIsNumber:
+		return nil, false, fmt.Errorf("%s needs two numbers or two strings, not %s and %s", operator, regoKey(left), regoKey(right))
+	}
+	switch operator {
+	case "<":
+		return leftNumber < rightNumber, true, nil
+	case "<=":
+		return leftNumber <= rightNumber, true, nil
+	case ">":
+		return leftNumber > rightNumber, true, nil
+	case ">=":
+		return leftNumber >= rightNumber, true, nil
+	case "+":
+		return leftNumber + rightNumber, true, nil
+	case "-":
+		return leftNumber - rightNumber, true, nil
+	case "*":
+		return leftNumber * rightNumber, true, nil
+	}
+	if rightNumber == 0 {
+		return nil, false, nil
+	}
+	return leftNumber / rightNumber, true, nil
+}
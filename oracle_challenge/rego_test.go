@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// geofencePolicy is the kind of policy decision.policy is meant for, a country block list with reasons and an allow list of networks
+const geofencePolicy = `package oracle
+
+import rego.v1
+
+# Countries nobody is served from
+blocked := {"KP", "IR"}
+
+default allow := false
+
+allow if {
+	count(deny) == 0
+}
+
+allow if {
+	some network in data.oracle.trusted_networks
+	net.cidr_contains(network, input.ip)
+}
+
+deny contains msg if {
+	input.geo.country in blocked
+	msg := sprintf("requests from %s are not served", [input.geo.country])
+}
+
+deny contains "the admin API isn't public" if startswith(input.path, "/admin")
+
+decision := {"allow": allow, "reason": concat("; ", deny)}
+`
+
+// The writeTestPolicy function writes files, named by their path below the policy directory, and returns the directory
+func writeTestPolicy(t *testing.T, files map[string]string) string {
+	t.Helper()
+	directory := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(directory, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return directory
+}
+
+func TestRegoEvaluate(t *testing.T) {
+	policy, err := loadRegoPolicy(writeTestPolicy(t, map[string]string{
+		"policy.rego":             geofencePolicy,
+		"oracle/data.json":        `{"trusted_networks": ["10.0.0.0/8", "2001:db8::/32"]}`,
+		"oracle/limits/data.json": `{"max": 3}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		rule  string
+		input map[string]interface{}
+		want  string
+	}{
+		{name: "allowed country", rule: "data.oracle.allow", input: map[string]interface{}{"ip": "192.0.2.1", "path": "/ip", "geo": map[string]string{"country": "NL"}}, want: "true"},
+		{name: "blocked country", rule: "data.oracle.allow", input: map[string]interface{}{"ip": "192.0.2.1", "path": "/ip", "geo": map[string]string{"country": "KP"}}, want: "false"},
+		{name: "blocked country on a trusted network", rule: "oracle.allow", input: map[string]interface{}{"ip": "10.1.2.3", "path": "/ip", "geo": map[string]string{"country": "KP"}}, want: "true"},
+		{name: "trusted IPv6 network", rule: "oracle.allow", input: map[string]interface{}{"ip": "2001:db8::1", "path": "/admin/x"}, want: "true"},
+		{name: "no geo", rule: "oracle.allow", input: map[string]interface{}{"ip": "192.0.2.1", "path": "/ip"}, want: "true"},
+		{name: "reasons", rule: "oracle.deny", input: map[string]interface{}{"ip": "192.0.2.1", "path": "/admin/x", "geo": map[string]string{"country": "IR"}},
+			want: `["requests from IR are not served","the admin API isn't public"]`},
+		{name: "decision object", rule: "oracle.decision", input: map[string]interface{}{"ip": "192.0.2.1", "path": "/ip", "geo": map[string]string{"country": "IR"}},
+			want: `{"allow":false,"reason":"requests from IR are not served"}`},
+		{name: "not a rule", rule: "oracle.limits", input: map[string]interface{}{}, want: "<undefined>"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, defined, err := policy.evaluate(test.rule, test.input)
+			if err != nil {
+				t.Fatalf("evaluate() error = %v", err)
+			}
+			got := "<undefined>"
+			if defined {
+				got = regoKey(value)
+			}
+			if got != test.want {
+				t.Fatalf("evaluate() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegoExpressions(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{name: "v0 syntax", rule: "p { input.a == 1; input.b != 2 }", input: `{"a": 1, "b": 3}`, want: "true"},
+		{name: "undefined", rule: "p if input.a == 2", input: `{"a": 1}`, want: "<undefined>"},
+		{name: "missing field", rule: "p if input.missing.field == 1", input: `{}`, want: "<undefined>"},
+		{name: "not of a missing field", rule: "p if not input.missing", input: `{}`, want: "true"},
+		{name: "not", rule: "p if { not input.a == 1 }", input: `{"a": 1}`, want: "<undefined>"},
+		{name: "iteration", rule: "p if input.list[_] == \"b\"", input: `{"list": ["a", "b"]}`, want: "true"},
+		{name: "some with index", rule: "p contains i if { some i, x in input.list\n x > 1 }", input: `{"list": [1, 2, 3]}`, want: "[1,2]"},
+		{name: "object iteration", rule: "p contains k if { some k, v in input.o; v }", input: `{"o": {"x": true, "y": false}}`, want: `["x"]`},
+		{name: "assignment by unification", rule: "p := y if { x = input.a; y = x * 2 + 1 }", input: `{"a": 4}`, want: "9"},
+		{name: "arithmetic precedence", rule: "p := 2 + 3 * 4 - 10 / 5", input: `{}`, want: "12"},
+		{name: "division by zero", rule: "p := input.a / 0", input: `{"a": 1}`, want: "<undefined>"},
+		{name: "string comparison", rule: "p if \"abc\" < \"abd\"", input: `{}`, want: "true"},
+		{name: "in array", rule: "p if input.a in [1, 2]", input: `{"a": 2}`, want: "true"},
+		{name: "in object values", rule: "p if \"x\" in {\"k\": \"x\"}", input: `{}`, want: "true"},
+		{name: "array index", rule: "p := input.list[1]", input: `{"list": ["a", "b"]}`, want: `"b"`},
+		{name: "index out of range", rule: "p := input.list[5]", input: `{"list": ["a"]}`, want: "<undefined>"},
+		{name: "set membership by index", rule: "s := {\"a\", \"b\"}\np if s[\"a\"]", input: `{}`, want: "true"},
+		{name: "multi-line collections", rule: "p := [\n  1,\n  2,\n]", input: `{}`, want: "[1,2]"},
+		{name: "empty set", rule: "p := set()", input: `{}`, want: "[]"},
+		{name: "builtins", rule: "p := [lower(\"AB\"), upper(\"ab\"), trim_space(\" x \"), split(\"a,b\", \",\"), contains(\"abc\", \"b\"), endswith(\"abc\", \"c\"), count(\"héllo\")]",
+			input: `{}`, want: `["ab","AB","x",["a","b"],true,true,5]`},
+		{name: "object.get", rule: "p := [object.get(input, \"a\", 0), object.get(input, \"b\", 0)]", input: `{"a": 1}`, want: "[1,0]"},
+		{name: "cidr in cidr", rule: "p := [net.cidr_contains(\"10.0.0.0/8\", \"10.1.0.0/16\"), net.cidr_contains(\"10.0.0.0/16\", \"10.0.0.0/8\")]", input: `{}`, want: "[true,false]"},
+		{name: "raw string", rule: "p := `a\\b`", input: `{}`, want: `"a\\b"`},
+		{name: "rule values from several definitions", rule: "p := 1 if input.a\np := 1 if input.b", input: `{"a": true, "b": true}`, want: "1"},
+		{name: "conflicting values", rule: "p := 1 if input.a\np := 2 if input.b", input: `{"a": true, "b": true}`, wantErr: "conflicting values"},
+		{name: "recursion", rule: "p if q\nq if p", input: `{}`, wantErr: "depends on itself"},
+		{name: "comparing unlike types", rule: "p if input.a < \"x\"", input: `{"a": 1}`, wantErr: "two numbers or two strings"},
+		{name: "builtin given the wrong type", rule: "p if startswith(input.a, \"x\")", input: `{"a": 1}`, wantErr: "expected a string"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := loadRegoPolicy(writeTestPolicy(t, map[string]string{"p.rego": "package test\n" + test.rule + "\n"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var input interface{}
+			if err := json.Unmarshal([]byte(test.input), &input); err != nil {
+				t.Fatal(err)
+			}
+			value, defined, err := policy.evaluate("data.test.p", input)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("evaluate() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("evaluate() error = %v", err)
+			}
+			got := "<undefined>"
+			if defined {
+				got = regoKey(value)
+			}
+			if got != test.want {
+				t.Fatalf("evaluate() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRegoPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{name: "no package", files: map[string]string{"p.rego": "allow := true"}, wantErr: "expected package"},
+		{name: "no rules", files: map[string]string{"p.rego": "package test", "README.md": "allow := true"}, wantErr: "no rules"},
+		{name: "undefined name", files: map[string]string{"p.rego": "package test\nallow if inpt.ip == \"1\""}, wantErr: "inpt is undefined"},
+		{name: "variable used before it's assigned", files: map[string]string{"p.rego": "package test\nallow if { x == 1; x := 1 }"}, wantErr: "x is undefined"},
+		{name: "assigned twice", files: map[string]string{"p.rego": "package test\nallow if { x := 1; x := 2 }"}, wantErr: "assigned twice"},
+		{name: "unknown builtin", files: map[string]string{"p.rego": "package test\nallow if regex.match(\"a\", input.path)"}, wantErr: "isn't a supported builtin"},
+		{name: "wrong number of arguments", files: map[string]string{"p.rego": "package test\nallow if startswith(input.path)"}, wantErr: "takes 2 arguments"},
+		{name: "function", files: map[string]string{"p.rego": "package test\nf(x) := x"}, wantErr: "functions aren't supported"},
+		{name: "comprehension", files: map[string]string{"p.rego": "package test\np := [x | some x in input.list]"}, wantErr: "comprehensions aren't supported"},
+		{name: "else", files: map[string]string{"p.rego": "package test\np := 1 if input.a else := 2"}, wantErr: "else isn't supported"},
+		{name: "every", files: map[string]string{"p.rego": "package test\np if { every x in input.list { x } }"}, wantErr: "every isn't supported"},
+		{name: "with", files: map[string]string{"p.rego": "package test\nq := 1\np if { q with input as {} }"}, wantErr: "with isn't supported"},
+		{name: "other imports", files: map[string]string{"p.rego": "package test\nimport data.other\np := 1"}, wantErr: "isn't supported"},
+		{name: "set and complete rule", files: map[string]string{"p.rego": "package test\np contains 1\np := 2"}, wantErr: "both as a partial set"},
+		{name: "two defaults", files: map[string]string{"p.rego": "package test\ndefault p := 1\ndefault p := 2"}, wantErr: "more than one default"},
+		{name: "default that isn't a constant", files: map[string]string{"p.rego": "package test\ndefault p := input.a"}, wantErr: "must be given a constant"},
+		{name: "unterminated string", files: map[string]string{"p.rego": "package test\np := \"abc\n"}, wantErr: "unterminated string"},
+		{name: "two statements on a line", files: map[string]string{"p.rego": "package test\np := 1 q := 2"}, wantErr: "expected the end of the rule"},
+		{name: "data.json that conflicts", files: map[string]string{"p.rego": "package test\np := 1", "data.json": `{"a": 1}`, "a/data.json": `{"b": 2}`}, wantErr: "set twice"},
+		{name: "v0 keywords and rules across files", files: map[string]string{"a.rego": "package test\nimport future.keywords.in\np { 1 in [1] }", "b/b.rego": "package test\nq := p"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadRegoPolicy(writeTestPolicy(t, test.files))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("loadRegoPolicy() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("loadRegoPolicy() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadRegoBundle(t *testing.T) {
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressed)
+	for name, contents := range map[string]string{
+		"/.manifest":           `{"revision": "1"}`,
+		"/oracle/policy.rego":  "package oracle\nallow if input.geo.country in data.oracle.allowed",
+		"/oracle/data.json":    `{"allowed": ["NL", "BE"]}`,
+		"./other/unused.rego":  "package other\nx := 1",
+		"/oracle/ignored.yaml": "allow: true",
+	} {
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		archive.Write([]byte(contents))
+	}
+	archive.Close()
+	compressed.Close()
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := os.WriteFile(path, buffer.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := loadRegoPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for country, want := range map[string]bool{"NL": true, "BE": true, "US": false} {
+		value, defined, err := policy.evaluate("data.oracle.allow", map[string]interface{}{"geo": map[string]string{"country": country}})
+		if err != nil || defined != want || defined && value != true {
+			t.Errorf("allow for %s = %v, %v, %v, want defined %v", country, value, defined, err, want)
+		}
+	}
+}
+
+func TestEvaluateDecisionPolicy(t *testing.T) {
+	directory := writeTestPolicy(t, map[string]string{"p.rego": `package oracle
+allow if input.path != "/blocked"
+decision := {"allow": false, "reason": "closed"} if input.path == "/closed"
+bad := "yes"
+`})
+	defer func() { decisionPolicy, config.Decision = nil, decisionSettings{} }()
+	tests := []struct {
+		name        string
+		settings    decisionSettings
+		path        string
+		want        decision
+		wantErr     string
+		wantLoadErr string
+	}{
+		{name: "allowed", settings: decisionSettings{Policy: directory}, path: "/ip", want: decision{Allow: true}},
+		{name: "undefined", settings: decisionSettings{Policy: directory}, path: "/blocked", want: decision{Reason: "the policy is undefined for this request"}},
+		{name: "object", settings: decisionSettings{Policy: directory, Rule: "data.oracle.decision"}, path: "/closed", want: decision{Reason: "closed"}},
+		{name: "not a verdict", settings: decisionSettings{Policy: directory, Rule: "oracle.bad"}, path: "/ip", wantErr: "must be a boolean or an object"},
+		{name: "unknown rule", settings: decisionSettings{Policy: directory, Rule: "oracle.missing"}, wantLoadErr: "has no rule"},
+		{name: "policy and webhook", settings: decisionSettings{Policy: directory, URL: "http://127.0.0.1:1/"}, wantLoadErr: "not both"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Decision = test.settings
+			var err error
+			decisionPolicy, err = loadDecisionPolicy(test.settings)
+			if test.wantLoadErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantLoadErr) {
+					t.Fatalf("loadDecisionPolicy() error = %v, want one containing %q", err, test.wantLoadErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := evaluateDecisionPolicy("192.0.2.1", test.path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("evaluateDecisionPolicy() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("evaluateDecisionPolicy() = %+v, %v, want %+v", got, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// errNoAddresses is returned by resolveHostname for a name without A or AAAA records
+var errNoAddresses = errors.New("the name has no A or AAAA records")
+
+// The resolvedAddress struct is one address of /resolve/{hostname}, Type is the record it came from ("A" or "AAAA")
+type resolvedAddress struct {
+	Type string `json:"type"`
+	batchResult
+}
+
+// The resolveReport struct is the answer of /resolve/{hostname}
+type resolveReport struct {
+	Hostname  string            `json:"hostname"`
+	Addresses []resolvedAddress `json:"addresses"`
+}
+
+/*
+	The resolveHostname function returns the A and then the AAAA records of name, errNoAddresses when it has neither
+	A failure of one of the two lookups is only an error when the other found nothing either
+*/
+func resolveHostname(ctx context.Context, name string) ([]resolvedAddress, error) {
+	var addresses []resolvedAddress
+	var failure error
+	for _, family := range []struct{ network, record string }{{"ip4", "A"}, {"ip6", "AAAA"}} {
+		ips, err := net.DefaultResolver.LookupIP(ctx, family.network, name)
+		var dnsError *net.DNSError
+		if errors.As(err, &dnsError) && dnsError.IsNotFound {
+			continue
+		}
+		if err != nil {
+			failure = err
+			continue
+		}
+		for _, ip := range ips {
+			addresses = append(addresses, resolvedAddress{Type: family.record, batchResult: batchResult{IP: ip.String()}})
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses, nil
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return nil, errNoAddresses
+}
+
+// The writeResolveError function answers a request whose name didn't resolve, 404 when it has no addresses and 502 when resolving failed
+func writeResolveError(w http.ResponseWriter, name string, err error) {
+	if errors.Is(err, errNoAddresses) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"name": name, "error": name + " has no addresses"})
+		return
+	}
+	writeJSON(w, http.StatusBadGateway, map[string]string{"name": name, "error": "Error while resolving the name: " + err.Error()})
+}
+
+/*
+	The handleResolve function serves /resolve/{hostname}, the A and AAAA records of the name each with its geolocation,
+	so where a name lives takes a single call, ?fields= narrows every location as it does for /ip
+*/
+func handleResolve(w http.ResponseWriter, r *http.Request) {
+	name, err := parseHostname(strings.TrimPrefix(r.URL.Path, "/resolve/"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	fields, err := requestedFields(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), domainTimeout)
+	defer cancel()
+	addresses, err := resolveHostname(ctx, name)
+	if err != nil {
+		writeResolveError(w, name, err)
+		return
+	}
+	for i, address := range addresses {
+		addresses[i].batchResult = lookupBatchEntry(r, address.IP, fields)
+	}
+	writeJSON(w, http.StatusOK, resolveReport{Hostname: name, Addresses: addresses})
+}
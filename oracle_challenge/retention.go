@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultPurgeInterval applies when retention.purge_interval_minutes isn't configured
+const defaultPurgeInterval = time.Hour
+
+/*
+	The retentionSettings struct bounds how long stored data is kept, a zero number of days keeps that data indefinitely
+	HistoryDays applies to the self history (the newest change is always kept, it is the current address),
+	AuditDays to the audit log, while cached geolocations are purged once their cache.ttl_seconds pass
+*/
+type retentionSettings struct {
+	HistoryDays          int `json:"history_days"`
+	AuditDays            int `json:"audit_days"`
+	PurgeIntervalMinutes int `json:"purge_interval_minutes"`
+}
+
+// The purgeReport struct counts what one purge, or one request to forget an address, removed from each store
+type purgeReport struct {
+	History int `json:"history"`
+	Audit   int `json:"audit"`
+	Cache   int `json:"cache"`
+}
+
+// The purge function removes everything older than its retention period as of now
+func purge(now time.Time) (purgeReport, error) {
+	report := purgeReport{Cache: geoCache.purgeExpired()}
+	var err error
+	if days := config.Retention.HistoryDays; days > 0 && history != nil {
+		cutoff := now.AddDate(0, 0, -days)
+		report.History, err = history.remove(func(change ipChange, latest bool) bool {
+			return !latest && change.ChangedAt.Before(cutoff)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	if days := config.Retention.AuditDays; days > 0 {
+		cutoff := now.AddDate(0, 0, -days)
+		report.Audit, err = dropAuditRecords(func(record auditRecord) bool {
+			return record.Time.Before(cutoff)
+		})
+	}
+	return report, err
+}
+
+// The purgeEvery function purges on the configured interval until stop is closed
+func purgeEvery(stop <-chan struct{}) {
+	interval := defaultPurgeInterval
+	if config.Retention.PurgeIntervalMinutes > 0 {
+		interval = time.Duration(config.Retention.PurgeIntervalMinutes) * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report, err := purge(time.Now().UTC())
+			if err != nil {
+				log.Printf("retention purge: %v", err)
+			}
+			if report.History+report.Audit > 0 {
+				log.Printf("retention purge: removed %d history and %d audit records", report.History, report.Audit)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The forget function removes every record of ip from the cache, the audit log and the self history
+func forget(ip string) (purgeReport, error) {
+	report := purgeReport{}
+	if geoCache.forget(ip) {
+		report.Cache = 1
+	}
+	var err error
+	if report.Audit, err = dropAuditRecords(func(record auditRecord) bool { return record.IP == ip }); err != nil {
+		return report, err
+	}
+	if history != nil {
+		report.History, err = history.remove(func(change ipChange, _ bool) bool { return change.IP == ip })
+	}
+	return report, err
+}
+
+/*
+	The handleForget function serves POST /admin/forget?ip=..., deleting everything stored about an address for a data-deletion request
+	The response counts what was removed from each store, a second request for the same address removes nothing
+*/
+func handleForget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to forget an address", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "ip must be a valid IP address", http.StatusBadRequest)
+		return
+	}
+
+	report, err := forget(ip.String())
+	if err != nil {
+		http.Error(w, "Error while forgetting "+ip.String()+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin: forgot ip=%s", ip)
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+/*
+	The route struct describes a single endpoint, Feature names the flag that enables it while "" marks a core endpoint that is always served
+	Auth names the key the endpoint requires, see registerRoutes()
+*/
+type route struct {
+	Pattern string
+	Feature string
+	Handler http.HandlerFunc
+	Auth    string
+}
+
+// The keys a route can require, authNone leaves it open unless the virtual host requires an API key for everything
+const (
+	authNone   = ""
+	authAPIKey = "api_key"
+	authAdmin  = "admin"
+)
+
+/*
+	defaultFeatures lists every feature flag along with whether it is on when the config doesn't mention it
+	Anything that makes outbound requests on a client's behalf, polls the upstream in the background or exposes administrative controls
+	or internal usage ships disabled,
+	as do compat and ipinfo since they change what /ip returns
+*/
+var defaultFeatures = map[string]bool{
+	"email_headers":    true,
+	"checkip":          true,
+	"version":          true,
+	"headers":          true,
+	"ua":               true,
+	"tls":              true,
+	"connection":       true,
+	"openapi":          true,
+	"cidr":             true,
+	"classify":         true,
+	"compat":           false,
+	"connect":          false,
+	"ipinfo":           false,
+	"adapters":         true,
+	"enrich":           true,
+	"self":             false,
+	"self_history":     false,
+	"self_consistency": false,
+	"tenant_export":    false,
+	"ip_history":       false,
+	"aggregate":        false,
+	"batch":            false,
+	"rdns":             false,
+	"dnsbl":            false,
+	"asn":              false,
+	"domain":           false,
+	"whois":            false,
+	"resolve":          false,
+	"distance":         false,
+	"geofence":         false,
+	"time":             false,
+	"pool":             false,
+	"share":            false,
+	"bgp":              false,
+	"stats":            false,
+	"metrics":          false,
+	"url_analysis":     false,
+	"proxy_check":      false,
+	"admin":            false,
+}
+
+/*
+	The routes function is the single table of every endpoint the service knows how to serve
+	The compat and ipinfo features swap the labelled /ip output for the bare address that icanhazip/ifconfig.me/ipinfo.io clients expect
+	on the listeners they are enabled for, /ip/{address} and the other paths below /ip/ keep their usual handler
+*/
+func routes(listener listenerSettings) []route {
+	ipHandler := handleIP
+	if listener.output != nil {
+		ipHandler = listener.output.serveIP
+	}
+	bareIPHandler := ipHandler
+	if listener.featureEnabled("compat") || listener.featureEnabled("ipinfo") {
+		bareIPHandler = handleBareIP
+	}
+
+	// /asn/{n}/prefixes (bgp) and /asn/{ip} (asn) share a path, with the asn feature on a single handler serves both
+	asnRoute := route{Pattern: "/asn/", Feature: "bgp", Handler: handleASNPrefixes}
+	if listener.featureEnabled("asn") {
+		asnRoute = route{Pattern: "/asn/", Feature: "asn", Handler: asnHandler(listener.featureEnabled("bgp"))}
+	}
+
+	table := []route{
+		{Pattern: "/ip", Handler: withNegotiation(bareIPHandler)},
+		{Pattern: "/ip/", Handler: withNegotiation(ipHandler)},
+		{Pattern: "/ip/json", Handler: handleJSONIP},
+		{Pattern: "/ip/raw", Handler: handleBareIP},
+		{Pattern: "/healthz", Handler: handleHealthz},
+		{Pattern: "/readyz", Handler: handleReadyz},
+		{Pattern: "/version", Feature: "version", Handler: handleVersion},
+		{Pattern: "/headers", Feature: "headers", Handler: handleHeaders},
+		{Pattern: "/ua", Feature: "ua", Handler: handleUserAgent},
+		{Pattern: "/tls", Feature: "tls", Handler: handleTLS},
+		{Pattern: "/connection", Feature: "connection", Handler: handleConnection},
+		{Pattern: "/cidr/contains", Feature: "cidr", Handler: handleCIDRContains},
+		{Pattern: "/cidr/info/", Feature: "cidr", Handler: handleCIDRInfo},
+		{Pattern: "/classify", Feature: "classify", Handler: handleClassify},
+		{Pattern: "/classify/", Feature: "classify", Handler: handleClassify},
+		{Pattern: "/enrich", Feature: "enrich", Handler: handleEnrich},
+		{Pattern: "/" + connectService + "/", Feature: "connect", Handler: handleConnect},
+		{Pattern: "/self", Feature: "self", Handler: handleSelf},
+		{Pattern: "/self/history", Feature: "self_history", Handler: handleSelfHistory},
+		{Pattern: "/self/consistency", Feature: "self_consistency", Handler: handleSelfConsistency},
+		{Pattern: "/aggregate", Feature: "aggregate", Handler: handleAggregate, Auth: authAPIKey},
+		{Pattern: "/lookup", Feature: "batch", Handler: handleBatchLookup, Auth: authAPIKey},
+		{Pattern: "/share", Feature: "share", Handler: handleShare, Auth: authAPIKey},
+		{Pattern: "/shared/", Feature: "share", Handler: handleShared},
+		{Pattern: "/rdns/", Feature: "rdns", Handler: handleRDNS},
+		{Pattern: "/dnsbl/", Feature: "dnsbl", Handler: handleDNSBL},
+		asnRoute,
+		{Pattern: "/domain/", Feature: "domain", Handler: handleDomain},
+		{Pattern: "/whois/", Feature: "whois", Handler: handleWhois},
+		{Pattern: "/resolve/", Feature: "resolve", Handler: handleResolve},
+		{Pattern: "/distance", Feature: "distance", Handler: handleDistance},
+		{Pattern: "/geofence", Feature: "geofence", Handler: handleGeofence},
+		{Pattern: "/time", Feature: "time", Handler: handleTime},
+		{Pattern: "/time/", Feature: "time", Handler: handleTime},
+		{Pattern: "/pool/register", Feature: "pool", Handler: handlePoolRegister},
+		{Pattern: "/pool/members", Feature: "pool", Handler: handlePoolMembers, Auth: authAdmin},
+		{Pattern: "/origin/", Feature: "bgp", Handler: handleOrigin},
+		{Pattern: "/stats", Feature: "stats", Handler: handleStats},
+		{Pattern: "/metrics", Feature: "metrics", Handler: handleMetrics},
+		{Pattern: "/checkip", Feature: "checkip", Handler: handleCheckIP},
+		{Pattern: "/", Feature: "compat", Handler: handleBareIP},
+		{Pattern: "/all.json", Feature: "compat", Handler: handleAllJSON},
+		{Pattern: "/", Feature: "ipinfo", Handler: handleIPInfoEmulation},
+		{Pattern: "/email/headers", Feature: "email_headers", Handler: handleEmailHeaders},
+		{Pattern: "/proxy/check", Feature: "proxy_check", Handler: handleProxyCheck},
+		{Pattern: "/url/analyze", Feature: "url_analysis", Handler: handleURLAnalysis, Auth: authAPIKey},
+		{Pattern: "/admin/maintenance", Feature: "admin", Handler: handleMaintenance, Auth: authAdmin},
+		{Pattern: "/debug/config", Feature: "admin", Handler: handleDebugConfig, Auth: authAdmin},
+		{Pattern: "/admin/bench", Feature: "admin", Handler: handleBench, Auth: authAdmin},
+		{Pattern: "/admin/feeds", Feature: "admin", Handler: handleFeeds, Auth: authAdmin},
+		{Pattern: "/admin/forget", Feature: "admin", Handler: handleForget, Auth: authAdmin},
+		{Pattern: "/admin/export", Feature: "admin", Handler: handleExport, Auth: authAdmin},
+		{Pattern: "/admin/backup", Feature: "admin", Handler: handleBackup, Auth: authAdmin},
+		{Pattern: "/history/ip", Feature: "ip_history", Handler: handleIPHistory, Auth: authAPIKey},
+		{Pattern: "/tenant/export", Feature: "tenant_export", Handler: handleTenantExport, Auth: authAPIKey},
+		{Pattern: "/self/interfaces", Feature: "admin", Handler: handleSelfInterfaces, Auth: authAdmin},
+		{Pattern: "/shaped", Feature: "adapters", Handler: handleShaped, Auth: authAPIKey},
+		{Pattern: "/openapi.json", Feature: "openapi", Handler: openAPIHandler(listener)},
+		{Pattern: "/docs", Feature: "openapi", Handler: handleDocs},
+	}
+
+	// Response adapters with a path of their own are served there, see adapterSettings
+	for _, adapter := range adapters {
+		if adapter.settings.Path != "" {
+			table = append(table, route{Pattern: adapter.settings.Path, Feature: "adapters", Handler: adapter.serve})
+		}
+	}
+	return table
+}
+
+// The featureEnabled function reports whether feature is switched on for any listener or virtual host, background work behind a feature runs when it is
+func featureEnabled(feature string) bool {
+	for _, listener := range configuredListeners() {
+		if listener.featureEnabled(feature) {
+			return true
+		}
+		for _, virtualHost := range listener.VirtualHosts {
+			if virtualHost.Features[feature] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+	The registerRoutes function adds every route enabled for listener to mux, wrapped in the check for the key it requires
+	A virtual host with RequireAPIKey set puts every open route except /healthz behind an API key
+	Two enabled features claiming the same path (compat and ipinfo both want /) are rejected
+*/
+func registerRoutes(mux *http.ServeMux, listener listenerSettings) error {
+	claimed := map[string]string{}
+	for _, endpoint := range routes(listener) {
+		if !listener.featureEnabled(endpoint.Feature) {
+			continue
+		}
+		if feature, ok := claimed[endpoint.Pattern]; ok {
+			return fmt.Errorf("features %q and %q both serve %s, enable only one of them", feature, endpoint.Feature, endpoint.Pattern)
+		}
+		claimed[endpoint.Pattern] = endpoint.Feature
+
+		handler := endpoint.Handler
+		if endpoint.Auth == authNone && listener.requireAPIKey && endpoint.Pattern != "/healthz" && endpoint.Pattern != "/readyz" {
+			endpoint.Auth = authAPIKey
+		}
+		switch endpoint.Auth {
+		case authAPIKey:
+			handler = requireAPIKey(handler)
+		case authAdmin:
+			handler = requireAdminKey(handler)
+		}
+		mux.HandleFunc(endpoint.Pattern, handler)
+	}
+	return nil
+}
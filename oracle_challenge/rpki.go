@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRPKIRefresh applies when rpki.refresh_minutes isn't configured
+const defaultRPKIRefresh = time.Hour
+
+/*
+	The rpkiSettings struct points at a validated ROA payload export, the JSON published by Routinator, rpki-client
+	and https://rpki.cloudflare.com/rpki.json: {"roas": [{"asn": "AS13335", "prefix": "1.1.1.0/24", "maxLength": 24}, ...]}
+	When set alongside the bgp feature, /origin reports the RPKI validity of each announcement
+*/
+type rpkiSettings struct {
+	URL            string `json:"url"`
+	RefreshMinutes int    `json:"refresh_minutes"`
+}
+
+// The vrp struct is a single validated ROA payload
+type vrp struct {
+	ASN       int    `json:"asn"`
+	Prefix    string `json:"prefix"`
+	MaxLength int    `json:"max_length"`
+}
+
+// The rpkiValidity struct is the RFC 6811 outcome for one origin of an announcement along with the VRPs that decided it
+type rpkiValidity struct {
+	Origin   int    `json:"origin"`
+	Status   string `json:"status"`
+	Covering []vrp  `json:"covering_vrps"`
+}
+
+// The rpkiTable struct holds the VRPs in a prefix trie, each node's value is the []vrp for that exact prefix
+type rpkiTable struct {
+	mutex   sync.RWMutex
+	vrps    *prefixTrie
+	dataset *remoteDataset
+}
+
+// rpki is built in main() when rpki.url is configured alongside the bgp feature
+var rpki *rpkiTable
+
+// The newRPKITable function builds the table and loads the cached export, the download itself happens through dataset.watch()
+func newRPKITable(settings rpkiSettings) (*rpkiTable, error) {
+	interval := defaultRPKIRefresh
+	if settings.RefreshMinutes > 0 {
+		interval = time.Duration(settings.RefreshMinutes) * time.Minute
+	}
+	table := &rpkiTable{vrps: &prefixTrie{}}
+	table.dataset = newRemoteDataset("rpki_vrps.json", settings.URL, interval, table.parse)
+	return table, table.dataset.load()
+}
+
+// The parse function replaces the table with the VRPs in an export, the ASN may be written as "AS13335" or 13335
+func (table *rpkiTable) parse(contents []byte) error {
+	var export struct {
+		ROAs []struct {
+			ASN       json.RawMessage `json:"asn"`
+			Prefix    string          `json:"prefix"`
+			MaxLength int             `json:"maxLength"`
+		} `json:"roas"`
+	}
+	if err := json.Unmarshal(contents, &export); err != nil {
+		return err
+	}
+	if len(export.ROAs) == 0 {
+		return fmt.Errorf("the export lists no ROAs")
+	}
+
+	vrps := &prefixTrie{}
+	for _, roa := range export.ROAs {
+		asn, err := parseASN(strings.Trim(string(roa.ASN), `"`))
+		if err != nil {
+			return err
+		}
+		_, prefix, err := net.ParseCIDR(roa.Prefix)
+		if err != nil {
+			return err
+		}
+		entry := vrp{ASN: asn, Prefix: prefix.String(), MaxLength: roa.MaxLength}
+		existing, _ := vrps.get(prefix)
+		entries, _ := existing.([]vrp)
+		vrps.insert(prefix, append(entries, entry))
+	}
+
+	table.mutex.Lock()
+	table.vrps = vrps
+	table.mutex.Unlock()
+	return nil
+}
+
+/*
+	The validate function applies RFC 6811 origin validation to an announcement of prefix by origin
+	"unknown" when no VRP covers the prefix, "valid" when a covering VRP names the origin and allows the prefix length,
+	"invalid" otherwise (AS0 VRPs never validate anything)
+*/
+func (table *rpkiTable) validate(prefix *net.IPNet, origin int) rpkiValidity {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	length, _ := prefix.Mask.Size()
+	result := rpkiValidity{Origin: origin, Status: "unknown", Covering: []vrp{}}
+	for _, node := range table.vrps.matches(prefix.IP) {
+		if covering, _ := node.prefix.Mask.Size(); covering > length {
+			continue
+		}
+		for _, entry := range node.value.([]vrp) {
+			result.Covering = append(result.Covering, entry)
+			if entry.ASN != 0 && entry.ASN == origin && length <= entry.MaxLength {
+				result.Status = "valid"
+			}
+		}
+	}
+	if result.Status != "valid" && len(result.Covering) > 0 {
+		result.Status = "invalid"
+	}
+	return result
+}
+
+// The validateAll function validates every origin of an announcement
+func (table *rpkiTable) validateAll(announced announcedPrefix) []rpkiValidity {
+	validity := []rpkiValidity{}
+	for _, origin := range announced.Origins {
+		validity = append(validity, table.validate(announced.Prefix, origin))
+	}
+	return validity
+}
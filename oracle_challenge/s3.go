@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Timeout bounds a single object upload or download
+const s3Timeout = 10 * time.Minute
+
+/*
+	The s3Object struct is an s3://bucket/key location with what's needed to sign requests for it, read from the usual AWS environment variables
+	AWS_ENDPOINT_URL points it at an S3 compatible store instead, addressed path style (endpoint/bucket/key)
+*/
+type s3Object struct {
+	Bucket       string
+	Key          string
+	Region       string
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// The isS3URL function reports whether location is an s3:// URL rather than a local path
+func isS3URL(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+// The parseS3URL function splits an s3://bucket/key URL and picks up the credentials and region from the environment
+func parseS3URL(location string) (s3Object, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+	if bucket == "" || key == "" {
+		return s3Object{}, fmt.Errorf("%q is not an s3://bucket/key URL", location)
+	}
+	object := s3Object{
+		Bucket:       bucket,
+		Key:          key,
+		Region:       os.Getenv("AWS_REGION"),
+		Endpoint:     strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if object.Region == "" {
+		object.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if object.Region == "" {
+		object.Region = "us-east-1"
+	}
+	if object.AccessKey == "" || object.SecretKey == "" {
+		return s3Object{}, errors.New("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return object, nil
+}
+
+// The url function returns where the object is, virtual hosted style on AWS and path style on a custom endpoint
+func (object s3Object) url() string {
+	path := "/" + escapeS3Key(object.Key)
+	if object.Endpoint != "" {
+		return object.Endpoint + "/" + object.Bucket + path
+	}
+	return "https://" + object.Bucket + ".s3." + object.Region + ".amazonaws.com" + path
+}
+
+// The escapeS3Key function escapes every segment of key as Signature Version 4 expects, slashes are kept
+func escapeS3Key(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = escapeSigV4(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// The escapeSigV4 function percent-encodes everything but the unreserved characters (A-Z, a-z, 0-9, '-', '.', '_' and '~'), as Signature Version 4 does
+func escapeSigV4(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// The canonicalS3Query function sorts and escapes a query string the way Signature Version 4 signs it, a parameter without a value gets an empty one
+func canonicalS3Query(query string) string {
+	values, _ := url.ParseQuery(query)
+	var parameters [][2]string
+	for name, list := range values {
+		for _, value := range list {
+			parameters = append(parameters, [2]string{escapeSigV4(name), escapeSigV4(value)})
+		}
+	}
+	// Sorted by name, then value, comparing the escaped forms
+	sort.Slice(parameters, func(i, j int) bool {
+		if parameters[i][0] != parameters[j][0] {
+			return parameters[i][0] < parameters[j][0]
+		}
+		return parameters[i][1] < parameters[j][1]
+	})
+	var canonical []string
+	for _, parameter := range parameters {
+		canonical = append(canonical, parameter[0]+"="+parameter[1])
+	}
+	return strings.Join(canonical, "&")
+}
+
+// The hmacSHA256 function is HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/*
+	The sign function adds an AWS Signature Version 4 Authorization header to request, whose body hashes to payloadHash
+	Only host and the x-amz headers are signed, which is all S3 requires
+*/
+func (object s3Object) sign(request *http.Request, payloadHash string, now time.Time) {
+	stamp, day := now.UTC().Format("20060102T150405Z"), now.UTC().Format("20060102")
+	request.Header.Set("X-Amz-Date", stamp)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if object.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", object.SessionToken)
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := "host:" + request.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + stamp + "\n"
+	if object.SessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+		headers += "x-amz-security-token:" + object.SessionToken + "\n"
+	}
+	canonical := strings.Join([]string{request.Method, request.URL.EscapedPath(), canonicalS3Query(request.URL.RawQuery), headers, strings.Join(signed, ";"), payloadHash}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + object.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+object.SecretKey), day)
+	for _, part := range []string{object.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", object.AccessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+// The put function uploads body as the object
+func (object s3Object) put(body []byte) error {
+	request, err := http.NewRequest(http.MethodPut, object.url(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(body)
+	object.sign(request, hex.EncodeToString(digest[:]), time.Now())
+	response, err := egressClient(s3Timeout).Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4<<10))
+		return fmt.Errorf("s3: uploading s3://%s/%s: %s %s", object.Bucket, object.Key, response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// The get function downloads the object
+func (object s3Object) get() ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, object.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(nil)
+	object.sign(request, hex.EncodeToString(digest[:]), time.Now())
+	response, err := egressClient(s3Timeout).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4<<10))
+		return nil, fmt.Errorf("s3: downloading s3://%s/%s: %s %s", object.Bucket, object.Key, response.Status, bytes.TrimSpace(message))
+	}
+	return io.ReadAll(response.Body)
+}
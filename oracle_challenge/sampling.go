@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	The samplingSettings struct turns on A/B sampling of lookups for measuring provider accuracy over real traffic
+	Rate is the fraction (0 to 1) of upstream lookups that are looked up again with Provider, one of the configured providers,
+	in the background so clients never wait for it
+	The two answers disagree on a field when their countries or cities differ, or their coordinates are more than
+	MaxDistanceKM apart (self_consistency's default when zero), the counts are reported by /metrics
+*/
+type samplingSettings struct {
+	Provider      string  `json:"provider"`
+	Rate          float64 `json:"rate"`
+	MaxDistanceKM float64 `json:"max_distance_km"`
+}
+
+// samplingFields are the ways two answers can disagree, in the order /metrics reports them
+var samplingFields = []string{"country", "city", "loc"}
+
+// The providerSampler struct compares a sample of ipinfo's answers against a second provider and counts the outcome
+type providerSampler struct {
+	provider      geoProvider
+	rate          float64
+	maxDistance   float64
+	comparisons   atomic.Int64
+	errors        atomic.Int64
+	disagreements map[string]*atomic.Int64
+}
+
+// sampler is built by main() when sampling is configured, nil otherwise
+var sampler *providerSampler
+
+// The newProviderSampler function finds the provider settings names among providers, it returns nil when sampling is off
+func newProviderSampler(settings samplingSettings, providers []geoProvider) (*providerSampler, error) {
+	if settings.Rate == 0 && settings.Provider == "" {
+		return nil, nil
+	}
+	if settings.Rate <= 0 || settings.Rate > 1 {
+		return nil, fmt.Errorf("sampling: rate must be above 0 and at most 1, not %g", settings.Rate)
+	}
+	if settings.Provider == ipinfoProvider {
+		return nil, fmt.Errorf("sampling: provider must be another provider than %s", ipinfoProvider)
+	}
+	for _, provider := range providers {
+		if provider.name != settings.Provider {
+			continue
+		}
+		sampled := &providerSampler{provider: provider, rate: settings.Rate, maxDistance: settings.MaxDistanceKM, disagreements: map[string]*atomic.Int64{}}
+		if sampled.maxDistance <= 0 {
+			sampled.maxDistance = defaultMaxDistanceKM
+		}
+		for _, field := range samplingFields {
+			sampled.disagreements[field] = &atomic.Int64{}
+		}
+		return sampled, nil
+	}
+	return nil, fmt.Errorf("sampling: provider %q isn't configured", settings.Provider)
+}
+
+// The sample function compares location, ipinfo's answer about ip, with the second provider for the configured fraction of calls
+func (sampler *providerSampler) sample(ip string, location geolocation) {
+	if sampler == nil || rand.Float64() >= sampler.rate {
+		return
+	}
+	go sampler.compare(ip, location)
+}
+
+// The compare function looks ip up with the second provider and counts the fields it disagrees with location on
+func (sampler *providerSampler) compare(ip string, location geolocation) {
+	other, err := sampler.provider.lookup(ip)
+	if err != nil {
+		sampler.errors.Add(1)
+		return
+	}
+	sampler.comparisons.Add(1)
+	if !strings.EqualFold(location.Country, other.Country) {
+		sampler.disagreements["country"].Add(1)
+	}
+	if !strings.EqualFold(location.City, other.City) {
+		sampler.disagreements["city"].Add(1)
+	}
+	if distance, ok := distanceKM(location.Loc, other.Loc); ok && distance > sampler.maxDistance {
+		sampler.disagreements["loc"].Add(1)
+		log.Printf("sampling: %s and %s place %s %.0f km apart", ipinfoProvider, sampler.provider.name, ip, distance)
+	}
+}
+
+// The writeMetrics function writes the sampling counters in the Prometheus text exposition format, nothing when sampling is off
+func (sampler *providerSampler) writeMetrics(w io.Writer) {
+	if sampler == nil {
+		return
+	}
+	name := sampler.provider.name
+	writeMetricHeader(w, "oracle_sampling_comparisons_total", "counter", "Sampled lookups compared against the second provider.")
+	fmt.Fprintf(w, "oracle_sampling_comparisons_total{provider=%q} %d\n", name, sampler.comparisons.Load())
+	writeMetricHeader(w, "oracle_sampling_errors_total", "counter", "Sampled lookups the second provider failed to answer.")
+	fmt.Fprintf(w, "oracle_sampling_errors_total{provider=%q} %d\n", name, sampler.errors.Load())
+	writeMetricHeader(w, "oracle_sampling_disagreements_total", "counter", "Compared lookups where the providers disagree on the field, divide by comparisons for the rate.")
+	for _, field := range samplingFields {
+		fmt.Fprintf(w, "oracle_sampling_disagreements_total{provider=%q,field=%q} %d\n", name, field, sampler.disagreements[field].Load())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// selfAddressTTL is how long /self reuses a discovered address before asking the provider again, each discovery costs an upstream call
+const selfAddressTTL = time.Minute
+
+/*
+	The selfAddress struct is the external address seen over one IP family, Error is set instead of IP when the family has no route out
+	Method names the self_discovery method that found it
+*/
+type selfAddress struct {
+	IP           string    `json:"ip,omitempty"`
+	Method       string    `json:"method,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	DiscoveredAt time.Time `json:"discovered_at"`
+}
+
+// The selfAddresses struct caches the last discovery for each family, keyed by "tcp4" and "tcp6"
+type selfAddresses struct {
+	mutex     sync.Mutex
+	addresses map[string]selfAddress
+}
+
+var selfDiscovery = &selfAddresses{addresses: map[string]selfAddress{}}
+
+/*
+	The httpExternalIP function asks the provider which address the request came from, with the connection forced onto network's family
+	A dual-stack host has a different external address per family, and which one a plain request reports depends on the resolver
+	and the host's address selection
+*/
+func httpExternalIP(network string) (string, error) {
+	if err := quotas.allowUpstream(ipinfoProvider); err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: egress.familyTransport(network)}
+	response, err := client.Get("http://ipinfo.io/json")
+	if err != nil {
+		return "", err
+	}
+	location, err := buildGeolocation(response)
+	if err != nil {
+		return "", err
+	}
+	return checkFamily(network, location.IP)
+}
+
+// The address function returns the external address for network, discovering it again once the cached one is older than selfAddressTTL
+func (discovery *selfAddresses) address(network string) selfAddress {
+	discovery.mutex.Lock()
+	cached, ok := discovery.addresses[network]
+	discovery.mutex.Unlock()
+	if ok && time.Since(cached.DiscoveredAt) < selfAddressTTL {
+		return cached
+	}
+
+	ip, method, err := discoverExternalIP(network)
+	discovered := selfAddress{IP: ip, Method: method, DiscoveredAt: time.Now().UTC()}
+	if err != nil {
+		discovered.Error = err.Error()
+	}
+	discovery.mutex.Lock()
+	discovery.addresses[network] = discovered
+	discovery.mutex.Unlock()
+	return discovered
+}
+
+/*
+	The handleSelf function serves /self, the host's own external IPv4 and IPv6 addresses discovered independently of each other
+	Both families are asked in parallel, a family no discovery method works over reports their errors in place of an address
+*/
+func handleSelf(w http.ResponseWriter, r *http.Request) {
+	var ipv4, ipv6 selfAddress
+	var wait sync.WaitGroup
+	wait.Add(2)
+	go func() {
+		defer wait.Done()
+		ipv4 = selfDiscovery.address("tcp4")
+	}()
+	go func() {
+		defer wait.Done()
+		ipv6 = selfDiscovery.address("tcp6")
+	}()
+	wait.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]selfAddress{"ipv4": ipv4, "ipv6": ipv6})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+	The selfDiscoverySettings struct picks how the host finds its own external address, Methods are tried in order until one answers:
+		http - the provider's /json endpoint, counted against the upstream quota like any other provider call
+		dns  - OpenDNS answers myip.opendns.com with the address a query came from when it is asked directly
+		stun - a STUN binding request (RFC 5389) reports the address and port the server saw the packet from
+	Methods defaults to all three in that order, so /self keeps working through a provider outage
+	DNSResolver and STUNServer default to resolver1.opendns.com:53 and stun.l.google.com:19302
+*/
+type selfDiscoverySettings struct {
+	Methods     []string `json:"methods"`
+	DNSResolver string   `json:"dns_resolver"`
+	STUNServer  string   `json:"stun_server"`
+}
+
+// selfDiscoveryMethods maps each method name to its implementation, network is "tcp" for either family or "tcp4"/"tcp6" to force one
+var selfDiscoveryMethods = map[string]func(network string) (string, error){
+	"http": httpExternalIP,
+	"dns":  dnsExternalIP,
+	"stun": stunExternalIP,
+}
+
+// The checkSelfDiscovery function rejects unknown method names so a typo doesn't leave the host without a working method
+func checkSelfDiscovery(settings selfDiscoverySettings) error {
+	for _, method := range settings.Methods {
+		if _, ok := selfDiscoveryMethods[method]; !ok {
+			return fmt.Errorf("self_discovery: unknown method %q", method)
+		}
+	}
+	return nil
+}
+
+/*
+	The discoverExternalIP function tries each configured method in turn and returns the first address found along with the method that found it
+	When every method fails the errors of all of them are returned together
+*/
+func discoverExternalIP(network string) (string, string, error) {
+	methods := config.SelfDiscovery.Methods
+	if len(methods) == 0 {
+		methods = []string{"http", "dns", "stun"}
+	}
+	var failures []string
+	for _, method := range methods {
+		ip, err := selfDiscoveryMethods[method](network)
+		if err == nil {
+			return ip, method, nil
+		}
+		failures = append(failures, method+": "+err.Error())
+	}
+	return "", "", errors.New(strings.Join(failures, "; "))
+}
+
+// The checkFamily function makes sure a discovered address belongs to the family network asked for
+func checkFamily(network, address string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", address)
+	}
+	// An answer over IPv6 naming an IPv4 address (or the reverse) came through a translator, which isn't the answer asked for
+	if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+		return "", fmt.Errorf("%s was reported over %s", address, network)
+	}
+	return ip.String(), nil
+}
+
+// The dnsExternalIP function asks the OpenDNS resolver directly for myip.opendns.com, which it answers with the address the query came from
+func dnsExternalIP(network string) (string, error) {
+	resolver := config.SelfDiscovery.DNSResolver
+	if resolver == "" {
+		resolver = "resolver1.opendns.com:53"
+	}
+	family := strings.TrimPrefix(network, "tcp")
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	lookup := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return egress.dialContext(ctx, dialer, "udp"+family, resolver)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addresses, err := lookup.LookupIP(ctx, "ip"+family, "myip.opendns.com")
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) == 0 {
+		return "", errors.New("the resolver returned no address")
+	}
+	return checkFamily(network, addresses[0].String())
+}
+
+const (
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunMagicCookie      = 0x2112A442
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+)
+
+/*
+	The stunExternalIP function sends a STUN binding request and reads the mapped address out of the response
+	XOR-MAPPED-ADDRESS is preferred, MAPPED-ADDRESS is still accepted from servers predating RFC 5389
+*/
+func stunExternalIP(network string) (string, error) {
+	server := config.SelfDiscovery.STUNServer
+	if server == "" {
+		server = "stun.l.google.com:19302"
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	connection, err := egress.dialContext(context.Background(), dialer, "udp"+strings.TrimPrefix(network, "tcp"), server)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	transaction := request[8:20]
+	if _, err := rand.Read(transaction); err != nil {
+		return "", err
+	}
+
+	// UDP may drop either packet, so the request is resent a few times before giving up
+	response := make([]byte, 1500)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := connection.Write(request); err != nil {
+			return "", err
+		}
+		connection.SetReadDeadline(time.Now().Add(2 * time.Second))
+		length, err := connection.Read(response)
+		if err != nil {
+			var timeout net.Error
+			if errors.As(err, &timeout) && timeout.Timeout() {
+				continue
+			}
+			return "", err
+		}
+		if length < 20 || binary.BigEndian.Uint16(response[0:]) != stunBindingSuccess || string(response[8:20]) != string(transaction) {
+			continue
+		}
+		address, err := parseSTUNAddress(response[20:length], response[4:20])
+		if err != nil {
+			return "", err
+		}
+		return checkFamily(network, address)
+	}
+	return "", errors.New("no response from the STUN server")
+}
+
+// The parseSTUNAddress function walks the attributes of a binding response, xorKey is the magic cookie followed by the transaction ID
+func parseSTUNAddress(attributes, xorKey []byte) (string, error) {
+	mapped := ""
+	for len(attributes) >= 4 {
+		kind := binary.BigEndian.Uint16(attributes[0:])
+		length := int(binary.BigEndian.Uint16(attributes[2:]))
+		if len(attributes) < 4+length {
+			break
+		}
+		value := attributes[4 : 4+length]
+		// Attributes are padded to a multiple of four bytes
+		attributes = attributes[min(len(attributes), 4+(length+3)/4*4):]
+
+		if (kind != stunXORMappedAddress && kind != stunMappedAddress) || len(value) < 8 {
+			continue
+		}
+		size := net.IPv4len
+		if value[1] == 0x02 {
+			size = net.IPv6len
+		}
+		if len(value) < 4+size {
+			continue
+		}
+		ip := make(net.IP, size)
+		copy(ip, value[4:4+size])
+		if kind == stunXORMappedAddress {
+			for i := range ip {
+				ip[i] ^= xorKey[i]
+			}
+			return ip.String(), nil
+		}
+		mapped = ip.String()
+	}
+	if mapped == "" {
+		return "", errors.New("the STUN response carried no mapped address")
+	}
+	return mapped, nil
+}
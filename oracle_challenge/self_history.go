@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The selfHistorySettings struct configures how often the host's external IP is checked
+type selfHistorySettings struct {
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+// The ipChange struct is one persisted row of the external IP history, written whenever the address differs from the last one seen
+type ipChange struct {
+	IP        string    `json:"ip"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// The selfHistory struct holds the external IP history in memory, mirroring what has been appended to its store
+type selfHistory struct {
+	mutex       sync.Mutex
+	store       *jsonlStore
+	changes     []ipChange
+	lastChecked time.Time
+	lastError   string
+}
+
+// history is started by main() when the self_history feature is on
+var history *selfHistory
+
+// The loadSelfHistory function reads back every recorded change from self_history.jsonl in the data_dir
+func loadSelfHistory() (*selfHistory, error) {
+	tracker := &selfHistory{store: newJSONLStore("self_history.jsonl")}
+	err := tracker.store.each(func(line []byte) error {
+		var change ipChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			return err
+		}
+		tracker.changes = append(tracker.changes, change)
+		return nil
+	})
+	return tracker, err
+}
+
+// The check function asks acquireExternalIP() for the current address and records it when it differs from the last one
+func (tracker *selfHistory) check() {
+	ip, err := acquireExternalIP()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.lastChecked = time.Now().UTC()
+	if err != nil {
+		tracker.lastError = err.Error()
+		return
+	}
+	tracker.lastError = ""
+
+	if len(tracker.changes) > 0 && tracker.changes[len(tracker.changes)-1].IP == ip {
+		return
+	}
+	change := ipChange{IP: ip, ChangedAt: tracker.lastChecked}
+	if len(tracker.changes) > 0 {
+		notify(notification{Event: eventExternalIPChange, IP: ip, Previous: tracker.changes[len(tracker.changes)-1].IP})
+	}
+	if err := tracker.store.append(change); err != nil {
+		log.Printf("recording external IP change: %v", err)
+	}
+	tracker.changes = append(tracker.changes, change)
+}
+
+/*
+	The remove function deletes the changes drop matches from memory and from the store, returning how many were deleted
+	latest is the index of the newest change, so callers can choose to spare it
+*/
+func (tracker *selfHistory) remove(drop func(change ipChange, latest bool) bool) (int, error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	var kept []ipChange
+	// Changes are matched by address and time rather than compared as structs, a decoded time.Time needn't be == to the original
+	key := func(change ipChange) string {
+		return change.IP + "@" + strconv.FormatInt(change.ChangedAt.UnixNano(), 10)
+	}
+	removed := map[string]bool{}
+	for i, change := range tracker.changes {
+		if drop(change, i == len(tracker.changes)-1) {
+			removed[key(change)] = true
+		} else {
+			kept = append(kept, change)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	tracker.changes = kept
+	_, err := tracker.store.rewrite(func(line []byte) bool {
+		var change ipChange
+		return json.Unmarshal(line, &change) != nil || !removed[key(change)]
+	})
+	return len(removed), err
+}
+
+// The watch function checks the external IP immediately and then every interval until stop is closed
+func (tracker *selfHistory) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		tracker.check()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+/*
+	The handleSelfHistory function serves /self/history, the recorded changes of the host's external IP with their timestamps, oldest first
+	Changes are paginated (see parsePage) by the time they were recorded, so purged changes can't shift a later page
+*/
+func handleSelfHistory(w http.ResponseWriter, r *http.Request) {
+	current, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	history.mutex.Lock()
+	count := len(history.changes)
+	start, end, next := paginate(current, count, func(i int) string {
+		return fmt.Sprintf("%020d", history.changes[i].ChangedAt.UnixNano())
+	})
+	changes := append([]ipChange{}, history.changes[start:end]...)
+	currentIP := ""
+	if count > 0 {
+		currentIP = history.changes[count-1].IP
+	}
+	response := struct {
+		Current     string     `json:"current"`
+		LastChecked time.Time  `json:"last_checked"`
+		LastError   string     `json:"last_error,omitempty"`
+		ChangeCount int        `json:"change_count"`
+		Changes     []ipChange `json:"changes"`
+		NextCursor  string     `json:"next_cursor,omitempty"`
+	}{currentIP, history.lastChecked, history.lastError, count, changes, next}
+	history.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(response)
+}
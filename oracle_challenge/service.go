@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// The serviceOptions struct describes the service "oracle service" generates or installs
+type serviceOptions struct {
+	Name       string
+	Format     string
+	Executable string
+	ConfigPath string
+	User       string
+}
+
+// serviceName is what -name may be, it ends up in file paths and in the service manager's namespace
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]*$`)
+
+// serviceTemplateFunctions escape values for the format they are written into
+var serviceTemplateFunctions = template.FuncMap{"systemd": systemdQuote, "systemdValue": systemdValue, "xml": xmlEscape}
+
+// The systemdQuote function quotes a word of an ExecStart= command line, escaping what systemd would otherwise expand: % specifiers and $ variables
+func systemdQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(value) + `"`
+}
+
+// The systemdValue function escapes the % specifiers of a plain setting such as User=
+func systemdValue(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// The xmlEscape function escapes value for the text of a plist element
+func xmlEscape(value string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(value))
+	return escaped.String()
+}
+
+// systemdUnit has no ExecReload: systemd tracks the process it started, so it would take the handoff done by upgrade() for the service exiting
+var systemdUnit = template.Must(template.New("systemd").Funcs(serviceTemplateFunctions).Parse(`[Unit]
+Description=IP geolocation oracle
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart={{systemd .Executable}}{{if .ConfigPath}} -config {{systemd .ConfigPath}}{{end}}
+{{- if .User}}
+User={{systemdValue .User}}
+{{- end}}
+Restart=on-failure
+RestartSec=2
+KillSignal=SIGTERM
+TimeoutStopSec=15
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var launchdPlist = template.Must(template.New("launchd").Funcs(serviceTemplateFunctions).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Name}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .Executable}}</string>
+{{- if .ConfigPath}}
+		<string>-config</string>
+		<string>{{xml .ConfigPath}}</string>
+{{- end}}
+	</array>
+{{- if .User}}
+	<key>UserName</key>
+	<string>{{xml .User}}</string>
+{{- end}}
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>/var/log/{{xml .Name}}.log</string>
+	<key>StandardErrorPath</key>
+	<string>/var/log/{{xml .Name}}.log</string>
+</dict>
+</plist>
+`))
+
+/*
+	The runServiceCommand function implements "oracle service unit|install|uninstall"
+	unit prints the systemd unit or launchd plist, install writes it to the system location and starts the service, uninstall stops and removes it
+	For Windows the service is registered with the service control manager through sc.exe, unit prints the commands install runs,
+	and the process answers the service control manager itself once started, see startServiceDispatcher()
+	The format follows the platform (launchd on macOS, windows on Windows, systemd elsewhere) unless -format says otherwise
+	It returns the process exit code
+*/
+func runServiceCommand(arguments []string) int {
+	if len(arguments) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: oracle service unit|install|uninstall [flags]")
+		return 2
+	}
+	action := arguments[0]
+
+	flags := flag.NewFlagSet("service "+action, flag.ContinueOnError)
+	options := serviceOptions{}
+	flags.StringVar(&options.Name, "name", "oracle", "service name (launchd label)")
+	flags.StringVar(&options.Format, "format", defaultServiceFormat(), "service manager: systemd, launchd or windows")
+	flags.StringVar(&options.ConfigPath, "config", "", "config file the service is started with")
+	flags.StringVar(&options.User, "user", "", "user the service runs as")
+	if err := flags.Parse(arguments[1:]); err != nil {
+		return 2
+	}
+	if !serviceName.MatchString(options.Name) {
+		fmt.Fprintf(os.Stderr, "-name %q: a service name is letters, digits, '_', '.', '@' and '-', starting with a letter or digit\n", options.Name)
+		return 2
+	}
+
+	var err error
+	switch action {
+	case "unit":
+		err = writeServiceDefinition(os.Stdout, options)
+	case "install":
+		err = installService(options)
+	case "uninstall":
+		err = uninstallService(options)
+	default:
+		err = fmt.Errorf("unknown service action %q", action)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// The defaultServiceFormat function picks the service manager of the platform the binary was built for
+func defaultServiceFormat() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "launchd"
+	case "windows":
+		return "windows"
+	}
+	return "systemd"
+}
+
+/*
+	The writeServiceDefinition function renders the unit, plist or sc.exe commands for options
+	Paths are made absolute since service managers don't start in the caller's directory, and rejected when they hold a line break
+	that would let them write settings of their own into the definition
+*/
+func writeServiceDefinition(out io.Writer, options serviceOptions) error {
+	options, err := resolveServiceOptions(options)
+	if err != nil {
+		return err
+	}
+	switch options.Format {
+	case "systemd":
+		return systemdUnit.Execute(out, options)
+	case "launchd":
+		return launchdPlist.Execute(out, options)
+	case "windows":
+		for _, command := range windowsServiceCommands(options) {
+			var quoted []string
+			for _, argument := range command {
+				quoted = append(quoted, windowsQuote(argument))
+			}
+			fmt.Fprintln(out, "sc.exe "+strings.Join(quoted, " "))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown service format %q", options.Format)
+}
+
+// The resolveServiceOptions function fills in the executable and makes the config path absolute
+func resolveServiceOptions(options serviceOptions) (serviceOptions, error) {
+	if options.Executable == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return options, err
+		}
+		options.Executable = executable
+	}
+	if options.ConfigPath != "" {
+		absolute, err := filepath.Abs(options.ConfigPath)
+		if err != nil {
+			return options, err
+		}
+		options.ConfigPath = absolute
+	}
+	for _, value := range []string{options.Executable, options.ConfigPath, options.User} {
+		if strings.ContainsAny(value, "\r\n") {
+			return options, fmt.Errorf("%q can't be written into a service definition", value)
+		}
+	}
+	return options, nil
+}
+
+/*
+	The windowsServiceCommands function lists the sc.exe arguments that register the service for options, started at boot
+	and restarted 2 seconds after a failure as the systemd unit is, -user becomes the account it runs as (obj=),
+	which has to be one without a password such as "NT AUTHORITY\LocalService"
+*/
+func windowsServiceCommands(options serviceOptions) [][]string {
+	command := `"` + options.Executable + `"`
+	if options.ConfigPath != "" {
+		command += ` -config "` + options.ConfigPath + `"`
+	}
+	create := []string{"create", options.Name, "binPath=", command, "start=", "auto", "DisplayName=", "IP geolocation oracle"}
+	if options.User != "" {
+		create = append(create, "obj=", options.User)
+	}
+	return [][]string{create, {"failure", options.Name, "reset=", "86400", "actions=", "restart/2000"}}
+}
+
+// The windowsQuote function quotes an argument the way the Windows command line parser reads it back, for printing the sc.exe commands
+func windowsQuote(argument string) string {
+	if argument != "" && !strings.ContainsAny(argument, " \t\"") {
+		return argument
+	}
+	return `"` + strings.ReplaceAll(argument, `"`, `\"`) + `"`
+}
+
+// The serviceDefinitionPath function is where install writes the definition for options
+func serviceDefinitionPath(options serviceOptions) (string, error) {
+	switch options.Format {
+	case "systemd":
+		return "/etc/systemd/system/" + options.Name + ".service", nil
+	case "launchd":
+		return "/Library/LaunchDaemons/" + options.Name + ".plist", nil
+	case "windows":
+		return "", errors.New("windows services are registered with the service control manager rather than written to a file")
+	}
+	return "", fmt.Errorf("unknown service format %q", options.Format)
+}
+
+// The installService function writes the service definition (or registers it with sc.exe) and asks the service manager to start it now and at boot
+func installService(options serviceOptions) error {
+	if options.Format == "windows" {
+		resolved, err := resolveServiceOptions(options)
+		if err != nil {
+			return err
+		}
+		for _, command := range windowsServiceCommands(resolved) {
+			if err := runServiceManager("sc.exe", command...); err != nil {
+				return err
+			}
+		}
+		return runServiceManager("sc.exe", "start", options.Name)
+	}
+	path, err := serviceDefinitionPath(options)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeServiceDefinition(file, options); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if options.Format == "launchd" {
+		return runServiceManager("launchctl", "load", "-w", path)
+	}
+	if err := runServiceManager("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runServiceManager("systemctl", "enable", "--now", options.Name+".service")
+}
+
+// The uninstallService function stops the service, disables it and removes its definition
+func uninstallService(options serviceOptions) error {
+	if options.Format == "windows" {
+		// A service that isn't running can't be stopped, which is no reason not to delete it
+		runServiceManager("sc.exe", "stop", options.Name)
+		return runServiceManager("sc.exe", "delete", options.Name)
+	}
+	path, err := serviceDefinitionPath(options)
+	if err != nil {
+		return err
+	}
+
+	if options.Format == "launchd" {
+		if err := runServiceManager("launchctl", "unload", "-w", path); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+	if err := runServiceManager("systemctl", "disable", "--now", options.Name+".service"); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return runServiceManager("systemctl", "daemon-reload")
+}
+
+// The runServiceManager function runs a service manager command, passing its output through
+func runServiceManager(name string, arguments ...string) error {
+	command := exec.Command(name, arguments...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	if err := command.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(arguments, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// The startServiceDispatcher function does nothing outside Windows, systemd and launchd start the process as it is
+func startServiceDispatcher() {}
+
+// The forwardServiceStop function does nothing outside Windows, service managers there stop the process with SIGTERM
+func forwardServiceStop(chan<- os.Signal) {}
+
+// The reportServiceRunning function does nothing outside Windows
+func reportServiceRunning() {}
+
+// The reportServiceStopped function does nothing outside Windows
+func reportServiceStopped() {}
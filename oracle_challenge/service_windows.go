@@ -0,0 +1,192 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Service types, states, controls and errors of the service control manager API
+const (
+	serviceWin32OwnProcess    = 0x10
+	serviceStopped            = 1
+	serviceStartPending       = 2
+	serviceStopPending        = 3
+	serviceRunning            = 4
+	serviceAcceptStop         = 1
+	serviceAcceptShutdown     = 4
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	errorCallNotImplemented   = 120
+	// servicePendingWaitHint is how long the service control manager is told to wait between reports while starting or stopping
+	servicePendingWaitHint = 30 * time.Second
+	// serviceStopReportTimeout bounds how long the process waits for the stopped state to be reported before exiting anyway
+	serviceStopReportTimeout = 5 * time.Second
+)
+
+var (
+	advapi32                     = syscall.NewLazyDLL("advapi32.dll")
+	startServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	registerServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	setServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+// The serviceTableEntry struct is a SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	main uintptr
+}
+
+// The serviceStatus struct is a SERVICE_STATUS
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+/*
+	The serviceControlManager struct is this process' side of the service control manager, when it was started as a service
+	handle is 0 until the manager calls serviceMain(), and stays 0 when the process was started from a console
+	ready records that the server is serving, in case that happens before serviceMain() is called
+*/
+type serviceControlManager struct {
+	mutex    sync.Mutex
+	handle   uintptr
+	status   serviceStatus
+	ready    bool
+	shutdown chan<- os.Signal
+	stopped  chan struct{}
+	reported chan struct{}
+}
+
+// scm is the process' one service, callbacks from the manager have no other way to reach it
+var scm = &serviceControlManager{stopped: make(chan struct{}), reported: make(chan struct{})}
+
+/*
+	The startServiceDispatcher function connects to the service control manager when the process was started as a service
+	StartServiceCtrlDispatcherW blocks its thread for as long as the service runs, so it is called from a goroutine locked to one,
+	and fails straight away when the process was started from a console, which leaves it running as a plain program
+*/
+func startServiceDispatcher() {
+	go func() {
+		runtime.LockOSThread()
+		empty := uint16(0)
+		// The name is ignored for a service that has its process to itself, but can't be NULL
+		table := []serviceTableEntry{{name: &empty, main: syscall.NewCallback(serviceMain)}, {}}
+		startServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0])))
+	}()
+}
+
+/*
+	The serviceMain function is called by the service control manager on a thread of its own once the dispatcher is connected
+	It registers serviceControl() and reports the service starting (or running, if the server got there first),
+	then waits for the process to finish shutting down and reports it stopped
+*/
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	handle, _, err := registerServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(*argv)), syscall.NewCallback(serviceControl), 0)
+	if handle == 0 {
+		log.Printf("service: registering the control handler: %v", err)
+		return 0
+	}
+	scm.mutex.Lock()
+	scm.handle = handle
+	if scm.ready {
+		scm.report(serviceRunning)
+	} else {
+		scm.report(serviceStartPending)
+	}
+	scm.mutex.Unlock()
+
+	<-scm.stopped
+	scm.mutex.Lock()
+	scm.report(serviceStopped)
+	scm.mutex.Unlock()
+	close(scm.reported)
+	return 0
+}
+
+// The serviceControl function handles a control sent by the service control manager, a stop or shutdown starts the same graceful shutdown as SIGTERM
+func serviceControl(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		scm.mutex.Lock()
+		scm.report(serviceStopPending)
+		shutdown := scm.shutdown
+		scm.mutex.Unlock()
+		if shutdown != nil {
+			select {
+			case shutdown <- syscall.SIGTERM:
+			default:
+			}
+		}
+		return 0
+	case serviceControlInterrogate:
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+// The report function tells the service control manager the service is in state, the caller holds the mutex
+func (manager *serviceControlManager) report(state uint32) {
+	if manager.handle == 0 {
+		return
+	}
+	manager.status.serviceType = serviceWin32OwnProcess
+	manager.status.currentState = state
+	manager.status.controlsAccepted = 0
+	manager.status.waitHint = 0
+	switch state {
+	case serviceRunning:
+		manager.status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+		manager.status.checkPoint = 0
+	case serviceStopped:
+		manager.status.checkPoint = 0
+	default:
+		manager.status.checkPoint++
+		manager.status.waitHint = uint32(servicePendingWaitHint / time.Millisecond)
+	}
+	if ok, _, err := setServiceStatus.Call(manager.handle, uintptr(unsafe.Pointer(&manager.status))); ok == 0 {
+		log.Printf("service: reporting state %d: %v", state, err)
+	}
+}
+
+// The forwardServiceStop function has stop and shutdown controls delivered to signals as SIGTERM
+func forwardServiceStop(signals chan<- os.Signal) {
+	scm.mutex.Lock()
+	scm.shutdown = signals
+	scm.mutex.Unlock()
+}
+
+// The reportServiceRunning function tells the service control manager the server is serving
+func reportServiceRunning() {
+	scm.mutex.Lock()
+	scm.ready = true
+	scm.report(serviceRunning)
+	scm.mutex.Unlock()
+}
+
+// The reportServiceStopped function lets serviceMain() report the service stopped and waits for it, the process should exit right after
+func reportServiceStopped() {
+	scm.mutex.Lock()
+	started := scm.handle != 0
+	scm.mutex.Unlock()
+	if !started {
+		return
+	}
+	close(scm.stopped)
+	select {
+	case <-scm.reported:
+	case <-time.After(serviceStopReportTimeout):
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+/*
+	The adapterSettings struct maps the canonical geolocation onto one consumer's JSON shape
+	Fields maps a dotted output path (e.g. "src.geo.country") to either a canonical field name (see locationFields)
+	or a text/template such as "{{.city}}, {{.country}}" rendered against those same fields
+	An adapter is served at Path when one is set, and through /shaped to any of its APIKeys
+*/
+type adapterSettings struct {
+	Name    string            `json:"name"`
+	Path    string            `json:"path"`
+	APIKeys []string          `json:"api_keys"`
+	Fields  map[string]string `json:"fields"`
+}
+
+// The responseAdapter struct is a compiled adapterSettings, templates are parsed once at startup rather than per request
+type responseAdapter struct {
+	settings  adapterSettings
+	templates map[string]*template.Template
+}
+
+// adapters is built from config.Adapters by compileAdapters()
+var adapters []*responseAdapter
+
+// The locationFields function flattens a geolocation into the canonical field names every adapter, template and renderer refers to
+func locationFields(location geolocation) map[string]string {
+	return map[string]string{
+		"ip":       location.IP,
+		"hostname": location.Hostname,
+		"country":  location.Country,
+		"region":   location.Region,
+		"city":     location.City,
+		"postal":   location.Postal,
+		"timezone": location.Timezone,
+		"loc":      location.Loc,
+		"org":      location.Org,
+	}
+}
+
+/*
+	The compileAdapters function validates every configured adapter and parses its templates
+	Unknown canonical field names are rejected here so a typo fails at startup rather than producing empty values
+*/
+func compileAdapters(configured []adapterSettings) ([]*responseAdapter, error) {
+	known := locationFields(geolocation{})
+	var compiled []*responseAdapter
+	for _, settings := range configured {
+		if settings.Name == "" {
+			return nil, errors.New("every adapter needs a name")
+		}
+		if settings.Path != "" && !strings.HasPrefix(settings.Path, "/") {
+			return nil, fmt.Errorf("adapter %q: path must start with /", settings.Name)
+		}
+
+		adapter := &responseAdapter{settings: settings, templates: map[string]*template.Template{}}
+		for output, source := range settings.Fields {
+			if strings.Contains(source, "{{") {
+				parsed, err := template.New(output).Option("missingkey=error").Parse(source)
+				if err != nil {
+					return nil, fmt.Errorf("adapter %q field %q: %w", settings.Name, output, err)
+				}
+				adapter.templates[output] = parsed
+				continue
+			}
+			if _, ok := known[source]; !ok {
+				return nil, fmt.Errorf("adapter %q field %q: unknown field %q", settings.Name, output, source)
+			}
+		}
+		compiled = append(compiled, adapter)
+	}
+	return compiled, nil
+}
+
+// The apply function builds the adapter's output document for location, nesting values according to the dotted output paths
+func (adapter *responseAdapter) apply(location geolocation) (map[string]interface{}, error) {
+	fields := locationFields(location)
+	document := map[string]interface{}{}
+	for output, source := range adapter.settings.Fields {
+		value := fields[source]
+		if parsed, ok := adapter.templates[output]; ok {
+			var rendered strings.Builder
+			if err := parsed.Execute(&rendered, fields); err != nil {
+				return nil, err
+			}
+			value = rendered.String()
+		}
+
+		parts := strings.Split(output, ".")
+		node := document
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+	return document, nil
+}
+
+// The serve function geolocates the client and writes the adapter's shape of the result
+func (adapter *responseAdapter) serve(w http.ResponseWriter, r *http.Request) {
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	location, _, err := lookupFor(r, ip)
+	if writeBogon(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error while attempting to get location data: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	location.IP = ip
+
+	document, err := adapter.apply(location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setResultHash(w, location)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+/*
+	The handleShaped function serves /shaped, picking the adapter assigned to the presented API key
+	requireAPIKey has already checked the key, this only finds which shape it was given
+*/
+func handleShaped(w http.ResponseWriter, r *http.Request) {
+	key := requestAPIKey(r)
+	for _, adapter := range adapters {
+		if validAPIKey(key, adapter.settings.APIKeys) {
+			adapter.serve(w, r)
+			return
+		}
+	}
+	http.Error(w, "no response adapter is assigned to this API key", http.StatusNotFound)
+}
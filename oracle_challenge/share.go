@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultShareTTL applies when a /share request doesn't ask for a ttl
+	defaultShareTTL = time.Hour
+	// defaultShareMaxTTL applies when share.max_ttl_seconds isn't configured
+	defaultShareMaxTTL = 24 * time.Hour
+)
+
+/*
+	The shareSettings struct configures the links /share hands out for showing a lookup result to someone without an API key
+	Secret signs the links, without one a random secret is made at startup and every link stops working when the process restarts
+	MaxTTLSeconds caps how long a link may be asked to live for
+*/
+type shareSettings struct {
+	Secret        string `json:"secret"`
+	MaxTTLSeconds int    `json:"max_ttl_seconds"`
+}
+
+// shareSecret is the key links are signed with, set by loadShareSecret() when the share feature is enabled
+var shareSecret []byte
+
+/*
+	The sharedResult struct is what a link carries, the result as it was when it was shared
+	The link holds the result itself rather than an address to look up again, so opening it costs no provider quota
+	and shows the person it was sent to exactly what the sender saw
+*/
+type sharedResult struct {
+	Result  batchResult `json:"result"`
+	Created int64       `json:"created"`
+	Expires int64       `json:"expires"`
+}
+
+// The loadShareSecret function sets shareSecret from share.secret, or to a random one when it isn't configured
+func loadShareSecret(settings shareSettings) error {
+	if settings.MaxTTLSeconds < 0 {
+		return errors.New("share: max_ttl_seconds can't be negative")
+	}
+	if settings.Secret != "" {
+		shareSecret = []byte(settings.Secret)
+		return nil
+	}
+	shareSecret = make([]byte, 32)
+	if _, err := rand.Read(shareSecret); err != nil {
+		return fmt.Errorf("share: generating a secret: %w", err)
+	}
+	log.Print("share: share.secret isn't configured, links will stop working when this process restarts")
+	return nil
+}
+
+// The signShare function returns the signature of payload, a link's token is the payload and its signature joined by "."
+func signShare(payload string) string {
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// The shareToken function encodes and signs shared
+func shareToken(shared sharedResult) (string, error) {
+	document, err := json.Marshal(shared)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(document)
+	return payload + "." + signShare(payload), nil
+}
+
+// The openShareToken function checks the signature of token and decodes what it carries, it doesn't check the expiry
+func openShareToken(token string) (sharedResult, error) {
+	var shared sharedResult
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signShare(payload))) {
+		return shared, errors.New("the link isn't valid")
+	}
+	document, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return shared, err
+	}
+	return shared, json.Unmarshal(document, &shared)
+}
+
+/*
+	The handleShare function serves POST /share, looking up the address of ?ip= and answering with a link to a read-only view of the result
+	?ttl= is how many seconds the link lives for, an hour by default and at most share.max_ttl_seconds (a day by default)
+	?fields= narrows the shared location as it does for /ip, so only what the recipient needs leaves the auth boundary
+*/
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST /share?ip=... to share the lookup of an address", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, err := targetIP(r)
+	if writeInvalidAddress(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fields, err := requestedFields(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxTTL := defaultShareMaxTTL
+	if config.Share.MaxTTLSeconds > 0 {
+		maxTTL = time.Duration(config.Share.MaxTTLSeconds) * time.Second
+	}
+	ttl := defaultShareTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl > maxTTL {
+		http.Error(w, fmt.Sprintf("ttl can be at most %d seconds", int(maxTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	result := lookupBatchEntry(r, ip, fields)
+	if result.Error != "" && !result.Bogon {
+		writeJSON(w, http.StatusBadGateway, result)
+		return
+	}
+	now := time.Now()
+	token, err := shareToken(sharedResult{Result: result, Created: now.Unix(), Expires: now.Add(ttl).Unix()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"url":     scheme + "://" + r.Host + "/shared/" + token,
+		"expires": now.Add(ttl).UTC().Format(time.RFC3339),
+	})
+}
+
+// sharedPage is the read-only view of a shared result
+var sharedPage = template.Must(template.New("shared").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>{{.Result.IP}}</title></head>
+<body>
+<h1>{{.Result.IP}}</h1>
+{{if .Result.Error}}<p>{{.Result.Error}}</p>{{else}}<dl>
+{{range $field, $value := .Result.Location}}<dt>{{$field}}</dt><dd>{{$value}}</dd>
+{{end}}</dl>{{end}}
+<p>Looked up {{.Looked}}, this link expires {{.Expires}}</p>
+</body>
+</html>
+`))
+
+/*
+	The handleShared function serves /shared/{token}, the read-only view of a result handed out by /share, as HTML or as JSON for ?format=json
+	It is open to anyone holding the link, a link that was tampered with is a 404 and one past its expiry a 410
+*/
+func handleShared(w http.ResponseWriter, r *http.Request) {
+	shared, err := openShareToken(strings.TrimPrefix(r.URL.Path, "/shared/"))
+	if err != nil {
+		http.Error(w, "there is no such shared result", http.StatusNotFound)
+		return
+	}
+	expires := time.Unix(shared.Expires, 0)
+	if time.Now().After(expires) {
+		http.Error(w, "this link expired at "+expires.UTC().Format(time.RFC3339), http.StatusGone)
+		return
+	}
+	// The token is the credential, keep it out of caches and out of the Referer of links followed from the page
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, shared)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	sharedPage.Execute(w, struct {
+		Result          batchResult
+		Looked, Expires string
+	}{shared.Result, time.Unix(shared.Created, 0).UTC().Format(time.RFC3339), expires.UTC().Format(time.RFC3339)})
+}
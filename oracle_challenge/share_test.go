@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShareToken signs a token for ip with shareSecret, expiring at expires
+func testShareToken(t *testing.T, ip string, expires time.Time) string {
+	t.Helper()
+	token, err := shareToken(sharedResult{Result: batchResult{IP: ip, Location: map[string]string{"country": "NL"}}, Created: expires.Add(-time.Hour).Unix(), Expires: expires.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOpenShareToken(t *testing.T) {
+	shareSecret = []byte("test secret")
+	defer func() { shareSecret = nil }()
+	token := testShareToken(t, "192.0.2.1", time.Now().Add(time.Hour))
+	payload, signature, _ := strings.Cut(token, ".")
+	// A token for another address, signed under another secret
+	shareSecret = []byte("other secret")
+	foreign := testShareToken(t, "198.51.100.1", time.Now().Add(time.Hour))
+	shareSecret = []byte("test secret")
+
+	flip := func(s string, i int) string {
+		replacement := "A"
+		if s[i] == 'A' {
+			replacement = "B"
+		}
+		return s[:i] + replacement + s[i+1:]
+	}
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "valid", token: token, valid: true},
+		{name: "empty", token: ""},
+		{name: "no signature", token: payload},
+		{name: "empty signature", token: payload + "."},
+		{name: "payload altered", token: flip(payload, 10) + "." + signature},
+		{name: "signature altered", token: payload + "." + flip(signature, 0)},
+		{name: "signature truncated", token: payload + "." + signature[:len(signature)-1]},
+		{name: "payload swapped", token: strings.Split(foreign, ".")[0] + "." + signature},
+		{name: "signed under another secret", token: foreign},
+		{name: "extra segment", token: token + ".x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared, err := openShareToken(test.token)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("openShareToken() = %+v, want an error", shared)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openShareToken() error = %v", err)
+			}
+			if shared.Result.IP != "192.0.2.1" || shared.Result.Location["country"] != "NL" {
+				t.Fatalf("openShareToken() = %+v, want the shared result back", shared)
+			}
+		})
+	}
+}
+
+func TestHandleSharedExpiry(t *testing.T) {
+	shareSecret = []byte("test secret")
+	defer func() { shareSecret = nil }()
+	valid := testShareToken(t, "192.0.2.1", time.Now().Add(time.Minute))
+	payload, signature, _ := strings.Cut(valid, ".")
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "valid", token: valid, wantStatus: http.StatusOK},
+		{name: "expired", token: testShareToken(t, "192.0.2.1", time.Now().Add(-time.Second)), wantStatus: http.StatusGone},
+		{name: "expired long ago", token: testShareToken(t, "192.0.2.1", time.Unix(0, 0)), wantStatus: http.StatusGone},
+		{name: "tampered", token: payload + "x." + signature, wantStatus: http.StatusNotFound},
+		{name: "garbage", token: "not-a-token", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handleShared(recorder, httptest.NewRequest(http.MethodGet, "/shared/"+test.token+"?format=json", nil))
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body)
+			}
+			if test.wantStatus == http.StatusOK && recorder.Header().Get("Cache-Control") != "private, no-store" {
+				t.Fatalf("Cache-Control = %q, want the shared result kept out of caches", recorder.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
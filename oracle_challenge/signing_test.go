@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSignedRequest builds a request signed with secret as a client would, edit may change it after signing
+func testSignedRequest(method, target, body, keyID, secret, nonce string, signedAt time.Time, edit func(*http.Request)) *http.Request {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingPayload(request, timestamp, nonce, []byte(body))))
+	request.Header.Set("X-Signature-Key", keyID)
+	request.Header.Set("X-Signature-Timestamp", timestamp)
+	request.Header.Set("X-Signature-Nonce", nonce)
+	request.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	if edit != nil {
+		edit(request)
+	}
+	return request
+}
+
+func TestVerifySignature(t *testing.T) {
+	config.Signing = signingSettings{Keys: map[string]string{"ci": "secret"}}
+	defer func() { config.Signing = signingSettings{} }()
+	nonces = &nonceTracker{seen: map[string]time.Time{}}
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		wantErr string
+	}{
+		{name: "valid", request: testSignedRequest("POST", "/lookup?fields=country", `["192.0.2.1"]`, "ci", "secret", "n1", now, nil)},
+		{name: "valid at the edge of the window", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n2", now.Add(-defaultSigningWindow), nil)},
+		{name: "nonce replayed", request: testSignedRequest("POST", "/lookup?fields=country", `["192.0.2.1"]`, "ci", "secret", "n1", now, nil), wantErr: "already been used"},
+		{name: "same nonce, other request", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n1", now, nil), wantErr: "already been used"},
+		{name: "unknown key", request: testSignedRequest("GET", "/ip", "", "other", "secret", "n3", now, nil), wantErr: "unknown key"},
+		{name: "wrong secret", request: testSignedRequest("GET", "/ip", "", "ci", "guess", "n4", now, nil), wantErr: "does not match"},
+		{name: "no nonce", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "", now, nil), wantErr: "Nonce is required"},
+		{name: "too old", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n5", now.Add(-defaultSigningWindow-time.Second), nil), wantErr: "outside the allowed window"},
+		{name: "too far ahead", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n6", now.Add(defaultSigningWindow+time.Second), nil), wantErr: "outside the allowed window"},
+		{name: "timestamp that isn't a number", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n7", now, func(r *http.Request) {
+			r.Header.Set("X-Signature-Timestamp", "yesterday")
+		}), wantErr: "unix seconds"},
+		{name: "signature that isn't hex", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n8", now, func(r *http.Request) {
+			r.Header.Set("X-Signature", "zz")
+		}), wantErr: "hex HMAC"},
+		{name: "body altered", request: testSignedRequest("POST", "/lookup", `["192.0.2.1"]`, "ci", "secret", "n9", now, func(r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader(`["192.0.2.2"]`))
+		}), wantErr: "does not match"},
+		{name: "query altered", request: testSignedRequest("GET", "/ip?fields=country", "", "ci", "secret", "n10", now, func(r *http.Request) {
+			r.URL.RawQuery = "fields=city"
+		}), wantErr: "does not match"},
+		{name: "method altered", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n11", now, func(r *http.Request) {
+			r.Method = "DELETE"
+		}), wantErr: "does not match"},
+		{name: "timestamp altered", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n12", now, func(r *http.Request) {
+			r.Header.Set("X-Signature-Timestamp", strconv.FormatInt(now.Unix()+1, 10))
+		}), wantErr: "does not match"},
+		{name: "body too large", request: testSignedRequest("POST", "/lookup", strings.Repeat("x", maxSignedBody+1), "ci", "secret", "n13", now, nil), wantErr: "too large"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyID, err := verifySignature(test.request, now)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("verifySignature() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifySignature() error = %v", err)
+			}
+			if keyID != "ci" {
+				t.Fatalf("verifySignature() = %q, want the key ID", keyID)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureKeepsBody(t *testing.T) {
+	config.Signing = signingSettings{Keys: map[string]string{"ci": "secret"}}
+	defer func() { config.Signing = signingSettings{} }()
+	nonces = &nonceTracker{seen: map[string]time.Time{}}
+	now := time.Now()
+	request := testSignedRequest("POST", "/lookup", `["192.0.2.1"]`, "ci", "secret", "n1", now, nil)
+	if _, err := verifySignature(request, now); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(request.Body); string(body) != `["192.0.2.1"]` {
+		t.Fatalf("body after verifying = %q, want it left for the handler", body)
+	}
+}
+
+func TestWithSignatures(t *testing.T) {
+	config.Signing = signingSettings{Keys: map[string]string{"ci": "secret"}, Required: true}
+	defer func() { config.Signing = signingSettings{} }()
+	nonces = &nonceTracker{seen: map[string]time.Time{}}
+	handler := withSignatures(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		request    *http.Request
+		wantStatus int
+	}{
+		{name: "signed", request: testSignedRequest("GET", "/ip", "", "ci", "secret", "n1", time.Now(), nil), wantStatus: http.StatusOK},
+		{name: "unsigned", request: httptest.NewRequest("GET", "/ip", nil), wantStatus: http.StatusUnauthorized},
+		{name: "badly signed", request: testSignedRequest("GET", "/ip", "", "ci", "guess", "n2", time.Now(), nil), wantStatus: http.StatusUnauthorized},
+		{name: "health check", request: httptest.NewRequest("GET", "/healthz", nil), wantStatus: http.StatusOK},
+		{name: "readiness check", request: httptest.NewRequest("GET", "/readyz", nil), wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, test.request)
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body)
+			}
+		})
+	}
+}
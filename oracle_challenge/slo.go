@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSLOWindow applies when an SLO's window_hours isn't configured
+	defaultSLOWindow = 24 * time.Hour
+	// maxSLOWindow bounds window_hours, every minute of the window is kept in memory
+	maxSLOWindow = 7 * 24 * time.Hour
+	// defaultAlertBurnRate applies when an SLO's alert_burn_rate isn't configured
+	defaultAlertBurnRate = 10
+	// sloShortWindow is the recent window the alerting burn rate is measured over
+	sloShortWindow = time.Hour
+)
+
+/*
+	The sloSettings struct is the objective of one provider, keyed by the provider's name under slos
+	Availability is the fraction of calls that must get an answer, e.g. 0.99
+	LatencyMS and LatencyTarget ask for LatencyTarget of the answered calls to take no longer than LatencyMS, e.g. 0.95 within 500ms
+	Both are measured over the last WindowHours (24 by default, at most a week)
+	An alert is raised when the budget of either is burning AlertBurnRate times faster than the objective allows over the last hour,
+	or is spent for the whole window, see sloTracker.evaluate()
+*/
+type sloSettings struct {
+	Availability  float64 `json:"availability"`
+	LatencyMS     int     `json:"latency_ms"`
+	LatencyTarget float64 `json:"latency_target"`
+	WindowHours   int     `json:"window_hours"`
+	AlertBurnRate float64 `json:"alert_burn_rate"`
+}
+
+// The sloMinute struct counts a provider's calls during one minute, Slow counts answered calls over the latency objective
+type sloMinute struct {
+	Minute int64
+	Total  int
+	Failed int
+	Slow   int
+}
+
+// The providerSLO struct is a provider's objective and its calls, a ring of minutes as long as the window
+type providerSLO struct {
+	settings sloSettings
+	minutes  []sloMinute
+	alerting map[string]bool
+}
+
+// The sloTracker struct records every provider call against the objective of its provider
+type sloTracker struct {
+	mutex     sync.Mutex
+	providers map[string]*providerSLO
+}
+
+// slos is built in main() from config.SLOs, providers without an objective aren't tracked
+var slos = &sloTracker{providers: map[string]*providerSLO{}}
+
+// The objectiveStatus struct is how one SLI is doing against its objective, BudgetRemaining goes negative once the budget is overspent
+type objectiveStatus struct {
+	Objective       float64 `json:"objective"`
+	SLI             float64 `json:"sli"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+	BurnRateHour    float64 `json:"burn_rate_1h"`
+	BurnRateWindow  float64 `json:"burn_rate_window"`
+}
+
+// The sloStatus struct is a provider's SLO status as /stats reports it, Latency is only set when a latency objective is configured
+type sloStatus struct {
+	WindowHours  int              `json:"window_hours"`
+	Calls        int              `json:"calls"`
+	Availability objectiveStatus  `json:"availability"`
+	Latency      *objectiveStatus `json:"latency,omitempty"`
+	Alerting     bool             `json:"alerting"`
+}
+
+// The window function returns the SLO's window, window_hours or defaultSLOWindow
+func (settings sloSettings) window() time.Duration {
+	if settings.WindowHours > 0 {
+		return time.Duration(settings.WindowHours) * time.Hour
+	}
+	return defaultSLOWindow
+}
+
+// The newSLOTracker function validates the objectives in configured against the names of providers
+func newSLOTracker(configured map[string]sloSettings, providers []geoProvider) (*sloTracker, error) {
+	known := map[string]bool{}
+	for _, provider := range providers {
+		known[provider.name] = true
+	}
+	tracker := &sloTracker{providers: map[string]*providerSLO{}}
+	for name, settings := range configured {
+		if !known[name] {
+			return nil, fmt.Errorf("slos: there is no provider named %q", name)
+		}
+		if settings.Availability <= 0 || settings.Availability >= 1 {
+			return nil, fmt.Errorf("slos: %s: availability must be between 0 and 1, e.g. 0.99", name)
+		}
+		if (settings.LatencyMS > 0) != (settings.LatencyTarget > 0) || settings.LatencyTarget >= 1 {
+			return nil, fmt.Errorf("slos: %s: latency_ms and latency_target go together, latency_target between 0 and 1", name)
+		}
+		if settings.WindowHours < 0 || settings.window() > maxSLOWindow || settings.AlertBurnRate < 0 {
+			return nil, fmt.Errorf("slos: %s: window_hours can be at most %d and alert_burn_rate can't be negative", name, int(maxSLOWindow.Hours()))
+		}
+		tracker.providers[name] = &providerSLO{
+			settings: settings,
+			minutes:  make([]sloMinute, int(settings.window().Minutes())),
+			alerting: map[string]bool{},
+		}
+	}
+	return tracker, nil
+}
+
+// The recordProviderCall function counts a call to provider that took duration and failed with err (nil when it got an answer)
+func recordProviderCall(provider string, duration time.Duration, err error) {
+	providerOutages.record(provider, err)
+	slos.record(provider, duration, err, time.Now())
+}
+
+// The record function counts a call against provider's objective, nothing is kept for a provider without one
+func (tracker *sloTracker) record(provider string, duration time.Duration, err error, now time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	slo, ok := tracker.providers[provider]
+	if !ok {
+		return
+	}
+	minute := now.Unix() / 60
+	bucket := &slo.minutes[minute%int64(len(slo.minutes))]
+	if bucket.Minute != minute {
+		*bucket = sloMinute{Minute: minute}
+	}
+	bucket.Total++
+	switch {
+	case err != nil:
+		bucket.Failed++
+	case slo.settings.LatencyMS > 0 && duration > time.Duration(slo.settings.LatencyMS)*time.Millisecond:
+		bucket.Slow++
+	}
+}
+
+// The since function adds up the minutes of slo from span ago until now
+func (slo *providerSLO) since(now time.Time, span time.Duration) sloMinute {
+	var sum sloMinute
+	oldest := now.Add(-span).Unix() / 60
+	for _, bucket := range slo.minutes {
+		if bucket.Minute > oldest && bucket.Minute <= now.Unix()/60 {
+			sum.Total += bucket.Total
+			sum.Failed += bucket.Failed
+			sum.Slow += bucket.Slow
+		}
+	}
+	return sum
+}
+
+/*
+	The objective function measures one SLI, bad counting the calls that missed it out of total in the window and recentBad out of recentTotal in the last hour
+	A burn rate of 1 spends the budget exactly over the window, with no calls at all nothing is being burnt
+*/
+func objective(target float64, total, bad, recentTotal, recentBad int) objectiveStatus {
+	status := objectiveStatus{Objective: target, SLI: 1, BudgetRemaining: 1}
+	allowed := 1 - target
+	if total > 0 {
+		status.SLI = 1 - float64(bad)/float64(total)
+		status.BurnRateWindow = float64(bad) / float64(total) / allowed
+		status.BudgetRemaining = 1 - status.BurnRateWindow
+	}
+	if recentTotal > 0 {
+		status.BurnRateHour = float64(recentBad) / float64(recentTotal) / allowed
+	}
+	round := func(value float64) float64 { return math.Round(value*10000) / 10000 }
+	status.SLI, status.BudgetRemaining, status.BurnRateHour, status.BurnRateWindow = round(status.SLI), round(status.BudgetRemaining), round(status.BurnRateHour), round(status.BurnRateWindow)
+	return status
+}
+
+// The status function measures every provider's SLIs against their objectives
+func (tracker *sloTracker) status(now time.Time) map[string]sloStatus {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	statuses := map[string]sloStatus{}
+	for name, slo := range tracker.providers {
+		window, recent := slo.since(now, slo.settings.window()), slo.since(now, sloShortWindow)
+		status := sloStatus{
+			WindowHours:  int(slo.settings.window().Hours()),
+			Calls:        window.Total,
+			Availability: objective(slo.settings.Availability, window.Total, window.Failed, recent.Total, recent.Failed),
+		}
+		if slo.settings.LatencyMS > 0 {
+			// Latency is judged on the calls that got an answer, failures are availability's budget
+			latency := objective(slo.settings.LatencyTarget, window.Total-window.Failed, window.Slow, recent.Total-recent.Failed, recent.Slow)
+			status.Latency = &latency
+		}
+		status.Alerting = slo.alerting["availability"] || slo.alerting["latency"]
+		statuses[name] = status
+	}
+	return statuses
+}
+
+/*
+	The evaluate function raises an alert for every SLI that started burning too fast since it was last evaluated, and logs the ones that recovered
+	Alerts are logged and sent as slo_burn notifications
+*/
+func (tracker *sloTracker) evaluate(now time.Time) {
+	statuses := tracker.status(now)
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for name, status := range statuses {
+		slo := tracker.providers[name]
+		threshold := slo.settings.AlertBurnRate
+		if threshold == 0 {
+			threshold = defaultAlertBurnRate
+		}
+		indicators := map[string]*objectiveStatus{"availability": &status.Availability, "latency": status.Latency}
+		for indicator, measured := range indicators {
+			if measured == nil {
+				continue
+			}
+			burning := measured.BurnRateHour >= threshold || measured.BudgetRemaining <= 0
+			switch {
+			case burning && !slo.alerting[indicator]:
+				log.Printf("slo: %s is burning its %s budget at %gx over the last hour, %g of it left", name, indicator, measured.BurnRateHour, measured.BudgetRemaining)
+				notify(notification{Event: eventSLOBurn, Provider: name, SLI: indicator, BurnRate: measured.BurnRateHour, Budget: measured.BudgetRemaining})
+			case !burning && slo.alerting[indicator]:
+				log.Printf("slo: %s %s is back within its objective", name, indicator)
+			}
+			slo.alerting[indicator] = burning
+		}
+	}
+}
+
+// The watch function evaluates the objectives every minute until stop is closed
+func (tracker *sloTracker) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			tracker.evaluate(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The writeMetrics function writes the SLIs, burn rates and remaining error budgets of every provider with an objective
+func (tracker *sloTracker) writeMetrics(w io.Writer) {
+	statuses := tracker.status(time.Now())
+	var names []string
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type sample struct {
+		provider, sli string
+		status        objectiveStatus
+	}
+	var samples []sample
+	for _, name := range names {
+		samples = append(samples, sample{name, "availability", statuses[name].Availability})
+		if latency := statuses[name].Latency; latency != nil {
+			samples = append(samples, sample{name, "latency", *latency})
+		}
+	}
+
+	writeMetricHeader(w, "oracle_provider_sli", "gauge", "Fraction of the provider's calls meeting the objective over its SLO window.")
+	for _, s := range samples {
+		fmt.Fprintf(w, "oracle_provider_sli{provider=%q,sli=%q} %g\n", s.provider, s.sli, s.status.SLI)
+	}
+	writeMetricHeader(w, "oracle_provider_slo_burn_rate", "gauge", "How fast the error budget is being spent, 1 spends it exactly over the SLO window.")
+	for _, s := range samples {
+		fmt.Fprintf(w, "oracle_provider_slo_burn_rate{provider=%q,sli=%q,window=\"1h\"} %g\n", s.provider, s.sli, s.status.BurnRateHour)
+		fmt.Fprintf(w, "oracle_provider_slo_burn_rate{provider=%q,sli=%q,window=\"slo\"} %g\n", s.provider, s.sli, s.status.BurnRateWindow)
+	}
+	writeMetricHeader(w, "oracle_provider_error_budget_remaining", "gauge", "Fraction of the error budget left over the SLO window, negative once overspent.")
+	for _, s := range samples {
+		fmt.Fprintf(w, "oracle_provider_error_budget_remaining{provider=%q,sli=%q} %g\n", s.provider, s.sli, s.status.BudgetRemaining)
+	}
+}
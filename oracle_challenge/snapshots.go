@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	The snapshotSettings struct is one dated set of archived MaxMind databases, e.g. a GeoLite2-City and GeoLite2-ASN pair
+	Date is the day the databases were published (YYYY-MM-DD), Files lists their paths
+*/
+type snapshotSettings struct {
+	Date  string   `json:"date"`
+	Files []string `json:"files"`
+}
+
+/*
+	The geoSnapshot struct is a snapshotSettings with its date parsed
+	Its databases are read into memory the first time the snapshot is asked about, and kept from then on
+*/
+type geoSnapshot struct {
+	date    time.Time
+	files   []string
+	once    sync.Once
+	readers []*mmdbReader
+	err     error
+}
+
+// snapshots are the configured snapshots, oldest first
+var snapshots []*geoSnapshot
+
+// The loadSnapshots function validates the configured snapshots and sorts them by date, their files are only read when used
+func loadSnapshots(configured []snapshotSettings) ([]*geoSnapshot, error) {
+	var loaded []*geoSnapshot
+	dates := map[string]bool{}
+	for _, settings := range configured {
+		date, err := time.Parse(time.DateOnly, settings.Date)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %q: date must be YYYY-MM-DD", settings.Date)
+		}
+		if dates[settings.Date] {
+			return nil, fmt.Errorf("snapshot %s is configured twice", settings.Date)
+		}
+		dates[settings.Date] = true
+		if len(settings.Files) == 0 {
+			return nil, fmt.Errorf("snapshot %s: files is required", settings.Date)
+		}
+		for _, file := range settings.Files {
+			if _, err := os.Stat(file); err != nil {
+				return nil, fmt.Errorf("snapshot %s: %w", settings.Date, err)
+			}
+		}
+		loaded = append(loaded, &geoSnapshot{date: date, files: settings.Files})
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].date.Before(loaded[j].date) })
+	return loaded, nil
+}
+
+// The snapshotAsOf function returns the newest snapshot published on or before asOf, nil when every snapshot is newer
+func snapshotAsOf(asOf time.Time) *geoSnapshot {
+	var chosen *geoSnapshot
+	for _, snapshot := range snapshots {
+		if !snapshot.date.After(asOf) {
+			chosen = snapshot
+		}
+	}
+	return chosen
+}
+
+// The open function reads the snapshot's databases into memory the first time it is called, returning what went wrong from then on
+func (snapshot *geoSnapshot) open() error {
+	snapshot.once.Do(func() {
+		for _, file := range snapshot.files {
+			reader, err := openMMDB(file)
+			if err != nil {
+				snapshot.err = err
+				return
+			}
+			snapshot.readers = append(snapshot.readers, reader)
+		}
+	})
+	return snapshot.err
+}
+
+/*
+	The lookup function geolocates ip with the snapshot's databases, each filling the fields the others left empty,
+	and reports whether any of them had a record of it
+	The record layout is that of the GeoIP2/GeoLite2 City, Country and ASN databases
+*/
+func (snapshot *geoSnapshot) lookup(ip net.IP) (geolocation, bool, error) {
+	if err := snapshot.open(); err != nil {
+		return geolocation{}, false, err
+	}
+
+	location := geolocation{IP: ip.String()}
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	found := false
+	for _, reader := range snapshot.readers {
+		record, err := reader.lookup(ip)
+		if err != nil {
+			return geolocation{}, false, err
+		}
+		if record == nil {
+			continue
+		}
+		found = true
+		fill(&location.Country, mmdbString(record, "country", "iso_code"))
+		fill(&location.Region, mmdbString(record, "subdivisions", "0", "names", "en"))
+		fill(&location.City, mmdbString(record, "city", "names", "en"))
+		fill(&location.Postal, mmdbString(record, "postal", "code"))
+		fill(&location.Timezone, mmdbString(record, "location", "time_zone"))
+		latitude, longitude := mmdbString(record, "location", "latitude"), mmdbString(record, "location", "longitude")
+		if latitude != "" && longitude != "" {
+			fill(&location.Loc, latitude+","+longitude)
+		}
+		if asn := mmdbString(record, "autonomous_system_number"); asn != "" {
+			fill(&location.Org, "AS"+asn+" "+mmdbString(record, "autonomous_system_organization"))
+		}
+	}
+	return location, found, nil
+}
+
+// The mmdbString function follows path through a decoded record (map keys, or array indexes as digits) and formats the value it finds
+func mmdbString(record interface{}, path ...string) string {
+	node := record
+	for _, key := range path {
+		switch value := node.(type) {
+		case map[string]interface{}:
+			node = value[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index >= len(value) {
+				return ""
+			}
+			node = value[index]
+		default:
+			return ""
+		}
+	}
+	switch value := node.(type) {
+	case string:
+		return value
+	case uint64:
+		return strconv.FormatUint(value, 10)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', 4, 64)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// locationFieldOrder is the column order of the unix socket protocol, every name is a key of locationFields()
+var locationFieldOrder = []string{"ip", "hostname", "country", "region", "city", "postal", "timezone", "loc", "org"}
+
+/*
+	The serveUnixSocket function listens on path for the line protocol used by local scripts and programs
+	Each request is a line holding an IP address, each answer is one line of tab separated fields in locationFieldOrder
+	or "ERR" followed by a tab and the reason, lookups share the cache and upstream quota with the HTTP endpoints
+	Access is controlled by the socket's file permissions (owner and group only), and the listener is closed once stop is closed
+*/
+func serveUnixSocket(path string, stop <-chan struct{}) error {
+	// A socket left behind by a previous run would make the listen fail
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return errors.New(path + " exists and is not a socket")
+		}
+		os.Remove(path)
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return err
+	}
+
+	// During an upgrade the new process replaces the socket file before this one stops, so closing mustn't unlink it,
+	// the file left behind on shutdown is removed by the next start
+	listener.SetUnlinkOnClose(false)
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("unix socket: %v", err)
+				}
+				return
+			}
+			go serveSocketConnection(connection)
+		}
+	}()
+	return nil
+}
+
+// The serveSocketConnection function answers every line sent over connection until the client hangs up
+func serveSocketConnection(connection net.Conn) {
+	defer connection.Close()
+	scanner := bufio.NewScanner(connection)
+	writer := bufio.NewWriter(connection)
+	for scanner.Scan() {
+		writer.WriteString(socketAnswer(strings.TrimSpace(scanner.Text())) + "\n")
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// The socketAnswer function builds the reply line for a single request line
+func socketAnswer(request string) string {
+	if net.ParseIP(request) == nil {
+		return "ERR\tnot an IP address"
+	}
+	location, err := lookupGeolocation(request)
+	if err != nil {
+		return "ERR\t" + socketField(err.Error())
+	}
+	location.IP = request
+
+	fields := locationFields(location)
+	columns := make([]string, len(locationFieldOrder))
+	for i, name := range locationFieldOrder {
+		columns[i] = socketField(fields[name])
+	}
+	return strings.Join(columns, "\t")
+}
+
+// The socketField function keeps a value on one line and in one column
+func socketField(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(value)
+}
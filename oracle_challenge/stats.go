@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+	The statsReport struct is the /stats response, Noise is only set when the counts were perturbed
+	Providers is paginated by name, NextCursor fetches the providers after this page
+*/
+type statsReport struct {
+	UpstreamCallsToday int                     `json:"upstream_calls_today"`
+	Providers          map[string]providerCost `json:"providers"`
+	ProviderCount      int                     `json:"provider_count"`
+	NextCursor         string                  `json:"next_cursor,omitempty"`
+	Cache              cacheStats              `json:"cache"`
+	Latency            latencyReport           `json:"latency"`
+	SLOs               map[string]sloStatus    `json:"slos,omitempty"`
+	Noise              *noiseInfo              `json:"noise,omitempty"`
+}
+
+// The currentStats function gathers the exact counters /stats reports
+func currentStats() statsReport {
+	callsToday, calls := quotas.usage()
+	return statsReport{UpstreamCallsToday: callsToday, Providers: estimateCosts(calls, time.Now()), Cache: geoCache.snapshot(), Latency: latencies.report(), SLOs: slos.status(time.Now())}
+}
+
+/*
+	The handleStats function serves /stats, the upstream usage counters along with each provider's estimated cost for the month, the cache's size
+	request latency by country and continent, and how each provider with an objective is doing against it (see sloSettings)
+	With stats.noise_epsilon configured the counts are noised for publishing, see noisedStats(), /metrics always reports exact values
+	Providers are paginated in name order, see parsePage()
+*/
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	current, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var report statsReport
+	if config.Stats.NoiseEpsilon > 0 {
+		report = noisedStats(currentStats, config.Stats, time.Now())
+	} else {
+		report = currentStats()
+	}
+
+	providers := sortedKeys(report.Providers)
+	start, end, next := paginate(current, len(providers), func(i int) string { return providers[i] })
+	onPage := map[string]providerCost{}
+	for _, provider := range providers[start:end] {
+		onPage[provider] = report.Providers[provider]
+	}
+	report.Providers, report.ProviderCount, report.NextCursor = onPage, len(providers), next
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// The handleMetrics function serves /metrics in the Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	callsToday, calls := quotas.usage()
+	costs := estimateCosts(calls, time.Now())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetricHeader(w, "oracle_upstream_calls_today", "gauge", "Upstream lookups made today (UTC), counted against the daily limit.")
+	fmt.Fprintf(w, "oracle_upstream_calls_today %d\n", callsToday)
+
+	providers := sortedKeys(costs)
+	writeMetricHeader(w, "oracle_provider_calls_month", "gauge", "Billable provider calls made this month (UTC).")
+	for _, provider := range providers {
+		fmt.Fprintf(w, "oracle_provider_calls_month{provider=%q} %d\n", provider, costs[provider].CallsThisMonth)
+	}
+	writeMetricHeader(w, "oracle_provider_estimated_monthly_cost", "gauge", "Projected provider cost for this month, in the configured currency.")
+	for _, provider := range providers {
+		fmt.Fprintf(w, "oracle_provider_estimated_monthly_cost{provider=%q,currency=%q} %g\n", provider, costs[provider].Currency, costs[provider].EstimatedMonthlyCost)
+	}
+
+	writeMetricHeader(w, "oracle_feed_entries", "gauge", "Ranges currently loaded per threat feed.")
+	for _, feed := range feeds {
+		fmt.Fprintf(w, "oracle_feed_entries{feed=%q} %d\n", feed.settings.Name, feed.status().Entries)
+	}
+	writeMetricHeader(w, "oracle_feed_hits_total", "counter", "Lookups that matched at least one range of the feed.")
+	for _, feed := range feeds {
+		fmt.Fprintf(w, "oracle_feed_hits_total{feed=%q} %d\n", feed.settings.Name, feed.hits.Load())
+	}
+
+	cache := geoCache.snapshot()
+	writeMetricHeader(w, "oracle_cache_entries", "gauge", "Geolocations currently cached.")
+	fmt.Fprintf(w, "oracle_cache_entries %d\n", cache.Entries)
+	writeMetricHeader(w, "oracle_cache_capacity_entries", "gauge", "Entries that fit the memory budget at the sampled average entry size.")
+	fmt.Fprintf(w, "oracle_cache_capacity_entries %d\n", cache.Capacity)
+	writeMetricHeader(w, "oracle_cache_estimated_bytes", "gauge", "Estimated memory held by cached entries.")
+	fmt.Fprintf(w, "oracle_cache_estimated_bytes %d\n", cache.EstimatedBytes)
+	writeMetricHeader(w, "oracle_cache_budget_bytes", "gauge", "Configured cache memory budget.")
+	fmt.Fprintf(w, "oracle_cache_budget_bytes %d\n", cache.BudgetBytes)
+	writeMetricHeader(w, "oracle_cache_requests_total", "counter", "Cache lookups by result.")
+	fmt.Fprintf(w, "oracle_cache_requests_total{result=\"hit\"} %d\n", cache.Hits)
+	fmt.Fprintf(w, "oracle_cache_requests_total{result=\"miss\"} %d\n", cache.Misses)
+	writeMetricHeader(w, "oracle_cache_evictions_total", "counter", "Entries evicted to stay within the memory budget.")
+	fmt.Fprintf(w, "oracle_cache_evictions_total %d\n", cache.Evictions)
+	writeMetricHeader(w, "oracle_cache_expirations_total", "counter", "Entries dropped because their TTL passed.")
+	fmt.Fprintf(w, "oracle_cache_expirations_total %d\n", cache.Expirations)
+	sampler.writeMetrics(w)
+	activity.writeMetrics(w)
+	latencies.writeMetrics(w)
+	slos.writeMetrics(w)
+	degradation.writeMetrics(w)
+}
+
+// The writeMetricHeader function writes the HELP and TYPE lines that precede a metric's samples
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// The sortedKeys function returns the provider names of costs in a stable order so scrapes diff cleanly
+func sortedKeys(costs map[string]providerCost) []string {
+	var keys []string
+	for key := range costs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
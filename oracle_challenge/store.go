@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+	The jsonlStore struct is an append-only file of JSON records, one per line
+	It backs the small amount of history this service persists, every method is safe for concurrent use
+	A store without a path keeps nothing on disk, its callers hold their records in memory instead
+*/
+type jsonlStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// The newJSONLStore function returns a store for name inside config.DataDir, or a memory-only store when no data_dir is configured
+func newJSONLStore(name string) *jsonlStore {
+	if config.DataDir == "" {
+		return &jsonlStore{}
+	}
+	return &jsonlStore{path: filepath.Join(config.DataDir, name)}
+}
+
+// The append function writes record as a new line at the end of the file
+func (store *jsonlStore) append(record interface{}) error {
+	if store.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if line, err = sealLine(line); err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	persisting.RLock()
+	defer persisting.RUnlock()
+	file, err := os.OpenFile(store.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+	The each function calls decode with every line of the file, oldest first, decrypted when it was stored encrypted
+	A missing file is treated as an empty store
+*/
+func (store *jsonlStore) each(decode func(line []byte) error) error {
+	if store.path == "" {
+		return nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	file, err := os.Open(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		line, err := openLine(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s: %w", store.path, err)
+		}
+		if err := decode(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+/*
+	The rewrite function keeps only the lines keep accepts, replacing the file atomically, and returns how many lines were dropped
+	Plaintext lines that are kept are encrypted on the way when encryption is on, so a purge migrates older data
+	A memory-only store has nothing to rewrite
+*/
+func (store *jsonlStore) rewrite(keep func(line []byte) bool) (int, error) {
+	if store.path == "" {
+		return 0, nil
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	file, err := os.Open(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var kept []byte
+	dropped, migrated := 0, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		line, err := openLine(scanner.Bytes())
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", store.path, err)
+		}
+		if !keep(line) {
+			dropped++
+			continue
+		}
+		stored := scanner.Bytes()
+		if storageCipher != nil && !bytes.HasPrefix(stored, []byte(sealedPrefix)) {
+			if stored, err = sealLine(line); err != nil {
+				return 0, err
+			}
+			migrated++
+		}
+		kept = append(append(kept, stored...), '\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if dropped == 0 && migrated == 0 {
+		return 0, nil
+	}
+	return dropped, writeFileAtomic(store.path, kept)
+}
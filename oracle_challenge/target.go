@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The invalidAddressError type is returned for an address a client asked about that isn't an IP address
+type invalidAddressError struct {
+	Input string
+}
+
+// The Error function names the input that failed to parse
+func (err *invalidAddressError) Error() string {
+	return strconv.Quote(err.Input) + " is not a valid IP address"
+}
+
+/*
+	The explicitIP function returns the address a request names for itself, from the path of /ip/{address} or from ?ip=,
+	in canonical form and with false when it names none
+*/
+func explicitIP(r *http.Request) (string, bool, error) {
+	input := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ip/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/ip/") || input == "json" || input == "raw" {
+		input = ""
+	}
+	if input == "" {
+		input = r.URL.Query().Get("ip")
+	}
+	if input == "" {
+		return "", false, nil
+	}
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		return "", false, &invalidAddressError{Input: input}
+	}
+	return parsed.String(), true, nil
+}
+
+// The targetIP function returns the address a request is about, the one it names (see explicitIP()) or the client's own
+func targetIP(r *http.Request) (string, error) {
+	ip, ok, err := explicitIP(r)
+	if err != nil || ok {
+		return ip, err
+	}
+	return determineIP(r)
+}
+
+// The writeInvalidAddress function answers a request that named a malformed address with a 400 and a JSON body saying so
+func writeInvalidAddress(w http.ResponseWriter, err error) bool {
+	var invalid *invalidAddressError
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]string{"ip": invalid.Input, "error": invalid.Error()})
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+/*
+	The tenantSettings struct groups API keys into a tenant, whose lookups are recorded under its name
+	Every key must also be listed in api_keys, a tenant decides whose records a lookup produces rather than who may make it
+*/
+type tenantSettings struct {
+	Name    string   `json:"name"`
+	APIKeys []string `json:"api_keys"`
+}
+
+// The checkTenants function rejects tenants without a name, duplicate names and keys that aren't API keys or belong to two tenants
+func checkTenants(tenants []tenantSettings) error {
+	names := map[string]bool{}
+	owners := map[string]string{}
+	for _, tenant := range tenants {
+		if tenant.Name == "" {
+			return errors.New("every tenant needs a name")
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenant %q is configured twice", tenant.Name)
+		}
+		names[tenant.Name] = true
+		for _, key := range tenant.APIKeys {
+			if !validAPIKey(key, config.APIKeys) {
+				return fmt.Errorf("tenant %q: every key must also be one of api_keys", tenant.Name)
+			}
+			if owner, ok := owners[key]; ok {
+				return fmt.Errorf("tenants %q and %q share an API key", owner, tenant.Name)
+			}
+			owners[key] = tenant.Name
+		}
+	}
+	return nil
+}
+
+// The tenantFor function returns the name of the tenant whose API key the request presents, "" when it belongs to none
+func tenantFor(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	key := requestAPIKey(r)
+	if key == "" {
+		return ""
+	}
+	for _, tenant := range config.Tenants {
+		if validAPIKey(key, tenant.APIKeys) {
+			return tenant.Name
+		}
+	}
+	return ""
+}
+
+/*
+	The handleTenantExport function serves /tenant/export?ip=... or ?hash=..., the subject export of /admin/export limited to
+	the records of the caller's tenant, so a tenant can answer its own access requests without seeing another tenant's lookups
+	Only a tenant's API key may call it
+*/
+func handleTenantExport(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFor(r)
+	if tenant == "" {
+		http.Error(w, "this API key doesn't belong to a tenant", http.StatusForbidden)
+		return
+	}
+	ip, hash, ok := exportSubjectQuery(w, r)
+	if !ok {
+		return
+	}
+	export, err := exportSubject(ip, hash, tenant)
+	if err != nil {
+		http.Error(w, "Error while reading the stored records: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="subject-export.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
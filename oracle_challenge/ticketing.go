@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// defaultTicketCooldown applies when ticketing.cooldown_seconds isn't configured
+	defaultTicketCooldown = 24 * time.Hour
+	// ticketTimeout bounds a single call to a ticketing system
+	ticketTimeout = 15 * time.Second
+	// ticketQueueLength bounds the flagged lookups waiting to be filed, more than that are dropped and logged
+	ticketQueueLength = 100
+)
+
+/*
+	The ticketingSettings struct files a ticket when an enrichment trips one of its rules, so SOC workflows pick flagged lookups up directly
+	Reputation flags an address the reputation stage found listed, GeoFence flags an address the geo stage placed in one of the listed countries
+	A flagged address gets a new ticket in every connector, flagged again within CooldownSeconds (a day by default) it annotates that ticket instead
+*/
+type ticketingSettings struct {
+	Connectors      []ticketConnectorSettings `json:"connectors"`
+	Reputation      bool                      `json:"reputation"`
+	GeoFence        []string                  `json:"geo_fence"`
+	CooldownSeconds int                       `json:"cooldown_seconds"`
+}
+
+/*
+	The ticketConnectorSettings struct is one ticketing system, Kind is one of ticketKinds and URL its base URL (e.g. https://example.atlassian.net)
+	Headers carry its credentials, Fields are extra values for the templates such as the Jira project and issue_type
+	CreateTemplate and AnnotateTemplate replace the kind's JSON payloads, see ticketEvent for what they are rendered against
+*/
+type ticketConnectorSettings struct {
+	Name             string            `json:"name"`
+	Kind             string            `json:"kind"`
+	URL              string            `json:"url"`
+	Headers          map[string]string `json:"headers"`
+	Fields           map[string]string `json:"fields"`
+	CreateTemplate   string            `json:"create_template"`
+	AnnotateTemplate string            `json:"annotate_template"`
+}
+
+/*
+	The ticketKind struct is how to talk to one kind of ticketing system: the paths tickets are created at and annotated at ({id} is the ticket),
+	where the new ticket's ID is in the create response (a dotted path as for jsonPath()) and the default payloads
+	Adding a ticketing system is adding an entry to ticketKinds
+*/
+type ticketKind struct {
+	CreatePath       string
+	AnnotateMethod   string
+	AnnotatePath     string
+	IDPath           string
+	Required         []string
+	CreateTemplate   string
+	AnnotateTemplate string
+}
+
+// ticketKinds lists the ticketing systems a connector can be
+var ticketKinds = map[string]ticketKind{
+	"jira": {
+		CreatePath:     "/rest/api/2/issue",
+		AnnotateMethod: http.MethodPost,
+		AnnotatePath:   "/rest/api/2/issue/{id}/comment",
+		IDPath:         "key",
+		Required:       []string{"project"},
+		CreateTemplate: `{"fields": {"project": {"key": {{json .Fields.project}}}, ` +
+			`"issuetype": {"name": {{with .Fields.issue_type}}{{json .}}{{else}}"Task"{{end}}}, ` +
+			`"summary": {{json .Summary}}, "description": {{json .Description}}}}`,
+		AnnotateTemplate: `{"body": {{json .Description}}}`,
+	},
+	"servicenow": {
+		CreatePath:       "/api/now/table/incident",
+		AnnotateMethod:   http.MethodPatch,
+		AnnotatePath:     "/api/now/table/incident/{id}",
+		IDPath:           "result.sys_id",
+		CreateTemplate:   `{"short_description": {{json .Summary}}, "description": {{json .Description}}}`,
+		AnnotateTemplate: `{"work_notes": {{json .Description}}}`,
+	},
+}
+
+/*
+	The ticketEvent struct is what the payload templates are rendered against, a flagged lookup
+	Rules names the rules it tripped, Matches the blocklist ranges and Feeds the threat feeds that listed it when reputation is one of them
+	The json template function encodes a value as JSON, so {{json .Summary}} is a quoted and escaped string
+*/
+type ticketEvent struct {
+	IP          string
+	Rules       []string
+	Country     string
+	Matches     []string
+	Feeds       []string
+	ResultHash  string
+	Time        string
+	Summary     string
+	Description string
+	Fields      map[string]string
+}
+
+// The ticketConnector struct is a connector with its kind and parsed templates
+type ticketConnector struct {
+	settings ticketConnectorSettings
+	kind     ticketKind
+	create   *template.Template
+	annotate *template.Template
+}
+
+// The openTicket struct remembers the ticket a connector filed for an address, so repeat flags annotate it
+type openTicket struct {
+	ID     string
+	Opened time.Time
+}
+
+// The ticketFiler struct files flagged lookups one at a time off a queue, so tickets never hold up a response or race each other
+type ticketFiler struct {
+	connectors []*ticketConnector
+	queue      chan ticketEvent
+	mutex      sync.Mutex
+	open       map[string]openTicket
+}
+
+// tickets is built in main() when ticketing connectors are configured, nil otherwise
+var tickets *ticketFiler
+
+// ticketFunctions are the functions available to payload templates
+var ticketFunctions = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// The newTicketFiler function validates settings and parses every connector's templates, nil when no connectors are configured
+func newTicketFiler(settings ticketingSettings) (*ticketFiler, error) {
+	if len(settings.Connectors) == 0 {
+		return nil, nil
+	}
+	if !settings.Reputation && len(settings.GeoFence) == 0 {
+		return nil, errors.New("ticketing: connectors are configured but neither reputation nor geo_fence would ever flag a lookup")
+	}
+	for _, country := range settings.GeoFence {
+		if len(country) != 2 {
+			return nil, fmt.Errorf("ticketing: %q is not a two-letter country code", country)
+		}
+	}
+	filer := &ticketFiler{queue: make(chan ticketEvent, ticketQueueLength), open: map[string]openTicket{}}
+	names := map[string]bool{}
+	for _, connector := range settings.Connectors {
+		if connector.Name == "" || names[connector.Name] {
+			return nil, fmt.Errorf("ticketing: connector name %q is empty or already taken", connector.Name)
+		}
+		names[connector.Name] = true
+		kind, ok := ticketKinds[connector.Kind]
+		if !ok {
+			return nil, fmt.Errorf("ticketing: connector %q: unknown kind %q", connector.Name, connector.Kind)
+		}
+		if !strings.HasPrefix(connector.URL, "https://") && !strings.HasPrefix(connector.URL, "http://") {
+			return nil, fmt.Errorf("ticketing: connector %q: url must be an http or https URL", connector.Name)
+		}
+		for _, field := range kind.Required {
+			if connector.Fields[field] == "" {
+				return nil, fmt.Errorf("ticketing: connector %q: a %s connector needs fields.%s", connector.Name, connector.Kind, field)
+			}
+		}
+
+		parsed := &ticketConnector{settings: connector, kind: kind}
+		sources := map[string]string{"create": kind.CreateTemplate, "annotate": kind.AnnotateTemplate}
+		if connector.CreateTemplate != "" {
+			sources["create"] = connector.CreateTemplate
+		}
+		if connector.AnnotateTemplate != "" {
+			sources["annotate"] = connector.AnnotateTemplate
+		}
+		var err error
+		if parsed.create, err = template.New("create").Funcs(ticketFunctions).Parse(sources["create"]); err != nil {
+			return nil, fmt.Errorf("ticketing: connector %q: %w", connector.Name, err)
+		}
+		if parsed.annotate, err = template.New("annotate").Funcs(ticketFunctions).Parse(sources["annotate"]); err != nil {
+			return nil, fmt.Errorf("ticketing: connector %q: %w", connector.Name, err)
+		}
+		filer.connectors = append(filer.connectors, parsed)
+	}
+	return filer, nil
+}
+
+/*
+	The flagged function checks an enrichment against the ticketing rules, returning the event to file and whether any rule tripped
+	Stages that were switched off or failed can't trip their rule
+*/
+func flagged(result enrichmentResult, settings ticketingSettings) (ticketEvent, bool) {
+	event := ticketEvent{IP: result.IP, ResultHash: result.ResultHash, Time: time.Now().UTC().Format(time.RFC3339)}
+	var reasons []string
+	if reputation, ok := result.Blocks["reputation"].(map[string]interface{}); ok && settings.Reputation {
+		if listed, _ := reputation["listed"].(bool); listed {
+			event.Rules = append(event.Rules, "reputation")
+			event.Matches, _ = reputation["matches"].([]string)
+			event.Feeds, _ = reputation["feeds"].([]string)
+			reasons = append(reasons, "it is listed in "+strings.Join(event.Matches, ", ")+" by "+strings.Join(event.Feeds, ", "))
+		}
+	}
+	if geo, ok := result.Blocks["geo"].(map[string]string); ok {
+		event.Country = geo["country"]
+		for _, country := range settings.GeoFence {
+			if event.Country != "" && strings.EqualFold(country, event.Country) {
+				event.Rules = append(event.Rules, "geo_fence")
+				reasons = append(reasons, "it is located in "+event.Country+", which is geo-fenced")
+			}
+		}
+	}
+	if len(event.Rules) == 0 {
+		return event, false
+	}
+	event.Summary = "Flagged lookup of " + event.IP
+	event.Description = fmt.Sprintf("A lookup of %s at %s was flagged because %s (result hash %s)",
+		event.IP, event.Time, strings.Join(reasons, " and "), event.ResultHash)
+	return event, true
+}
+
+// The flag function queues the enrichment for filing when it trips a rule, it never blocks
+func (filer *ticketFiler) flag(result enrichmentResult) {
+	event, ok := flagged(result, config.Ticketing)
+	if !ok {
+		return
+	}
+	select {
+	case filer.queue <- event:
+	default:
+		log.Printf("ticketing: the queue is full, dropping the flagged lookup of %s", event.IP)
+	}
+}
+
+// The run function files queued events until stop is closed
+func (filer *ticketFiler) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event := <-filer.queue:
+			for _, connector := range filer.connectors {
+				if err := filer.file(connector, event); err != nil {
+					log.Printf("ticketing: %s: filing the flagged lookup of %s: %v", connector.settings.Name, event.IP, err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The file function opens a ticket for the event in connector, or annotates the one opened for the same address within the cooldown
+func (filer *ticketFiler) file(connector *ticketConnector, event ticketEvent) error {
+	cooldown := defaultTicketCooldown
+	if config.Ticketing.CooldownSeconds > 0 {
+		cooldown = time.Duration(config.Ticketing.CooldownSeconds) * time.Second
+	}
+	key := connector.settings.Name + "\n" + event.IP
+	filer.mutex.Lock()
+	for known, ticket := range filer.open {
+		if time.Since(ticket.Opened) > cooldown {
+			delete(filer.open, known)
+		}
+	}
+	ticket, ok := filer.open[key]
+	filer.mutex.Unlock()
+
+	event.Fields = connector.settings.Fields
+	if ok {
+		_, err := connector.send(connector.kind.AnnotateMethod, strings.ReplaceAll(connector.kind.AnnotatePath, "{id}", ticket.ID), connector.annotate, event)
+		return err
+	}
+	response, err := connector.send(http.MethodPost, connector.kind.CreatePath, connector.create, event)
+	if err != nil {
+		return err
+	}
+	id := jsonPath(response, connector.kind.IDPath)
+	if id == "" {
+		return fmt.Errorf("the response has no ticket ID at %s", connector.kind.IDPath)
+	}
+	filer.mutex.Lock()
+	filer.open[key] = openTicket{ID: id, Opened: time.Now()}
+	filer.mutex.Unlock()
+	log.Printf("ticketing: %s: opened %s for %s", connector.settings.Name, id, event.IP)
+	return nil
+}
+
+// The send function renders payload for event and sends it to path of the connector, returning the decoded response
+func (connector *ticketConnector) send(method, path string, payload *template.Template, event ticketEvent) (interface{}, error) {
+	var body bytes.Buffer
+	if err := payload.Execute(&body, event); err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(method, strings.TrimSuffix(connector.settings.URL, "/")+path, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	for name, value := range connector.settings.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := egressClient(ticketTimeout).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s answered %s", method, path, response.Status)
+	}
+	var document interface{}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&document); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return document, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The clientHello struct holds the JA3 fingerprint of a connection's ClientHello, filled in during the handshake
+type clientHello struct {
+	JA3 string
+}
+
+// The clientHelloKey type is the context key of a connection's *clientHello
+type clientHelloKey struct{}
+
+// pendingHellos maps a connection that hasn't finished its handshake to the clientHello its GetConfigForClient fills in
+var pendingHellos sync.Map
+
+/*
+	The tlsConfig function returns the TLS config of a listener with tls_cert and tls_key, nil for a plain HTTP one
+	Each ClientHello is fingerprinted on its way through, for /tls
+*/
+func (listener listenerSettings) tlsConfig() (*tls.Config, error) {
+	if listener.TLSCert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(listener.TLSCert, listener.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			recorder, recorded := info.Conn.(*helloRecorder)
+			if !recorded {
+				return nil, nil
+			}
+			records := recorder.stop()
+			if pending, ok := pendingHellos.LoadAndDelete(info.Conn); ok {
+				pending.(*clientHello).JA3, _ = ja3String(records)
+			}
+			return nil, nil
+		},
+	}, nil
+}
+
+// The rememberClientHello function is the http.Server ConnContext hook that gives a TLS connection somewhere to keep its fingerprint
+func rememberClientHello(ctx context.Context, connection net.Conn) context.Context {
+	tlsConnection, ok := connection.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	hello := &clientHello{}
+	pendingHellos.Store(tlsConnection.NetConn(), hello)
+	return context.WithValue(ctx, clientHelloKey{}, hello)
+}
+
+// The forgetClientHello function drops the pending fingerprint of a connection that closed before finishing its handshake
+func forgetClientHello(connection net.Conn, state http.ConnState) {
+	if tlsConnection, ok := connection.(*tls.Conn); ok && (state == http.StateClosed || state == http.StateHijacked) {
+		pendingHellos.Delete(tlsConnection.NetConn())
+	}
+}
+
+// The isGREASE function reports whether value is one of the reserved GREASE values (RFC 8701), which JA3 leaves out
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// maxHelloBytes bounds how much of a connection helloRecorder keeps, a ClientHello is far smaller
+const maxHelloBytes = 64 << 10
+
+/*
+	The helloRecorder struct is a connection that keeps a copy of what is read from it until stop is called, so the raw ClientHello
+	can be fingerprinted: crypto/tls only hands GetConfigForClient the parsed fields, and not the extensions on every Go version
+*/
+type helloRecorder struct {
+	net.Conn
+	mutex    sync.Mutex
+	recorded []byte
+	stopped  bool
+}
+
+// The Read function reads from the connection, recording what it read
+func (recorder *helloRecorder) Read(buffer []byte) (int, error) {
+	n, err := recorder.Conn.Read(buffer)
+	recorder.mutex.Lock()
+	if !recorder.stopped {
+		recorder.recorded = append(recorder.recorded, buffer[:n]...)
+		recorder.stopped = len(recorder.recorded) >= maxHelloBytes
+	}
+	recorder.mutex.Unlock()
+	return n, err
+}
+
+// The stop function stops recording and returns what was recorded
+func (recorder *helloRecorder) stop() []byte {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorded := recorder.recorded
+	recorder.recorded, recorder.stopped = nil, true
+	return recorded
+}
+
+// The helloListener struct wraps a TLS listener's connections in helloRecorders as they are accepted
+type helloListener struct {
+	net.Listener
+}
+
+// The Accept function accepts the next connection, wrapped so its ClientHello is recorded
+func (listener helloListener) Accept() (net.Conn, error) {
+	connection, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloRecorder{Conn: connection}, nil
+}
+
+// errMalformedHello is returned for a ClientHello that ends early or isn't one
+var errMalformedHello = errors.New("malformed ClientHello")
+
+// The helloCursor struct reads the big-endian fields of a ClientHello in order, remembering if it ran out of data
+type helloCursor struct {
+	data      []byte
+	truncated bool
+}
+
+// The take function returns the next n bytes, nil once the data runs out
+func (cursor *helloCursor) take(n int) []byte {
+	if cursor.truncated || n > len(cursor.data) {
+		cursor.truncated = true
+		return nil
+	}
+	taken := cursor.data[:n]
+	cursor.data = cursor.data[n:]
+	return taken
+}
+
+// The number function reads an unsigned field of size bytes
+func (cursor *helloCursor) number(size int) int {
+	value := 0
+	for _, b := range cursor.take(size) {
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+// The vector function reads a field prefixed with its length in lengthSize bytes
+func (cursor *helloCursor) vector(lengthSize int) *helloCursor {
+	return &helloCursor{data: cursor.take(cursor.number(lengthSize)), truncated: cursor.truncated}
+}
+
+// The uint16s function reads the rest of the cursor as a list of 16-bit values
+func (cursor *helloCursor) uint16s() []uint16 {
+	var values []uint16
+	for len(cursor.data) >= 2 {
+		values = append(values, binary.BigEndian.Uint16(cursor.take(2)))
+	}
+	return values
+}
+
+/*
+	The ja3String function formats a raw ClientHello, as it arrived in TLS records, the way JA3 does:
+	legacy version, ciphers, extensions, curves and point formats, each list joined by "-" with GREASE values left out
+*/
+func ja3String(records []byte) (string, error) {
+	// The handshake message may be split over several records
+	var handshake []byte
+	for len(records) >= 5 && records[0] == 22 {
+		length := int(binary.BigEndian.Uint16(records[3:5]))
+		if len(records) < 5+length {
+			break
+		}
+		handshake = append(handshake, records[5:5+length]...)
+		records = records[5+length:]
+	}
+	message := &helloCursor{data: handshake}
+	if message.number(1) != 1 {
+		return "", errMalformedHello
+	}
+	hello := message.vector(3)
+	version := hello.number(2)
+	hello.take(32)
+	hello.vector(1)
+	ciphers := hello.vector(2).uint16s()
+	hello.vector(1)
+	var extensions, curves, points []uint16
+	all := hello.vector(2)
+	for len(all.data) > 0 && !all.truncated {
+		extension := uint16(all.number(2))
+		body := all.vector(2)
+		extensions = append(extensions, extension)
+		switch extension {
+		case 10:
+			curves = body.vector(2).uint16s()
+		case 11:
+			for _, format := range body.vector(1).data {
+				points = append(points, uint16(format))
+			}
+		}
+	}
+	if hello.truncated || all.truncated {
+		return "", errMalformedHello
+	}
+
+	join := func(values []uint16) string {
+		var parts []string
+		for _, value := range values {
+			if !isGREASE(value) {
+				parts = append(parts, strconv.Itoa(int(value)))
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+	return strings.Join([]string{strconv.Itoa(version), join(ciphers), join(extensions), join(curves), join(points)}, ","), nil
+}
+
+// The tlsInfo struct is the answer of /tls, JA3 and JA3Hash are only filled in for ?fingerprint=true
+type tlsInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn"`
+	SNI         string `json:"sni"`
+	Resumed     bool   `json:"resumed"`
+	JA3         string `json:"ja3,omitempty"`
+	JA3Hash     string `json:"ja3_hash,omitempty"`
+}
+
+/*
+	The handleTLS function serves /tls, what the client's TLS connection negotiated, for diagnosing client TLS issues
+	It only answers on a listener with tls_cert, behind a TLS-terminating proxy the connection it sees is the proxy's
+*/
+func handleTLS(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "this request didn't arrive over TLS"})
+		return
+	}
+	info := tlsInfo{
+		Version:     tls.VersionName(r.TLS.Version),
+		CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+		ALPN:        r.TLS.NegotiatedProtocol,
+		SNI:         r.TLS.ServerName,
+		Resumed:     r.TLS.DidResume,
+	}
+	if fingerprint, _ := strconv.ParseBool(r.URL.Query().Get("fingerprint")); fingerprint {
+		if hello, ok := r.Context().Value(clientHelloKey{}).(*clientHello); ok && hello.JA3 != "" {
+			sum := md5.Sum([]byte(hello.JA3))
+			info.JA3, info.JA3Hash = hello.JA3, hex.EncodeToString(sum[:])
+		}
+	}
+	writeJSON(w, http.StatusOK, info)
+}
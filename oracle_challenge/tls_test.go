@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testClientHello returns the records of a ClientHello sent by crypto/tls configured with config
+func testClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, config).Handshake()
+	}()
+	defer client.Close()
+	defer server.Close()
+
+	var records []byte
+	buffer := make([]byte, 4096)
+	for {
+		n, err := server.Read(buffer)
+		records = append(records, buffer[:n]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) >= 5 && len(records) >= 5+(int(records[3])<<8|int(records[4])) {
+			return records
+		}
+	}
+}
+
+func TestJA3String(t *testing.T) {
+	hello := testClientHello(t, &tls.Config{ServerName: "example.com", MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256}})
+	got, err := ja3String(hello)
+	if err != nil {
+		t.Fatalf("ja3String() error = %v", err)
+	}
+	fields := strings.Split(got, ",")
+	if len(fields) != 5 {
+		t.Fatalf("ja3String() = %q, want 5 fields", got)
+	}
+	// 771 is TLS 1.2, 49199 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, extension 0 the server name, curves 29 and 23 X25519 and P-256
+	if fields[0] != "771" || !strings.HasPrefix(fields[1], "49199") || !strings.HasPrefix(fields[2], "0-") || fields[3] != "29-23" || fields[4] != "0" {
+		t.Fatalf("ja3String() = %q", got)
+	}
+
+	// The same hello split over two records
+	body := hello[5:]
+	split := append([]byte{22, 3, 1, 0, 10}, body[:10]...)
+	split = append(split, 22, 3, 1, byte((len(body)-10)>>8), byte(len(body)-10))
+	split = append(split, body[10:]...)
+	if fragmented, err := ja3String(split); err != nil || fragmented != got {
+		t.Fatalf("ja3String() of a fragmented hello = %q, %v, want %q", fragmented, err, got)
+	}
+
+	tests := []struct {
+		name    string
+		records []byte
+	}{
+		{name: "empty"},
+		{name: "not a handshake", records: append([]byte{23}, hello[1:]...)},
+		{name: "not a ClientHello", records: append(append([]byte{}, hello[:5]...), append([]byte{2}, hello[6:]...)...)},
+		{name: "truncated record", records: hello[:len(hello)-1]},
+		{name: "only the record header", records: hello[:5]},
+		{name: "HTTP instead of TLS", records: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := ja3String(test.records); err == nil {
+				t.Fatalf("ja3String() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, value := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(value) {
+			t.Errorf("isGREASE(%#04x) = false", value)
+		}
+	}
+	for _, value := range []uint16{0x0a1a, 0x0000, 0x1301, 0xc02f} {
+		if isGREASE(value) {
+			t.Errorf("isGREASE(%#04x) = true", value)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// listenFDEnv tells a process started by upgrade() how many listeners it inherited, they start at descriptor 3 in config order
+	listenFDEnv = "ORACLE_LISTEN_FDS"
+	// packetFDEnv tells a process started by upgrade() how many UDP sockets it inherited, they follow the listeners in the order listenPacket() opened them
+	packetFDEnv = "ORACLE_PACKET_FDS"
+	// readyFDEnv tells a process started by upgrade() which descriptor to report readiness on
+	readyFDEnv = "ORACLE_READY_FD"
+	// upgradeReadyTimeout is how long the old process waits for the new one before giving up and carrying on serving
+	upgradeReadyTimeout = 30 * time.Second
+	// readyMessage is written by the new process once it is serving
+	readyMessage = "ready"
+)
+
+// upgradeSignals triggers an in-place upgrade rather than a shutdown
+var upgradeSignals = []os.Signal{syscall.SIGHUP}
+
+// packetSockets are the UDP sockets opened by listenPacket(), upgrade() hands them over along with the listeners
+var packetSockets []*net.UDPConn
+
+/*
+	The listenAll function opens a listener for every address, reusing the sockets handed over by the previous process when there are some
+	A handover only works when the listeners are configured the same way, otherwise the new process fails and the old one keeps serving
+*/
+func listenAll(addresses []string) ([]net.Listener, error) {
+	inherited := os.Getenv(listenFDEnv)
+	if inherited == "" {
+		var listeners []net.Listener
+		for _, address := range addresses {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, listener)
+		}
+		return listeners, nil
+	}
+
+	count, err := strconv.Atoi(inherited)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", listenFDEnv, err)
+	}
+	if count != len(addresses) {
+		return nil, fmt.Errorf("the previous process handed over %d listeners but %d are configured", count, len(addresses))
+	}
+	var listeners []net.Listener
+	for i := range addresses {
+		file := os.NewFile(uintptr(3+i), "inherited listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !samePort(listener.Addr(), addresses[i]) {
+			return nil, fmt.Errorf("the inherited listener %s doesn't match the configured %s", listener.Addr(), addresses[i])
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+/*
+	The listenPacket function opens a UDP socket on address, reusing the next one handed over by the previous process when there is one
+	Like the listeners a UDP socket stays bound through an upgrade, the new process couldn't bind the port while the old one still serves it
+*/
+func listenPacket(address string) (net.PacketConn, error) {
+	index := len(packetSockets)
+	inherited, _ := strconv.Atoi(os.Getenv(packetFDEnv))
+	var connection *net.UDPConn
+	if index < inherited {
+		listeners, err := strconv.Atoi(os.Getenv(listenFDEnv))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", listenFDEnv, err)
+		}
+		file := os.NewFile(uintptr(3+listeners+index), "inherited packet socket")
+		inheritedConnection, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if connection, ok = inheritedConnection.(*net.UDPConn); !ok || !samePort(connection.LocalAddr(), address) {
+			inheritedConnection.Close()
+			return nil, fmt.Errorf("the inherited packet socket %s doesn't match the configured %s", inheritedConnection.LocalAddr(), address)
+		}
+	} else {
+		opened, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		connection = opened.(*net.UDPConn)
+	}
+	packetSockets = append(packetSockets, connection)
+	return connection, nil
+}
+
+// The samePort function reports whether a bound listener is on the port of a configured address such as ":8080", a cheap guard against a reordered listeners list
+func samePort(bound net.Addr, configured string) bool {
+	_, boundPort, err := net.SplitHostPort(bound.String())
+	if err != nil {
+		return false
+	}
+	_, port, err := net.SplitHostPort(configured)
+	return err == nil && port == boundPort
+}
+
+// The notifyReady function tells the process that started this one (through upgrade()) that it can stop serving, it does nothing otherwise
+func notifyReady() {
+	descriptor := os.Getenv(readyFDEnv)
+	os.Unsetenv(listenFDEnv)
+	os.Unsetenv(packetFDEnv)
+	os.Unsetenv(readyFDEnv)
+	if descriptor == "" {
+		return
+	}
+	number, err := strconv.Atoi(descriptor)
+	if err != nil {
+		return
+	}
+	ready := os.NewFile(uintptr(number), "ready pipe")
+	ready.Write([]byte(readyMessage))
+	ready.Close()
+}
+
+/*
+	The upgrade function starts the binary currently on disk with the same arguments, handing it a copy of every listener and of packetSockets
+	The listening sockets are never closed, so connections arriving during the handoff queue up and are accepted by whichever process gets to them
+	It returns once the new process reports it is serving, after which the caller should shut down gracefully
+	If the new process fails to start or doesn't become ready in time it is killed and this process carries on serving
+*/
+func upgrade(listeners []net.Listener) error {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			return errors.New("the listener on " + listener.Addr().String() + " cannot be handed over")
+		}
+		file, err := tcpListener.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	for _, connection := range packetSockets {
+		file, err := connection.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	var environment []string
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, listenFDEnv+"=") && !strings.HasPrefix(variable, packetFDEnv+"=") && !strings.HasPrefix(variable, readyFDEnv+"=") {
+			environment = append(environment, variable)
+		}
+	}
+	// ExtraFiles start at descriptor 3, the listeners come first, then the packet sockets, and the ready pipe follows them
+	environment = append(environment, listenFDEnv+"="+strconv.Itoa(len(listeners)), packetFDEnv+"="+strconv.Itoa(len(packetSockets)), readyFDEnv+"="+strconv.Itoa(3+len(files)))
+
+	command := exec.Command(executable, os.Args[1:]...)
+	command.Env = environment
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.ExtraFiles = append(append([]*os.File{}, files...), readyWriter)
+	err = command.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	reported := make(chan string, 1)
+	go func() {
+		message, _ := io.ReadAll(ready)
+		reported <- string(message)
+	}()
+
+	select {
+	case message := <-reported:
+		if message != readyMessage {
+			go command.Wait()
+			return errors.New("the new process exited before it was ready")
+		}
+		return command.Process.Release()
+	case <-time.After(upgradeReadyTimeout):
+		command.Process.Kill()
+		go command.Wait()
+		return fmt.Errorf("the new process wasn't ready within %s", upgradeReadyTimeout)
+	}
+}
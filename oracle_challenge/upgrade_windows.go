@@ -0,0 +1,38 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// upgradeSignals is empty on Windows, there is no way to hand a listening socket to a new process there
+var upgradeSignals []os.Signal
+
+// The listenAll function opens a listener for every address
+func listenAll(addresses []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// The listenPacket function opens a UDP socket on address
+func listenPacket(address string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", address)
+}
+
+// The notifyReady function does nothing on Windows since no process is ever waiting on it
+func notifyReady() {}
+
+// The upgrade function always fails on Windows, restart the service instead
+func upgrade([]net.Listener) error {
+	return errors.New("in-place upgrades are not supported on Windows")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRedirectHops bounds how many Location headers we are willing to follow for a single analysis
+	maxRedirectHops = 10
+	// urlAnalysisTimeout bounds the whole analysis, including every hop and DNS lookup
+	urlAnalysisTimeout = 30 * time.Second
+)
+
+// The redirectHop struct records what was observed for a single request within a redirect chain
+type redirectHop struct {
+	URL         string
+	StatusCode  int
+	ResolvedIPs []string
+	ConnectedIP string
+}
+
+/*
+	The handleURLAnalysis function fetches the URL given in the "url" query parameter server-side and reports every hop of its redirect chain
+	For each hop the resolved IP addresses are listed and the address we actually connected to is geolocated via determineGeoLocation()
+	Every hop is vetted by the shared outboundGuard before it is dialed, so the endpoint can't be used to probe our own network
+*/
+func handleURLAnalysis(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		http.Error(w, "the url query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), urlAnalysisTimeout)
+	defer cancel()
+
+	hops, err := followRedirectChain(ctx, target)
+	for i, hop := range hops {
+		if i > 0 {
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprintf(w, "Hop %d: %s (%d)", i+1, hop.URL, hop.StatusCode)
+		fmt.Fprint(w, "\nResolved IPs: "+strings.Join(hop.ResolvedIPs, ", "))
+		fmt.Fprint(w, "\nConnected IP: "+hop.ConnectedIP)
+		locationData, err := determineGeoLocation(r, hop.ConnectedIP)
+		if err != nil {
+			fmt.Fprint(w, "\nError while attempting to get location data: "+err.Error())
+		} else {
+			fmt.Fprint(w, "\n"+locationData)
+		}
+		fmt.Fprint(w, "\n")
+	}
+	if err != nil {
+		if len(hops) > 0 {
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprint(w, "Error while attempting to follow the redirect chain: "+err.Error())
+	}
+}
+
+/*
+	The followRedirectChain function requests target and manually follows each redirect until a non-redirect response is received
+	Redirects are followed by hand (rather than by http.Client) so that every hop can be resolved and vetted before it is dialed
+	The hops gathered so far are always returned, even when an error stops the chain part way through
+*/
+func followRedirectChain(ctx context.Context, target string) ([]redirectHop, error) {
+	var hops []redirectHop
+
+	current, err := url.Parse(target)
+	if err != nil {
+		return hops, err
+	}
+
+	for len(hops) <= maxRedirectHops {
+		if err := outbound.checkURL(current); err != nil {
+			return hops, err
+		}
+
+		ips, err := outbound.resolve(ctx, current.Hostname())
+		if err != nil {
+			return hops, err
+		}
+		var resolvedIPs []string
+		for _, ip := range ips {
+			resolvedIPs = append(resolvedIPs, ip.String())
+		}
+		connectIP := resolvedIPs[0]
+
+		hop := redirectHop{URL: current.String(), ResolvedIPs: resolvedIPs, ConnectedIP: connectIP}
+		response, err := fetchPinned(ctx, current, connectIP)
+		if err != nil {
+			return hops, err
+		}
+		response.Body.Close()
+		hop.StatusCode = response.StatusCode
+		hops = append(hops, hop)
+
+		location := response.Header.Get("Location")
+		if response.StatusCode < 300 || response.StatusCode > 399 || location == "" {
+			return hops, nil
+		}
+		current, err = current.Parse(location)
+		if err != nil {
+			return hops, err
+		}
+	}
+	return hops, fmt.Errorf("stopped after %d redirects", maxRedirectHops)
+}
+
+/*
+	The fetchPinned function sends a GET for target but dials connectIP directly instead of resolving the hostname again
+	Pinning the connection to the vetted address closes the gap where DNS could answer differently the second time,
+	and dialing through the outboundGuard re-checks the address at connect time regardless
+*/
+func fetchPinned(ctx context.Context, target *url.URL, connectIP string) (*http.Response, error) {
+	transport := &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			return outbound.dialContext(ctx, network, net.JoinHostPort(connectIP, port))
+		},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "oracle-url-analysis/1.0")
+	return client.Do(request)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The uaRule struct names what a User-Agent matching Pattern is, the first submatch of Pattern (if any) is its version
+type uaRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+/*
+	browserRules are tried in order and the first match wins, so browsers built on another one come before it:
+	Edge, Opera, Samsung Internet and friends all claim to be Chrome, and Chrome claims to be Safari
+*/
+var browserRules = []uaRule{
+	{"Edge", regexp.MustCompile(`\bEdg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`\b(?:OPR|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`\bSamsungBrowser/([\d.]+)`)},
+	{"Yandex Browser", regexp.MustCompile(`\bYaBrowser/([\d.]+)`)},
+	{"Vivaldi", regexp.MustCompile(`\bVivaldi/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`\b(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`\b(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`\bVersion/([\d.]+).*\bSafari/`)},
+	{"Internet Explorer", regexp.MustCompile(`\b(?:MSIE |Trident/.*\brv:)([\d.]+)`)},
+	{"curl", regexp.MustCompile(`^curl/([\d.]+)`)},
+	{"Wget", regexp.MustCompile(`^Wget/([\d.]+)`)},
+	{"HTTPie", regexp.MustCompile(`^HTTPie/([\d.]+)`)},
+	{"Go", regexp.MustCompile(`^Go-http-client/([\d.]+)`)},
+	{"Python Requests", regexp.MustCompile(`^python-requests/([\d.]+)`)},
+}
+
+// osRules are tried in order like browserRules, iOS and Android before the desktop systems whose names their User-Agents also carry
+var osRules = []uaRule{
+	{"iOS", regexp.MustCompile(`\b(?:iPhone|iPad|iPod).*?\bOS ([\d_]+)`)},
+	{"Android", regexp.MustCompile(`\bAndroid ?([\d.]*)`)},
+	{"Windows", regexp.MustCompile(`\bWindows NT ([\d.]+)`)},
+	{"macOS", regexp.MustCompile(`\bMac OS X ([\d_.]+)`)},
+	{"Chrome OS", regexp.MustCompile(`\bCrOS \S+ ([\d.]+)`)},
+	{"Linux", regexp.MustCompile(`\bLinux\b()`)},
+}
+
+// windowsVersions maps the NT version in a Windows User-Agent to the release it stands for, 10.0 covers 11 as well
+var windowsVersions = map[string]string{"10.0": "10", "6.3": "8.1", "6.2": "8", "6.1": "7", "6.0": "Vista", "5.1": "XP"}
+
+var (
+	botPattern    = regexp.MustCompile(`(?i)bot\b|crawler|spider|slurp|facebookexternalhit|preview`)
+	tabletPattern = regexp.MustCompile(`(?i)\biPad\b|\bTablet\b|\bKindle\b|\bSilk/`)
+	mobilePattern = regexp.MustCompile(`(?i)\bMobile\b|\biPhone\b|\biPod\b|Windows Phone`)
+	toolPattern   = regexp.MustCompile(`^(?:curl|Wget|HTTPie|Go-http-client|python-requests)/`)
+)
+
+// The userAgentInfo struct is the answer of /ua, Device is "bot", "mobile", "tablet", "desktop", "tool" (a command line or library client) or "unknown"
+type userAgentInfo struct {
+	IP             string `json:"ip"`
+	UserAgent      string `json:"user_agent"`
+	Browser        string `json:"browser,omitempty"`
+	BrowserVersion string `json:"browser_version,omitempty"`
+	OS             string `json:"os,omitempty"`
+	OSVersion      string `json:"os_version,omitempty"`
+	Device         string `json:"device"`
+}
+
+// The matchUARule function returns the name and version of the first rule matching userAgent
+func matchUARule(rules []uaRule, userAgent string) (string, string) {
+	for _, rule := range rules {
+		if match := rule.Pattern.FindStringSubmatch(userAgent); match != nil {
+			version := ""
+			if len(match) > 1 {
+				version = match[1]
+			}
+			return rule.Name, version
+		}
+	}
+	return "", ""
+}
+
+// The parseUserAgent function recognises the browser, operating system and class of device a User-Agent describes
+func parseUserAgent(userAgent string) userAgentInfo {
+	info := userAgentInfo{UserAgent: userAgent, Device: "unknown"}
+	info.Browser, info.BrowserVersion = matchUARule(browserRules, userAgent)
+	info.OS, info.OSVersion = matchUARule(osRules, userAgent)
+	info.OSVersion = strings.ReplaceAll(info.OSVersion, "_", ".")
+	if release, ok := windowsVersions[info.OSVersion]; ok && info.OS == "Windows" {
+		info.OSVersion = release
+	}
+
+	switch {
+	case userAgent == "":
+	case botPattern.MatchString(userAgent):
+		info.Device = "bot"
+	case toolPattern.MatchString(userAgent):
+		info.Device = "tool"
+	// Android phones say Mobile and Android tablets don't
+	case tabletPattern.MatchString(userAgent), info.OS == "Android" && !strings.Contains(userAgent, "Mobile"):
+		info.Device = "tablet"
+	case mobilePattern.MatchString(userAgent):
+		info.Device = "mobile"
+	case info.OS != "":
+		info.Device = "desktop"
+	}
+	return info
+}
+
+// The handleUserAgent function serves /ua, the client's User-Agent broken down by parseUserAgent() along with its IP address
+func handleUserAgent(w http.ResponseWriter, r *http.Request) {
+	ip, err := determineIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info := parseUserAgent(r.UserAgent())
+	info.IP = ip
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+/*
+	The build information reported by /version, set at build time with -ldflags, e.g.
+		go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+	A binary built without them reports "unknown", apart from the commit the Go toolchain may have embedded itself
+*/
+var (
+	version   = "unknown"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// The versionInfo struct is the answer of /version
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// The currentVersion function returns the build information of the running binary
+func currentVersion() versionInfo {
+	info := versionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info.Commit == "unknown" {
+		if build, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range build.Settings {
+				if setting.Key == "vcs.revision" {
+					info.Commit = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// The handleVersion function serves /version, so operators can confirm which build is deployed
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentVersion())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rdapRegistries names the regional internet registries by the WHOIS server their RDAP answers point at
+var rdapRegistries = map[string]string{
+	"whois.arin.net":    "ARIN",
+	"whois.ripe.net":    "RIPE NCC",
+	"whois.apnic.net":   "APNIC",
+	"whois.lacnic.net":  "LACNIC",
+	"whois.afrinic.net": "AFRINIC",
+}
+
+// The abuseContact struct is the abuse entity of an RDAP network
+type abuseContact struct {
+	Handle string `json:"handle,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Phone  string `json:"phone,omitempty"`
+}
+
+/*
+	The networkRegistration struct is what RDAP says about the network an address was allocated from
+	RIR is the registry that answered, when its WHOIS server is one of rdapRegistries
+*/
+type networkRegistration struct {
+	Handle       string        `json:"handle"`
+	Name         string        `json:"netname"`
+	Type         string        `json:"type,omitempty"`
+	Country      string        `json:"country,omitempty"`
+	StartAddress string        `json:"start_address"`
+	EndAddress   string        `json:"end_address"`
+	CIDRs        []string      `json:"cidrs,omitempty"`
+	Registered   string        `json:"registered,omitempty"`
+	LastChanged  string        `json:"last_changed,omitempty"`
+	Registrant   string        `json:"registrant,omitempty"`
+	Abuse        *abuseContact `json:"abuse,omitempty"`
+	RIR          string        `json:"rir,omitempty"`
+}
+
+// The whoisReport struct is the answer of /whois/{ip}, the registration of the address next to its geolocation
+type whoisReport struct {
+	IP            string               `json:"ip"`
+	Registration  *networkRegistration `json:"registration"`
+	Location      map[string]string    `json:"location,omitempty"`
+	LocationError string               `json:"location_error,omitempty"`
+}
+
+// The lookupNetworkRegistration function asks RDAP about the network ip belongs to, nil without an error when no registry knows it
+func lookupNetworkRegistration(ctx context.Context, ip string) (*networkRegistration, error) {
+	var document struct {
+		Handle       string       `json:"handle"`
+		Name         string       `json:"name"`
+		Type         string       `json:"type"`
+		Country      string       `json:"country"`
+		StartAddress string       `json:"startAddress"`
+		EndAddress   string       `json:"endAddress"`
+		Port43       string       `json:"port43"`
+		Events       []rdapEvent  `json:"events"`
+		Entities     []rdapEntity `json:"entities"`
+		CIDRs        []struct {
+			V4Prefix string `json:"v4prefix"`
+			V6Prefix string `json:"v6prefix"`
+			Length   int    `json:"length"`
+		} `json:"cidr0_cidrs"`
+	}
+	found, err := fetchRDAP(ctx, "ip", ip, &document)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	registration := &networkRegistration{
+		Handle:       document.Handle,
+		Name:         document.Name,
+		Type:         document.Type,
+		Country:      document.Country,
+		StartAddress: document.StartAddress,
+		EndAddress:   document.EndAddress,
+		Registered:   rdapEventDate(document.Events, "registration"),
+		LastChanged:  rdapEventDate(document.Events, "last changed"),
+		RIR:          rdapRegistries[strings.ToLower(document.Port43)],
+	}
+	for _, cidr := range document.CIDRs {
+		prefix := cidr.V4Prefix
+		if prefix == "" {
+			prefix = cidr.V6Prefix
+		}
+		registration.CIDRs = append(registration.CIDRs, prefix+"/"+strconv.Itoa(cidr.Length))
+	}
+	if registrant, ok := rdapEntityWithRole(document.Entities, "registrant"); ok {
+		registration.Registrant = registrant.vcardValue("fn")
+	}
+	if abuse, ok := rdapEntityWithRole(document.Entities, "abuse"); ok {
+		registration.Abuse = &abuseContact{Handle: abuse.Handle, Name: abuse.vcardValue("fn"), Email: abuse.vcardValue("email"), Phone: abuse.vcardValue("tel")}
+	}
+	return registration, nil
+}
+
+/*
+	The handleWhois function serves /whois/{ip}, the registration data of the address' network from its RIR over RDAP along with its geolocation
+	?fields= narrows the location as it does for /ip
+*/
+func handleWhois(w http.ResponseWriter, r *http.Request) {
+	input := strings.TrimPrefix(r.URL.Path, "/whois/")
+	parsed := net.ParseIP(input)
+	if parsed == nil {
+		writeInvalidAddress(w, &invalidAddressError{Input: input})
+		return
+	}
+	ip := parsed.String()
+	if writeBogon(w, checkBogon(ip)) {
+		return
+	}
+	fields, err := requestedFields(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	registration, err := lookupNetworkRegistration(r.Context(), ip)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"ip": ip, "error": "Error while querying RDAP: " + err.Error()})
+		return
+	}
+	if registration == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"ip": ip, "error": "no registry knows this address"})
+		return
+	}
+
+	located := lookupBatchEntry(r, ip, fields)
+	writeJSON(w, http.StatusOK, whoisReport{IP: ip, Registration: registration, Location: located.Location, LocationError: located.Error})
+}